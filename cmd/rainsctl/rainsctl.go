@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/rains/internal/pkg/rainsd"
+	"github.com/spf13/cobra"
+)
+
+var adminAddress string
+var zone string
+var zoneContext string
+var expires time.Duration
+
+var rootCmd = &cobra.Command{
+	Use:   "rainsctl",
+	Short: "rainsctl controls a running RAINS server",
+	Long: `	This program connects to the admin API of a running rainsd instance. It can dump the
+	content of the server's caches in zonefile format, flush zones from the caches, trigger a
+	checkpoint, show cache and queue sizes, change the log level, manage the server's
+	blocklist, and reload the server's configuration file.
+
+	The admin API must be enabled on the server with the adminAddress option.`,
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the sizes of the server's caches, input queues and authoritative store",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var stats rainsd.Stats
+		getJSON("/stats", &stats)
+		fmt.Printf("assertions:      %d\n", stats.Assertions)
+		fmt.Printf("negAssertions:   %d\n", stats.NegAssertions)
+		fmt.Printf("zoneKeys:        %d\n", stats.ZoneKeys)
+		fmt.Printf("pendingKeys:     %d\n", stats.PendingKeys)
+		fmt.Printf("pendingQueries:  %d\n", stats.PendingQueries)
+		fmt.Printf("connections:     %d\n", stats.Connections)
+		fmt.Printf("capabilities:    %d\n", stats.Capabilities)
+		fmt.Printf("prioQueue:       %d\n", stats.PrioQueue)
+		fmt.Printf("normalQueue:     %d\n", stats.NormalQueue)
+		fmt.Printf("notifyQueue:     %d\n", stats.NotifyQueue)
+		fmt.Printf("authoritative:   %d\n", stats.Authoritative)
+	},
+}
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump (assertions|negAssertions|zoneKeys)",
+	Short: "Print the content of a cache in zonefile format",
+	Args:  cobra.ExactArgs(1),
+	ValidArgs: []string{rainsd.CacheAssertions, rainsd.CacheNegAssertions,
+		rainsd.CacheZoneKeys},
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Print(request(http.MethodGet, "/cache/"+args[0], url.Values{"zone": {zone}}))
+	},
+}
+
+var flushCmd = &cobra.Command{
+	Use:   "flush ZONE",
+	Short: "Remove all cached assertions, shards, pshards and zones of ZONE",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		request(http.MethodPost, "/flush", url.Values{"zone": {args[0]}})
+	},
+}
+
+var checkpointCmd = &cobra.Command{
+	Use:   "checkpoint",
+	Short: "Write a checkpoint of the server's caches",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		request(http.MethodPost, "/checkpoint", nil)
+	},
+}
+
+var logLevelCmd = &cobra.Command{
+	Use:   "loglevel [debug|info|warn|error|crit]",
+	Short: "Show or change the server's log level",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			fmt.Print(request(http.MethodGet, "/loglevel", nil))
+			return
+		}
+		fmt.Print(request(http.MethodPut, "/loglevel", url.Values{"level": {args[0]}}))
+	},
+}
+
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Show the server's blocklist",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var entries rainsd.BlocklistEntries
+		getJSON("/blocklist", &entries)
+		for _, p := range entries.Peers {
+			fmt.Printf("peer %s %s\n", p.Prefix, expirationString(p.Expiration))
+		}
+		for _, z := range entries.Zones {
+			ctx := z.Context
+			if ctx == "" {
+				ctx = "*"
+			}
+			fmt.Printf("zone %s %s %s\n", z.Zone, ctx, expirationString(z.Expiration))
+		}
+	},
+}
+
+var blocklistReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Replace the server's blocklist with the content of its blocklist file",
+	Long: `	Replace the server's blocklist with the content of the server's configured blocklist
+	file.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		request(http.MethodPost, "/blocklist/reload", nil)
+	},
+}
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the server's configuration file",
+	Long: `	Reload the server's configuration file and apply the changed settings which can be
+	changed at runtime. The changed settings which only take effect after a restart of the server
+	are listed as well.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var result rainsd.ReloadResult
+		if err := json.Unmarshal([]byte(request(http.MethodPost, "/config/reload", nil)),
+			&result); err != nil {
+			log.Fatalf("Error: was not able to decode response: %v", err)
+		}
+		fmt.Printf("applied:          %s\n", strings.Join(result.Applied, ", "))
+		fmt.Printf("restart required: %s\n", strings.Join(result.RestartRequired, ", "))
+	},
+}
+
+var blockCmd = &cobra.Command{
+	Use:   "block",
+	Short: "Add a peer or zone to the server's blocklist",
+}
+
+var unblockCmd = &cobra.Command{
+	Use:   "unblock",
+	Short: "Remove a peer or zone from the server's blocklist",
+}
+
+var blockPeerCmd = &cobra.Command{
+	Use:   "peer PREFIX",
+	Short: "Drop all messages from peers in PREFIX",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{"prefix": {args[0]}}
+		addExpiration(params)
+		request(http.MethodPost, "/blocklist/peer", params)
+	},
+}
+
+var blockZoneCmd = &cobra.Command{
+	Use:   "zone ZONE",
+	Short: "Drop all sections of ZONE and remove it from the caches",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		params := url.Values{"zone": {args[0]}, "context": {zoneContext}}
+		addExpiration(params)
+		request(http.MethodPost, "/blocklist/zone", params)
+	},
+}
+
+var unblockPeerCmd = &cobra.Command{
+	Use:   "peer PREFIX",
+	Short: "Accept messages from peers in PREFIX again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		request(http.MethodDelete, "/blocklist/peer", url.Values{"prefix": {args[0]}})
+	},
+}
+
+var unblockZoneCmd = &cobra.Command{
+	Use:   "zone ZONE",
+	Short: "Accept sections of ZONE again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		request(http.MethodDelete, "/blocklist/zone",
+			url.Values{"zone": {args[0]}, "context": {zoneContext}})
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&adminAddress, "admin", "a", "127.0.0.1:55554", "The "+
+		"address of the server's admin API. Prefix a path with unix: to connect to a Unix socket.")
+	dumpCmd.Flags().StringVarP(&zone, "zone", "z", "", "Only print sections of this zone.")
+	for _, cmd := range []*cobra.Command{blockZoneCmd, unblockZoneCmd} {
+		cmd.Flags().StringVarP(&zoneContext, "context", "c", "", "The context of the zone. An "+
+			"empty context stands for all contexts.")
+	}
+	for _, cmd := range []*cobra.Command{blockPeerCmd, blockZoneCmd} {
+		cmd.Flags().DurationVarP(&expires, "expires", "e", 0, "Duration after which the entry "+
+			"is removed again. The entry never expires if it is 0.")
+	}
+	blockCmd.AddCommand(blockPeerCmd, blockZoneCmd)
+	unblockCmd.AddCommand(unblockPeerCmd, unblockZoneCmd)
+	blocklistCmd.AddCommand(blocklistReloadCmd)
+	rootCmd.AddCommand(statsCmd, dumpCmd, flushCmd, checkpointCmd, logLevelCmd, blocklistCmd,
+		blockCmd, unblockCmd, reloadCmd)
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+//client returns an http client connecting to the admin API and the base url of the API.
+func client() (*http.Client, string) {
+	network, address := rainsd.ParseAdminAddress(adminAddress)
+	if network == "unix" {
+		dialer := net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", address)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://rainsd"
+	}
+	return http.DefaultClient, "http://" + address
+}
+
+//request sends a request to path of the admin API and returns the body of the response. It exits
+//the program if the request fails.
+func request(method, path string, params url.Values) string {
+	c, base := client()
+	u := base + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		log.Fatalf("Error: was not able to create request: %v", err)
+	}
+	req.Header.Set(rainsd.AdminHeader, "1")
+	resp, err := c.Do(req)
+	if err != nil {
+		log.Fatalf("Error: was not able to reach the admin API at %s: %v", adminAddress, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Error: was not able to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Error: %s", strings.TrimSpace(string(body)))
+	}
+	return string(body)
+}
+
+func getJSON(path string, value interface{}) {
+	if err := json.Unmarshal([]byte(request(http.MethodGet, path, nil)), value); err != nil {
+		log.Fatalf("Error: was not able to decode response: %v", err)
+	}
+}
+
+func addExpiration(params url.Values) {
+	if expires > 0 {
+		params.Set("expiration", strconv.FormatInt(time.Now().Add(expires).Unix(), 10))
+	}
+}
+
+func expirationString(expiration int64) string {
+	if expiration == 0 {
+		return "never"
+	}
+	return time.Unix(expiration, 0).Format(time.RFC3339)
+}
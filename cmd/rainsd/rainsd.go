@@ -3,9 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/inconshreveable/log15"
@@ -18,6 +22,7 @@ import (
 )
 
 var config = rainsd.DefaultConfig()
+var configPath string
 var id string
 var rootZonePublicKeyPath string
 var assertionCheckPointInterval time.Duration
@@ -25,15 +30,36 @@ var negAssertionCheckPointInterval time.Duration
 var zoneKeyCheckPointInterval time.Duration
 var checkPointPath string
 var preLoadCaches bool
+var adminAddress string
+var monitorResources bool
+var metricsAddress string
+var logLevel string
+var shutdownTimeout time.Duration
 
 //switchboard
-var serverAddress addressFlag
+var serverAddresses = addressesFlag{defaultValue: "[127.0.0.1:55553]"}
 var rootServerAddress addressFlag
 var maxConnections int
 var keepAlivePeriod time.Duration
 var tcpTimeout time.Duration
 var tlsCertificateFile string
 var tlsPrivateKeyFile string
+var blocklistPath string
+var maxMessageSize int
+var infraKeyPath string
+var messageSigPolicy string
+var infraKeyPeers infraKeyPeersFlag
+
+//rate limiting
+var rateLimit float64
+var rateLimitBurst int
+var prefixRateLimit float64
+var prefixRateLimitBurst int
+var rateLimitIPv4PrefixLength int
+var rateLimitIPv6PrefixLength int
+var responseRateLimit float64
+var responseRateLimitBurst int
+var rateLimitAction string
 
 //inbox
 var prioBufferSize int
@@ -53,6 +79,8 @@ var pendingKeyCacheSize int
 var delegationQueryValidity time.Duration
 var reapZoneKeyCacheInterval time.Duration
 var reapPendingKeyCacheInterval time.Duration
+var maxDelegationQueries int
+var backupServers = addressesFlag{defaultValue: "[]"}
 
 //engine
 var assertionCacheSize int
@@ -67,14 +95,39 @@ var maxZoneValidity time.Duration
 var reapAssertionCacheInterval time.Duration
 var reapNegAssertionCacheInterval time.Duration
 var reapPendingQCacheInterval time.Duration
+var evictInconsistentZones bool
+var forwardingRules forwardingRulesFlag
+
+//intermediary
+var intermediaryService bool
+var intermediaryZones authoritiesFlag
+var retentionPeriod time.Duration
+
+//replication
+var secondaryZones secondaryZonesFlag
+var secondaries = addressesFlag{defaultValue: "[]"}
+var zoneRefreshInterval time.Duration
+
+//zonefiles
+var zonefiles zonefilesFlag
+var zonefileCheckInterval time.Duration
+
+//authoritative store
+var authoritativeStorePath string
+
+//event log
+var eventLogPath string
+var eventLogMaxSize int64
+var eventLogMaxFiles int
+
 var maxRecurseDepth int
 
 var rootCmd = &cobra.Command{
 	Use:   "rainsd [PATH]",
 	Short: "rainsd is an implementation of a RAINS server",
 	Long: `	This program implements a RAINS server which serves requests over the RAINS protocol.
-	The server can be configured to support the first two modes of operation, authority
-	service and query service. The third one is not yet implemented.
+	The server can be configured to support all three modes of operation, authority
+	service, query service and intermediary service.
 
 	* authority service -- the server acts on behalf of an authority to ensure
 	 properly signed assertions are available to the system,
@@ -83,7 +136,8 @@ var rootCmd = &cobra.Command{
 	* intermediary service -- the server provides storage and lookup services to
 	 authority services and query services.
 
-	If no path to a config file is provided, the default config is used.
+	If no path to a config file is provided, the default config is used. On SIGHUP, the config
+	file is loaded again and all settings which can be changed at runtime are applied.
 
 	A capability represents a set of features the server supports, and is used for
 	advertising functionality to other servers. Currently only the following
@@ -94,7 +148,8 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 1 {
 			var err error
-			if config, err = rainsd.LoadConfig(args[0]); err != nil {
+			configPath = args[0]
+			if config, err = rainsd.LoadConfig(configPath); err != nil {
 				log.Fatalf("Error: was not able to load config file: %v", err)
 			}
 		}
@@ -102,10 +157,13 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.Flags().Var(&serverAddress, "serverAddress", "The network address of this server.")
+	rootCmd.Flags().Var(&serverAddresses, "serverAddress", "A network address of this server. "+
+		"Prefix an IP address with udp:// to serve plain UDP instead of TLS over TCP. Repeat the flag "+
+		"to listen on several addresses.")
 	rootCmd.Flags().Var(&authorities, "authorities", "A list of contexts and zones for which this server "+
 		"is authoritative. The format is elem(,elem)* where elem := zoneName,contextName")
-	rootCmd.Flags().Var(&rootServerAddress, "rootServerAddress", "The root name server address")
+	rootCmd.Flags().Var(&rootServerAddress, "rootServerAddress", "The root name server address. "+
+		"Prefix an IP address with udp:// to reach it over plain UDP.")
 	rootCmd.Flags().StringVar(&id, "id", "", "Server id")
 	rootCmd.Flags().StringVar(&rootZonePublicKeyPath, "rootZonePublicKeyPath", "data/keys/rootDelegationAssertion.gob", "Path to the "+
 		"file storing the RAINS' root zone public key.")
@@ -119,6 +177,17 @@ func init() {
 		"checkpoint information is stored.")
 	rootCmd.Flags().BoolVar(&preLoadCaches, "preLoadCaches", false, "If true, the assertion, negative assertion, "+
 		"and zone key cache are pre-loaded from the checkpoint files in CheckPointPath at start up.")
+	rootCmd.Flags().StringVar(&adminAddress, "adminAddress", "", "The address of the admin API "+
+		"used by rainsctl. Prefix a path with unix: to serve it on a Unix socket. It must be a "+
+		"localhost or loopback address otherwise. The admin API is disabled if empty.")
+	rootCmd.Flags().BoolVar(&monitorResources, "monitorResources", false, "If true, the server's "+
+		"metrics are served in the Prometheus text format on metricsAddress/metrics.")
+	rootCmd.Flags().StringVar(&metricsAddress, "metricsAddress", "127.0.0.1:55555", "The address "+
+		"on which the server's metrics are served if monitorResources is set.")
+	rootCmd.Flags().StringVar(&logLevel, "logLevel", "info", "The minimal level of logged "+
+		"messages. One of debug, info, warn, error or crit.")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdownTimeout", 5*time.Second, "The maximum "+
+		"time the server spends processing queued messages when it shuts down.")
 
 	//switchboard
 	rootCmd.Flags().IntVar(&maxConnections, "maxConnections", 10000, "The maximum number of allowed active connections.")
@@ -129,6 +198,39 @@ func init() {
 		"certificate file proving the server's identity.")
 	rootCmd.Flags().StringVar(&tlsPrivateKeyFile, "tlsPrivateKeyFile", "data/cert/server.key", "The path to the server's tls "+
 		"private key file proving the server's identity.")
+	rootCmd.Flags().StringVar(&blocklistPath, "blocklistPath", "", "Path to a json file containing "+
+		"the peers and zones from which the server drops all messages.")
+	rootCmd.Flags().IntVar(&maxMessageSize, "maxMessageSize", 1<<20, "The maximum size in bytes of an "+
+		"incoming message. Larger messages are answered with a message too large notification.")
+	rootCmd.Flags().StringVar(&infraKeyPath, "infraKeyPath", "", "Path to the private "+
+		"infrastructure key with which outgoing messages are signed. If empty, messages are not signed.")
+	rootCmd.Flags().StringVar(&messageSigPolicy, "messageSigPolicy", "none", "How message signatures "+
+		"are checked. 'none' ignores them, 'verify' rejects messages of infraKeyPeers with an invalid "+
+		"signature and 'require' rejects all messages without a valid signature of an infraKeyPeer.")
+	rootCmd.Flags().Var(&infraKeyPeers, "infraKeyPeers", "A list of peers and the names holding "+
+		"their infrastructure keys. The format is elem(,elem) where elem := prefix,name,contextName")
+
+	//rate limiting
+	rootCmd.Flags().Float64Var(&rateLimit, "rateLimit", 0, "The maximum number of messages per "+
+		"second accepted from a source address. Zero disables the limit.")
+	rootCmd.Flags().IntVar(&rateLimitBurst, "rateLimitBurst", 20, "The maximum number of messages "+
+		"accepted at once from a source address.")
+	rootCmd.Flags().Float64Var(&prefixRateLimit, "prefixRateLimit", 0, "The maximum number of "+
+		"messages per second accepted from a source prefix. Zero disables the limit.")
+	rootCmd.Flags().IntVar(&prefixRateLimitBurst, "prefixRateLimitBurst", 100, "The maximum number "+
+		"of messages accepted at once from a source prefix.")
+	rootCmd.Flags().IntVar(&rateLimitIPv4PrefixLength, "rateLimitIPv4PrefixLength", 24, "The length "+
+		"in bits of the IPv4 prefixes whose messages and answers are rate limited together.")
+	rootCmd.Flags().IntVar(&rateLimitIPv6PrefixLength, "rateLimitIPv6PrefixLength", 56, "The length "+
+		"in bits of the IPv6 prefixes whose messages and answers are rate limited together.")
+	rootCmd.Flags().Float64Var(&responseRateLimit, "responseRateLimit", 0, "The maximum number of "+
+		"identical answers per second an authoritative server sends to a prefix. Zero disables the "+
+		"limit.")
+	rootCmd.Flags().IntVar(&responseRateLimitBurst, "responseRateLimitBurst", 5, "The maximum "+
+		"number of identical answers an authoritative server sends at once to a prefix.")
+	rootCmd.Flags().StringVar(&rateLimitAction, "rateLimitAction", "drop", "What happens to "+
+		"messages and answers exceeding a rate limit. 'drop' discards them and 'notify' sends an "+
+		"unspecified server error notification instead.")
 
 	//inbox
 	rootCmd.Flags().IntVar(&prioBufferSize, "prioBufferSize", 50, "The maximum number of messages in the priority buffer.")
@@ -150,8 +252,13 @@ func init() {
 		"future when delegation queries are set to expire.")
 	rootCmd.Flags().DurationVar(&reapZoneKeyCacheInterval, "reapZoneKeyCacheInterval", 15*time.Minute, "The time interval to wait "+
 		"between removing expired entries from the zone key cache.")
-	rootCmd.Flags().DurationVar(&reapPendingKeyCacheInterval, "reapPendingKeyCacheInterval", 15*time.Minute, "The time interval to wait "+
-		"between removing expired entries from the pending key cache.")
+	rootCmd.Flags().DurationVar(&reapPendingKeyCacheInterval, "reapPendingKeyCacheInterval", time.Second, "The time interval to wait "+
+		"between removing expired entries from the pending key cache. Expired delegation queries are retried.")
+	rootCmd.Flags().IntVar(&maxDelegationQueries, "maxDelegationQueries", 2, "The number of delegation "+
+		"queries for a section sent to its sender before the backup servers are queried.")
+	rootCmd.Flags().Var(&backupServers, "backupServer", "A server which is queried for delegations "+
+		"the sender of a section did not provide. Prefix an IP address with udp:// to reach it over "+
+		"plain UDP. Repeat the flag to query several servers in turn.")
 
 	//engine
 	rootCmd.Flags().IntVar(&assertionCacheSize, "assertionCacheSize", 10000, "The maximum number of entries in the "+
@@ -180,12 +287,62 @@ func init() {
 		"wait between removing expired entries from the negative assertion cache.")
 	rootCmd.Flags().DurationVar(&reapPendingQCacheInterval, "reapPendingQCacheInterval", 15*time.Minute, "The time interval to "+
 		"wait between removing expired entries from the pending query cache.")
+	rootCmd.Flags().BoolVar(&evictInconsistentZones, "evictInconsistentZones", false, "If true, all "+
+		"cached sections of a zone are removed when a received section is inconsistent with them.")
+	rootCmd.Flags().Var(&forwardingRules, "forwardingRule", "A zone, a context and a list of "+
+		"forwarders separated by commas. Queries for names in the zone and context are sent to the "+
+		"forwarders instead of being resolved according to the resolver's mode. Without forwarders "+
+		"they are resolved recursively. An empty context matches all contexts. Repeat the flag to "+
+		"add several rules.")
+
+	//intermediary
+	rootCmd.Flags().BoolVar(&intermediaryService, "intermediaryService", false, "If true, the server "+
+		"stores signed sections pushed to it for zones it has no authority over and answers queries "+
+		"only with stored sections.")
+	rootCmd.Flags().Var(&intermediaryZones, "intermediaryZones", "A list of contexts and zones for "+
+		"which this server stores pushed sections as an intermediary. Sections of other zones are "+
+		"cached and may be evicted. The format is elem(,elem) where elem := zoneName,contextName")
+	rootCmd.Flags().DurationVar(&retentionPeriod, "retentionPeriod", 0, "The maximum time an "+
+		"intermediary stores a pushed section. If zero, sections are stored until they expire.")
+
+	//replication
+	rootCmd.Flags().Var(&secondaryZones, "secondaryZone", "A zone, a context and the address of "+
+		"the primary separated by commas. The zone is transferred from the primary. It must be one "+
+		"of the authorities. Repeat the flag to add several zones.")
+	rootCmd.Flags().Var(&secondaries, "secondary", "A server which may transfer the zones of this "+
+		"server's authorities and which is notified when they change. Repeat the flag to add "+
+		"several servers.")
+	rootCmd.Flags().DurationVar(&zoneRefreshInterval, "zoneRefreshInterval", time.Hour, "The time "+
+		"interval between transfer requests for the secondary zones.")
+
+	//zonefiles
+	rootCmd.Flags().Var(&zonefiles, "zonefile", "A zone, a context and the path of a signed "+
+		"zonefile separated by commas. The zonefile is loaded at start up and whenever it changes. "+
+		"The zone must be one of the authorities. Repeat the flag to add several zonefiles.")
+	rootCmd.Flags().DurationVar(&zonefileCheckInterval, "zonefileCheckInterval", 30*time.Second,
+		"The time interval between checks whether a zonefile has changed.")
+
+	//authoritative store
+	rootCmd.Flags().StringVar(&authoritativeStorePath, "authoritativeStorePath", "", "The path "+
+		"to the file in which the sections of the authorities are stored. If empty, the sections "+
+		"are only kept in memory.")
+
+	//event log
+	rootCmd.Flags().StringVar(&eventLogPath, "eventLogPath", "", "The path to the file to which "+
+		"received queries, sent answers, notifications and verification failures are written as "+
+		"json lines. Prefix a path with unix:// to write to a unix socket. If empty, no events are "+
+		"written.")
+	rootCmd.Flags().Int64Var(&eventLogMaxSize, "eventLogMaxSize", 100<<20, "The size in bytes "+
+		"after which the event log file is rotated.")
+	rootCmd.Flags().IntVar(&eventLogMaxFiles, "eventLogMaxFiles", 5, "The number of rotated event "+
+		"log files which are kept.")
+
 	rootCmd.Flags().IntVar(&maxRecurseDepth, "maxrecurse", 50, "Recursive resolver maximum depth (max. depth of recursive stack)")
 }
 
 func main() {
 	h := log15.CallerFileHandler(log15.StdoutHandler)
-	log15.Root().SetHandler(log15.LvlFilterHandler(log15.LvlInfo, h))
+	rainsd.SetLogHandler(h, log15.LvlInfo)
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -207,10 +364,19 @@ func main() {
 			log.Fatalf("Error: Unable to initialize recursive resolver: %v", err.Error())
 			return
 		}
+		resolver.Rules = rainsd.ResolverRules(server.Config().ForwardingRules)
 		server.SetResolver(resolver)
+		if configPath != "" {
+			server.SetConfigLoader(loadConfig)
+			go reloadOnSignal(server)
+		}
 		log.Println("Server successfully initialized")
-		go server.Start(false, id)
-		handleUserInput()
+		go func() {
+			if err := server.Start(monitorResources, id); err != nil {
+				log.Fatalf("Error: Unable to start server: %v", err)
+			}
+		}()
+		waitForShutdown()
 		server.Shutdown()
 	}
 }
@@ -235,8 +401,20 @@ func updateConfig(config *rainsd.Config) {
 	if rootCmd.Flag("preLoadCaches").Changed {
 		config.PreLoadCaches = preLoadCaches
 	}
+	if rootCmd.Flag("adminAddress").Changed {
+		config.AdminAddress = adminAddress
+	}
+	if rootCmd.Flag("metricsAddress").Changed {
+		config.MetricsAddress = metricsAddress
+	}
+	if rootCmd.Flag("logLevel").Changed {
+		config.LogLevel = logLevel
+	}
+	if rootCmd.Flag("shutdownTimeout").Changed {
+		config.ShutdownTimeout = shutdownTimeout
+	}
 	if rootCmd.Flag("serverAddress").Changed {
-		config.ServerAddress = serverAddress.value
+		config.ServerAddresses = serverAddresses.value
 	}
 	if rootCmd.Flag("maxConnections").Changed {
 		config.MaxConnections = maxConnections
@@ -253,6 +431,48 @@ func updateConfig(config *rainsd.Config) {
 	if rootCmd.Flag("tlsPrivateKeyFile").Changed {
 		config.TLSPrivateKeyFile = tlsPrivateKeyFile
 	}
+	if rootCmd.Flag("blocklistPath").Changed {
+		config.BlocklistPath = blocklistPath
+	}
+	if rootCmd.Flag("maxMessageSize").Changed {
+		config.MaxMessageSize = maxMessageSize
+	}
+	if rootCmd.Flag("infraKeyPath").Changed {
+		config.InfraKeyPath = infraKeyPath
+	}
+	if rootCmd.Flag("messageSigPolicy").Changed {
+		config.MessageSigPolicy = messageSigPolicy
+	}
+	if rootCmd.Flag("infraKeyPeers").Changed {
+		config.InfraKeyPeers = infraKeyPeers.value
+	}
+	if rootCmd.Flag("rateLimit").Changed {
+		config.RateLimit = rateLimit
+	}
+	if rootCmd.Flag("rateLimitBurst").Changed {
+		config.RateLimitBurst = rateLimitBurst
+	}
+	if rootCmd.Flag("prefixRateLimit").Changed {
+		config.PrefixRateLimit = prefixRateLimit
+	}
+	if rootCmd.Flag("prefixRateLimitBurst").Changed {
+		config.PrefixRateLimitBurst = prefixRateLimitBurst
+	}
+	if rootCmd.Flag("rateLimitIPv4PrefixLength").Changed {
+		config.RateLimitIPv4PrefixLength = rateLimitIPv4PrefixLength
+	}
+	if rootCmd.Flag("rateLimitIPv6PrefixLength").Changed {
+		config.RateLimitIPv6PrefixLength = rateLimitIPv6PrefixLength
+	}
+	if rootCmd.Flag("responseRateLimit").Changed {
+		config.ResponseRateLimit = responseRateLimit
+	}
+	if rootCmd.Flag("responseRateLimitBurst").Changed {
+		config.ResponseRateLimitBurst = responseRateLimitBurst
+	}
+	if rootCmd.Flag("rateLimitAction").Changed {
+		config.RateLimitAction = rateLimitAction
+	}
 	if rootCmd.Flag("prioBufferSize").Changed {
 		config.PrioBufferSize = prioBufferSize
 	}
@@ -298,6 +518,12 @@ func updateConfig(config *rainsd.Config) {
 	if rootCmd.Flag("reapPendingKeyCacheInterval").Changed {
 		config.ReapPendingKeyCacheInterval = reapPendingKeyCacheInterval
 	}
+	if rootCmd.Flag("maxDelegationQueries").Changed {
+		config.MaxDelegationQueries = maxDelegationQueries
+	}
+	if rootCmd.Flag("backupServer").Changed {
+		config.BackupServers = backupServers.value
+	}
 	if rootCmd.Flag("assertionCacheSize").Changed {
 		config.AssertionCacheSize = assertionCacheSize
 	}
@@ -331,20 +557,109 @@ func updateConfig(config *rainsd.Config) {
 	if rootCmd.Flag("reapPendingQCacheInterval").Changed {
 		config.ReapPendingQCacheInterval = reapPendingQCacheInterval
 	}
+	if rootCmd.Flag("evictInconsistentZones").Changed {
+		config.EvictInconsistentZones = evictInconsistentZones
+	}
+	if rootCmd.Flag("forwardingRule").Changed {
+		config.ForwardingRules = forwardingRules.value
+	}
+	if rootCmd.Flag("intermediaryService").Changed {
+		config.IntermediaryService = intermediaryService
+	}
+	if rootCmd.Flag("intermediaryZones").Changed {
+		config.IntermediaryZones = intermediaryZones.value
+	}
+	if rootCmd.Flag("retentionPeriod").Changed {
+		config.RetentionPeriod = retentionPeriod
+	}
+	if rootCmd.Flag("secondaryZone").Changed {
+		config.SecondaryZones = secondaryZones.value
+	}
+	if rootCmd.Flag("secondary").Changed {
+		config.Secondaries = secondaries.value
+	}
+	if rootCmd.Flag("zoneRefreshInterval").Changed {
+		config.ZoneRefreshInterval = zoneRefreshInterval
+	}
+	if rootCmd.Flag("zonefile").Changed {
+		config.Zonefiles = zonefiles.value
+	}
+	if rootCmd.Flag("zonefileCheckInterval").Changed {
+		config.ZonefileCheckInterval = zonefileCheckInterval
+	}
+	if rootCmd.Flag("authoritativeStorePath").Changed {
+		config.AuthoritativeStorePath = authoritativeStorePath
+	}
+	if rootCmd.Flag("eventLogPath").Changed {
+		config.EventLogPath = eventLogPath
+	}
+	if rootCmd.Flag("eventLogMaxSize").Changed {
+		config.EventLogMaxSize = eventLogMaxSize
+	}
+	if rootCmd.Flag("eventLogMaxFiles").Changed {
+		config.EventLogMaxFiles = eventLogMaxFiles
+	}
+}
+
+//loadConfig loads the config file and overrides it with the provided cmd line flags.
+func loadConfig() (rainsd.Config, error) {
+	c, err := rainsd.LoadConfig(configPath)
+	if err != nil {
+		return rainsd.Config{}, err
+	}
+	updateConfig(&c)
+	return c, nil
+}
+
+//reloadOnSignal reloads the config file of server whenever the process receives SIGHUP.
+func reloadOnSignal(server *rainsd.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if _, err := server.Reload(); err != nil {
+			log.Printf("Error: was not able to reload config file: %v", err)
+		}
+	}
+}
+
+//waitForShutdown returns when the user quits or the process receives SIGINT or SIGTERM.
+func waitForShutdown() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	input := make(chan struct{})
+	go func() {
+		if handleUserInput() {
+			close(input)
+		}
+	}()
+	select {
+	case sig := <-quit:
+		log.Printf("Received %v, shutting down the server", sig)
+	case <-input:
+	}
+	signal.Stop(quit)
 }
 
-func handleUserInput() {
+//handleUserInput returns true when the user enters q or quit. It returns false if standard input
+//is closed.
+func handleUserInput() bool {
 	time.Sleep(500 * time.Millisecond)
 	fmt.Println("Enter q or quit to shutdown the server")
 	var input string
 	for true {
-		fmt.Scanln(&input)
+		if _, err := fmt.Scanln(&input); err == io.EOF {
+			return false
+		}
 		if input == "q" || input == "quit" {
-			return
+			return true
 		}
 	}
+	return false
 }
 
+//udpScheme marks an IP address flag value as plain UDP instead of TLS over TCP.
+const udpScheme = "udp://"
+
 type addressFlag struct {
 	set   bool
 	value connection.Info
@@ -352,6 +667,9 @@ type addressFlag struct {
 
 func (i *addressFlag) String() string {
 	if i.set {
+		if i.value.Type == connection.UDP {
+			return udpScheme + i.value.Addr.String()
+		}
 		return i.value.Addr.String()
 	}
 	return "127.0.0.1:55553" //default
@@ -360,6 +678,11 @@ func (i *addressFlag) String() string {
 func (i *addressFlag) Set(value string) (err error) {
 	i.set = true
 	i.value = connection.Info{}
+	if strings.HasPrefix(value, udpScheme) {
+		i.value.Type = connection.UDP
+		i.value.Addr, err = net.ResolveUDPAddr("", strings.TrimPrefix(value, udpScheme))
+		return err
+	}
 	i.value.Addr, err = net.ResolveTCPAddr("", value)
 	if err != nil { // Not an IP address
 		i.value.Addr, err = snet.ParseUDPAddr(value)
@@ -376,6 +699,38 @@ func (i *addressFlag) Type() string {
 	return "net.Addr"
 }
 
+type addressesFlag struct {
+	set          bool
+	value        []connection.Info
+	defaultValue string
+}
+
+func (i *addressesFlag) String() string {
+	if i.set {
+		addrs := []string{}
+		for _, info := range i.value {
+			addr := addressFlag{set: true, value: info}
+			addrs = append(addrs, addr.String())
+		}
+		return fmt.Sprintf("%v", addrs)
+	}
+	return i.defaultValue
+}
+
+func (i *addressesFlag) Set(value string) error {
+	addr := addressFlag{}
+	if err := addr.Set(value); err != nil {
+		return err
+	}
+	i.set = true
+	i.value = append(i.value, addr.value)
+	return nil
+}
+
+func (i *addressesFlag) Type() string {
+	return "[]net.Addr"
+}
+
 type authoritiesFlag struct {
 	set   bool
 	value []rainsd.ZoneContext
@@ -404,3 +759,125 @@ func (i *authoritiesFlag) Set(value string) error {
 func (i *authoritiesFlag) Type() string {
 	return "[]zoneContext"
 }
+
+type infraKeyPeersFlag struct {
+	set   bool
+	value []rainsd.InfraKeyPeer
+}
+
+func (i *infraKeyPeersFlag) String() string {
+	if i.set {
+		return fmt.Sprintf("%v", i.value)
+	}
+	return "[]" //default
+}
+
+func (i *infraKeyPeersFlag) Set(value string) error {
+	values := strings.Split(value, ",")
+	if len(values)%3 != 0 {
+		return errors.New("Error: each peer needs a prefix, a name and a context value")
+	}
+	i.set = true
+	for j := 0; j < len(values); j += 3 {
+		i.value = append(i.value, rainsd.InfraKeyPeer{Prefix: values[j], Name: values[j+1],
+			Context: values[j+2]})
+	}
+	return nil
+}
+
+func (i *infraKeyPeersFlag) Type() string {
+	return "[]infraKeyPeer"
+}
+
+type forwardingRulesFlag struct {
+	set   bool
+	value []rainsd.ForwardingRule
+}
+
+func (i *forwardingRulesFlag) String() string {
+	if i.set {
+		return fmt.Sprintf("%v", i.value)
+	}
+	return "[]" //default
+}
+
+func (i *forwardingRulesFlag) Set(value string) error {
+	values := strings.Split(value, ",")
+	if len(values) < 2 {
+		return errors.New("Error: a forwarding rule needs a zone and a context value")
+	}
+	rule := rainsd.ForwardingRule{Zone: values[0], Context: values[1],
+		Forwarders: []connection.Info{}}
+	for _, v := range values[2:] {
+		addr := addressFlag{}
+		if err := addr.Set(v); err != nil {
+			return err
+		}
+		rule.Forwarders = append(rule.Forwarders, addr.value)
+	}
+	i.set = true
+	i.value = append(i.value, rule)
+	return nil
+}
+
+func (i *forwardingRulesFlag) Type() string {
+	return "[]forwardingRule"
+}
+
+type secondaryZonesFlag struct {
+	set   bool
+	value []rainsd.SecondaryZone
+}
+
+func (i *secondaryZonesFlag) String() string {
+	if i.set {
+		return fmt.Sprintf("%v", i.value)
+	}
+	return "[]" //default
+}
+
+func (i *secondaryZonesFlag) Set(value string) error {
+	values := strings.Split(value, ",")
+	if len(values) != 3 {
+		return errors.New("Error: a secondary zone needs a zone, a context and a primary value")
+	}
+	primary := addressFlag{}
+	if err := primary.Set(values[2]); err != nil {
+		return err
+	}
+	i.set = true
+	i.value = append(i.value, rainsd.SecondaryZone{Zone: values[0], Context: values[1],
+		Primary: primary.value})
+	return nil
+}
+
+func (i *secondaryZonesFlag) Type() string {
+	return "[]secondaryZone"
+}
+
+type zonefilesFlag struct {
+	set   bool
+	value []rainsd.Zonefile
+}
+
+func (i *zonefilesFlag) String() string {
+	if i.set {
+		return fmt.Sprintf("%v", i.value)
+	}
+	return "[]" //default
+}
+
+func (i *zonefilesFlag) Set(value string) error {
+	values := strings.SplitN(value, ",", 3)
+	if len(values) != 3 {
+		return errors.New("Error: a zonefile needs a zone, a context and a path value")
+	}
+	i.set = true
+	i.value = append(i.value, rainsd.Zonefile{Zone: values[0], Context: values[1],
+		Path: values[2]})
+	return nil
+}
+
+func (i *zonefilesFlag) Type() string {
+	return "[]zonefile"
+}
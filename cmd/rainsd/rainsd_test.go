@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/netsec-ethz/rains/internal/pkg/connection"
+)
+
+func TestAddressFlag(t *testing.T) {
+	var tests = []struct {
+		input  string
+		t      connection.Type
+		output string
+		valid  bool
+	}{
+		{"127.0.0.1:5022", connection.TCP, "127.0.0.1:5022", true},
+		{"udp://127.0.0.1:5022", connection.UDP, "udp://127.0.0.1:5022", true},
+		{"udp://[::1]:5022", connection.UDP, "udp://[::1]:5022", true},
+		{"udp://127.0.0.1", 0, "", false},
+	}
+	for i, test := range tests {
+		var addr addressFlag
+		err := addr.Set(test.input)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: wrong result for %s. expected valid=%t actual error=%v", i, test.input,
+				test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if addr.value.Type != test.t || addr.String() != test.output {
+			t.Errorf("%d: wrong address. expected=(%v,%s) actual=(%v,%s)", i, test.t, test.output,
+				addr.value.Type, addr.String())
+		}
+		if _, ok := addr.value.Addr.(*net.UDPAddr); ok != (test.t == connection.UDP) {
+			t.Errorf("%d: wrong address type %T", i, addr.value.Addr)
+		}
+	}
+}
+
+func TestAddressesFlag(t *testing.T) {
+	addrs := addressesFlag{defaultValue: "[127.0.0.1:55553]"}
+	if addrs.String() != "[127.0.0.1:55553]" {
+		t.Errorf("wrong default value. expected=[127.0.0.1:55553] actual=%s", addrs.String())
+	}
+	for _, value := range []string{"127.0.0.1:5022", "udp://127.0.0.1:5023"} {
+		if err := addrs.Set(value); err != nil {
+			t.Fatalf("Was not able to set %s: %v", value, err)
+		}
+	}
+	expected := "[127.0.0.1:5022 udp://127.0.0.1:5023]"
+	if addrs.String() != expected {
+		t.Errorf("wrong addresses. expected=%s actual=%s", expected, addrs.String())
+	}
+	if addrs.value[0].Type != connection.TCP || addrs.value[1].Type != connection.UDP {
+		t.Errorf("wrong address types. expected=[TCP UDP] actual=[%v %v]", addrs.value[0].Type,
+			addrs.value[1].Type)
+	}
+}
@@ -29,6 +29,8 @@ var insecureTLS = flag.BoolP("insecureTLS", "i", false,
 	"when set it does not check the validity of the server's TLS certificate. (default false)")
 var tok = flag.StringP("token", "t", "",
 	"specifies a token to be used in the query instead of using a randomly generated one.")
+var udp = flag.BoolP("udp", "u", false,
+	"when set the query is sent over plain UDP instead of TLS over TCP. (default false)")
 
 //Query Options
 var minEE = flag.BoolP("minEE", "1", false, "Query option: Minimize end-to-end latency")
@@ -44,6 +46,7 @@ var maxAF = flag.BoolP("maxAF", "9", false, "Query option: Maximize answer fresh
 func init() {
 	flag.CommandLine.SortFlags = false
 	flag.Lookup("insecureTLS").NoOptDefVal = "true"
+	flag.Lookup("udp").NoOptDefVal = "true"
 	flag.Lookup("minEE").NoOptDefVal = "true"
 	flag.Lookup("minAS").NoOptDefVal = "true"
 	flag.Lookup("minIL").NoOptDefVal = "true"
@@ -79,7 +82,11 @@ func main() {
 	serverAddr, err := snet.ParseUDPAddr(fmt.Sprintf("%s:%d", server, *port))
 	if err != nil {
 		// was not a valid SCION address, try to parse it as a regular IP address
-		serverAddr, err = net.ResolveTCPAddr("", fmt.Sprintf("%s:%d", server, *port))
+		if *udp {
+			serverAddr, err = net.ResolveUDPAddr("", fmt.Sprintf("%s:%d", server, *port))
+		} else {
+			serverAddr, err = net.ResolveTCPAddr("", fmt.Sprintf("%s:%d", server, *port))
+		}
 		if err != nil {
 			log.Fatalf("Error: serverAddr or port malformed: %v", err)
 		}
@@ -49,6 +49,7 @@ var doSigning bool
 var maxZoneSize int
 var outputPath string
 var doPublish bool
+var notifyServers addressesFlag
 
 var rootCmd = &cobra.Command{
 	Use:   "zonepub [PATH]",
@@ -149,6 +150,9 @@ func init() {
 		"authoritative rains servers. If the zone is smaller than the maximum allowed size, the zone is "+
 		"sent. Otherwise, the zone section's content is sent separately such that the maximum message "+
 		"size is not exceeded.")
+	rootCmd.Flags().Var(&notifyServers, "notifyServers", "Server addresses which are notified with "+
+		"a message signed by the zone after the zone has been published such that they invalidate "+
+		"their cached sections of the zone.")
 }
 
 //main initializes rainspub
@@ -260,6 +264,9 @@ func updateConfig(config *publisher.Config) {
 	if rootCmd.Flag("doPublish").Changed {
 		config.DoPublish = doPublish
 	}
+	if rootCmd.Flag("notifyServers").Changed {
+		config.NotifyServers = notifyServers.value
+	}
 }
 
 type addressesFlag struct {
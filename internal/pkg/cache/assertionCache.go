@@ -18,7 +18,9 @@ import (
 type assertionCacheValue struct {
 	assertions map[string]assertionExpiration //assertion.Hash -> assertionExpiration
 	cacheKey   string
+	name       string
 	zone       string
+	context    string
 	deleted    bool
 	//mux protects deleted and assertions from simultaneous access.
 	mux sync.RWMutex
@@ -39,6 +41,7 @@ type AssertionImpl struct {
 	cache                  *lruCache.Cache
 	counter                *safeCounter.Counter
 	zoneMap                *safeHashMap.Map
+	names                  *nameIndex     //cache keys by subject name per zone and context
 	entriesPerAssertionMap map[string]int //a.Hash() -> int
 	mux                    sync.Mutex     //protects entriesPerAssertionMap from simultaneous access
 }
@@ -48,6 +51,7 @@ func NewAssertion(maxSize int) *AssertionImpl {
 		cache:                  lruCache.New(),
 		counter:                safeCounter.New(maxSize),
 		zoneMap:                safeHashMap.New(),
+		names:                  newNameIndex(),
 		entriesPerAssertionMap: make(map[string]int),
 	}
 }
@@ -85,7 +89,9 @@ func (c *AssertionImpl) Add(a *section.Assertion, expiration int64, isInternal b
 		cacheValue := assertionCacheValue{
 			assertions: make(map[string]assertionExpiration),
 			cacheKey:   key,
+			name:       a.SubjectName,
 			zone:       a.SubjectZone,
+			context:    a.Context,
 		}
 		v, new := c.cache.GetOrAdd(key, &cacheValue, isInternal)
 		value := v.(*assertionCacheValue)
@@ -96,7 +102,8 @@ func (c *AssertionImpl) Add(a *section.Assertion, expiration int64, isInternal b
 		}
 		if new {
 			val, _ := c.zoneMap.GetOrAdd(a.SubjectZone, safeHashMap.New())
-			val.(*safeHashMap.Map).Add(key, true)
+			val.(*safeHashMap.Map).Add(key, a.Context)
+			c.names.add(a.SubjectZone, a.Context, a.SubjectName, key)
 		}
 		if _, ok := value.assertions[a.Hash()]; !ok {
 			value.assertions[a.Hash()] = assertionExpiration{assertion: a, expiration: expiration}
@@ -124,6 +131,7 @@ func (c *AssertionImpl) Add(a *section.Assertion, expiration int64, isInternal b
 		if val, ok := c.zoneMap.Get(v.zone); ok {
 			val.(*safeHashMap.Map).Remove(v.cacheKey)
 		}
+		c.names.remove(v.zone, v.context, v.name, v.cacheKey)
 		for _, val := range v.assertions {
 			c.mux.Lock()
 			c.entriesPerAssertionMap[val.assertion.Hash()]--
@@ -186,6 +194,33 @@ func (c *AssertionImpl) Get(fqdn, context string, objType object.Type, strict bo
 	return assertions, len(assertions) > 0
 }
 
+//GetZone returns all cached assertions of zone in context whose subject name is within interval.
+func (c *AssertionImpl) GetZone(zone, context string, interval section.Interval) []*section.Assertion {
+	//An assertion is stored once per contained object type.
+	assertions := make(map[string]*section.Assertion)
+	for _, key := range c.names.get(zone, context, interval) {
+		v, ok := c.cache.Get(key)
+		if !ok {
+			continue
+		}
+		value := v.(*assertionCacheValue)
+		value.mux.RLock()
+		if !value.deleted {
+			for hash, av := range value.assertions {
+				if av.assertion.Context == context {
+					assertions[hash] = av.assertion
+				}
+			}
+		}
+		value.mux.RUnlock()
+	}
+	result := make([]*section.Assertion, 0, len(assertions))
+	for _, a := range assertions {
+		result = append(result, a)
+	}
+	return result
+}
+
 //RemoveExpiredValues goes through the cache and removes all expired assertions from the
 //assertionCache and the consistency cache.
 func (c *AssertionImpl) RemoveExpiredValues() {
@@ -212,6 +247,7 @@ func (c *AssertionImpl) RemoveExpiredValues() {
 			if set, ok := c.zoneMap.Get(value.zone); ok {
 				set.(*safeHashMap.Map).Remove(value.cacheKey)
 			}
+			c.names.remove(value.zone, value.context, value.name, value.cacheKey)
 		}
 		value.mux.Unlock()
 		c.counter.Sub(deleteCount)
@@ -222,36 +258,59 @@ func (c *AssertionImpl) RemoveExpiredValues() {
 func (c *AssertionImpl) RemoveZone(zone string) {
 	if set, ok := c.zoneMap.Remove(zone); ok {
 		for _, key := range set.(*safeHashMap.Map).GetAllKeys() {
-			v, ok := c.cache.Remove(key)
-			if ok {
-				value := v.(*assertionCacheValue)
-				value.mux.Lock()
-				if value.deleted {
-					value.mux.Unlock()
-					continue
-				}
-				value.deleted = true
-				for _, val := range value.assertions {
-					c.mux.Lock()
-					c.entriesPerAssertionMap[val.assertion.Hash()]--
-					c.mux.Unlock()
-				}
-				c.counter.Sub(len(value.assertions))
-				value.mux.Unlock()
-			}
+			c.remove(key)
+		}
+	}
+}
+
+//RemoveZoneContext deletes all assertions of zone in context from the assertionCache and
+//consistencyCache. The assertions of zone in other contexts are kept.
+func (c *AssertionImpl) RemoveZoneContext(zone, context string) {
+	set, ok := c.zoneMap.Get(zone)
+	if !ok {
+		return
+	}
+	keys := set.(*safeHashMap.Map)
+	for _, key := range keys.GetAllKeys() {
+		if ctx, ok := keys.Get(key); ok && ctx == context {
+			keys.Remove(key)
+			c.remove(key)
 		}
 	}
 }
 
-//Checkpoint returns all cached assertions
-func (c *AssertionImpl) Checkpoint() (assertions []section.Section) {
-	entries := c.cache.GetAll()
-	for _, e := range entries {
+//remove deletes the cache entry with key.
+func (c *AssertionImpl) remove(key string) {
+	v, ok := c.cache.Remove(key)
+	if !ok {
+		return
+	}
+	value := v.(*assertionCacheValue)
+	value.mux.Lock()
+	defer value.mux.Unlock()
+	if value.deleted {
+		return
+	}
+	value.deleted = true
+	c.names.remove(value.zone, value.context, value.name, value.cacheKey)
+	for _, val := range value.assertions {
+		c.mux.Lock()
+		c.entriesPerAssertionMap[val.assertion.Hash()]--
+		c.mux.Unlock()
+	}
+	c.counter.Sub(len(value.assertions))
+}
+
+//Checkpoint returns all cached assertions together with their expiration.
+func (c *AssertionImpl) Checkpoint() (checkpoint []CheckpointEntry) {
+	entries, internal := c.cache.GetAllInternal()
+	for i, e := range entries {
 		values := e.(*assertionCacheValue)
 		values.mux.RLock()
 		if !values.deleted {
 			for _, v := range values.assertions {
-				assertions = append(assertions, v.assertion)
+				checkpoint = append(checkpoint, CheckpointEntry{Section: v.assertion,
+					Expiration: v.expiration, Internal: internal[i]})
 			}
 		}
 		values.mux.RUnlock()
@@ -263,3 +322,9 @@ func (c *AssertionImpl) Checkpoint() (assertions []section.Section) {
 func (c *AssertionImpl) Len() int {
 	return c.counter.Value()
 }
+
+//SetMaxSize changes the maximum number of elements in the cache. Non internal elements in excess
+//are removed when the next element is added.
+func (c *AssertionImpl) SetMaxSize(maxSize int) {
+	c.counter.SetMaxCount(maxSize)
+}
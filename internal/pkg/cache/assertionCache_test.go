@@ -10,6 +10,7 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/datastructures/safeHashMap"
 	"github.com/netsec-ethz/rains/internal/pkg/lruCache"
 	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
 )
 
 func TestAssertionCache(t *testing.T) {
@@ -22,6 +23,7 @@ func TestAssertionCache(t *testing.T) {
 				cache:                  lruCache.New(),
 				counter:                safeCounter.New(4),
 				zoneMap:                safeHashMap.New(),
+				names:                  newNameIndex(),
 				entriesPerAssertionMap: make(map[string]int),
 			},
 		},
@@ -126,6 +128,7 @@ func TestAssertionCheckpoint(t *testing.T) {
 				cache:                  lruCache.New(),
 				counter:                safeCounter.New(4),
 				zoneMap:                safeHashMap.New(),
+				names:                  newNameIndex(),
 				entriesPerAssertionMap: make(map[string]int),
 			},
 		},
@@ -138,10 +141,17 @@ func TestAssertionCheckpoint(t *testing.T) {
 			t.Errorf("%d:init size is incorrect actual=%d", i, c.Len())
 		}
 		//Add delegationAssertions
-		c.Add(delegationsCH[0], time.Now().Add(time.Hour).Unix(), false)
-		c.Add(delegationsORG[0], time.Now().Add(time.Hour).Unix(), false)
+		expiration := time.Now().Add(time.Hour).Unix()
+		c.Add(delegationsCH[0], expiration, false)
+		c.Add(delegationsORG[0], expiration, true)
 		//Test Checkpointing
-		assertions := c.Checkpoint()
+		entries := c.Checkpoint()
+		for _, e := range entries {
+			if e.Expiration != expiration || e.Internal != (e.Section == delegationsORG[0]) {
+				t.Errorf("%d:wrong checkpoint entry. actual=%v", i, e)
+			}
+		}
+		assertions := checkpointSections(entries)
 		if len(assertions) != 2 {
 			t.Errorf("Number of assertions is wrong")
 		}
@@ -153,3 +163,59 @@ func TestAssertionCheckpoint(t *testing.T) {
 		}
 	}
 }
+
+func TestAssertionGetZone(t *testing.T) {
+	c := NewAssertion(10)
+	delegationsCH := getExampleDelgations("ch")
+	delegationsORG := getExampleDelgations("org")
+	c.Add(delegationsCH[0], time.Now().Add(time.Hour).Unix(), false)
+	c.Add(delegationsCH[4], time.Now().Add(time.Hour).Unix(), false)
+	c.Add(delegationsORG[0], time.Now().Add(time.Hour).Unix(), false)
+	if as := c.GetZone(".", ".", section.TotalInterval{}); len(as) != 3 {
+		t.Errorf("wrong number of assertions of zone. expected=3 actual=%d", len(as))
+	}
+	if as := c.GetZone(".", "other", section.TotalInterval{}); len(as) != 0 {
+		t.Errorf("assertions of a different context were returned. actual=%v", as)
+	}
+	if as := c.GetZone("ch.", ".", section.TotalInterval{}); len(as) != 0 {
+		t.Errorf("assertions of a different zone were returned. actual=%v", as)
+	}
+}
+
+func TestAssertionSetMaxSize(t *testing.T) {
+	c := NewAssertion(10)
+	delegations := getExampleDelgations("ch")
+	for _, a := range delegations[:4] {
+		c.Add(a, time.Now().Add(time.Hour).Unix(), false)
+	}
+	size := c.Len()
+	c.SetMaxSize(size - 1)
+	if c.Len() != size {
+		t.Errorf("elements were removed before the next addition. expected=%d actual=%d", size,
+			c.Len())
+	}
+	c.Add(getExampleDelgations("org")[0], time.Now().Add(time.Hour).Unix(), false)
+	if c.Len() >= size-1 {
+		t.Errorf("elements in excess were not removed. actual=%d", c.Len())
+	}
+}
+
+func TestAssertionRemoveZoneContext(t *testing.T) {
+	c := NewAssertion(10)
+	a, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other.Context = "other"
+	c.Add(a, a.ValidUntil(), false)
+	c.Add(other, other.ValidUntil(), true)
+	c.RemoveZoneContext("example.", "other")
+	if as := c.GetZone("example.", "other", section.TotalInterval{}); len(as) != 0 {
+		t.Errorf("assertions of removed context are still cached. actual=%v", as)
+	}
+	if as := c.GetZone("example.", ".", section.TotalInterval{}); len(as) != 1 || c.Len() != 2 {
+		t.Errorf("assertions of other context were removed. actual=%v len=%d", as, c.Len())
+	}
+	c.RemoveZone("example.")
+	if c.Len() != 0 {
+		t.Errorf("assertions of zone were not removed. actual=%d", c.Len())
+	}
+}
@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cbor "github.com/britram/borat"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+const (
+	//Operations of the records in an authoritative store file.
+	opAdd        = 1
+	opRemoveZone = 2
+
+	//Section types of added sections. They are the same as in the content of a message.
+	storeAssertion = 1
+	storeShard     = 2
+	storePshard    = 3
+	storeZone      = 4
+
+	//minCompactionRecords is the number of records a store file must at least contain before it
+	//is compacted.
+	minCompactionRecords = 1000
+	//maxRecordSize is the maximum size of an encoded record in bytes.
+	maxRecordSize = 1 << 26
+)
+
+/*
+ * on-disk authoritative store implementation
+ * All sections are kept in memory and every change is appended as a record to a single file. When
+ * the store is opened, the records are replayed. Each record is a cbor encoded map prefixed by its
+ * length as a 32 bit big endian integer. The file is compacted when it contains more than twice as
+ * many records as there are sections in the store.
+ */
+type AuthoritativeFileImpl struct {
+	//mutex serializes changes of the store such that records are appended in order.
+	mutex  sync.Mutex
+	memory *AuthoritativeMemoryImpl
+	path   string
+	file   *os.File
+	//records is the number of records in file.
+	records int
+}
+
+//NewAuthoritativeFile opens the store at path. The file is created if it does not exist. Expired
+//sections are not loaded. A partially written record at the end of the file is discarded.
+func NewAuthoritativeFile(path string) (*AuthoritativeFileImpl, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &AuthoritativeFileImpl{memory: NewAuthoritativeMemory(), path: path, file: file}
+	if err := c.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := c.compactIfNeeded(); err != nil {
+		c.file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//replay applies the records of the store's file to the in-memory store.
+func (c *AuthoritativeFileImpl) replay() error {
+	reader := bufio.NewReader(c.file)
+	now := time.Now().Unix()
+	offset := int64(0)
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return c.truncate(offset)
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxRecordSize {
+			return fmt.Errorf("record at offset %d is too large: %d bytes", offset, size)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(reader, record); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return c.truncate(offset)
+		} else if err != nil {
+			return err
+		}
+		if err := c.apply(record, now); err != nil {
+			return fmt.Errorf("malformed record at offset %d: %v", offset, err)
+		}
+		offset += int64(len(length) + len(record))
+		c.records++
+	}
+}
+
+//truncate removes the partially written record at offset from the end of the file.
+func (c *AuthoritativeFileImpl) truncate(offset int64) error {
+	log.Warn("Discarding partially written record of authoritative store", "path", c.path,
+		"offset", offset)
+	return c.file.Truncate(offset)
+}
+
+//apply decodes record and applies it to the in-memory store. Added sections which expired before
+//now are ignored.
+func (c *AuthoritativeFileImpl) apply(record []byte, now int64) error {
+	m, err := cbor.NewCBORReader(bytes.NewReader(record)).ReadIntMapUntagged()
+	if err != nil {
+		return err
+	}
+	switch m[0] {
+	case opAdd:
+		sec, err := decodeStoreSection(m)
+		if err != nil {
+			return err
+		}
+		if sec.ValidUntil() < now {
+			return nil
+		}
+		if a, ok := sec.(*section.Assertion); ok {
+			c.memory.addAssertion(a)
+		} else {
+			c.memory.addNegAssertion(sec)
+		}
+	case opRemoveZone:
+		zone, ok1 := m[5].(string)
+		context, ok2 := m[6].(string)
+		if !ok1 || !ok2 {
+			return errors.New("zone and context of a removal must be strings")
+		}
+		c.memory.removeZone(zone, context)
+	default:
+		return fmt.Errorf("unknown operation: %v", m[0])
+	}
+	return nil
+}
+
+func decodeStoreSection(m map[int]interface{}) (section.WithSigForward, error) {
+	val, ok := m[2].(map[int]interface{})
+	if !ok {
+		return nil, errors.New("cbor encoding of a section should be a map")
+	}
+	var sec interface {
+		section.WithSigForward
+		UnmarshalMap(map[int]interface{}) error
+	}
+	switch m[1] {
+	case storeAssertion:
+		sec = &section.Assertion{}
+	case storeShard:
+		sec = &section.Shard{}
+	case storePshard:
+		sec = &section.Pshard{}
+	case storeZone:
+		sec = &section.Zone{}
+	default:
+		return nil, fmt.Errorf("unknown section type: %v", m[1])
+	}
+	if err := sec.UnmarshalMap(val); err != nil {
+		return nil, err
+	}
+	validSince, ok1 := m[3].(int)
+	validUntil, ok2 := m[4].(int)
+	if !ok1 || !ok2 {
+		return nil, errors.New("validity of a section must be integers")
+	}
+	sec.SetValidSince(int64(validSince))
+	sec.SetValidUntil(int64(validUntil))
+	return sec, nil
+}
+
+//encodeAddRecord returns the record adding sec to the store.
+func encodeAddRecord(sec section.WithSigForward) (map[int]interface{}, error) {
+	var t int
+	switch sec.(type) {
+	case *section.Assertion:
+		t = storeAssertion
+	case *section.Shard:
+		t = storeShard
+	case *section.Pshard:
+		t = storePshard
+	case *section.Zone:
+		t = storeZone
+	default:
+		return nil, fmt.Errorf("unknown section type: %T", sec)
+	}
+	return map[int]interface{}{0: opAdd, 1: t, 2: sec, 3: sec.ValidSince(), 4: sec.ValidUntil()},
+		nil
+}
+
+//writeRecord appends the length prefixed cbor encoding of record to w.
+func writeRecord(w io.Writer, record map[int]interface{}) error {
+	encoding := new(bytes.Buffer)
+	encoding.Write(make([]byte, 4))
+	if err := cbor.NewCBORWriter(encoding).WriteIntMap(record); err != nil {
+		return err
+	}
+	b := encoding.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := w.Write(b)
+	return err
+}
+
+//append writes record to the store's file. The caller must hold the lock.
+func (c *AuthoritativeFileImpl) append(record map[int]interface{}) error {
+	if c.file == nil {
+		return errors.New("authoritative store is closed")
+	}
+	if err := writeRecord(c.file, record); err != nil {
+		return err
+	}
+	c.records++
+	return nil
+}
+
+//AddAssertion adds a to the store. Assertions with the same subject name, zone and context which
+//have an object type in common with a are replaced.
+func (c *AuthoritativeFileImpl) AddAssertion(a *section.Assertion) error {
+	return c.add(a)
+}
+
+//AddNegAssertion adds a shard, pshard or zone to the store. A shard or pshard with the same range
+//and a zone with the same subject zone and context is replaced.
+func (c *AuthoritativeFileImpl) AddNegAssertion(s section.WithSigForward) error {
+	if err := checkNegAssertion(s); err != nil {
+		return err
+	}
+	return c.add(s)
+}
+
+func (c *AuthoritativeFileImpl) add(sec section.WithSigForward) error {
+	record, err := encodeAddRecord(sec)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.append(record); err != nil {
+		return err
+	}
+	if a, ok := sec.(*section.Assertion); ok {
+		return c.memory.AddAssertion(a)
+	}
+	return c.memory.AddNegAssertion(sec)
+}
+
+//Get returns true and the assertions of fqdn in context containing an object of objType if there
+//exist some. Otherwise nil and false is returned.
+func (c *AuthoritativeFileImpl) Get(fqdn, context string, objType object.Type) (
+	[]*section.Assertion, bool) {
+	return c.memory.Get(fqdn, context, objType)
+}
+
+//GetZone returns the assertions of zone in context whose subject name is within interval.
+func (c *AuthoritativeFileImpl) GetZone(zone, context string,
+	interval section.Interval) []*section.Assertion {
+	return c.memory.GetZone(zone, context, interval)
+}
+
+//GetNegAssertions returns true and the shards, pshards and zones of zone in context which overlap
+//with interval if there exist some. Otherwise nil and false is returned.
+func (c *AuthoritativeFileImpl) GetNegAssertions(zone, context string,
+	interval section.Interval) ([]section.WithSigForward, bool) {
+	return c.memory.GetNegAssertions(zone, context, interval)
+}
+
+//RemoveExpiredValues deletes all expired sections from the store. The file is compacted if it
+//contains too many records of removed sections.
+func (c *AuthoritativeFileImpl) RemoveExpiredValues() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.memory.RemoveExpiredValues()
+	return c.compactIfNeeded()
+}
+
+//RemoveZone deletes all sections of zone in context from the store.
+func (c *AuthoritativeFileImpl) RemoveZone(zone, context string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.append(map[int]interface{}{0: opRemoveZone, 5: zone, 6: context}); err != nil {
+		return err
+	}
+	c.memory.RemoveZone(zone, context)
+	return c.compactIfNeeded()
+}
+
+//compactIfNeeded rewrites the store's file with one record per section if it contains more than
+//twice as many records as there are sections. The caller must hold the lock.
+func (c *AuthoritativeFileImpl) compactIfNeeded() error {
+	if c.records < minCompactionRecords || c.records <= 2*c.memory.Len() {
+		return nil
+	}
+	c.memory.mutex.RLock()
+	sections := c.memory.all()
+	c.memory.mutex.RUnlock()
+	dir, file := filepath.Split(c.path)
+	tmp, err := ioutil.TempFile(dir, file+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, sec := range sections {
+		var record map[int]interface{}
+		if record, err = encodeAddRecord(sec); err != nil {
+			break
+		}
+		if err = writeRecord(writer, record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	compacted, err := os.OpenFile(c.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.Info("Compacted authoritative store", "path", c.path, "records", c.records,
+		"sections", len(sections))
+	c.file.Close()
+	c.file = compacted
+	c.records = len(sections)
+	return nil
+}
+
+//Len returns the number of sections in the store.
+func (c *AuthoritativeFileImpl) Len() int {
+	return c.memory.Len()
+}
+
+//Close writes the store's file to disk and closes it.
+func (c *AuthoritativeFileImpl) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Sync()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file = nil
+	return err
+}
@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+/*
+ * in-memory authoritative store implementation
+ * Assertions are stored by their subject name, zone, context and object types and indexed by fqdn,
+ * context and object type. Shards and pshards are stored by their range and zones by their subject
+ * zone per subject zone and context. A shard, pshard or zone replaces the stored one with the same
+ * key. An assertion replaces all stored assertions of its subject name, zone and context which have
+ * an object type in common with it, such that a republished section replaces its previous version
+ * even if its object types have changed. Nothing is evicted before it expires.
+ */
+type AuthoritativeMemoryImpl struct {
+	mutex sync.RWMutex
+	//assertions maps the store key of an assertion to the assertion.
+	assertions map[string]*section.Assertion
+	//index maps an fqdn, context and object type to the store keys of the assertions containing
+	//such an object.
+	index map[string]map[string]bool
+	//names contains the store keys of the assertions by subject name per zone and context.
+	names *nameIndex
+	//negAssertions maps a zone and context to its shards, pshards and zones by their store key.
+	negAssertions map[string]map[string]section.WithSigForward
+}
+
+func NewAuthoritativeMemory() *AuthoritativeMemoryImpl {
+	return &AuthoritativeMemoryImpl{
+		assertions:    make(map[string]*section.Assertion),
+		index:         make(map[string]map[string]bool),
+		names:         newNameIndex(),
+		negAssertions: make(map[string]map[string]section.WithSigForward),
+	}
+}
+
+//AddAssertion adds a to the store. Assertions with the same subject name, zone and context which
+//have an object type in common with a are replaced.
+func (c *AuthoritativeMemoryImpl) AddAssertion(a *section.Assertion) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addAssertion(a)
+	return nil
+}
+
+func (c *AuthoritativeMemoryImpl) addAssertion(a *section.Assertion) {
+	for _, o := range a.Content {
+		for storeKey := range c.index[assertionCacheMapKeyFQDN(a.FQDN(), a.Context, o.Type)] {
+			if old := c.assertions[storeKey]; old.SubjectZone == a.SubjectZone {
+				c.removeAssertion(storeKey, old)
+			}
+		}
+	}
+	storeKey := assertionStoreKey(a)
+	c.assertions[storeKey] = a
+	c.names.add(a.SubjectZone, a.Context, a.SubjectName, storeKey)
+	for _, o := range a.Content {
+		key := assertionCacheMapKeyFQDN(a.FQDN(), a.Context, o.Type)
+		if c.index[key] == nil {
+			c.index[key] = make(map[string]bool)
+		}
+		c.index[key][storeKey] = true
+	}
+}
+
+//removeAssertion deletes a stored under storeKey. The caller must hold the lock.
+func (c *AuthoritativeMemoryImpl) removeAssertion(storeKey string, a *section.Assertion) {
+	delete(c.assertions, storeKey)
+	c.names.remove(a.SubjectZone, a.Context, a.SubjectName, storeKey)
+	for _, o := range a.Content {
+		key := assertionCacheMapKeyFQDN(a.FQDN(), a.Context, o.Type)
+		delete(c.index[key], storeKey)
+		if len(c.index[key]) == 0 {
+			delete(c.index, key)
+		}
+	}
+}
+
+//assertionStoreKey returns the key under which a is stored. It consists of a's subject name, zone,
+//context and the sorted types of its objects.
+func assertionStoreKey(a *section.Assertion) string {
+	types := []string{}
+	for _, o := range a.Content {
+		types = append(types, fmt.Sprint(int(o.Type)))
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("%s %s %s %s", a.SubjectName, a.SubjectZone, a.Context,
+		strings.Join(types, ","))
+}
+
+//negAssertionStoreKey returns the key under which the shard, pshard or zone s is stored within its
+//zone and context. Shards and pshards are identified by their range.
+func negAssertionStoreKey(s section.WithSigForward) string {
+	switch s := s.(type) {
+	case *section.Shard:
+		return fmt.Sprintf("shard %s %s", s.RangeFrom, s.RangeTo)
+	case *section.Pshard:
+		return fmt.Sprintf("pshard %s %s", s.RangeFrom, s.RangeTo)
+	default:
+		return "zone"
+	}
+}
+
+//AddNegAssertion adds a shard, pshard or zone to the store. A shard or pshard with the same range
+//and a zone with the same subject zone and context is replaced.
+func (c *AuthoritativeMemoryImpl) AddNegAssertion(s section.WithSigForward) error {
+	if err := checkNegAssertion(s); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addNegAssertion(s)
+	return nil
+}
+
+func (c *AuthoritativeMemoryImpl) addNegAssertion(s section.WithSigForward) {
+	key := zoneCtxKey(s.GetSubjectZone(), s.GetContext())
+	if c.negAssertions[key] == nil {
+		c.negAssertions[key] = make(map[string]section.WithSigForward)
+	}
+	c.negAssertions[key][negAssertionStoreKey(s)] = s
+}
+
+//checkNegAssertion returns an error if s is not a shard, pshard or zone.
+func checkNegAssertion(s section.WithSigForward) error {
+	switch s.(type) {
+	case *section.Shard, *section.Pshard, *section.Zone:
+		return nil
+	default:
+		return fmt.Errorf("expected a shard, pshard or zone but got: %T", s)
+	}
+}
+
+//Get returns true and the assertions of fqdn in context containing an object of objType if there
+//exist some. Otherwise nil and false is returned.
+func (c *AuthoritativeMemoryImpl) Get(fqdn, context string, objType object.Type) (
+	[]*section.Assertion, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var assertions []*section.Assertion
+	for storeKey := range c.index[assertionCacheMapKeyFQDN(fqdn, context, objType)] {
+		assertions = append(assertions, c.assertions[storeKey])
+	}
+	return assertions, len(assertions) > 0
+}
+
+//GetZone returns the assertions of zone in context whose subject name is within interval.
+func (c *AuthoritativeMemoryImpl) GetZone(zone, context string,
+	interval section.Interval) []*section.Assertion {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	assertions := []*section.Assertion{}
+	for _, storeKey := range c.names.get(zone, context, interval) {
+		assertions = append(assertions, c.assertions[storeKey])
+	}
+	return assertions
+}
+
+//GetNegAssertions returns true and the shards, pshards and zones of zone in context which overlap
+//with interval if there exist some. Otherwise nil and false is returned.
+func (c *AuthoritativeMemoryImpl) GetNegAssertions(zone, context string,
+	interval section.Interval) ([]section.WithSigForward, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var secs []section.WithSigForward
+	for _, s := range c.negAssertions[zoneCtxKey(zone, context)] {
+		if section.Intersect(s, interval) {
+			secs = append(secs, s)
+		}
+	}
+	return secs, len(secs) > 0
+}
+
+//RemoveExpiredValues deletes all expired sections from the store.
+func (c *AuthoritativeMemoryImpl) RemoveExpiredValues() error {
+	now := time.Now().Unix()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(func(s section.WithSigForward) bool { return s.ValidUntil() < now })
+	return nil
+}
+
+//RemoveZone deletes all sections of zone in context from the store.
+func (c *AuthoritativeMemoryImpl) RemoveZone(zone, context string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeZone(zone, context)
+	return nil
+}
+
+func (c *AuthoritativeMemoryImpl) removeZone(zone, context string) {
+	c.remove(func(s section.WithSigForward) bool {
+		return s.GetSubjectZone() == zone && s.GetContext() == context
+	})
+}
+
+//remove deletes all sections for which match returns true. The caller must hold the lock.
+func (c *AuthoritativeMemoryImpl) remove(match func(section.WithSigForward) bool) {
+	for storeKey, a := range c.assertions {
+		if match(a) {
+			c.removeAssertion(storeKey, a)
+		}
+	}
+	for key, secs := range c.negAssertions {
+		for storeKey, s := range secs {
+			if match(s) {
+				delete(secs, storeKey)
+			}
+		}
+		if len(secs) == 0 {
+			delete(c.negAssertions, key)
+		}
+	}
+}
+
+//all returns all sections of the store. The caller must hold the lock.
+func (c *AuthoritativeMemoryImpl) all() []section.WithSigForward {
+	secs := []section.WithSigForward{}
+	for _, a := range c.assertions {
+		secs = append(secs, a)
+	}
+	for _, zoneSecs := range c.negAssertions {
+		for _, s := range zoneSecs {
+			secs = append(secs, s)
+		}
+	}
+	return secs
+}
+
+//Len returns the number of sections in the store.
+func (c *AuthoritativeMemoryImpl) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	n := len(c.assertions)
+	for _, secs := range c.negAssertions {
+		n += len(secs)
+	}
+	return n
+}
+
+//Close implements AuthoritativeStore. It has no effect.
+func (c *AuthoritativeMemoryImpl) Close() error {
+	return nil
+}
@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/rains/internal/pkg/algorithmTypes"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+)
+
+func getStoreSections(validUntil int64) (*section.Assertion, *section.Shard, *section.Zone) {
+	sig := signature.Sig{
+		PublicKeyID: keys.PublicKeyID{Algorithm: algorithmTypes.Ed25519},
+		ValidSince:  time.Now().Unix(),
+		ValidUntil:  validUntil,
+		Data:        []byte("signature"),
+	}
+	a := &section.Assertion{
+		SubjectName: "www",
+		SubjectZone: "example.",
+		Context:     ".",
+		Content: []object.Object{
+			{Type: object.OTIP4Addr, Value: net.ParseIP("192.0.2.1")},
+			{Type: object.OTRedirection, Value: "ns.example."},
+		},
+		Signatures: []signature.Sig{sig},
+	}
+	shard := &section.Shard{
+		SubjectZone: "example.",
+		Context:     ".",
+		RangeFrom:   "a",
+		RangeTo:     "z",
+		Signatures:  []signature.Sig{sig},
+	}
+	zone := &section.Zone{
+		SubjectZone: "example.",
+		Context:     ".",
+		Signatures:  []signature.Sig{sig},
+	}
+	for _, s := range []section.WithSigForward{a, shard, zone} {
+		s.SetValidSince(time.Now().Unix())
+		s.SetValidUntil(validUntil)
+	}
+	return a, shard, zone
+}
+
+func checkStoreContent(t *testing.T, name string, store AuthoritativeStore,
+	expected []section.WithSigForward) {
+	if store.Len() != len(expected) {
+		t.Errorf("%s: wrong number of sections. expected=%d actual=%d", name, len(expected),
+			store.Len())
+	}
+	for _, e := range expected {
+		var secs []section.WithSigForward
+		if a, ok := e.(*section.Assertion); ok {
+			assertions, _ := store.Get(a.FQDN(), a.Context, a.Content[0].Type)
+			for _, a := range assertions {
+				secs = append(secs, a)
+			}
+		} else {
+			secs, _ = store.GetNegAssertions(e.GetSubjectZone(), e.GetContext(),
+				section.TotalInterval{})
+		}
+		found := false
+		for _, s := range secs {
+			if s.Hash() == e.Hash() && s.ValidUntil() == e.ValidUntil() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: section not in store: %v", name, e)
+		}
+	}
+}
+
+func TestAuthoritativeMemory(t *testing.T) {
+	store := NewAuthoritativeMemory()
+	a, shard, zone := getStoreSections(time.Now().Add(time.Hour).Unix())
+	expired, _, _ := getStoreSections(time.Now().Add(-time.Hour).Unix())
+	expired.SubjectName = "old"
+	for _, s := range []*section.Assertion{a, expired} {
+		if err := store.AddAssertion(s); err != nil {
+			t.Fatalf("was not able to add assertion: %v", err)
+		}
+	}
+	for _, s := range []section.WithSigForward{shard, zone} {
+		if err := store.AddNegAssertion(s); err != nil {
+			t.Fatalf("was not able to add negative assertion: %v", err)
+		}
+	}
+	if err := store.AddNegAssertion(a); err == nil {
+		t.Error("assertion was added as negative assertion")
+	}
+	checkStoreContent(t, "add", store, []section.WithSigForward{a, expired, shard, zone})
+	if assertions, ok := store.Get("www.example.", ".", object.OTRedirection); !ok ||
+		len(assertions) != 1 {
+		t.Errorf("assertion not found by its second type. actual=%v", assertions)
+	}
+	if _, ok := store.Get("www.example.", ".", object.OTIP6Addr); ok {
+		t.Error("assertion found by a type it does not contain")
+	}
+	if secs, _ := store.GetNegAssertions("example.", ".", section.StringInterval{Name: "b"}); len(secs) != 2 {
+		t.Errorf("wrong sections for interval. actual=%v", secs)
+	}
+	if as := store.GetZone("example.", ".", shard); len(as) != 2 {
+		t.Errorf("wrong assertions in range of shard. actual=%v", as)
+	}
+	if as := store.GetZone("example.", ".", section.StringInterval{Name: "old"}); len(as) != 1 {
+		t.Errorf("wrong assertions of name. actual=%v", as)
+	}
+	store.RemoveExpiredValues()
+	checkStoreContent(t, "expired", store, []section.WithSigForward{a, shard, zone})
+	if as := store.GetZone("example.", ".", section.TotalInterval{}); len(as) != 1 {
+		t.Errorf("expired assertion is still in the range of the zone. actual=%v", as)
+	}
+	store.RemoveZone("example.", "other")
+	checkStoreContent(t, "other context", store, []section.WithSigForward{a, shard, zone})
+	store.RemoveZone("example.", ".")
+	checkStoreContent(t, "removed", store, nil)
+	if _, ok := store.Get("www.example.", ".", object.OTIP4Addr); ok {
+		t.Error("removed assertion is still in the store")
+	}
+}
+
+func TestAuthoritativeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authoritativeStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+	store, err := NewAuthoritativeFile(path)
+	if err != nil {
+		t.Fatalf("was not able to create store: %v", err)
+	}
+	a, shard, zone := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other.SubjectZone = "other."
+	if err := store.AddAssertion(a); err != nil {
+		t.Fatalf("was not able to add assertion: %v", err)
+	}
+	store.AddAssertion(other)
+	store.AddNegAssertion(shard)
+	store.AddNegAssertion(zone)
+	store.RemoveZone("other.", ".")
+	checkStoreContent(t, "add", store, []section.WithSigForward{a, shard, zone})
+	if err := store.Close(); err != nil {
+		t.Fatalf("was not able to close store: %v", err)
+	}
+
+	//The sections are restored from the file, except the removed ones.
+	store, err = NewAuthoritativeFile(path)
+	if err != nil {
+		t.Fatalf("was not able to open store: %v", err)
+	}
+	checkStoreContent(t, "reopen", store, []section.WithSigForward{a, shard, zone})
+	store.Close()
+
+	//A partially written record at the end of the file is discarded.
+	info, _ := os.Stat(path)
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte{0, 0, 1, 0, 0xa5})
+	file.Close()
+	store, err = NewAuthoritativeFile(path)
+	if err != nil {
+		t.Fatalf("was not able to open store with partial record: %v", err)
+	}
+	checkStoreContent(t, "partial record", store, []section.WithSigForward{a, shard, zone})
+	if truncated, _ := os.Stat(path); truncated.Size() != info.Size() {
+		t.Errorf("partial record was not removed. expected=%d actual=%d", info.Size(),
+			truncated.Size())
+	}
+	store.Close()
+
+	//Garbage is not accepted as a store file.
+	ioutil.WriteFile(path, []byte{0, 0, 0, 1, 0xff}, 0600)
+	if _, err := NewAuthoritativeFile(path); err == nil {
+		t.Error("malformed store file was accepted")
+	}
+}
+
+func TestAuthoritativeFileCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authoritativeStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+	store, err := NewAuthoritativeFile(path)
+	if err != nil {
+		t.Fatalf("was not able to create store: %v", err)
+	}
+	a, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	other.SubjectZone = "other."
+	store.AddAssertion(a)
+	for i := 0; i < minCompactionRecords/2; i++ {
+		store.AddAssertion(other)
+		store.RemoveZone("other.", ".")
+	}
+	if store.records != 1 {
+		t.Errorf("store file was not compacted. records=%d", store.records)
+	}
+	store.Close()
+	store, err = NewAuthoritativeFile(path)
+	if err != nil {
+		t.Fatalf("was not able to open compacted store: %v", err)
+	}
+	defer store.Close()
+	checkStoreContent(t, "compacted", store, []section.WithSigForward{a})
+}
+
+func TestAuthoritativeStoreReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authoritativeStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, shard, zone := getStoreSections(time.Now().Add(time.Hour).Unix())
+	newA, newShard, newZone := getStoreSections(time.Now().Add(2 * time.Hour).Unix())
+	newA.Content[0].Value = net.ParseIP("192.0.2.2")
+	ip6, otherShard, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	ip6.Content = []object.Object{{Type: object.OTIP6Addr, Value: net.ParseIP("2001:db8::1")}}
+	otherShard.RangeTo = "m"
+	both, _, _ := getStoreSections(time.Now().Add(time.Hour).Unix())
+	both.Content = append(both.Content, ip6.Content...)
+	var tests = []struct {
+		added    []section.WithSigForward
+		expected []section.WithSigForward
+		//ip6 is true if an assertion with an IPv6 address is served.
+		ip6 bool
+	}{
+		{[]section.WithSigForward{a, newA}, []section.WithSigForward{newA}, false},
+		{[]section.WithSigForward{newA, a}, []section.WithSigForward{a}, false},
+		{[]section.WithSigForward{a, ip6}, []section.WithSigForward{a, ip6}, true},
+		{[]section.WithSigForward{a, both}, []section.WithSigForward{both}, true},
+		{[]section.WithSigForward{both, a}, []section.WithSigForward{a}, false},
+		{[]section.WithSigForward{a, ip6, both}, []section.WithSigForward{both}, true},
+		{[]section.WithSigForward{shard, newShard}, []section.WithSigForward{newShard}, false},
+		{[]section.WithSigForward{shard, otherShard}, []section.WithSigForward{shard, otherShard},
+			false},
+		{[]section.WithSigForward{zone, newZone}, []section.WithSigForward{newZone}, false},
+	}
+	for i, test := range tests {
+		file, err := NewAuthoritativeFile(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("%d: was not able to create store: %v", i, err)
+		}
+		for _, store := range []AuthoritativeStore{NewAuthoritativeMemory(), file} {
+			for _, s := range test.added {
+				if a, ok := s.(*section.Assertion); ok {
+					store.AddAssertion(a)
+				} else {
+					store.AddNegAssertion(s)
+				}
+			}
+			checkStoreContent(t, fmt.Sprintf("%d: %T", i, store), store, test.expected)
+			assertions := 0
+			for _, s := range test.expected {
+				if _, ok := s.(*section.Assertion); ok {
+					assertions++
+				}
+			}
+			if as := store.GetZone("example.", ".", section.TotalInterval{}); len(as) != assertions {
+				t.Errorf("%d: replaced assertion is still in the range of the zone. actual=%v",
+					i, as)
+			}
+			if _, ok := store.Get(a.FQDN(), a.Context, object.OTIP6Addr); ok != test.ip6 {
+				t.Errorf("%d: wrong IPv6 assertion. expected=%t actual=%t", i, test.ip6, ok)
+			}
+		}
+		file.Close()
+		//The records of replaced sections are replayed in order.
+		file, err = NewAuthoritativeFile(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("%d: was not able to open store: %v", i, err)
+		}
+		checkStoreContent(t, fmt.Sprintf("%d: reopen", i), file, test.expected)
+		file.Close()
+	}
+}
@@ -32,6 +32,15 @@ func TestZoneCtxKey(t *testing.T) {
 	}
 }
 
+//checkpointSections returns the sections of entries.
+func checkpointSections(entries []CheckpointEntry) []section.WithSigForward {
+	sections := []section.WithSigForward{}
+	for _, e := range entries {
+		sections = append(sections, e.Section)
+	}
+	return sections
+}
+
 func getExampleDelgations(tld string) []*section.Assertion {
 	a1 := &section.Assertion{
 		SubjectName: tld,
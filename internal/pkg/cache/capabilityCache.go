@@ -1,9 +1,7 @@
 package cache
 
 import (
-	"crypto/sha256"
 	"fmt"
-	"sort"
 
 	log "github.com/inconshreveable/log15"
 	"github.com/netsec-ethz/rains/internal/pkg/datastructures/safeCounter"
@@ -24,24 +22,15 @@ func NewCapability(maxSize int) *CapabilityImpl {
 		capabilityMap: lruCache.New(),
 		counter:       safeCounter.New(maxSize),
 	}
-	cache.capabilityMap.GetOrAdd("e5365a09be554ae55b855f15264dbc837b04f5831daeb321359e18cdabab5745",
-		[]message.Capability{message.TLSOverTCP}, true)
-	cache.capabilityMap.GetOrAdd("76be8b528d0075f7aae98d6fa57a6d3c83ae480a8469e668d7b0af968995ac71",
-		[]message.Capability{message.NoCapability}, false)
+	for _, caps := range [][]message.Capability{{message.TLSOverTCP}, {message.NoCapability}} {
+		cache.capabilityMap.GetOrAdd(message.CapabilityHash(caps), caps, true)
+	}
 	cache.counter.Add(2)
 	return cache
 }
 
 func (c *CapabilityImpl) Add(capabilities []message.Capability) {
-	//FIXME CFE take a SHA-256 hash of the CBOR byte stream derived from normalizing such an array by sorting it in lexicographically increasing order,
-	//then serializing it and add it to the cache
-	sort.Slice(capabilities, func(i, j int) bool { return capabilities[i] < capabilities[j] })
-	cs := []byte{}
-	for _, c := range capabilities {
-		cs = append(cs, []byte(c)...)
-	}
-	hash := sha256.Sum256(cs)
-	_, ok := c.capabilityMap.GetOrAdd(string(hash[:]), capabilities, false)
+	_, ok := c.capabilityMap.GetOrAdd(message.CapabilityHash(capabilities), capabilities, false)
 	//handle full cache
 	if ok && c.counter.Inc() {
 		for {
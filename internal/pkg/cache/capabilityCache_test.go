@@ -4,31 +4,20 @@ import (
 	"reflect"
 	"testing"
 
-	"github.com/netsec-ethz/rains/internal/pkg/datastructures/safeCounter"
-	"github.com/netsec-ethz/rains/internal/pkg/lruCache"
 	"github.com/netsec-ethz/rains/internal/pkg/message"
 )
 
 func TestCapabilityCache(t *testing.T) {
-	//TODO CFE remove these manually added entries once there is a working add implementation
-	cache := lruCache.New()
-	cache.GetOrAdd("e5365a09be554ae55b855f15264dbc837b04f5831daeb321359e18cdabab5745",
-		[]message.Capability{message.TLSOverTCP}, true)
-	cache.GetOrAdd("76be8b528d0075f7aae98d6fa57a6d3c83ae480a8469e668d7b0af968995ac71",
-		[]message.Capability{message.NoCapability}, false)
-	counter := safeCounter.New(10)
-	counter.Add(2)
 	var tests = []struct {
 		input Capability
 	}{
-		{&CapabilityImpl{capabilityMap: cache, counter: counter}},
+		{NewCapability(4)},
 	}
 	for i, test := range tests {
 		c := test.input
 		if c.Len() != 2 {
 			t.Error("init size is incorrect", "size", c.Len())
 		}
-		//TODO CFE test add when it is correctly implemented.
 		caps, ok := c.Get([]byte("e5365a09be554ae55b855f15264dbc837b04f5831daeb321359e18cdabab5745"))
 		if !ok {
 			t.Errorf("%d: Get did not returned contained element.", i)
@@ -36,12 +25,31 @@ func TestCapabilityCache(t *testing.T) {
 		if !reflect.DeepEqual(caps, []message.Capability{message.TLSOverTCP}) {
 			t.Errorf("%d: Returned element is wrong", i)
 		}
-		caps, ok = c.Get([]byte("76be8b528d0075f7aae98d6fa57a6d3c83ae480a8469e668d7b0af968995ac71"))
+		caps, ok = c.Get([]byte(message.CapabilityHash([]message.Capability{message.NoCapability})))
 		if !ok {
 			t.Errorf("%d: Get did not returned contained element.", i)
 		}
 		if !reflect.DeepEqual(caps, []message.Capability{message.NoCapability}) {
 			t.Errorf("%d: Returned element is wrong", i)
 		}
+		//the hash does not depend on the order of the capabilities
+		list := []message.Capability{"urn:x-rains:b", "urn:x-rains:a"}
+		c.Add(list)
+		caps, ok = c.Get([]byte(message.CapabilityHash([]message.Capability{"urn:x-rains:a",
+			"urn:x-rains:b"})))
+		if !ok || !reflect.DeepEqual(caps, list) {
+			t.Errorf("%d: Added element was not returned. actual=%v", i, caps)
+		}
+		//adding another list removes the least recently used one which is not built in.
+		c.Add([]message.Capability{"urn:x-rains:c"})
+		if c.Len() != 3 {
+			t.Errorf("%d: wrong size after lru removal. expected=3 actual=%d", i, c.Len())
+		}
+		if _, ok := c.Get([]byte(message.CapabilityHash(list))); ok {
+			t.Errorf("%d: least recently used element was not removed", i)
+		}
+		if _, ok := c.Get([]byte(message.CapabilityHash([]message.Capability{message.TLSOverTCP}))); !ok {
+			t.Errorf("%d: built in element was removed", i)
+		}
 	}
 }
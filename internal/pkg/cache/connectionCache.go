@@ -12,8 +12,7 @@ import (
 
 //connCacheValue is the value pointed to by the hash map in the ConnectionImpl
 type connCacheValue struct {
-	connections  []net.Conn
-	capabilities []message.Capability
+	connections []net.Conn
 
 	mux sync.RWMutex
 	//set to true if the pointer to this element is removed from the hash map
@@ -26,12 +25,19 @@ type connCacheValue struct {
 type ConnectionImpl struct {
 	cache   *lruCache.Cache
 	counter *safeCounter.Counter
+	//capabilities maps a destination address to its capability list. Entries are kept after the
+	//connections to the destination have been closed such that the capabilities are known before a
+	//new connection is opened.
+	capabilities        *lruCache.Cache
+	capabilitiesCounter *safeCounter.Counter
 }
 
 func NewConnection(maxSize int) *ConnectionImpl {
 	return &ConnectionImpl{
-		cache:   lruCache.New(),
-		counter: safeCounter.New(maxSize),
+		cache:               lruCache.New(),
+		counter:             safeCounter.New(maxSize),
+		capabilities:        lruCache.New(),
+		capabilitiesCounter: safeCounter.New(maxSize),
 	}
 }
 
@@ -74,19 +80,24 @@ func (c *ConnectionImpl) AddConnection(conn net.Conn) {
 
 //AddCapability adds capabilities to the destAddr entry. It returns false if there is no entry in
 //the cache for dstAddr. If there is already a capability list associated with destAddr, it will be
-//overwritten.
+//overwritten. The capability list is kept when all connections to dstAddr are removed.
 func (c *ConnectionImpl) AddCapabilityList(dstAddr net.Addr, capabilities []message.Capability) bool {
-	if e, ok := c.cache.Get(networkAddr(dstAddr)); ok {
-		v := e.(*connCacheValue)
-		v.mux.Lock()
-		defer v.mux.Unlock()
-		if v.deleted {
-			return false
+	if _, ok := c.GetConnection(dstAddr); !ok {
+		return false
+	}
+	key := networkAddr(dstAddr)
+	if _, ok := c.capabilities.Remove(key); ok {
+		c.capabilitiesCounter.Dec()
+	}
+	c.capabilities.GetOrAdd(key, capabilities, false)
+	if c.capabilitiesCounter.Inc() {
+		//cache is full, remove the capabilities of the least recently used destination
+		key, _ := c.capabilities.GetLeastRecentlyUsed()
+		if _, ok := c.capabilities.Remove(key); ok {
+			c.capabilitiesCounter.Dec()
 		}
-		v.capabilities = capabilities
-		return true
 	}
-	return false
+	return true
 }
 
 //GetConnection returns true and all cached connection objects to dstAddr.
@@ -105,18 +116,13 @@ func (c *ConnectionImpl) GetConnection(dstAddr net.Addr) ([]net.Conn, bool) {
 }
 
 //Get returns true and the capability list of dstAddr.
-//Get returns false if there is no capability list of dstAddr.
+//Get returns false if there is no capability list of dstAddr and no connection to it.
 func (c *ConnectionImpl) GetCapabilityList(dstAddr net.Addr) ([]message.Capability, bool) {
-	if e, ok := c.cache.Get(networkAddr(dstAddr)); ok {
-		v := e.(*connCacheValue)
-		v.mux.RLock()
-		defer v.mux.RUnlock()
-		if v.deleted {
-			return nil, false
-		}
-		return v.capabilities, true
+	if e, ok := c.capabilities.Get(networkAddr(dstAddr)); ok {
+		return e.([]message.Capability), true
 	}
-	return nil, false
+	_, ok := c.GetConnection(dstAddr)
+	return nil, ok
 }
 
 //CloseAndRemoveConnection closes conn and removes it from the cache
@@ -17,7 +17,8 @@ func TestConnectionCache(t *testing.T) {
 	var tests = []struct {
 		input Connection
 	}{
-		{&ConnectionImpl{cache: lruCache.New(), counter: safeCounter.New(3)}},
+		{&ConnectionImpl{cache: lruCache.New(), counter: safeCounter.New(3),
+			capabilities: lruCache.New(), capabilitiesCounter: safeCounter.New(3)}},
 	}
 	for i, test := range tests {
 		tcpAddr := "localhost:8100"
@@ -91,6 +92,11 @@ func TestConnectionCache(t *testing.T) {
 		if ok || c.Len() != 1 {
 			t.Errorf("%d: Wrong connection removed or count is off", i)
 		}
+		//capabilities are kept after the connection has been removed
+		returnList, ok = c.GetCapabilityList(connInfo2)
+		if !ok || !reflect.DeepEqual(returnList, capabilityList) {
+			t.Errorf("%d: Capability list was not kept after removing the connection", i)
+		}
 	}
 }
 
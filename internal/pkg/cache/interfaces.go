@@ -12,6 +12,14 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/util"
 )
 
+//CheckpointEntry is a cached section together with its expiration time (number of seconds since
+//01.01.1970) and whether it is internal.
+type CheckpointEntry struct {
+	Section    section.WithSigForward
+	Expiration int64
+	Internal   bool
+}
+
 //Connection stores persistent stream-oriented network connections.
 type Connection interface {
 	//AddConnection adds conn to the cache. If the cache capacity is reached, a connection from the cache will be
@@ -19,13 +27,13 @@ type Connection interface {
 	AddConnection(conn net.Conn)
 	//AddCapability adds capabilities to the destAddr entry. It returns false if there is no entry
 	//in the cache for dstAddr. If there is already a capability list associated with destAddr, it
-	//will be overwritten.
+	//will be overwritten. The capability list is kept when all connections to dstAddr are removed.
 	AddCapabilityList(dstAddr net.Addr, capabilities []message.Capability) bool
 	//GetConnection returns true and all cached connections to dstAddr.
 	//GetConnection returns false if there is no cached connection to dstAddr.
 	GetConnection(dstAddr net.Addr) ([]net.Conn, bool)
 	//Get returns true and the capability list of dstAddr.
-	//Get returns false if there is no capability list of dstAddr.
+	//Get returns false if there is no capability list of dstAddr and no connection to it.
 	GetCapabilityList(dstAddr net.Addr) ([]message.Capability, bool)
 	//CloseAndRemoveConnection closes conn and removes it from the cache.
 	CloseAndRemoveConnection(conn net.Conn)
@@ -67,26 +75,37 @@ type ZonePublicKey interface {
 		keys.PublicKey, *section.Assertion, bool)
 	//RemoveExpiredKeys deletes all expired public keys from the cache.
 	RemoveExpiredKeys()
-	//Checkpoint returns all cached assertions
-	Checkpoint() []section.Section
+	//RemoveZoneContext deletes all public keys of zone in context from the cache.
+	RemoveZoneContext(zone, context string)
+	//Checkpoint returns all cached assertions containing a public key. The expiration of an entry
+	//is the end of the public key's validity.
+	Checkpoint() []CheckpointEntry
 	//Len returns the number of public keys currently in the cache.
 	Len() int
+	//SetMaxSize changes the maximum number of public keys in the cache. Keys in excess are
+	//removed gradually as new keys are added.
+	SetMaxSize(maxSize int)
 }
 
 type PendingKey interface {
 	//Add adds ss to the cache together with the token and expiration time of the query sent to the
-	//host with the addr defined in ss.
-	Add(ss util.MsgSectionSender, t token.Token, expiration int64)
-	//GetAndRemove returns util.MsgSectionSender which corresponds to token and true, and deletes it from
-	//the cache. False is returned if no util.MsgSectionSender matched token.
-	GetAndRemove(t token.Token) (util.MsgSectionSender, bool)
+	//host with the addr defined in ss. queries is the number of delegation queries sent for ss,
+	//including the one with token t.
+	Add(ss util.MsgSectionSender, t token.Token, expiration int64, queries int)
+	//GetAndRemove returns util.MsgSectionSender which corresponds to token, the number of delegation
+	//queries sent for it and true, and deletes it from the cache. False is returned if no
+	//util.MsgSectionSender matched token.
+	GetAndRemove(t token.Token) (util.MsgSectionSender, int, bool)
 	//ContainsToken returns true if t is cached
 	ContainsToken(t token.Token) bool
-	//RemoveExpiredValues deletes all expired entries. It logs the host's addr which was not able to
-	//respond in time.
-	RemoveExpiredValues()
+	//RemoveExpiredValues deletes all expired entries and returns them. It logs the host's addr which
+	//was not able to respond in time.
+	RemoveExpiredValues() []PendingKeyEntry
 	//Len returns the number of sections in the cache
 	Len() int
+	//SetMaxSize changes the maximum number of sections in the cache. No new sections are added
+	//while the cache holds maxSize or more sections.
+	SetMaxSize(maxSize int)
 }
 
 type PendingQuery interface {
@@ -97,10 +116,17 @@ type PendingQuery interface {
 	//GetAndRemove returns all util.MsgSectionSenders which correspond to token and delete them from the
 	//cache.
 	GetAndRemove(t token.Token) []util.MsgSectionSender
+	//GetAllAndRemove returns all util.MsgSectionSenders and deletes them from the cache.
+	GetAllAndRemove() []util.MsgSectionSender
+	//ContainsToken returns true if t is cached
+	ContainsToken(t token.Token) bool
 	//RemoveExpiredValues deletes all expired entries.
 	RemoveExpiredValues()
 	//Len returns the number of sections in the cache
 	Len() int
+	//SetMaxSize changes the maximum number of sections in the cache. No new sections are added
+	//while the cache holds maxSize or more sections.
+	SetMaxSize(maxSize int)
 }
 
 //Assertion is used to store and efficiently lookup assertions
@@ -113,16 +139,26 @@ type Assertion interface {
 	//nil and false is returned. If strict is set only an exact match for the provided FQDN is returned
 	// otherwise a search up the domain name hiearchy is performed.
 	Get(fqdn, context string, objType object.Type, strict bool) ([]*section.Assertion, bool)
+	//GetZone returns all cached assertions of zone in context whose subject name is within
+	//interval. It is used to check the consistency of shards, pshards and zones with cached
+	//assertions.
+	GetZone(zone, context string, interval section.Interval) []*section.Assertion
 	//RemoveExpiredValues goes through the cache and removes all expired assertions from the
 	//assertionCache and the consistency cache.
 	RemoveExpiredValues()
 	//RemoveZone deletes all assertions in the assertionCache and consistencyCache of the given
 	//zone.
 	RemoveZone(zone string)
-	//Checkpoint returns all cached assertions
-	Checkpoint() []section.Section
+	//RemoveZoneContext deletes all assertions of zone in context. Assertions of zone in other
+	//contexts are kept.
+	RemoveZoneContext(zone, context string)
+	//Checkpoint returns all cached assertions together with their expiration.
+	Checkpoint() []CheckpointEntry
 	//Len returns the number of elements in the cache.
 	Len() int
+	//SetMaxSize changes the maximum number of elements in the cache. Non internal elements in
+	//excess are removed when the next element is added.
+	SetMaxSize(maxSize int)
 }
 
 type NegativeAssertion interface {
@@ -148,8 +184,40 @@ type NegativeAssertion interface {
 	//RemoveZone deletes all shards and zones in the assertionCache and consistencyCache of the
 	//given subjectZone.
 	RemoveZone(subjectZone string)
-	//Checkpoint returns all cached negative assertions
-	Checkpoint() []section.Section
+	//RemoveZoneContext deletes all shards, pshards and zones of subjectZone in context. Sections of
+	//subjectZone in other contexts are kept.
+	RemoveZoneContext(subjectZone, context string)
+	//Checkpoint returns all cached negative assertions together with their expiration.
+	Checkpoint() []CheckpointEntry
 	//Len returns the number of elements in the cache.
 	Len() int
+	//SetMaxSize changes the maximum number of elements in the cache. Non internal elements in
+	//excess are removed when the next element is added.
+	SetMaxSize(maxSize int)
+}
+
+//AuthoritativeStore stores the sections of the zones over which a server has authority. In
+//contrast to the caches, sections are never evicted before they expire.
+type AuthoritativeStore interface {
+	//AddAssertion adds assertion to the store.
+	AddAssertion(assertion *section.Assertion) error
+	//AddNegAssertion adds a shard, pshard or zone to the store.
+	AddNegAssertion(s section.WithSigForward) error
+	//Get returns true and the assertions of fqdn in context containing an object of objType if
+	//there exist some. Otherwise nil and false is returned.
+	Get(fqdn, context string, objType object.Type) ([]*section.Assertion, bool)
+	//GetZone returns the assertions of zone in context whose subject name is within interval.
+	GetZone(zone, context string, interval section.Interval) []*section.Assertion
+	//GetNegAssertions returns true and the shards, pshards and zones of zone in context which
+	//overlap with interval if there exist some. Otherwise nil and false is returned.
+	GetNegAssertions(zone, context string, interval section.Interval) (
+		[]section.WithSigForward, bool)
+	//RemoveExpiredValues deletes all expired sections from the store.
+	RemoveExpiredValues() error
+	//RemoveZone deletes all sections of zone in context from the store.
+	RemoveZone(zone, context string) error
+	//Len returns the number of sections in the store.
+	Len() int
+	//Close releases the resources of the store. The store must not be used afterwards.
+	Close() error
 }
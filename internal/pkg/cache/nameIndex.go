@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+/*
+ * name index
+ * It keeps the subject names of the assertions of each zone and context in sorted order such that
+ * the assertions within the range of a shard or pshard can be found without going through all
+ * assertions of the zone. Each name maps to a set of values, e.g. cache keys or hashes, under which
+ * the assertions are stored.
+ */
+type nameIndex struct {
+	mutex sync.Mutex
+	zones map[string]*zoneNames
+}
+
+//zoneNames contains the sorted subject names of a zone and context and the values of each name.
+type zoneNames struct {
+	names  []string
+	values map[string]map[string]bool
+}
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{zones: make(map[string]*zoneNames)}
+}
+
+//add adds value to name of zone in context.
+func (n *nameIndex) add(zone, context, name, value string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	key := zoneCtxKey(zone, context)
+	z, ok := n.zones[key]
+	if !ok {
+		z = &zoneNames{values: make(map[string]map[string]bool)}
+		n.zones[key] = z
+	}
+	if _, ok := z.values[name]; !ok {
+		z.values[name] = make(map[string]bool)
+		i := sort.SearchStrings(z.names, name)
+		z.names = append(z.names, "")
+		copy(z.names[i+1:], z.names[i:])
+		z.names[i] = name
+	}
+	z.values[name][value] = true
+}
+
+//remove removes value from name of zone in context. Names without values are removed.
+func (n *nameIndex) remove(zone, context, name, value string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	key := zoneCtxKey(zone, context)
+	z, ok := n.zones[key]
+	if !ok {
+		return
+	}
+	delete(z.values[name], value)
+	if len(z.values[name]) > 0 {
+		return
+	}
+	delete(z.values, name)
+	if i := sort.SearchStrings(z.names, name); i < len(z.names) && z.names[i] == name {
+		z.names = append(z.names[:i], z.names[i+1:]...)
+	}
+	if len(z.names) == 0 {
+		delete(n.zones, key)
+	}
+}
+
+//get returns the values of all names of zone in context which are within interval. The bounds of
+//interval are exclusive unless interval is a single name. An empty bound or the range markers <
+//and > are unbounded.
+func (n *nameIndex) get(zone, context string, interval section.Interval) []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	z, ok := n.zones[zoneCtxKey(zone, context)]
+	if !ok {
+		return nil
+	}
+	begin, end := interval.Begin(), interval.End()
+	if begin == "<" {
+		begin = ""
+	}
+	if end == ">" {
+		end = ""
+	}
+	values := []string{}
+	for i := sort.SearchStrings(z.names, begin); i < len(z.names); i++ {
+		name := z.names[i]
+		if name == begin && begin != end {
+			continue
+		}
+		if end != "" && (name > end || name == end && begin != end) {
+			break
+		}
+		for v := range z.values[name] {
+			values = append(values, v)
+		}
+	}
+	return values
+}
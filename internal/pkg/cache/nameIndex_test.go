@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+func TestNameIndex(t *testing.T) {
+	index := newNameIndex()
+	for _, name := range []string{"d", "b", "@", "c", "a"} {
+		index.add("example.", ".", name, name+"1")
+	}
+	index.add("example.", ".", "b", "b2")
+	index.add("example.", "other", "b", "other")
+	index.add("example.", ".", "e", "e1")
+	index.remove("example.", ".", "e", "e1")
+	index.remove("example.", ".", "x", "x1")
+	var tests = []struct {
+		interval section.Interval
+		expected []string
+	}{
+		{section.TotalInterval{}, []string{"@1", "a1", "b1", "b2", "c1", "d1"}},
+		{section.StringInterval{Name: "b"}, []string{"b1", "b2"}},
+		{section.StringInterval{Name: "e"}, []string{}},
+		{&section.Shard{RangeFrom: "a", RangeTo: "d"}, []string{"b1", "b2", "c1"}},
+		{&section.Shard{RangeFrom: "<", RangeTo: "b"}, []string{"@1", "a1"}},
+		{&section.Shard{RangeFrom: "b", RangeTo: ""}, []string{"c1", "d1"}},
+		{&section.Shard{RangeFrom: "c", RangeTo: ">"}, []string{"d1"}},
+		{&section.Shard{RangeFrom: "d", RangeTo: "z"}, []string{}},
+	}
+	for i, test := range tests {
+		values := index.get("example.", ".", test.interval)
+		sort.Strings(values)
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%d: wrong values. expected=%v actual=%v", i, test.expected, values)
+		}
+	}
+	if values := index.get("example.", "other", section.TotalInterval{}); len(values) != 1 {
+		t.Errorf("wrong values of other context. actual=%v", values)
+	}
+	index.remove("example.", "other", "b", "other")
+	if _, ok := index.zones[zoneCtxKey("example.", "other")]; ok {
+		t.Error("empty zone was not removed from the index")
+	}
+}
@@ -172,31 +172,47 @@ func (c *NegAssertionImpl) RemoveExpiredValues() {
 func (c *NegAssertionImpl) RemoveZone(zone string) {
 	if set, ok := c.zoneMap.Remove(zone); ok {
 		for _, key := range set.(*safeHashMap.Map).GetAllKeys() {
-			v, ok := c.cache.Remove(key)
-			if ok {
-				value := v.(*negAssertionCacheValue)
-				value.mux.Lock()
-				if value.deleted {
-					value.mux.Unlock()
-					continue
-				}
-				value.deleted = true
-				c.counter.Sub(len(value.sections))
-				value.mux.Unlock()
-			}
+			c.remove(key)
 		}
 	}
 }
 
-//Checkpoint returns all cached assertions
-func (c *NegAssertionImpl) Checkpoint() (sections []section.Section) {
-	entries := c.cache.GetAll()
-	for _, e := range entries {
+//RemoveZoneContext deletes all shards, pshards and zones of zone in context. The sections of zone
+//in other contexts are kept.
+func (c *NegAssertionImpl) RemoveZoneContext(zone, context string) {
+	key := zoneCtxKey(zone, context)
+	if set, ok := c.zoneMap.Get(zone); ok {
+		set.(*safeHashMap.Map).Remove(key)
+	}
+	c.remove(key)
+}
+
+//remove deletes the cache entry with key.
+func (c *NegAssertionImpl) remove(key string) {
+	v, ok := c.cache.Remove(key)
+	if !ok {
+		return
+	}
+	value := v.(*negAssertionCacheValue)
+	value.mux.Lock()
+	defer value.mux.Unlock()
+	if value.deleted {
+		return
+	}
+	value.deleted = true
+	c.counter.Sub(len(value.sections))
+}
+
+//Checkpoint returns all cached shards, pshards and zones together with their expiration.
+func (c *NegAssertionImpl) Checkpoint() (checkpoint []CheckpointEntry) {
+	entries, internal := c.cache.GetAllInternal()
+	for i, e := range entries {
 		values := e.(*negAssertionCacheValue)
 		values.mux.RLock()
 		if !values.deleted {
 			for _, v := range values.sections {
-				sections = append(sections, v.section)
+				checkpoint = append(checkpoint, CheckpointEntry{Section: v.section,
+					Expiration: v.expiration, Internal: internal[i]})
 			}
 		}
 		values.mux.RUnlock()
@@ -208,3 +224,9 @@ func (c *NegAssertionImpl) Checkpoint() (sections []section.Section) {
 func (c *NegAssertionImpl) Len() int {
 	return c.counter.Value()
 }
+
+//SetMaxSize changes the maximum number of elements in the cache. Non internal elements in excess
+//are removed when the next element is added.
+func (c *NegAssertionImpl) SetMaxSize(maxSize int) {
+	c.counter.SetMaxCount(maxSize)
+}
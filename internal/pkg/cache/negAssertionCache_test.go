@@ -102,6 +102,7 @@ func TestNegAssertionCheckpoint(t *testing.T) {
 				cache:                  lruCache.New(),
 				counter:                safeCounter.New(4),
 				zoneMap:                safeHashMap.New(),
+				names:                  newNameIndex(),
 				entriesPerAssertionMap: make(map[string]int),
 			},
 		},
@@ -117,7 +118,7 @@ func TestNegAssertionCheckpoint(t *testing.T) {
 		c.Add(delegationsCH[0], time.Now().Add(time.Hour).Unix(), false)
 		c.Add(delegationsORG[0], time.Now().Add(time.Hour).Unix(), false)
 		//Test Checkpointing
-		assertions := c.Checkpoint()
+		assertions := checkpointSections(c.Checkpoint())
 		if len(assertions) != 2 {
 			t.Errorf("Number of assertions is wrong")
 		}
@@ -129,3 +130,22 @@ func TestNegAssertionCheckpoint(t *testing.T) {
 		}
 	}
 }
+
+func TestNegAssertionRemoveZoneContext(t *testing.T) {
+	c := NewNegAssertion(10)
+	_, shard, zone := getStoreSections(time.Now().Add(time.Hour).Unix())
+	zone.Context = "other"
+	c.AddShard(shard, shard.ValidUntil(), false)
+	c.AddZone(zone, zone.ValidUntil(), true)
+	c.RemoveZoneContext("example.", "other")
+	if secs, ok := c.Get("example.", "other", section.TotalInterval{}); ok {
+		t.Errorf("sections of removed context are still cached. actual=%v", secs)
+	}
+	if _, ok := c.Get("example.", ".", section.TotalInterval{}); !ok || c.Len() != 1 {
+		t.Errorf("sections of other context were removed. len=%d", c.Len())
+	}
+	c.RemoveZone("example.")
+	if c.Len() != 0 {
+		t.Errorf("sections of zone were not removed. actual=%d", c.Len())
+	}
+}
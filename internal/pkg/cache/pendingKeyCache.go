@@ -15,6 +15,15 @@ type pkcValue struct {
 	mss util.MsgSectionSender
 	//expiration contains the expiration value of the forwarded query
 	expiration int64
+	//queries contains the number of delegation queries sent for mss
+	queries int
+}
+
+//PendingKeyEntry is a section sender whose delegation query has expired.
+type PendingKeyEntry struct {
+	MsgSectionSender util.MsgSectionSender
+	//Queries is the number of delegation queries which have been sent for MsgSectionSender.
+	Queries int
 }
 
 type PendingKeyImpl struct {
@@ -32,28 +41,30 @@ func NewPendingKey(maxSize int) *PendingKeyImpl {
 }
 
 //Add adds ss to the cache together with the token and expiration time of the query sent to the
-//host with the addr defined in ss.
-func (c *PendingKeyImpl) Add(ss util.MsgSectionSender, t token.Token, expiration int64) {
+//host with the addr defined in ss. queries is the number of delegation queries sent for ss,
+//including the one with token t.
+func (c *PendingKeyImpl) Add(ss util.MsgSectionSender, t token.Token, expiration int64,
+	queries int) {
 	if c.counter.IsFull() {
 		log.Error("Pending key cache is full")
 		return
 	}
-	if ok := c.tokenMap.Add(t.String(), pkcValue{mss: ss, expiration: expiration}); !ok {
+	if ok := c.tokenMap.Add(t.String(), pkcValue{mss: ss, expiration: expiration, queries: queries}); !ok {
 		log.Warn("Token already in key cache. Random source of Token generator no random enough?")
 		return
 	}
 	c.counter.Inc()
 }
 
-//GetAndRemove returns util.MsgSectionSender which corresponds to token and true, and deletes it from
-//the cache. False is returned if no util.MsgSectionSender matched token.
-func (c *PendingKeyImpl) GetAndRemove(t token.Token) (util.MsgSectionSender, bool) {
-	if val, present := c.tokenMap.Get(t.String()); present {
-		c.tokenMap.Remove(t.String())
+//GetAndRemove returns util.MsgSectionSender which corresponds to token, the number of delegation
+//queries sent for it and true, and deletes it from the cache. False is returned if no
+//util.MsgSectionSender matched token.
+func (c *PendingKeyImpl) GetAndRemove(t token.Token) (util.MsgSectionSender, int, bool) {
+	if val, present := c.tokenMap.Remove(t.String()); present {
 		c.counter.Dec()
-		return val.(pkcValue).mss, true
+		return val.(pkcValue).mss, val.(pkcValue).queries, true
 	}
-	return util.MsgSectionSender{}, false
+	return util.MsgSectionSender{}, 0, false
 }
 
 //ContainsToken returns true if t is cached
@@ -62,23 +73,34 @@ func (c *PendingKeyImpl) ContainsToken(t token.Token) bool {
 	return present
 }
 
-//RemoveExpiredValues deletes all expired entries. It logs the host's addr which was not able to
-//respond in time.
-func (c *PendingKeyImpl) RemoveExpiredValues() {
+//RemoveExpiredValues deletes all expired entries and returns them. It logs the host's addr which
+//was not able to respond in time.
+func (c *PendingKeyImpl) RemoveExpiredValues() []PendingKeyEntry {
+	expired := []PendingKeyEntry{}
 	keys := c.tokenMap.GetAllKeys()
 	for _, key := range keys {
 		if val, present := c.tokenMap.Get(key); present {
 			if val := val.(pkcValue); val.expiration < time.Now().Unix() {
-				c.tokenMap.Remove(key)
+				if _, removed := c.tokenMap.Remove(key); !removed {
+					continue
+				}
 				c.counter.Dec()
 				log.Warn("No response to delegation query received before expiration",
 					"sectionSender", val.mss)
+				expired = append(expired, PendingKeyEntry{MsgSectionSender: val.mss,
+					Queries: val.queries})
 			}
 		}
 	}
+	return expired
 }
 
 //Len returns the number of sections in the cache
 func (c *PendingKeyImpl) Len() int {
 	return c.tokenMap.Len()
 }
+
+//SetMaxSize changes the maximum number of sections in the cache.
+func (c *PendingKeyImpl) SetMaxSize(maxSize int) {
+	c.counter.SetMaxCount(maxSize)
+}
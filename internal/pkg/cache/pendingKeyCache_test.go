@@ -23,15 +23,15 @@ func TestPendingKeyCache(t *testing.T) {
 			t.Errorf("%d:init size is incorrect actual=%d", i, c.Len())
 		}
 		//Test c.Add()
-		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix(), 1)
 		if c.Len() != 1 {
 			t.Error("mss[0] was not added to the cache")
 		}
-		c.Add(mss[1], mss[1].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[1], mss[1].Token, time.Now().Add(time.Hour).Unix(), 1)
 		if c.Len() != 2 {
 			t.Error("mss[1] was not added to the cache")
 		}
-		c.Add(mss[2], mss[2].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[2], mss[2].Token, time.Now().Add(time.Hour).Unix(), 1)
 		if c.Len() != 3 {
 			t.Error("mss[2] was not added to the cache")
 		}
@@ -41,24 +41,27 @@ func TestPendingKeyCache(t *testing.T) {
 			t.Error("unexpected token was in the cache")
 		}
 		//Test c.GetAndRemove()
-		if v, ok := c.GetAndRemove(mss[0].Token); !ok || c.Len() != 2 ||
+		if v, _, ok := c.GetAndRemove(mss[0].Token); !ok || c.Len() != 2 ||
 			!reflect.DeepEqual(v, mss[0]) {
 			t.Error("mss[0] should be returned for this token")
 		}
-		if v, ok := c.GetAndRemove(mss[1].Token); !ok || c.Len() != 1 ||
+		if v, _, ok := c.GetAndRemove(mss[1].Token); !ok || c.Len() != 1 ||
 			!reflect.DeepEqual(v, mss[1]) {
 			t.Error("mss[1] should be returned for this token")
 		}
-		if v, ok := c.GetAndRemove(mss[2].Token); !ok || c.Len() != 0 ||
+		if v, _, ok := c.GetAndRemove(mss[2].Token); !ok || c.Len() != 0 ||
 			!reflect.DeepEqual(v, mss[2]) {
 			t.Error("mss[2] should be returned for this token")
 		}
 		//Test c.RemoveExpiredValues()
-		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix())
-		c.Add(mss[2], mss[2].Token, time.Now().Add(-time.Hour).Unix())
-		c.RemoveExpiredValues()
-		if v, ok := c.GetAndRemove(mss[0].Token); !ok || c.Len() != 0 ||
-			!reflect.DeepEqual(v, mss[0]) {
+		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix(), 1)
+		c.Add(mss[2], mss[2].Token, time.Now().Add(-time.Hour).Unix(), 3)
+		expired := c.RemoveExpiredValues()
+		if !reflect.DeepEqual(expired, []PendingKeyEntry{{MsgSectionSender: mss[2], Queries: 3}}) {
+			t.Errorf("wrong expired entries returned. actual=%v", expired)
+		}
+		if v, queries, ok := c.GetAndRemove(mss[0].Token); !ok || c.Len() != 0 ||
+			!reflect.DeepEqual(v, mss[0]) || queries != 1 {
 			t.Error("expired value was not removed")
 		}
 	}
@@ -73,15 +76,15 @@ func TestPendingKeyCacheCounter(t *testing.T) {
 	}
 	for _, test := range tests {
 		c := &PendingKeyImpl{counter: safeCounter.New(test.maxSize), tokenMap: safeHashMap.New()}
-		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix(), 1)
 		//Test same token
-		c.Add(mss[1], mss[0].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[1], mss[0].Token, time.Now().Add(time.Hour).Unix(), 1)
 		if c.Len() != 1 {
 			t.Error("entry added with same token did not overwrite old value")
 		}
-		c.Add(mss[1], mss[1].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[1], mss[1].Token, time.Now().Add(time.Hour).Unix(), 1)
 		//Test MaxSize
-		c.Add(mss[2], mss[2].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[2], mss[2].Token, time.Now().Add(time.Hour).Unix(), 1)
 		if c.Len() != 2 {
 			t.Error("was able to add more entries than maxSize")
 		}
@@ -108,6 +108,31 @@ func (c *PendingQueryImpl) GetAndRemove(t token.Token) []util.MsgSectionSender {
 	return nil
 }
 
+//GetAllAndRemove returns all util.MsgSectionSenders and deletes them from the cache.
+func (c *PendingQueryImpl) GetAllAndRemove() []util.MsgSectionSender {
+	c.qmux.Lock()
+	c.tmux.Lock()
+	defer c.qmux.Unlock()
+	defer c.tmux.Unlock()
+
+	sss := []util.MsgSectionSender{}
+	for _, val := range c.tokenMap {
+		sss = append(sss, val.sss...)
+		c.counter.Sub(len(val.sss))
+	}
+	c.tokenMap = make(map[token.Token]*pqcValue)
+	c.queryMap = make(map[string]token.Token)
+	return sss
+}
+
+//ContainsToken returns true if t is cached
+func (c *PendingQueryImpl) ContainsToken(t token.Token) bool {
+	c.tmux.Lock()
+	defer c.tmux.Unlock()
+	_, present := c.tokenMap[t]
+	return present
+}
+
 //RemoveExpiredValues deletes all expired entries.
 func (c *PendingQueryImpl) RemoveExpiredValues() {
 	c.qmux.Lock()
@@ -129,3 +154,8 @@ func (c *PendingQueryImpl) RemoveExpiredValues() {
 func (c *PendingQueryImpl) Len() int {
 	return c.counter.Value()
 }
+
+//SetMaxSize changes the maximum number of sections in the cache.
+func (c *PendingQueryImpl) SetMaxSize(maxSize int) {
+	c.counter.SetMaxCount(maxSize)
+}
@@ -28,6 +28,9 @@ func TestPendingQueryCache(t *testing.T) {
 		if ok := c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix()); !ok || c.Len() != 1 {
 			t.Error("mss[0] was not added to the cache")
 		}
+		if !c.ContainsToken(mss[0].Token) || c.ContainsToken(token.New()) {
+			t.Error("ContainsToken returned a wrong result")
+		}
 		if ok := c.Add(mss[1], mss[1].Token, time.Now().Add(time.Hour).Unix()); ok || c.Len() != 2 {
 			t.Error("mss[1] was not added to the cache")
 		}
@@ -54,6 +57,13 @@ func TestPendingQueryCache(t *testing.T) {
 			t.Error("expired value was not removed")
 		}
 
+		//Test c.GetAllAndRemove()
+		c.Add(mss[0], mss[0].Token, time.Now().Add(time.Hour).Unix())
+		c.Add(mss[2], mss[2].Token, time.Now().Add(time.Hour).Unix())
+		if v := c.GetAllAndRemove(); len(v) != 2 || c.Len() != 0 || c.ContainsToken(mss[0].Token) {
+			t.Error("not all entries were returned and removed")
+		}
+
 		//Add and retrieve delegation query
 		if ok := c.Add(mss[3], mss[3].Token, time.Now().Add(time.Hour).Unix()); !ok || c.Len() != 1 {
 			t.Error("mss[0] was not added to the cache")
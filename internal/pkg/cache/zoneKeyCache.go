@@ -183,13 +183,41 @@ func (c *ZoneKeyImpl) RemoveExpiredKeys() {
 	}
 }
 
-//Checkpoint returns all cached assertions
-func (c *ZoneKeyImpl) Checkpoint() (assertions []section.Section) {
-	entries := c.cache.GetAll()
-	for _, e := range entries {
+//RemoveZoneContext deletes all public keys of zone in context from the cache.
+func (c *ZoneKeyImpl) RemoveZoneContext(zone, context string) {
+	for _, value := range c.cache.GetAll() {
+		val := value.(*zoneKeyCacheValue)
+		if val.zone != zone || val.context != context {
+			continue
+		}
+		val.mux.Lock() //This lock makes sure that no add methods are interfering while deleting
+		//the pointer to this entry.
+		if !val.deleted {
+			val.deleted = true
+			for _, key := range val.publicKeys.GetAllKeys() {
+				if _, ok := val.publicKeys.Remove(key); ok {
+					c.counter.Dec()
+					c.mux.Lock()
+					c.keysPerContextZone[val.getContextZone()]--
+					c.mux.Unlock()
+				}
+			}
+			c.cache.Remove(val.getCacheKey())
+		}
+		val.mux.Unlock()
+	}
+}
+
+//Checkpoint returns all cached assertions containing a public key. The expiration of an entry is
+//the end of the public key's validity.
+func (c *ZoneKeyImpl) Checkpoint() (checkpoint []CheckpointEntry) {
+	entries, internal := c.cache.GetAllInternal()
+	for i, e := range entries {
 		values := e.(*zoneKeyCacheValue).publicKeys.GetAll()
 		for _, v := range values {
-			assertions = append(assertions, v.(publicKeyAssertion).assertion)
+			v := v.(publicKeyAssertion)
+			checkpoint = append(checkpoint, CheckpointEntry{Section: v.assertion,
+				Expiration: v.publicKey.ValidUntil, Internal: internal[i]})
 		}
 	}
 	return
@@ -200,6 +228,12 @@ func (c *ZoneKeyImpl) Len() int {
 	return c.counter.Value()
 }
 
+//SetMaxSize changes the maximum number of public keys in the cache. Keys in excess are removed
+//gradually as new keys are added.
+func (c *ZoneKeyImpl) SetMaxSize(maxSize int) {
+	c.counter.SetMaxCount(maxSize)
+}
+
 func zoneCtxKey(zone, context string) string {
 	return fmt.Sprintf("%s %s", zone, context)
 }
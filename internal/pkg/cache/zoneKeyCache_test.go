@@ -115,7 +115,7 @@ func TestCheckpoint(t *testing.T) {
 		c.Add(delegationsCH[0], delegationsCH[0].Content[0].Value.(keys.PublicKey), false)
 		c.Add(delegationsORG[0], delegationsORG[0].Content[0].Value.(keys.PublicKey), false)
 		//Test Checkpointing
-		assertions := c.Checkpoint()
+		assertions := checkpointSections(c.Checkpoint())
 		if len(assertions) != 2 {
 			t.Errorf("Number of assertions is wrong")
 		}
@@ -127,3 +127,31 @@ func TestCheckpoint(t *testing.T) {
 		}
 	}
 }
+
+func TestZoneKeyRemoveZoneContext(t *testing.T) {
+	var tests = []struct {
+		zone    string
+		context string
+		length  int
+	}{
+		{"ch.", ".", 1},
+		{"org.", ".", 2},
+		{"ch.", "other", 3},
+	}
+	for i, test := range tests {
+		c := NewZoneKey(10, 10, 10)
+		delegationsCH := getExampleDelgations("ch")
+		delegationsORG := getExampleDelgations("org")
+		c.Add(delegationsCH[0], delegationsCH[0].Content[0].Value.(keys.PublicKey), true)
+		c.Add(delegationsCH[1], delegationsCH[1].Content[0].Value.(keys.PublicKey), true)
+		c.Add(delegationsORG[0], delegationsORG[0].Content[0].Value.(keys.PublicKey), false)
+		c.RemoveZoneContext(test.zone, test.context)
+		if c.Len() != test.length {
+			t.Errorf("%d:wrong number of keys after removal. expected=%d actual=%d", i,
+				test.length, c.Len())
+		}
+		if len(c.Checkpoint()) != test.length {
+			t.Errorf("%d:removed keys are still cached", i)
+		}
+	}
+}
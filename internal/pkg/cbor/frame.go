@@ -0,0 +1,229 @@
+package cbor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Major types of cbor data items.
+const (
+	MajorUint   = 0
+	MajorNegInt = 1
+	MajorBytes  = 2
+	MajorString = 3
+	MajorArray  = 4
+	MajorMap    = 5
+	MajorTag    = 6
+	MajorOther  = 7
+
+	//maxDepth is the maximum nesting depth of arrays, maps and tags in a data item.
+	maxDepth = 256
+	//maxDiscard is the maximum number of bytes discarded at once.
+	maxDiscard = 1 << 16
+)
+
+//ErrTooLarge is returned by a FrameReader if a data item is larger than the maximum item size.
+var ErrTooLarge = errors.New("cbor data item exceeds maximum size")
+
+//errBreak is returned internally when a break code is read instead of a data item.
+var errBreak = errors.New("unexpected break code")
+
+//FrameReader reads single cbor data items from a stream. It never buffers more than the maximum
+//item size such that the size of incoming messages can be enforced before decoding them.
+type FrameReader struct {
+	in       *bufio.Reader
+	maxBytes int
+	buf      []byte
+	//tooLarge is set as soon as the current data item exceeds the maximum item size. From then on
+	//the item's remaining bytes are discarded.
+	tooLarge bool
+	//scratch holds the head of a data item which does not fit into buf anymore.
+	scratch [9]byte
+}
+
+//NewFrameReader returns a new FrameReader which reads data items of at most maxBytes bytes from in.
+func NewFrameReader(in io.Reader, maxBytes int) *FrameReader {
+	return &FrameReader{in: bufio.NewReader(in), maxBytes: maxBytes}
+}
+
+//ReadItem returns the encoding of the next data item. If the data item is larger than the maximum
+//item size, its remaining bytes are skipped and ErrTooLarge is returned together with the first
+//maximum item size bytes of the item. The reader can be used for the next item in this case. io.EOF
+//is returned if the stream ended before the first byte of the item.
+func (f *FrameReader) ReadItem() ([]byte, error) {
+	f.buf = make([]byte, 0, minInt(f.maxBytes, 4096))
+	f.tooLarge = false
+	err := f.item(0)
+	switch {
+	case err == io.EOF && len(f.buf) > 0:
+		err = io.ErrUnexpectedEOF
+	case err == errBreak:
+		err = errors.New("cbor break code outside of indefinite length item")
+	case err == nil && f.tooLarge:
+		err = ErrTooLarge
+	}
+	return f.buf, err
+}
+
+//ReadHead reads the head of the next data item and returns its major type and argument. For data
+//items of indefinite length, indefinite is true. It can be used to step into arrays, maps and tags
+//whose content is then read with ReadItem.
+func (f *FrameReader) ReadHead() (major byte, arg uint64, indefinite bool, err error) {
+	f.buf = f.buf[:0]
+	f.tooLarge = false
+	return f.head()
+}
+
+func (f *FrameReader) item(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("cbor data item is nested deeper than %d levels", maxDepth)
+	}
+	major, arg, indefinite, err := f.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case MajorUint, MajorNegInt:
+		return nil
+	case MajorBytes, MajorString:
+		if !indefinite {
+			_, err := f.consume(arg)
+			return err
+		}
+		for {
+			if err := f.item(depth + 1); err == errBreak {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	case MajorArray, MajorMap:
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if err := f.item(depth + 1); err == errBreak && indefinite {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if major == MajorMap {
+				//A break code must not occur between a key and its value.
+				if err := f.item(depth + 1); err == errBreak {
+					return errors.New("cbor map key without value")
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case MajorTag:
+		return f.item(depth + 1)
+	default:
+		if indefinite {
+			return errBreak
+		}
+		return nil
+	}
+}
+
+//head reads the initial byte and the argument of a data item.
+func (f *FrameReader) head() (major byte, arg uint64, indefinite bool, err error) {
+	b, err := f.consume(1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info <= 27:
+		n := uint64(1) << (info - 24)
+		b, err := f.consume(n)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		var arg [8]byte
+		copy(arg[8-n:], b)
+		return major, binary.BigEndian.Uint64(arg[:]), false, nil
+	case info == 31 && major != MajorUint && major != MajorNegInt && major != MajorTag:
+		//For major type 7 this is the break code terminating an indefinite length item.
+		return major, 0, true, nil
+	default:
+		return 0, 0, false, fmt.Errorf("malformed cbor data item head: %x", b[0])
+	}
+}
+
+//consume reads the next n bytes of the stream and appends them to the buffer as long as the
+//maximum item size is not exceeded. Bytes beyond the maximum item size are discarded. The consumed
+//bytes are only returned if n is at most the size of a data item's head.
+func (f *FrameReader) consume(n uint64) ([]byte, error) {
+	remaining := uint64(f.maxBytes - len(f.buf))
+	if !f.tooLarge && n <= remaining {
+		start := len(f.buf)
+		f.grow(int(n))
+		if _, err := io.ReadFull(f.in, f.buf[start:]); err != nil {
+			f.buf = f.buf[:start]
+			return nil, err
+		}
+		return f.buf[start:], nil
+	}
+	f.tooLarge = true
+	if n <= uint64(len(f.scratch)) {
+		b := f.scratch[:n]
+		if _, err := io.ReadFull(f.in, b); err != nil {
+			return nil, err
+		}
+		f.buf = append(f.buf, b[:minUint64(n, remaining)]...)
+		return b, nil
+	}
+	if remaining > 0 {
+		start := len(f.buf)
+		f.grow(int(remaining))
+		if _, err := io.ReadFull(f.in, f.buf[start:]); err != nil {
+			f.buf = f.buf[:start]
+			return nil, err
+		}
+		n -= remaining
+	}
+	for n > 0 {
+		discarded, err := f.in.Discard(int(minUint64(n, maxDiscard)))
+		n -= uint64(discarded)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+//grow extends the buffer by n bytes.
+func (f *FrameReader) grow(n int) {
+	start := len(f.buf)
+	if end := start + n; end > cap(f.buf) {
+		buf := make([]byte, start, minInt(f.maxBytes, maxInt(end, 2*cap(f.buf))))
+		copy(buf, f.buf)
+		f.buf = buf
+	}
+	f.buf = f.buf[:start+n]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,93 @@
+package cbor
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReadItem(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+	items := []interface{}{
+		5,
+		"rains",
+		[]byte{1, 2, 3},
+		[]interface{}{1, "a", []interface{}{2, "b"}},
+		map[int]interface{}{0: "zero", 23: []interface{}{1, 2}},
+	}
+	encodings := [][]byte{}
+	for _, item := range items {
+		start := stream.Len()
+		if err := w.Marshal(item); err != nil {
+			t.Fatalf("Was not able to marshal %v: %v", item, err)
+		}
+		encodings = append(encodings, append([]byte{}, stream.Bytes()[start:]...))
+	}
+	//indefinite length array containing a definite and an indefinite length byte string, a half
+	//precision float and true.
+	indefinite := []byte{0x9f, 0x41, 0x01, 0x5f, 0x41, 0x02, 0x41, 0x03, 0xff, 0xf9, 0x3c, 0x00, 0xf5,
+		0xff}
+	stream.Write(indefinite)
+	encodings = append(encodings, indefinite)
+
+	r := NewFrameReader(&stream, 1024)
+	for i, expected := range encodings {
+		item, err := r.ReadItem()
+		if err != nil {
+			t.Fatalf("%d: Was not able to read item: %v", i, err)
+		}
+		if !bytes.Equal(item, expected) {
+			t.Errorf("%d: wrong item. expected=%x actual=%x", i, expected, item)
+		}
+	}
+	if _, err := r.ReadItem(); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream. actual=%v", err)
+	}
+}
+
+func TestReadItemTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+	large := []interface{}{"a prefix", bytes.Repeat([]byte{7}, 100), "and a suffix"}
+	if err := w.Marshal(large); err != nil {
+		t.Fatalf("Was not able to marshal item: %v", err)
+	}
+	encoding := append([]byte{}, stream.Bytes()...)
+	if err := w.Marshal("next"); err != nil {
+		t.Fatalf("Was not able to marshal item: %v", err)
+	}
+	r := NewFrameReader(&stream, 20)
+	item, err := r.ReadItem()
+	if err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge. actual=%v", err)
+	}
+	if !bytes.Equal(item, encoding[:20]) {
+		t.Errorf("wrong prefix. expected=%x actual=%x", encoding[:20], item)
+	}
+	//The remainder of the large item must have been skipped.
+	item, err = r.ReadItem()
+	if err != nil || !bytes.Equal(item, []byte("\x64next")) {
+		t.Errorf("wrong item after too large item. item=%x err=%v", item, err)
+	}
+}
+
+func TestReadItemErrors(t *testing.T) {
+	var tests = []struct {
+		input []byte
+		err   bool
+	}{
+		{[]byte{0x83, 0x01}, true},                   //truncated array
+		{[]byte{0xff}, true},                         //break outside indefinite item
+		{[]byte{0x1c}, true},                         //reserved additional information
+		{[]byte{0xbf, 0x01, 0xff}, true},             //map key without value
+		{[]byte{0x5a, 0xff, 0xff, 0xff, 0xff}, true}, //huge byte string
+		{[]byte{0x9f, 0x01, 0xff}, false},
+	}
+	for i, test := range tests {
+		_, err := NewFrameReader(bytes.NewReader(test.input), 100).ReadItem()
+		if (err != nil) != test.err {
+			t.Errorf("%d: wrong error. expected error=%v actual=%v", i, test.err, err)
+		}
+	}
+}
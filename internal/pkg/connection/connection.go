@@ -75,6 +75,19 @@ func UnmarshalNetAddr(data []byte) (Type, net.Addr, error) {
 		}
 		value = scionLocal
 		t = SCION
+	case "UDP":
+		value = reflect.New(reflect.TypeOf(net.UDPAddr{})).Interface()
+		t = UDP
+		if _, ok := m["UDPAddr"]; !ok {
+			return -1, nil, errors.New("UDPAddr key not found in JSON config")
+		}
+		addrData, err := json.Marshal(m["UDPAddr"])
+		if err != nil {
+			return -1, nil, err
+		}
+		if err = json.Unmarshal(addrData, &value); err != nil {
+			return -1, nil, err
+		}
 	default:
 		return -1, nil, errors.New("Unknown Addr type")
 	}
@@ -90,6 +103,7 @@ type Type int
 const (
 	TCP Type = iota + 1
 	SCION
+	UDP
 )
 
 //CreateConnection returns a newly created connection with connInfo or an error
@@ -99,6 +113,8 @@ func CreateConnection(addr net.Addr) (conn net.Conn, err error) {
 		return tls.Dial(a.Network(), a.String(), &tls.Config{InsecureSkipVerify: true})
 	case *snet.UDPAddr:
 		return scion.DialAddr(a)
+	case *net.UDPAddr:
+		return net.DialUDP(a.Network(), nil, a)
 	default:
 		return nil, fmt.Errorf("unsupported Network address type: %s", addr)
 	}
@@ -0,0 +1,69 @@
+package connection
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUnmarshalNetAddr(t *testing.T) {
+	var tests = []struct {
+		input string
+		t     Type
+		addr  string
+		valid bool
+	}{
+		{`{"Type":"TCP","TCPAddr":{"IP":"127.0.0.1","Port":5022}}`, TCP, "127.0.0.1:5022", true},
+		{`{"Type":"UDP","UDPAddr":{"IP":"127.0.0.1","Port":5022}}`, UDP, "127.0.0.1:5022", true},
+		{`{"Type":"UDP","UDPAddr":{"IP":"::1","Port":5022}}`, UDP, "[::1]:5022", true},
+		{`{"Type":"UDP","TCPAddr":{"IP":"127.0.0.1","Port":5022}}`, -1, "", false},
+		{`{"Type":"QUIC","UDPAddr":{"IP":"127.0.0.1","Port":5022}}`, -1, "", false},
+		{`{"Type":"UDP"`, -1, "", false},
+	}
+	for i, test := range tests {
+		typ, addr, err := UnmarshalNetAddr([]byte(test.input))
+		if (err == nil) != test.valid || typ != test.t {
+			t.Errorf("%d: wrong result. expected=(%v,%t) actual=(%v,%v)", i, test.t, test.valid,
+				typ, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if addr.String() != test.addr {
+			t.Errorf("%d: wrong address. expected=%s actual=%s", i, test.addr, addr)
+		}
+		if _, ok := addr.(*net.UDPAddr); ok != (test.t == UDP) {
+			t.Errorf("%d: wrong address type %T", i, addr)
+		}
+	}
+}
+
+func TestCreateConnection(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Was not able to listen: %v", err)
+	}
+	defer listener.Close()
+	var tests = []struct {
+		addr  net.Addr
+		valid bool
+	}{
+		{listener.LocalAddr(), true},
+		{&net.UnixAddr{Name: "/tmp/rains.sock", Net: "unix"}, false},
+	}
+	for i, test := range tests {
+		conn, err := CreateConnection(test.addr)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: wrong result. expected valid=%t actual error=%v", i, test.valid, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if _, ok := conn.(*net.UDPConn); !ok || conn.RemoteAddr().String() != test.addr.String() {
+			t.Errorf("%d: wrong connection. expected UDP to %s actual %T to %s", i, test.addr,
+				conn, conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
@@ -10,11 +10,12 @@ func _() {
 	var x [1]struct{}
 	_ = x[TCP-1]
 	_ = x[SCION-2]
+	_ = x[UDP-3]
 }
 
-const _Type_name = "TCPSCION"
+const _Type_name = "TCPSCIONUDP"
 
-var _Type_index = [...]uint8{0, 3, 8}
+var _Type_index = [...]uint8{0, 3, 8, 11}
 
 func (i Type) String() string {
 	i -= 1
@@ -67,6 +67,14 @@ func (m *Counter) Info() (int, int) {
 	return m.count, m.maxCount
 }
 
+//SetMaxCount changes maxCount. The counter is full afterwards if count is larger or equal to
+//maxCount.
+func (m *Counter) SetMaxCount(maxCount int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.maxCount = maxCount
+}
+
 //IsFull returns true if count is larger or equal to maxCount.
 func (m *Counter) IsFull() bool {
 	return m.count >= m.maxCount
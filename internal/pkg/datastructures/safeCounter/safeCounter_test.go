@@ -172,6 +172,19 @@ func TestIsFull(t *testing.T) {
 	}
 }
 
+func TestSetMaxCount(t *testing.T) {
+	counter := New(5)
+	counter.count = 4
+	counter.SetMaxCount(3)
+	if !counter.IsFull() || counter.count != 4 {
+		t.Errorf("counter is full after decreasing maxCount. %v", counter)
+	}
+	counter.SetMaxCount(10)
+	if counter.IsFull() || counter.maxCount != 10 {
+		t.Errorf("counter is not full after increasing maxCount. %v", counter)
+	}
+}
+
 func TestString(t *testing.T) {
 	counter := New(5)
 	if counter.String() != "0/5" {
@@ -0,0 +1,245 @@
+package libresolve
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+)
+
+const (
+	//minForwarderBackoff is the time a forwarder is skipped after its first failed query. It
+	//doubles with each further consecutive failure up to maxForwarderBackoff.
+	minForwarderBackoff = time.Second
+	maxForwarderBackoff = 5 * time.Minute
+	//latencyWeight is the weight of a new measurement in a forwarder's average latency.
+	latencyWeight = 0.25
+)
+
+//ForwarderStats describes the observed health of a forwarder.
+type ForwarderStats struct {
+	Addr net.Addr
+	//Latency is the average time a forwarder took to answer a query. It is zero if the forwarder
+	//has not answered a query yet.
+	Latency time.Duration
+	//Failures is the number of consecutive queries the forwarder did not answer.
+	Failures int
+}
+
+//SelectionStrategy determines the order in which the forwarders are queried.
+type SelectionStrategy interface {
+	//Order returns the indices of forwarders in the order in which they are queried.
+	Order(forwarders []ForwarderStats) []int
+}
+
+//OrderedSelection queries the forwarders in the configured order.
+type OrderedSelection struct{}
+
+//Order implements SelectionStrategy.
+func (OrderedSelection) Order(forwarders []ForwarderStats) []int {
+	order := make([]int, len(forwarders))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+//RoundRobinSelection starts each query with the forwarder following the one the previous query
+//started with. It is safe for concurrent use.
+type RoundRobinSelection struct {
+	next uint32
+}
+
+//Order implements SelectionStrategy.
+func (s *RoundRobinSelection) Order(forwarders []ForwarderStats) []int {
+	if len(forwarders) == 0 {
+		return nil
+	}
+	start := int((atomic.AddUint32(&s.next, 1) - 1) % uint32(len(forwarders)))
+	order := make([]int, len(forwarders))
+	for i := range order {
+		order[i] = (start + i) % len(forwarders)
+	}
+	return order
+}
+
+//RandomSelection queries the forwarders in random order.
+type RandomSelection struct{}
+
+//Order implements SelectionStrategy.
+func (RandomSelection) Order(forwarders []ForwarderStats) []int {
+	return rand.Perm(len(forwarders))
+}
+
+//LowestLatencySelection queries the forwarders by increasing average latency. Forwarders which
+//have not answered a query yet are queried first such that their latency is learned.
+type LowestLatencySelection struct{}
+
+//Order implements SelectionStrategy.
+func (LowestLatencySelection) Order(forwarders []ForwarderStats) []int {
+	order := OrderedSelection{}.Order(forwarders)
+	sort.SliceStable(order, func(i, j int) bool {
+		return forwarders[order[i]].Latency < forwarders[order[j]].Latency
+	})
+	return order
+}
+
+type forwarderState struct {
+	latency  time.Duration
+	failures int
+	//retryAt is the time until which the forwarder is only queried if all others have failed.
+	retryAt time.Time
+}
+
+//forwarderHealth keeps track of the latency and failures of forwarders. It is safe for concurrent
+//use and its zero value is ready to use.
+type forwarderHealth struct {
+	mutex sync.Mutex
+	//states maps a forwarder's address to its state.
+	states map[string]*forwarderState
+}
+
+//state returns the state of addr. The caller must hold the lock.
+func (h *forwarderHealth) state(addr net.Addr) *forwarderState {
+	if h.states == nil {
+		h.states = make(map[string]*forwarderState)
+	}
+	s, ok := h.states[addr.String()]
+	if !ok {
+		s = &forwarderState{}
+		h.states[addr.String()] = s
+	}
+	return s
+}
+
+//stats returns the observed health of forwarders.
+func (h *forwarderHealth) stats(forwarders []net.Addr) []ForwarderStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stats := []ForwarderStats{}
+	for _, addr := range forwarders {
+		s := h.state(addr)
+		stats = append(stats, ForwarderStats{Addr: addr, Latency: s.latency, Failures: s.failures})
+	}
+	return stats
+}
+
+//order returns the indices of forwarders in the order determined by strategy. Forwarders which
+//are backing off are moved to the end.
+func (h *forwarderHealth) order(forwarders []net.Addr, strategy SelectionStrategy) []int {
+	order := strategy.Order(h.stats(forwarders))
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	sort.SliceStable(order, func(i, j int) bool {
+		return !now.Before(h.state(forwarders[order[i]]).retryAt) &&
+			now.Before(h.state(forwarders[order[j]]).retryAt)
+	})
+	return order
+}
+
+//update records the outcome of a query to addr which took latency.
+func (h *forwarderHealth) update(addr net.Addr, latency time.Duration, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.state(addr)
+	if err != nil {
+		backoff := maxForwarderBackoff
+		if s.failures < 16 && minForwarderBackoff<<uint(s.failures) < maxForwarderBackoff {
+			backoff = minForwarderBackoff << uint(s.failures)
+		}
+		s.failures++
+		s.retryAt = time.Now().Add(backoff)
+		log.Debug("Forwarder failed", "forwarder", addr, "failures", s.failures, "backoff", backoff,
+			"error", err)
+		return
+	}
+	if s.failures > 0 {
+		log.Debug("Forwarder recovered", "forwarder", addr, "failures", s.failures)
+	}
+	s.failures = 0
+	s.retryAt = time.Time{}
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency += time.Duration(latencyWeight * float64(latency-s.latency))
+	}
+}
+
+//ForwarderStats returns the observed health of the resolver's forwarders.
+func (r *Resolver) ForwarderStats() []ForwarderStats {
+	return r.health.stats(r.Forwarders)
+}
+
+//forwardQuery sends q to forwarders in the order of the resolver's selection strategy until one of
+//them answers. If RaceForwarders is set, the first two forwarders are queried in parallel.
+func (r *Resolver) forwardQuery(q *query.Name, forwarders []net.Addr) (*message.Message, error) {
+	if len(forwarders) == 0 {
+		return nil, errors.New("forwarders must be specified to use this mode")
+	}
+	strategy := r.Selection
+	if strategy == nil {
+		strategy = OrderedSelection{}
+	}
+	order := r.health.order(forwarders, strategy)
+	if r.RaceForwarders && len(order) > 1 {
+		answer, err := r.raceForwarders(q, forwarders[order[0]], forwarders[order[1]])
+		if err == nil {
+			return answer, nil
+		}
+		order = order[2:]
+	}
+	for _, i := range order {
+		if answer, err := r.queryForwarder(q, forwarders[i]); err == nil {
+			return answer, nil
+		}
+	}
+	return nil, fmt.Errorf("could not connect to any of the specified resolver: %v", forwarders)
+}
+
+//queryForwarder sends q to forwarder and records the outcome in the forwarder's health.
+func (r *Resolver) queryForwarder(q *query.Name, forwarder net.Addr) (*message.Message, error) {
+	msg := message.Message{Token: token.New(), Content: []section.Section{q}}
+	start := time.Now()
+	answer, err := r.sendQuery(msg, forwarder, r.DialTimeout)
+	r.health.update(forwarder, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+//raceForwarders sends q to both forwarders in parallel and returns the first answer. An error is
+//returned if neither of them answers.
+func (r *Resolver) raceForwarders(q *query.Name, first, second net.Addr) (*message.Message, error) {
+	type result struct {
+		answer *message.Message
+		err    error
+	}
+	results := make(chan result, 2)
+	for _, forwarder := range []net.Addr{first, second} {
+		go func(forwarder net.Addr) {
+			answer, err := r.queryForwarder(q, forwarder)
+			results <- result{answer: answer, err: err}
+		}(forwarder)
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err == nil {
+			return res.answer, nil
+		}
+		err = res.err
+	}
+	return nil, err
+}
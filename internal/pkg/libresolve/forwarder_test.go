@@ -0,0 +1,121 @@
+package libresolve
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+func forwarderAddrs(n int) []net.Addr {
+	addrs := []net.Addr{}
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, &net.TCPAddr{IP: net.IPv4(127, 0, 0, byte(i+1)), Port: 55553})
+	}
+	return addrs
+}
+
+func TestSelectionStrategies(t *testing.T) {
+	stats := []ForwarderStats{
+		{Latency: 30 * time.Millisecond},
+		{Latency: 10 * time.Millisecond},
+		{},
+		{Latency: 20 * time.Millisecond},
+	}
+	if order := (OrderedSelection{}).Order(stats); !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+		t.Errorf("wrong ordered selection. actual=%v", order)
+	}
+	if order := (LowestLatencySelection{}).Order(stats); !reflect.DeepEqual(order, []int{2, 1, 3, 0}) {
+		t.Errorf("wrong lowest latency selection. actual=%v", order)
+	}
+	rr := &RoundRobinSelection{}
+	for i, expected := range [][]int{{0, 1, 2, 3}, {1, 2, 3, 0}, {2, 3, 0, 1}, {3, 0, 1, 2},
+		{0, 1, 2, 3}} {
+		if order := rr.Order(stats); !reflect.DeepEqual(order, expected) {
+			t.Errorf("%d: wrong round robin selection. expected=%v actual=%v", i, expected, order)
+		}
+	}
+	order := (RandomSelection{}).Order(stats)
+	sort.Ints(order)
+	if !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+		t.Errorf("random selection is not a permutation. actual=%v", order)
+	}
+}
+
+func TestForwardQueryBackoff(t *testing.T) {
+	resolver := newResolver()
+	resolver.Mode = Forward
+	resolver.Forwarders = forwarderAddrs(3)
+	var mutex sync.Mutex
+	contacted := []net.Addr{}
+	resolver.sendQuery = func(msg message.Message, addr net.Addr, timeout time.Duration) (
+		message.Message, error) {
+		mutex.Lock()
+		contacted = append(contacted, addr)
+		mutex.Unlock()
+		if addr == resolver.Forwarders[0] {
+			return message.Message{}, errors.New("forwarder is down")
+		}
+		return message.Message{Content: []section.Section{&section.Assertion{}}}, nil
+	}
+	if _, err := resolver.forwardQuery(newQuery(), resolver.Forwarders); err != nil {
+		t.Fatalf("query was not answered: %v", err)
+	}
+	if !reflect.DeepEqual(contacted, resolver.Forwarders[:2]) {
+		t.Errorf("wrong forwarders contacted. actual=%v", contacted)
+	}
+	//The failed forwarder is backing off and only queried after the healthy ones.
+	contacted = nil
+	if _, err := resolver.forwardQuery(newQuery(), resolver.Forwarders); err != nil {
+		t.Fatalf("query was not answered: %v", err)
+	}
+	if !reflect.DeepEqual(contacted, resolver.Forwarders[1:2]) {
+		t.Errorf("failed forwarder was contacted again. actual=%v", contacted)
+	}
+	stats := resolver.ForwarderStats()
+	if stats[0].Failures != 1 || stats[1].Failures != 0 || stats[1].Latency == 0 {
+		t.Errorf("wrong forwarder stats. actual=%v", stats)
+	}
+	//The failed forwarder is queried first again once it has recovered.
+	resolver.health.state(resolver.Forwarders[0]).retryAt = time.Now().Add(-time.Second)
+	contacted = nil
+	resolver.forwardQuery(newQuery(), resolver.Forwarders)
+	if len(contacted) == 0 || contacted[0] != resolver.Forwarders[0] {
+		t.Errorf("forwarder was not queried after its backoff. actual=%v", contacted)
+	}
+}
+
+func TestForwardQueryRace(t *testing.T) {
+	resolver := newResolver()
+	resolver.Mode = Forward
+	resolver.Forwarders = forwarderAddrs(3)
+	resolver.RaceForwarders = true
+	slow := make(chan struct{})
+	resolver.sendQuery = func(msg message.Message, addr net.Addr, timeout time.Duration) (
+		message.Message, error) {
+		if addr == resolver.Forwarders[0] {
+			<-slow
+		}
+		return message.Message{Token: msg.Token}, nil
+	}
+	done := make(chan error)
+	go func() {
+		_, err := resolver.forwardQuery(newQuery(), resolver.Forwarders)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("query was not answered: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("answer of the faster forwarder was not returned")
+	}
+	close(slow)
+}
@@ -2,7 +2,6 @@
 package libresolve
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -62,8 +61,15 @@ type answerHandler func(r *Resolver, msg message.Message, q *query.Name, recurse
 
 // Resolver provides methods to resolve names in RAINS.
 type Resolver struct {
-	RootNameServers   []net.Addr
-	Forwarders        []net.Addr
+	RootNameServers []net.Addr
+	Forwarders      []net.Addr
+	//Selection determines the order in which Forwarders are queried. If nil, they are queried in
+	//the configured order.
+	Selection SelectionStrategy
+	//Rules determine how queries for specific zones are resolved regardless of Mode.
+	Rules []ForwardingRule
+	//RaceForwarders sends a query to the first two forwarders in parallel.
+	RaceForwarders    bool
 	Mode              ResolutionMode
 	InsecureTLS       bool
 	DialTimeout       time.Duration
@@ -74,6 +80,8 @@ type Resolver struct {
 	MaxRecursiveCount int
 	sendQuery         querySender
 	handleAnswer      answerHandler
+	//health contains the latency and failures of Forwarders.
+	health forwarderHealth
 }
 
 //New creates a resolver with the given parameters and default settings
@@ -114,36 +122,24 @@ func New(rootNS, forwarders []net.Addr, rootKeyPath string, mode ResolutionMode,
 //ClientLookup forwards the query to the specified forwarders or performs a recursive lookup starting at
 //the specified root servers. It returns the received information.
 func (r *Resolver) ClientLookup(query *query.Name) (*message.Message, error) {
-	switch r.Mode {
-	case Recursive:
-		return r.recursiveResolve(query, 0)
-	case Forward:
-		return r.forwardQuery(query)
-	default:
-		return nil, fmt.Errorf("Unsupported resolution mode: %v", r.Mode)
-	}
+	return r.resolve(query)
 }
 
 //ServerLookup forwards the query to the specified forwarders or performs a recursive lookup
 //starting at the specified root servers. It sends the received information to conInfo.
 func (r *Resolver) ServerLookup(query *query.Name, addr net.Addr, token token.Token) {
-	var msg *message.Message
-	var err error
 	log.Info("recResolver received query", "query", query, "token", token)
-	switch r.Mode {
-	case Recursive:
-		msg, err = r.recursiveResolve(query, 0)
-	case Forward:
-		msg, err = r.forwardQuery(query)
-	default:
-		log.Error("Unsupported resolution mode", "mode", r.Mode)
-		return
-	}
+	msg, err := r.resolve(query)
 	if err != nil {
 		log.Error("Query failed", "query failure", err)
 		return
 	}
 	msg.Token = token
+	for _, sec := range msg.Content {
+		if n, ok := sec.(*section.Notification); ok {
+			n.Token = token
+		}
+	}
 	if conn, ok := r.Connections.GetConnection(addr); ok {
 		log.Info("recResolver answers query", "answer", msg, "token", token, "conn",
 			conn[0].RemoteAddr(), "resolver", conn[0].LocalAddr())
@@ -172,20 +168,6 @@ func (r *Resolver) createConnAndWrite(addr net.Addr, msg *message.Message) {
 
 }
 
-func (r *Resolver) forwardQuery(q *query.Name) (*message.Message, error) {
-	if len(r.Forwarders) == 0 {
-		return nil, errors.New("forwarders must be specified to use this mode")
-	}
-	for _, forwarder := range r.Forwarders {
-		msg := message.Message{Token: token.New(), Content: []section.Section{q}}
-		answer, err := r.sendQuery(msg, forwarder, r.DialTimeout*time.Millisecond)
-		if err == nil {
-			return &answer, nil
-		}
-	}
-	return nil, fmt.Errorf("could not connect to any of the specified resolver: %v", r.Forwarders)
-}
-
 // recursiveResolve starts at the root and follows delegations until it receives an answer.
 // It aborts if called more than "recurseCount" times recursively.
 func (r *Resolver) recursiveResolve(q *query.Name, recurseCount int) (*message.Message, error) {
@@ -253,6 +235,11 @@ func handleAnswer(r *Resolver, msg message.Message, q *query.Name, recurseCount
 		types[t] = true
 	}
 	for _, sec := range msg.Content {
+		if n, ok := sec.(*section.Notification); ok {
+			//An authoritative server notifies that the queried name does not exist.
+			isFinal = n.Type == section.NTNoAssertionsExist
+			return
+		}
 		signed, ok := sec.(section.WithSigForward)
 		if !ok {
 			log.Error("Unexpected Section in Message not of type WithSigForward", "section", sec)
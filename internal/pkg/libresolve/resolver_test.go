@@ -94,3 +94,20 @@ func TestRecursiveResolveQueriesRoot(t *testing.T) {
 		t.Fatalf("Should have contacted 1 root server, but did it %d times", numberOfMessagesSent)
 	}
 }
+
+func TestRecursiveResolveNonexistentName(t *testing.T) {
+	resolver := newResolver()
+	resolver.RootNameServers = []net.Addr{&net.IPAddr{IP: net.IPv4(127, 0, 0, 11)}}
+	resolver.handleAnswer = handleAnswer
+	notification := &section.Notification{Type: section.NTNoAssertionsExist}
+	resolver.sendQuery = func(msg message.Message, addr net.Addr, timeout time.Duration) (message.Message, error) {
+		return message.Message{Content: []section.Section{notification}}, nil
+	}
+	ans, err := resolver.recursiveResolve(newQuery(), 0)
+	if err != nil {
+		t.Fatalf("The call to recursiveResolve finished with an error: %v", err)
+	}
+	if len(ans.Content) != 1 || ans.Content[0] != notification {
+		t.Fatalf("Wrong answer received: %v", ans.Content)
+	}
+}
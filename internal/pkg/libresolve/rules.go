@@ -0,0 +1,67 @@
+package libresolve
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+)
+
+//ForwardingRule determines how queries for names in a zone are resolved independently of the
+//resolver's mode.
+type ForwardingRule struct {
+	//Zone is a fully qualified zone name. The rule matches Zone and all names below it.
+	Zone string
+	//Context is the context of matching queries. An empty context matches all contexts.
+	Context string
+	//Forwarders receive the matching queries. If empty, matching queries are resolved recursively
+	//starting at the root name servers.
+	Forwarders []net.Addr
+}
+
+//matches returns true if q is about a name in r's zone and context.
+func (r ForwardingRule) matches(q *query.Name) bool {
+	if r.Context != "" && r.Context != q.Context {
+		return false
+	}
+	return r.Zone == "." || q.Name == r.Zone || strings.HasSuffix(q.Name, "."+r.Zone)
+}
+
+//rule returns the rule with the longest zone matching q. Among rules for the same zone, a rule
+//for q's context takes precedence over a rule for all contexts. False is returned if no rule
+//matches.
+func (r *Resolver) rule(q *query.Name) (ForwardingRule, bool) {
+	var match ForwardingRule
+	found := false
+	for _, rule := range r.Rules {
+		if !rule.matches(q) {
+			continue
+		}
+		if !found || len(rule.Zone) > len(match.Zone) ||
+			(len(rule.Zone) == len(match.Zone) && match.Context == "") {
+			match, found = rule, true
+		}
+	}
+	return match, found
+}
+
+//resolve answers q according to the matching forwarding rule or, if there is none, according to
+//the resolver's mode.
+func (r *Resolver) resolve(q *query.Name) (*message.Message, error) {
+	if rule, ok := r.rule(q); ok {
+		if len(rule.Forwarders) == 0 {
+			return r.recursiveResolve(q, 0)
+		}
+		return r.forwardQuery(q, rule.Forwarders)
+	}
+	switch r.Mode {
+	case Recursive:
+		return r.recursiveResolve(q, 0)
+	case Forward:
+		return r.forwardQuery(q, r.Forwarders)
+	default:
+		return nil, fmt.Errorf("Unsupported resolution mode: %v", r.Mode)
+	}
+}
@@ -0,0 +1,56 @@
+package libresolve
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+)
+
+func TestForwardingRules(t *testing.T) {
+	resolver := newResolver()
+	resolver.Mode = Forward
+	addrs := forwarderAddrs(4)
+	resolver.Forwarders = addrs[:1]
+	resolver.RootNameServers = addrs[1:2]
+	resolver.Rules = []ForwardingRule{
+		{Zone: "ch.", Context: "."},
+		{Zone: "corp.ch.", Forwarders: addrs[2:3]},
+		{Zone: "corp.ch.", Context: "test-cch", Forwarders: addrs[3:]},
+	}
+	var tests = []struct {
+		name     string
+		context  string
+		expected net.Addr
+	}{
+		{"example.com.", ".", addrs[0]},
+		{"example.ch.", ".", addrs[1]},
+		{"ch.", ".", addrs[1]},
+		{"example.ch.", "test-cch", addrs[0]},
+		{"www.corp.ch.", ".", addrs[2]},
+		{"corp.ch.", ".", addrs[2]},
+		{"www.corp.ch.", "test-cch", addrs[3]},
+		{"www.examplecorp.ch.", ".", addrs[1]},
+	}
+	for i, test := range tests {
+		var mutex sync.Mutex
+		var contacted net.Addr
+		resolver.sendQuery = func(msg message.Message, addr net.Addr, timeout time.Duration) (
+			message.Message, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if contacted == nil {
+				contacted = addr
+			}
+			return message.Message{Token: msg.Token}, nil
+		}
+		q := newQuery()
+		q.Name, q.Context = test.name, test.context
+		resolver.ClientLookup(q)
+		if contacted != test.expected {
+			t.Errorf("%d: wrong server contacted. expected=%v actual=%v", i, test.expected, contacted)
+		}
+	}
+}
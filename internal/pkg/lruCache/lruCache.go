@@ -89,6 +89,20 @@ func (c *Cache) GetAll() []interface{} {
 	return values
 }
 
+//GetAllInternal returns all contained values together with a flag per value which is true if the
+//value is internal. It does not affect lru list order.
+func (c *Cache) GetAllInternal() ([]interface{}, []bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	values := []interface{}{}
+	internal := []bool{}
+	for _, v := range c.hashMap {
+		values = append(values, v.Value.(*entry).value)
+		internal = append(internal, v.Value.(*entry).internal)
+	}
+	return values, internal
+}
+
 //Remove deletes the key value pair from the map.
 //It returns the value and true if an element was deleted. Otherwise the value and false.
 func (c *Cache) Remove(key string) (interface{}, bool) {
@@ -122,6 +122,21 @@ func TestGetAll(t *testing.T) {
 	}
 }
 
+func TestGetAllInternal(t *testing.T) {
+	cache := New()
+	cache.GetOrAdd("v2", 4, true)
+	cache.GetOrAdd("v4", 7, false)
+	v, internal := cache.GetAllInternal()
+	if len(v) != 2 || len(internal) != 2 {
+		t.Fatalf("return value is not correct. %v", cache.hashMap)
+	}
+	for i := range v {
+		if internal[i] != (v[i].(int) == 4) {
+			t.Errorf("wrong internal flag of value %d. actual=%v", v[i], internal[i])
+		}
+	}
+}
+
 func TestRemove(t *testing.T) {
 	//test if added value is stored correctly in the cache
 	cache := New()
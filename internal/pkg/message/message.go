@@ -1,11 +1,16 @@
 package message
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
 
 	cbor "github.com/britram/borat"
 
+	rcbor "github.com/netsec-ethz/rains/internal/pkg/cbor"
 	"github.com/netsec-ethz/rains/internal/pkg/query"
 	"github.com/netsec-ethz/rains/internal/pkg/section"
 	"github.com/netsec-ethz/rains/internal/pkg/signature"
@@ -177,6 +182,42 @@ func (rm *Message) MarshalCBOR(w *cbor.CBORWriter) error {
 	return w.WriteIntMap(m)
 }
 
+//PeekToken returns the token of the message whose cbor encoding starts with prefix. It is used to
+//identify a message which could not be decoded, e.g. because it exceeded the maximum message size.
+//As the map entries of a message are encoded in ascending key order, the token is only preceded by
+//the message's signatures and capabilities. It returns false if prefix does not contain the token.
+func PeekToken(prefix []byte) (token.Token, bool) {
+	r := rcbor.NewFrameReader(bytes.NewReader(prefix), len(prefix))
+	major, arg, _, err := r.ReadHead()
+	if err != nil || major != rcbor.MajorTag || arg != rainsTag {
+		return token.Token{}, false
+	}
+	major, entries, indefinite, err := r.ReadHead()
+	if err != nil || major != rcbor.MajorMap || indefinite {
+		return token.Token{}, false
+	}
+	for i := uint64(0); i < entries; i++ {
+		key, err := r.ReadItem()
+		if err != nil {
+			return token.Token{}, false
+		}
+		value, err := r.ReadItem()
+		if err != nil {
+			return token.Token{}, false
+		}
+		//The token is encoded as key 2 followed by a byte string of length 16.
+		if len(key) == 1 && key[0] == 2 {
+			var tok token.Token
+			if len(value) != len(tok)+1 || value[0] != rcbor.MajorBytes<<5|byte(len(tok)) {
+				return token.Token{}, false
+			}
+			copy(tok[:], value[1:])
+			return tok, true
+		}
+	}
+	return token.Token{}, false
+}
+
 //Capability is a urn of a capability
 type Capability string
 
@@ -186,3 +227,32 @@ const (
 	//TLSOverTCP is used when the server listens for tls over tcp connections
 	TLSOverTCP Capability = "urn:x-rains:tlssrv"
 )
+
+//CapabilityHash returns the hex encoded sha256 hash of the cbor encoding of capabilities sorted in
+//lexicographically increasing order. The order of capabilities is not changed.
+func CapabilityHash(capabilities []Capability) string {
+	sorted := make([]string, len(capabilities))
+	for i, c := range capabilities {
+		sorted[i] = string(c)
+	}
+	sort.Strings(sorted)
+	array := make([]interface{}, len(sorted))
+	for i, c := range sorted {
+		array[i] = c
+	}
+	encoding := new(bytes.Buffer)
+	//Writing to a bytes.Buffer does not fail and strings are always encodable.
+	cbor.NewCBORWriter(encoding).WriteArray(array)
+	hash := sha256.Sum256(encoding.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+//ContainsCapability returns true if capabilities contains c.
+func ContainsCapability(capabilities []Capability, c Capability) bool {
+	for _, capability := range capabilities {
+		if capability == c {
+			return true
+		}
+	}
+	return false
+}
@@ -55,6 +55,56 @@ func TestCBORErrorCases(t *testing.T) {
 	}
 }
 
+func TestPeekToken(t *testing.T) {
+	msg := GetMessage()
+	msg.Capabilities = []Capability{TLSOverTCP}
+	encoding := new(bytes.Buffer)
+	if err := cbor.NewWriter(encoding).Marshal(&msg); err != nil {
+		t.Fatalf("Was not able to marshal msg, err=%s", err.Error())
+	}
+	//prefix ends right after the token: tag, map head, capabilities and token.
+	prefix := bytes.Index(encoding.Bytes(), msg.Token[:]) + len(msg.Token)
+	var tests = []struct {
+		input []byte
+		ok    bool
+	}{
+		{encoding.Bytes(), true},
+		{encoding.Bytes()[:prefix], true},
+		{encoding.Bytes()[:prefix-1], false},
+		{[]byte("Just some nonsense data"), false},
+	}
+	for i, test := range tests {
+		tok, ok := PeekToken(test.input)
+		if ok != test.ok || (ok && tok != msg.Token) {
+			t.Errorf("%d: wrong token. expected=%v,%v actual=%v,%v", i, msg.Token, test.ok, tok, ok)
+		}
+	}
+}
+
+func TestCapabilityHash(t *testing.T) {
+	var tests = []struct {
+		input []Capability
+		hash  string
+	}{
+		//hash of the capability list from the draft
+		{[]Capability{TLSOverTCP}, "e5365a09be554ae55b855f15264dbc837b04f5831daeb321359e18cdabab5745"},
+		{[]Capability{NoCapability, TLSOverTCP}, CapabilityHash([]Capability{TLSOverTCP, NoCapability})},
+	}
+	for i, test := range tests {
+		if hash := CapabilityHash(test.input); hash != test.hash {
+			t.Errorf("%d: wrong capability hash. expected=%s actual=%s", i, test.hash, hash)
+		}
+	}
+	if CapabilityHash([]Capability{TLSOverTCP}) == CapabilityHash([]Capability{NoCapability}) {
+		t.Error("different capability lists have the same hash")
+	}
+	caps := []Capability{TLSOverTCP, NoCapability}
+	CapabilityHash(caps)
+	if caps[0] != TLSOverTCP {
+		t.Error("CapabilityHash changed the order of its input")
+	}
+}
+
 func CheckMessage(m1, m2 Message, t *testing.T) {
 	if m1.Token != m2.Token {
 		t.Error("Token mismatch")
@@ -0,0 +1,185 @@
+//Package metrics provides counters and gauges which can be exposed in the Prometheus text
+//exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	//labelSep separates label values in the keys of a metric's sample map. It must not occur in
+	//label values.
+	labelSep = "\xff"
+)
+
+//Registry stores a set of metrics. It is safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+}
+
+//New returns a new empty registry
+func New() *Registry {
+	return &Registry{}
+}
+
+//metric is a named family of samples which are distinguished by their label values.
+type metric struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mutex  sync.Mutex
+	//counts contains the value of each counter sample keyed by its joined label values.
+	counts map[string]uint64
+	//funcs contains the function computing each gauge sample keyed by its joined label values.
+	funcs map[string]func() float64
+}
+
+//Counter is a monotonically increasing value per combination of label values.
+type Counter struct {
+	m *metric
+}
+
+//Gauge is a value per combination of label values which is computed when the metrics are written.
+type Gauge struct {
+	m *metric
+}
+
+func (r *Registry) add(name, help, typ string, labels []string) *metric {
+	m := &metric{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		counts: make(map[string]uint64),
+		funcs:  make(map[string]func() float64),
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+//NewCounter adds a counter with the given name, help text and label names to the registry.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{m: r.add(name, help, typeCounter, labels)}
+}
+
+//NewGauge adds a gauge with the given name, help text and label names to the registry.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{m: r.add(name, help, typeGauge, labels)}
+}
+
+//Inc increases the counter of labelValues by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+//Add increases the counter of labelValues by n.
+func (c *Counter) Add(n uint64, labelValues ...string) {
+	key := c.m.key(labelValues)
+	c.m.mutex.Lock()
+	defer c.m.mutex.Unlock()
+	c.m.counts[key] += n
+}
+
+//Value returns the current value of the counter of labelValues.
+func (c *Counter) Value(labelValues ...string) uint64 {
+	key := c.m.key(labelValues)
+	c.m.mutex.Lock()
+	defer c.m.mutex.Unlock()
+	return c.m.counts[key]
+}
+
+//Func sets f as the function computing the gauge of labelValues.
+func (g *Gauge) Func(f func() float64, labelValues ...string) {
+	key := g.m.key(labelValues)
+	g.m.mutex.Lock()
+	defer g.m.mutex.Unlock()
+	g.m.funcs[key] = f
+}
+
+//key returns the key of labelValues in the sample maps. It panics if the number of label values
+//does not match the number of label names as this is a programming error.
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels),
+			len(labelValues)))
+	}
+	return strings.Join(labelValues, labelSep)
+}
+
+//Write writes all metrics of the registry to w in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.mutex.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+//ServeHTTP writes all metrics of the registry as response.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	samples := make(map[string]string)
+	m.mutex.Lock()
+	for k, v := range m.counts {
+		samples[k] = fmt.Sprintf("%d", v)
+	}
+	funcs := make(map[string]func() float64)
+	for k, f := range m.funcs {
+		funcs[k] = f
+	}
+	m.mutex.Unlock()
+	//Gauge functions are called without holding the lock as they might be slow.
+	for k, f := range funcs {
+		samples[k] = fmt.Sprintf("%g", f())
+	}
+	keys := make([]string, 0, len(samples))
+	for k := range samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(k), samples[k])
+	}
+}
+
+//formatLabels returns the label set of the sample with the given key.
+func (m *metric) formatLabels(key string) string {
+	if len(m.labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, labelSep)
+	pairs := make([]string, len(m.labels))
+	for i, l := range m.labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, l, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
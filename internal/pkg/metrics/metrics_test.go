@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := New()
+	c := r.NewCounter("test_total", "help", "type")
+	runs := 1000
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func() {
+			c.Inc("a")
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	c.Add(5, "b")
+	if c.Value("a") != uint64(runs) {
+		t.Errorf("wrong counter value. expected=%d actual=%d", runs, c.Value("a"))
+	}
+	if c.Value("b") != 5 || c.Value("c") != 0 {
+		t.Errorf("wrong counter values. expected=5/0 actual=%d/%d", c.Value("b"), c.Value("c"))
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with wrong number of label values did not panic")
+		}
+	}()
+	New().NewCounter("test_total", "help", "type").Inc()
+}
+
+func TestWrite(t *testing.T) {
+	r := New()
+	c := r.NewCounter("requests_total", "Number of\nrequests.", "method", "code")
+	c.Inc("get", "200")
+	c.Add(3, "get", "404")
+	c.Inc("post", `a"b`)
+	g := r.NewGauge("queue_length", "Queue length.")
+	g.Func(func() float64 { return 7 })
+	g2 := r.NewGauge("ratio", "Ratio.", "cache")
+	g2.Func(func() float64 { return 0.5 }, "x")
+	expected := `# HELP requests_total Number of\nrequests.
+# TYPE requests_total counter
+requests_total{method="get",code="200"} 1
+requests_total{method="get",code="404"} 3
+requests_total{method="post",code="a\"b"} 1
+# HELP queue_length Queue length.
+# TYPE queue_length gauge
+queue_length 7
+# HELP ratio Ratio.
+# TYPE ratio gauge
+ratio{cache="x"} 0.5
+`
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Write returned an error: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("wrong exposition. expected=\n%s\nactual=\n%s", expected, buf.String())
+	}
+}
@@ -18,6 +18,11 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/zonefile"
 )
 
+const (
+	//notificationValidity is the validity period of the signature on a zone changed notification.
+	notificationValidity = time.Minute
+)
+
 //Rainspub represents the publishing process of a zone authority. It can be configured to do
 //anything from just one step to the whole process of publishing information to the zone's
 //authoritative servers.
@@ -88,6 +93,9 @@ func (r *Rainspub) Publish() error {
 		log.Info("Writing updated zonefile to disk completed successfully")
 	}
 	r.publishZone(output)
+	if len(r.Config.NotifyServers) > 0 {
+		return r.notifyZoneChanged(zone.SubjectZone, zone.Context)
+	}
 	return nil
 }
 
@@ -466,3 +474,43 @@ func (r *Rainspub) publishSections(msg message.Message) []net.Addr {
 	}
 	return errorConns
 }
+
+//notifyZoneChanged sends a notification that zone in context has changed to all servers to notify.
+//The message is signed with the zone's private key such that the servers can verify that the
+//notification originates from the zone's authority.
+func (r *Rainspub) notifyZoneChanged(zone, context string) error {
+	privateKeys, err := LoadPrivateKeys(r.Config.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("Was not able to load private keys: %v", err)
+	}
+	msg := message.Message{
+		Token: token.New(),
+		Content: []section.Section{&section.Notification{
+			Token: token.New(),
+			Type:  section.NTZoneChanged,
+			Data:  fmt.Sprintf("%s %s", zone, context),
+		}},
+		Capabilities: []message.Capability{message.NoCapability},
+		Signatures: []signature.Sig{signature.Sig{
+			PublicKeyID: keys.PublicKeyID{
+				Algorithm: r.Config.MetaDataConf.SignatureAlgorithm,
+				KeyPhase:  r.Config.MetaDataConf.KeyPhase,
+				KeySpace:  keys.RainsKeySpace,
+			},
+			ValidSince: time.Now().Unix(),
+			ValidUntil: time.Now().Add(notificationValidity).Unix(),
+		}},
+	}
+	if err := siglib.SignMessageUnsafe(&msg, privateKeys); err != nil {
+		return fmt.Errorf("Was not able to sign zone changed notification: %v", err)
+	}
+	for _, server := range r.Config.NotifyServers {
+		if err := connectAndSendNotification(msg, server.Addr); err != nil {
+			log.Warn("Was not able to notify server about changed zone", "server", server.Addr,
+				"error", err)
+		} else {
+			log.Debug("Notified server about changed zone", "server", server.Addr, "zone", zone)
+		}
+	}
+	return nil
+}
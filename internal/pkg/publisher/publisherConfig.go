@@ -22,6 +22,9 @@ type Config struct {
 	MaxZoneSize     int
 	OutputPath      string
 	DoPublish       bool
+	//NotifyServers are notified with a message signed by the zone after the zone has been
+	//published such that they invalidate their cached sections of the zone.
+	NotifyServers []connection.Info
 }
 
 //ShardingConfig contains configuration options on how to split a zone into shards.
@@ -110,9 +113,10 @@ func DefaultConfig() Config {
 			SigNotExpired:      false,
 			CheckStringFields:  false,
 		},
-		DoSigning:   true,
-		MaxZoneSize: 60000,
-		OutputPath:  "",
-		DoPublish:   true,
+		DoSigning:     true,
+		MaxZoneSize:   60000,
+		OutputPath:    "",
+		DoPublish:     true,
+		NotifyServers: []connection.Info{},
 	}
 }
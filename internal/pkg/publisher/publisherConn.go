@@ -43,6 +43,20 @@ func connectAndSendMsg(msg message.Message, server net.Addr) error {
 	return fmt.Errorf("timeout while waiting for response")
 }
 
+//connectAndSendNotification establishes a connection to server and sends msg containing
+//notifications. As notifications are not answered, it does not wait for a reply.
+func connectAndSendNotification(msg message.Message, server net.Addr) error {
+	conn, err := connection.CreateConnection(server)
+	if err != nil {
+		return fmt.Errorf("unable to establish a connection: %s", err)
+	}
+	defer conn.Close()
+	if err := connection.WriteMessage(conn, &msg); err != nil {
+		return fmt.Errorf("unable send message: %s", err)
+	}
+	return nil
+}
+
 //handleResponse handles the received notification message and returns true if the connection can
 //be closed.
 func handleResponse(n *section.Notification) bool {
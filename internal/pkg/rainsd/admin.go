@@ -0,0 +1,427 @@
+//The admin API allows operators to inspect and control a running server. It is served over HTTP
+//on a Unix socket or a localhost TCP address and used by rainsctl.
+
+package rainsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/zonefile"
+)
+
+const (
+	//unixScheme marks an admin address as the path of a Unix socket.
+	unixScheme = "unix:"
+	//AdminHeader must be set on all admin API requests changing the server's state. Browsers do not
+	//add custom headers to cross-origin requests without the consent of the server.
+	AdminHeader = "X-Rains-Admin"
+
+	CacheAssertions    = "assertions"
+	CacheNegAssertions = "negAssertions"
+	CacheZoneKeys      = "zoneKeys"
+)
+
+//Stats contains the sizes of the server's caches, input queues and authoritative store.
+type Stats struct {
+	Assertions     int
+	NegAssertions  int
+	ZoneKeys       int
+	PendingKeys    int
+	PendingQueries int
+	Connections    int
+	Capabilities   int
+	PrioQueue      int
+	NormalQueue    int
+	NotifyQueue    int
+	Authoritative  int
+}
+
+var (
+	logMutex   sync.Mutex
+	logHandler log.Handler
+	logLevel   = log.LvlInfo
+)
+
+//SetLogHandler sets the root log handler to h and discards all records below lvl. The level can be
+//changed at runtime over the admin API.
+func SetLogHandler(h log.Handler, lvl log.Lvl) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logHandler = h
+	logLevel = lvl
+	log.Root().SetHandler(log.LvlFilterHandler(lvl, h))
+}
+
+//setLogLevel discards all log records below lvl from now on.
+func setLogLevel(lvl log.Lvl) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if logHandler == nil {
+		logHandler = log.Root().GetHandler()
+	}
+	logLevel = lvl
+	log.Root().SetHandler(log.LvlFilterHandler(lvl, logHandler))
+}
+
+func getLogLevel() log.Lvl {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	return logLevel
+}
+
+//ParseAdminAddress returns the network and address of an admin API address. An address prefixed
+//with unix: is the path of a Unix socket, all others are TCP addresses.
+func ParseAdminAddress(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	return "tcp", addr
+}
+
+//checkAdminAddress returns an error if addr is neither the path of a Unix socket nor a TCP address
+//on the loopback interface. The admin API is not authenticated and must not be reachable from
+//other hosts.
+func checkAdminAddress(addr string) error {
+	network, address := ParseAdminAddress(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("admin address has an empty socket path")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid admin address %s: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin address %s is not a loopback address", addr)
+	}
+	return nil
+}
+
+//removeStaleSocket removes the Unix socket at path left over by a previous run. An error is
+//returned if something else than a socket exists at path.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+//openAdmin checks the configured admin address and listens on it. The admin API is served once
+//the server is started.
+func (s *Server) openAdmin() error {
+	if err := checkAdminAddress(s.config.AdminAddress); err != nil {
+		return err
+	}
+	network, address := ParseAdminAddress(s.config.AdminAddress)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	s.adminListener = listener
+	return nil
+}
+
+//startAdmin starts serving the admin API on the listener opened by openAdmin.
+func (s *Server) startAdmin() {
+	listener := s.adminListener
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/", s.handleCacheDump)
+	mux.HandleFunc("/flush", s.handleFlush)
+	mux.HandleFunc("/checkpoint", s.handleCheckpoint)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/loglevel", s.handleLogLevel)
+	mux.HandleFunc("/blocklist", s.handleBlocklist)
+	mux.HandleFunc("/blocklist/peer", s.handleBlockPeer)
+	mux.HandleFunc("/blocklist/zone", s.handleBlockZone)
+	mux.HandleFunc("/blocklist/reload", s.handleBlocklistReload)
+	mux.HandleFunc("/config/reload", s.handleConfigReload)
+	mux.Handle("/metrics", s.metrics.registry)
+	s.admin = &http.Server{Handler: adminGuard(mux, listener.Addr().Network() == "tcp")}
+	s.goRead(func() {
+		if err := s.admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("Admin API stopped", "error", err)
+		}
+	})
+	log.Info("Started admin API", "addr", s.config.AdminAddress)
+}
+
+//adminGuard returns a handler which only passes requests to next that cannot originate from a web
+//page opened in a browser on the host. Requests carrying an Origin header and requests changing the
+//server's state without the AdminHeader are rejected. If checkHost is true, the request's host must
+//be a loopback address, such that DNS rebinding does not grant a web page access.
+func adminGuard(next http.Handler, checkHost bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "requests from web pages are not allowed", http.StatusForbidden)
+			return
+		}
+		if checkHost && !isLoopbackHost(r.Host) {
+			http.Error(w, "host is not a loopback address", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			r.Header.Get(AdminHeader) == "" {
+			http.Error(w, "missing "+AdminHeader+" header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//isLoopbackHost returns true if host, optionally followed by a port, is localhost or a loopback
+//address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//handleCacheDump writes the content of the cache named in the path in zonefile format. If the zone
+//parameter is set, only sections of this zone are returned.
+func (s *Server) handleCacheDump(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	var entries []cache.CheckpointEntry
+	switch strings.TrimPrefix(r.URL.Path, "/cache/") {
+	case CacheAssertions:
+		entries = s.caches.AssertionsCache.Checkpoint()
+	case CacheNegAssertions:
+		entries = s.caches.NegAssertionCache.Checkpoint()
+	case CacheZoneKeys:
+		entries = s.caches.ZoneKeyCache.Checkpoint()
+	default:
+		http.Error(w, "unknown cache", http.StatusNotFound)
+		return
+	}
+	zone := r.URL.Query().Get("zone")
+	sections := []section.Section{}
+	for _, e := range entries {
+		if zone == "" || e.Section.GetSubjectZone() == zone {
+			sections = append(sections, e.Section)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, zonefile.IO{}.Encode(sections))
+}
+
+//handleFlush removes all cached assertions, shards, pshards and zones of the zone parameter.
+func (s *Server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	zone := r.URL.Query().Get("zone")
+	if zone == "" {
+		http.Error(w, "missing zone", http.StatusBadRequest)
+		return
+	}
+	s.caches.removeZone(zone, "")
+	log.Info("Flushed zone from caches", "zone", zone)
+}
+
+//handleCheckpoint writes a checkpoint of the caches to the checkpoint path.
+func (s *Server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	path := s.Config().CheckPointPath
+	checkpointCaches(path, s.caches)
+	log.Info("Checkpoint written on request", "path", path)
+}
+
+//handleStats returns the server's Stats in json format.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, s.Stats())
+}
+
+//handleLogLevel returns the current log level on GET and sets it to the level parameter on PUT.
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		lvl, err := log.LvlFromString(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(lvl)
+		log.Info("Changed log level", "level", lvl)
+	}
+	fmt.Fprintln(w, getLogLevel())
+}
+
+//handleBlocklist returns the server's blocklist entries in json format.
+func (s *Server) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, s.Blocklist())
+}
+
+//handleBlockPeer blocks the prefix parameter on POST and unblocks it on DELETE.
+func (s *Server) handleBlockPeer(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if r.Method == http.MethodDelete {
+		if ok, err := s.UnblockPeer(prefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if !ok {
+			http.Error(w, "prefix is not blocked", http.StatusNotFound)
+		}
+		return
+	}
+	expiration, err := parseExpiration(r.URL.Query().Get("expiration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.BlockPeer(prefix, expiration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+//handleBlockZone blocks the zone parameter in the context parameter on POST and unblocks it on
+//DELETE.
+func (s *Server) handleBlockZone(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	zone := r.URL.Query().Get("zone")
+	context := r.URL.Query().Get("context")
+	if zone == "" {
+		http.Error(w, "missing zone", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !s.UnblockZone(zone, context) {
+			http.Error(w, "zone is not blocked", http.StatusNotFound)
+		}
+		return
+	}
+	expiration, err := parseExpiration(r.URL.Query().Get("expiration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.BlockZone(zone, context, expiration)
+}
+
+//handleBlocklistReload replaces the blocklist with the content of the configured blocklist file.
+func (s *Server) handleBlocklistReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	path := s.Config().BlocklistPath
+	if path == "" {
+		http.Error(w, "no blocklist file configured", http.StatusBadRequest)
+		return
+	}
+	if err := s.LoadBlocklist(path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//handleConfigReload reloads the server's configuration file and returns the changed fields in
+//json format.
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	result, err := s.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+//Stats returns the current sizes of the server's caches, input queues and authoritative store.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Assertions:     s.caches.AssertionsCache.Len(),
+		NegAssertions:  s.caches.NegAssertionCache.Len(),
+		ZoneKeys:       s.caches.ZoneKeyCache.Len(),
+		PendingKeys:    s.caches.PendingKeys.Len(),
+		PendingQueries: s.caches.PendingQueries.Len(),
+		Connections:    s.caches.ConnCache.Len(),
+		Capabilities:   s.caches.Capabilities.Len(),
+		PrioQueue:      len(s.queues.Prio),
+		NormalQueue:    len(s.queues.Normal),
+		NotifyQueue:    len(s.queues.Notify),
+		Authoritative:  s.authStore.Len(),
+	}
+}
+
+//allowMethods returns true if the request's method is one of methods. Otherwise, it responds with
+//an error and returns false.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warn("Was not able to encode admin API response", "error", err)
+	}
+}
+
+//parseExpiration returns the time corresponding to expiration in unix seconds. An empty expiration
+//results in the zero time.
+func parseExpiration(expiration string) (time.Time, error) {
+	if expiration == "" {
+		return time.Time{}, nil
+	}
+	exp, err := strconv.ParseInt(expiration, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration: %v", err)
+	}
+	return time.Unix(exp, 0), nil
+}
@@ -0,0 +1,110 @@
+package rainsd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAdminAddress(t *testing.T) {
+	var tests = []struct {
+		addr  string
+		valid bool
+	}{
+		{"unix:/run/rainsd.sock", true},
+		{"unix:", false},
+		{"localhost:5023", true},
+		{"127.0.0.1:5023", true},
+		{"[::1]:5023", true},
+		{":5023", false},
+		{"0.0.0.0:5023", false},
+		{"192.0.2.1:5023", false},
+		{"example.com:5023", false},
+		{"127.0.0.1", false},
+	}
+	for i, test := range tests {
+		if err := checkAdminAddress(test.addr); (err == nil) != test.valid {
+			t.Errorf("%d: wrong result for %s. expected valid=%t actual error=%v", i, test.addr,
+				test.valid, err)
+		}
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := removeStaleSocket(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("missing socket caused an error: %v", err)
+	}
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0600)
+	if err := removeStaleSocket(file); err == nil {
+		t.Error("regular file was accepted as a socket")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+	sock := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Keep the socket file when the listener is closed.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if err := removeStaleSocket(sock); err != nil {
+		t.Errorf("was not able to remove stale socket: %v", err)
+	}
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("stale socket was not removed: %v", err)
+	}
+}
+
+func TestAdminGuard(t *testing.T) {
+	var tests = []struct {
+		method    string
+		host      string
+		origin    string
+		header    bool
+		checkHost bool
+		status    int
+	}{
+		{http.MethodGet, "127.0.0.1:5023", "", false, true, http.StatusOK},
+		{http.MethodPost, "127.0.0.1:5023", "", true, true, http.StatusOK},
+		{http.MethodPut, "localhost:5023", "", true, true, http.StatusOK},
+		{http.MethodDelete, "[::1]:5023", "", true, true, http.StatusOK},
+		{http.MethodPost, "127.0.0.1:5023", "", false, true, http.StatusForbidden},
+		{http.MethodPost, "127.0.0.1:5023", "http://example.com", true, true, http.StatusForbidden},
+		{http.MethodGet, "127.0.0.1:5023", "http://example.com", false, true,
+			http.StatusForbidden},
+		{http.MethodGet, "example.com:5023", "", false, true, http.StatusForbidden},
+		{http.MethodPost, "example.com", "", true, true, http.StatusForbidden},
+		{http.MethodPost, "rainsd", "", true, false, http.StatusOK},
+		{http.MethodPost, "rainsd", "", false, false, http.StatusForbidden},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for i, test := range tests {
+		handler := adminGuard(next, test.checkHost)
+		r := httptest.NewRequest(test.method, "/flush?zone=example.", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.header {
+			r.Header.Set(AdminHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%d: wrong status for %s to %s. expected=%d actual=%d", i, test.method,
+				test.host, test.status, w.Code)
+		}
+	}
+}
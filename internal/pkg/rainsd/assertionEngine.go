@@ -7,6 +7,7 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/cache"
 	"github.com/netsec-ethz/rains/internal/pkg/keys"
 	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
 	"github.com/netsec-ethz/rains/internal/pkg/section"
 	"github.com/netsec-ethz/rains/internal/pkg/util"
 )
@@ -17,47 +18,252 @@ import (
 //rains signature on the message
 func (s *Server) assert(ss util.SectionWithSigSender) {
 	log.Debug("Adding section to cache", "section", ss)
-	if sectionsAreInconsistent(ss.Sections, s.caches.AssertionsCache, s.caches.NegAssertionCache) {
+	if zone, ok := s.zonefiles.removePending(ss.Token); ok {
+		//The verified sections of a zonefile replace the stored sections of its zone instead of
+		//being checked against them.
+		if err := s.replaceZone(zone, ss.Sections); err != nil {
+			log.Warn("Was not able to replace stored sections of zone", "zone", zone,
+				"error", err)
+		}
+		pendingKeysCallback(ss, s)
+		return
+	}
+	if zone, transfer, ok := s.zoneTransfers.remove(ss.Token, ss.Sender); ok {
+		//Transferred sections replace the stored sections of the secondary zone.
+		s.applyZoneTransfer(zone, transfer, ss.Sections)
+		pendingKeysCallback(ss, s)
+		return
+	}
+	if !s.isOwnToken(ss.Token) && !s.caches.PendingQueries.ContainsToken(ss.Token) {
+		//Pushed sections of the server's authorities replace the stored sections of their zone
+		//instead of being checked against them, such that removed names disappear.
+		ss.Sections = s.replacePushedZones(ss.Sections)
+		if len(ss.Sections) == 0 {
+			return
+		}
+	}
+	if sectionsAreInconsistent(ss.Sections, s.caches.AssertionsCache, s.caches.NegAssertionCache,
+		s.authStore) {
 		log.Warn("section is inconsistent with cached elements.", "sections", ss.Sections)
 		sendNotificationMsg(ss.Token, ss.Sender, section.NTRcvInconsistentMsg, "", s)
+		if s.config.EvictInconsistentZones {
+			for _, sec := range ss.Sections {
+				log.Info("Evicting inconsistent zone from the caches", "zone", sec.GetSubjectZone(),
+					"context", sec.GetContext())
+				s.caches.removeZone(sec.GetSubjectZone(), sec.GetContext())
+			}
+		}
 		return
 	}
-	addSectionsToCache(ss.Sections, s.config.Authorities, s.caches.AssertionsCache,
-		s.caches.NegAssertionCache, s.caches.ZoneKeyCache)
-	pendingKeysCallback(ss, s.caches.PendingKeys, s.queues.Normal)
-	pendingQueriesCallback(ss, s)
+	pending := s.caches.PendingQueries.GetAndRemove(ss.Token)
+	if noProactiveCaching(pending) {
+		log.Debug("Answer to queries with no proactive caching option is not cached",
+			"token", ss.Token)
+	} else {
+		addSectionsToCache(ss.Sections, s.Config(), s.caches.AssertionsCache,
+			s.caches.NegAssertionCache, s.caches.ZoneKeyCache, s.authStore)
+	}
+	pendingKeysCallback(ss, s)
+	pendingQueriesCallback(ss, pending, s)
+	s.pendingSignedCallback(ss.Token)
+	s.notifySecondaries(ss.Sections)
 	log.Info(fmt.Sprintf("Finished handling %T", ss.Sections), "section", ss.Sections)
 }
 
-//sectionsAreInconsistent returns true if at least one section is not consistent with cached element
-//which are valid at the same time.
-func sectionsAreInconsistent(sec []section.WithSigForward, assertionsCache cache.Assertion,
-	negAssertionCache cache.NegativeAssertion) bool {
+//sectionsAreInconsistent returns true if at least one section is not consistent with cached
+//elements or elements of the authoritative store which are valid at the same time.
+func sectionsAreInconsistent(sections []section.WithSigForward, assertionsCache cache.Assertion,
+	negAssertionCache cache.NegativeAssertion, authStore cache.AuthoritativeStore) bool {
+	for _, sec := range sections {
+		switch sec := sec.(type) {
+		case *section.Assertion:
+			if !isAssertionConsistent(sec, sec.SubjectZone, sec.Context, negAssertionCache,
+				authStore) {
+				return true
+			}
+		case *section.Shard:
+			if !isShardConsistent(sec, assertionsCache, negAssertionCache, authStore) {
+				return true
+			}
+		case *section.Pshard:
+			if !isPshardConsistent(sec, assertionsCache, authStore) {
+				return true
+			}
+		case *section.Zone:
+			if !isZoneConsistent(sec, assertionsCache, negAssertionCache, authStore) {
+				return true
+			}
+		default:
+			log.Error("Not supported message section with sig. This case must be prevented beforehand")
+		}
+	}
 	return false
 }
 
-//addSectionToCache adds sec to the cache if it comlies with the server's caching policy
-func addSectionsToCache(sections []section.WithSigForward, authorities []ZoneContext,
+//isAssertionConsistent returns false if a cached or stored shard, pshard or zone of zone and
+//context, which is valid at the same time as a, states that a's name does not have one of a's
+//object types.
+func isAssertionConsistent(a *section.Assertion, zone, context string,
+	negAssertionCache cache.NegativeAssertion, authStore cache.AuthoritativeStore) bool {
+	interval := section.StringInterval{Name: a.SubjectName}
+	secs, _ := negAssertionCache.Get(zone, context, interval)
+	stored, _ := authStore.GetNegAssertions(zone, context, interval)
+	for _, sec := range append(secs, stored...) {
+		if !validityOverlaps(a, sec) {
+			continue
+		}
+		for _, obj := range a.Content {
+			if !sectionContains(sec, a.SubjectName, obj.Type) {
+				log.Warn("Assertion is inconsistent with cached section", "assertion", a,
+					"type", obj.Type, "cachedSection", sec)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//isShardConsistent returns false if shard contains an assertion which is inconsistent with cached
+//or stored sections or if a cached or stored assertion valid at the same time is in shard's range
+//but not contained in it.
+func isShardConsistent(shard *section.Shard, assertionsCache cache.Assertion,
+	negAssertionCache cache.NegativeAssertion, authStore cache.AuthoritativeStore) bool {
+	for _, a := range shard.Content {
+		if !isAssertionConsistent(a, shard.SubjectZone, shard.Context, negAssertionCache,
+			authStore) {
+			return false
+		}
+	}
+	return cachedAssertionsContained(shard, shard.SubjectZone, shard.Context, assertionsCache,
+		authStore)
+}
+
+//isPshardConsistent returns false if a cached or stored assertion valid at the same time is in
+//pshard's range but not contained in its bloom filter.
+func isPshardConsistent(pshard *section.Pshard, assertionsCache cache.Assertion,
+	authStore cache.AuthoritativeStore) bool {
+	return cachedAssertionsContained(pshard, pshard.SubjectZone, pshard.Context, assertionsCache,
+		authStore)
+}
+
+//isZoneConsistent returns false if zone contains an assertion which is inconsistent with cached
+//or stored sections or if a cached or stored assertion of zone valid at the same time is not
+//contained in it.
+func isZoneConsistent(zone *section.Zone, assertionsCache cache.Assertion,
+	negAssertionCache cache.NegativeAssertion, authStore cache.AuthoritativeStore) bool {
+	for _, a := range zone.Content {
+		if !isAssertionConsistent(a, zone.SubjectZone, zone.Context, negAssertionCache,
+			authStore) {
+			return false
+		}
+	}
+	return cachedAssertionsContained(zone, zone.SubjectZone, zone.Context, assertionsCache,
+		authStore)
+}
+
+//cachedAssertionsContained returns true if all cached and stored assertions of zone and context
+//which are valid at the same time as sec and within its range are contained in sec. Only the
+//assertions within sec's range are looked up.
+func cachedAssertionsContained(sec section.WithSigForward, zone, context string,
+	assertionsCache cache.Assertion, authStore cache.AuthoritativeStore) bool {
+	assertions := assertionsCache.GetZone(zone, context, sec)
+	assertions = append(assertions, authStore.GetZone(zone, context, sec)...)
+	for _, a := range assertions {
+		if !validityOverlaps(a, sec) {
+			continue
+		}
+		for _, obj := range a.Content {
+			if !sectionContains(sec, a.SubjectName, obj.Type) {
+				log.Warn("Section is inconsistent with cached assertion", "section", sec,
+					"type", obj.Type, "cachedAssertion", a)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//sectionContains returns true if name is outside of sec's range or if sec contains an assertion
+//for name with an object of type t. For a pshard, true is also returned if its bloom filter cannot
+//be queried.
+func sectionContains(sec section.WithSigForward, name string, t object.Type) bool {
+	switch sec := sec.(type) {
+	case *section.Shard:
+		return !sec.InRange(name) || containsNameAndType(sec.Content, name, t)
+	case *section.Pshard:
+		if !sec.InRange(name) {
+			return true
+		}
+		contained, err := sec.BloomFilter.Contains(name, sec.SubjectZone, sec.Context, t)
+		if err != nil {
+			log.Warn("Was not able to query bloom filter", "pshard", sec, "error", err)
+			return true
+		}
+		return contained
+	case *section.Zone:
+		return containsNameAndType(sec.Content, name, t)
+	default:
+		return true
+	}
+}
+
+//containsNameAndType returns true if one of assertions is about name and contains an object of type
+//t.
+func containsNameAndType(assertions []*section.Assertion, name string, t object.Type) bool {
+	for _, a := range assertions {
+		if a.SubjectName != name {
+			continue
+		}
+		for _, obj := range a.Content {
+			if obj.Type == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//validityOverlaps returns true if s1 and s2 are valid at the same time.
+func validityOverlaps(s1, s2 section.WithSigForward) bool {
+	return s1.ValidSince() <= s2.ValidUntil() && s2.ValidSince() <= s1.ValidUntil()
+}
+
+//addSectionToCache adds sec to the cache if it comlies with the server's caching policy. Sections
+//an intermediary stores are never evicted before the end of the retention period. Sections of the
+//server's authorities are added to store instead.
+func addSectionsToCache(sections []section.WithSigForward, config Config,
 	assertionsCache cache.Assertion, negAssertionCache cache.NegativeAssertion,
-	zoneKeyCache cache.ZonePublicKey) {
+	zoneKeyCache cache.ZonePublicKey, store cache.AuthoritativeStore) {
 	for _, sec := range sections {
-		isAuth := isAuthoritative(sec, authorities)
+		if isAuthoritative(sec, config.Authorities) {
+			addSectionToStore(sec, store, zoneKeyCache)
+			continue
+		}
+		//Retained sections are stored as internal such that they are not evicted.
+		isAuth := isRetained(sec, config)
+		retainUntil := int64(0)
+		if isAuth {
+			retainUntil = retentionEnd(config)
+		}
 		switch sec := sec.(type) {
 		case *section.Assertion:
 			if shouldAssertionBeCached(sec) {
-				addAssertionToCache(sec, isAuth, assertionsCache, zoneKeyCache)
+				addAssertionToCache(sec, isAuth, retainUntil, assertionsCache, zoneKeyCache)
 			}
 		case *section.Shard:
 			if shouldShardBeCached(sec) {
-				addShardToCache(sec, isAuth, assertionsCache, negAssertionCache, zoneKeyCache)
+				addShardToCache(sec, isAuth, retainUntil, assertionsCache, negAssertionCache,
+					zoneKeyCache)
 			}
 		case *section.Pshard:
 			if shouldPshardBeCached(sec) {
-				addPshardToCache(sec, isAuth, assertionsCache, negAssertionCache, zoneKeyCache)
+				addPshardToCache(sec, isAuth, retainUntil, assertionsCache, negAssertionCache,
+					zoneKeyCache)
 			}
 		case *section.Zone:
 			if shouldZoneBeCached(sec) {
-				addZoneToCache(sec, isAuth, assertionsCache, negAssertionCache, zoneKeyCache)
+				addZoneToCache(sec, isAuth, retainUntil, assertionsCache, negAssertionCache,
+					zoneKeyCache)
 			}
 		default:
 			log.Error("Not supported message section with sig. This case must be prevented beforehand")
@@ -89,11 +295,17 @@ func shouldZoneBeCached(zone *section.Zone) bool {
 }
 
 //addAssertionToCache adds a to the assertion cache and to the public key cache in case a holds a
-//public key.
-func addAssertionToCache(a *section.Assertion, isAuthoritative bool, assertionsCache cache.Assertion,
-	zoneKeyCache cache.ZonePublicKey) {
-	assertionsCache.Add(a, a.ValidUntil(), isAuthoritative)
+//public key. A non zero retainUntil limits how long a is cached.
+func addAssertionToCache(a *section.Assertion, isAuthoritative bool, retainUntil int64,
+	assertionsCache cache.Assertion, zoneKeyCache cache.ZonePublicKey) {
+	assertionsCache.Add(a, cacheExpiration(a, retainUntil), isAuthoritative)
 	log.Info("Added assertion to cache", "assertion", *a)
+	addPublicKeysToCache(a, isAuthoritative, zoneKeyCache)
+}
+
+//addPublicKeysToCache adds the public keys of the delegations in a to the public key cache.
+func addPublicKeysToCache(a *section.Assertion, isAuthoritative bool,
+	zoneKeyCache cache.ZonePublicKey) {
 	for _, obj := range a.Content {
 		if obj.Type == object.OTDelegation {
 			publicKey, _ := obj.Value.(keys.PublicKey)
@@ -110,48 +322,66 @@ func addAssertionToCache(a *section.Assertion, isAuthoritative bool, assertionsC
 
 //addShardToCache adds shard to the negAssertion cache and all contained assertions to the
 //assertionsCache.
-func addShardToCache(shard *section.Shard, isAuthoritative bool, assertionsCache cache.Assertion,
-	negAssertionCache cache.NegativeAssertion, zoneKeyCache cache.ZonePublicKey) {
+func addShardToCache(shard *section.Shard, isAuthoritative bool, retainUntil int64,
+	assertionsCache cache.Assertion, negAssertionCache cache.NegativeAssertion,
+	zoneKeyCache cache.ZonePublicKey) {
 	for _, assertion := range shard.Content {
 		if shouldAssertionBeCached(assertion) {
 			a := assertion.Copy(shard.Context, shard.SubjectZone)
-			addAssertionToCache(a, isAuthoritative, assertionsCache, zoneKeyCache)
+			addAssertionToCache(a, isAuthoritative, retainUntil, assertionsCache, zoneKeyCache)
 		}
 	}
-	negAssertionCache.AddShard(shard, shard.ValidUntil(), isAuthoritative)
+	negAssertionCache.AddShard(shard, cacheExpiration(shard, retainUntil), isAuthoritative)
 	log.Debug("Added shard to cache", "shard", *shard)
 }
 
 //addPshardToCache adds pshard to the negAssertion cache
-func addPshardToCache(pshard *section.Pshard, isAuthoritative bool, assertionsCache cache.Assertion,
-	negAssertionCache cache.NegativeAssertion, zoneKeyCache cache.ZonePublicKey) {
-	negAssertionCache.AddPshard(pshard, pshard.ValidUntil(), isAuthoritative)
+func addPshardToCache(pshard *section.Pshard, isAuthoritative bool, retainUntil int64,
+	assertionsCache cache.Assertion, negAssertionCache cache.NegativeAssertion,
+	zoneKeyCache cache.ZonePublicKey) {
+	negAssertionCache.AddPshard(pshard, cacheExpiration(pshard, retainUntil), isAuthoritative)
 	log.Debug("Added pshard to cache", "pshard", *pshard)
 }
 
 //addZoneToCache adds zone and all contained shards to the negAssertion cache and all contained
 //assertions to the assertionCache.
-func addZoneToCache(zone *section.Zone, isAuthoritative bool, assertionsCache cache.Assertion,
-	negAssertionCache cache.NegativeAssertion, zoneKeyCache cache.ZonePublicKey) {
+func addZoneToCache(zone *section.Zone, isAuthoritative bool, retainUntil int64,
+	assertionsCache cache.Assertion, negAssertionCache cache.NegativeAssertion,
+	zoneKeyCache cache.ZonePublicKey) {
 	for _, assertion := range zone.Content {
 		if shouldAssertionBeCached(assertion) {
 			a := assertion.Copy(zone.Context, zone.SubjectZone)
-			addAssertionToCache(a, isAuthoritative, assertionsCache, zoneKeyCache)
+			addAssertionToCache(a, isAuthoritative, retainUntil, assertionsCache, zoneKeyCache)
 		}
 	}
-	negAssertionCache.AddZone(zone, zone.ValidUntil(), isAuthoritative)
+	negAssertionCache.AddZone(zone, cacheExpiration(zone, retainUntil), isAuthoritative)
 	log.Debug("Added zone to cache", "zone", *zone)
 }
 
-func pendingKeysCallback(mss util.SectionWithSigSender, pendingKeys cache.PendingKey,
-	normalChannel chan util.MsgSectionSender) {
-	if ss, ok := pendingKeys.GetAndRemove(mss.Token); ok {
-		normalChannel <- ss
+func pendingKeysCallback(mss util.SectionWithSigSender, s *Server) {
+	if ss, sent, ok := s.caches.PendingKeys.GetAndRemove(mss.Token); ok {
+		s.retryMissingKeys(ss, sent)
+	}
+}
+
+//noProactiveCaching returns true if msss is not empty and all queries in it contain the
+//QONoProactiveCaching option. The answer to such queries is only sent to the querier and not
+//cached for future queries.
+func noProactiveCaching(msss []util.MsgSectionSender) bool {
+	for _, ss := range msss {
+		for _, sec := range ss.Sections {
+			if q, ok := sec.(*query.Name); !ok || !q.ContainsOption(query.QONoProactiveCaching) {
+				return false
+			}
+		}
 	}
+	return len(msss) > 0
 }
 
-func pendingQueriesCallback(mss util.SectionWithSigSender, s *Server) {
-	msss := s.caches.PendingQueries.GetAndRemove(mss.Token)
+//pendingQueriesCallback sends the sections of mss to the senders of the pending queries msss
+//which mss answers.
+func pendingQueriesCallback(mss util.SectionWithSigSender, msss []util.MsgSectionSender,
+	s *Server) {
 	if len(msss) == 0 {
 		return
 	}
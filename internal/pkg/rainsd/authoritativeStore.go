@@ -0,0 +1,96 @@
+package rainsd
+
+import (
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+//assertionGetter returns the assertions of fqdn in context containing an object of objType.
+type assertionGetter func(fqdn, context string, objType object.Type) ([]*section.Assertion, bool)
+
+//cachedAssertions returns an assertionGetter looking up assertions with exactly the given name in
+//assertionsCache.
+func cachedAssertions(assertionsCache cache.Assertion) assertionGetter {
+	return func(fqdn, context string, objType object.Type) ([]*section.Assertion, bool) {
+		return assertionsCache.Get(fqdn, context, objType, true)
+	}
+}
+
+//newAuthoritativeStore returns the on-disk authoritative store at config's AuthoritativeStorePath
+//or an in-memory store if no path is configured.
+func newAuthoritativeStore(config Config) (cache.AuthoritativeStore, error) {
+	if config.AuthoritativeStorePath == "" {
+		return cache.NewAuthoritativeMemory(), nil
+	}
+	store, err := cache.NewAuthoritativeFile(config.AuthoritativeStorePath)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Opened authoritative store", "path", config.AuthoritativeStorePath,
+		"sections", store.Len())
+	return store, nil
+}
+
+//addSectionToStore adds sec to store. The assertions contained in a shard or zone are added
+//individually. The public keys of delegations are also added to the public key cache.
+func addSectionToStore(sec section.WithSigForward, store cache.AuthoritativeStore,
+	zoneKeyCache cache.ZonePublicKey) {
+	var err error
+	switch sec := sec.(type) {
+	case *section.Assertion:
+		if shouldAssertionBeCached(sec) {
+			err = addAssertionToStore(sec, store, zoneKeyCache)
+		}
+	case *section.Shard:
+		for _, a := range sec.Content {
+			if err == nil && shouldAssertionBeCached(a) {
+				err = addAssertionToStore(a.Copy(sec.Context, sec.SubjectZone), store,
+					zoneKeyCache)
+			}
+		}
+		if err == nil {
+			err = store.AddNegAssertion(sec)
+		}
+	case *section.Pshard:
+		err = store.AddNegAssertion(sec)
+	case *section.Zone:
+		for _, a := range sec.Content {
+			if err == nil && shouldAssertionBeCached(a) {
+				err = addAssertionToStore(a.Copy(sec.Context, sec.SubjectZone), store,
+					zoneKeyCache)
+			}
+		}
+		if err == nil {
+			err = store.AddNegAssertion(sec)
+		}
+	default:
+		log.Error("Not supported message section with sig. This case must be prevented beforehand")
+		return
+	}
+	if err != nil {
+		log.Error("Was not able to add section to the authoritative store", "section", sec,
+			"error", err)
+		return
+	}
+	log.Debug("Added section to authoritative store", "section", sec)
+}
+
+func addAssertionToStore(a *section.Assertion, store cache.AuthoritativeStore,
+	zoneKeyCache cache.ZonePublicKey) error {
+	if err := store.AddAssertion(a); err != nil {
+		return err
+	}
+	addPublicKeysToCache(a, true, zoneKeyCache)
+	return nil
+}
+
+//removeExpiredAuthoritative deletes the expired sections from the authoritative store.
+func (s *Server) removeExpiredAuthoritative() {
+	if err := s.authStore.RemoveExpiredValues(); err != nil {
+		log.Warn("Was not able to remove expired sections from the authoritative store",
+			"error", err)
+	}
+}
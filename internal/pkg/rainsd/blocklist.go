@@ -0,0 +1,308 @@
+package rainsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+//BlocklistEntries lists the peers and zones from which a server does not accept messages. It is
+//the format of a blocklist file.
+type BlocklistEntries struct {
+	Peers []BlockedPeer
+	Zones []BlockedZone
+}
+
+//BlockedPeer is a blocked IP prefix.
+type BlockedPeer struct {
+	//Prefix is in CIDR notation. A single IP address blocks only this address.
+	Prefix string
+	//Expiration is the unix time in seconds after which the entry is no longer in effect. Zero
+	//means the entry never expires.
+	Expiration int64
+}
+
+//BlockedZone is a blocked zone in a context.
+type BlockedZone struct {
+	Zone string
+	//Context is the context in which Zone is blocked. An empty context blocks Zone in all contexts.
+	Context string
+	//Expiration is the unix time in seconds after which the entry is no longer in effect. Zero
+	//means the entry never expires.
+	Expiration int64
+}
+
+//blocklist stores the blocked peers and zones of a server. It is safe for concurrent use.
+type blocklist struct {
+	mutex sync.RWMutex
+	//peers maps an IP prefix in CIDR notation to the blocked network and its expiration.
+	peers map[string]blockedNet
+	//zones maps a zone and context to the expiration of the block.
+	zones map[ZoneContext]int64
+}
+
+type blockedNet struct {
+	ipNet      *net.IPNet
+	expiration int64
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{
+		peers: make(map[string]blockedNet),
+		zones: make(map[ZoneContext]int64),
+	}
+}
+
+//loadBlocklist reads a json encoded BlocklistEntries from the file at path.
+func loadBlocklist(path string) (BlocklistEntries, error) {
+	entries := BlocklistEntries{}
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return BlocklistEntries{}, err
+	}
+	if err = json.Unmarshal(file, &entries); err != nil {
+		return BlocklistEntries{}, err
+	}
+	return entries, nil
+}
+
+//parsePrefix returns the network described by prefix, which is either in CIDR notation or a single
+//IP address.
+func parsePrefix(prefix string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(prefix); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP prefix: %s", prefix)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+//replace substitutes the content of the blocklist with entries. The blocklist is left unchanged if
+//an entry is malformed.
+func (b *blocklist) replace(entries BlocklistEntries) error {
+	peers := make(map[string]blockedNet)
+	for _, p := range entries.Peers {
+		ipNet, err := parsePrefix(p.Prefix)
+		if err != nil {
+			return err
+		}
+		peers[ipNet.String()] = blockedNet{ipNet: ipNet, expiration: p.Expiration}
+	}
+	zones := make(map[ZoneContext]int64)
+	for _, z := range entries.Zones {
+		zones[ZoneContext{Zone: z.Zone, Context: z.Context}] = z.Expiration
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.peers = peers
+	b.zones = zones
+	return nil
+}
+
+//addPeer blocks all addresses in prefix until expiration.
+func (b *blocklist) addPeer(prefix string, expiration int64) error {
+	ipNet, err := parsePrefix(prefix)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.removeExpired()
+	b.peers[ipNet.String()] = blockedNet{ipNet: ipNet, expiration: expiration}
+	return nil
+}
+
+//removePeer unblocks prefix. It returns false if prefix was not blocked.
+func (b *blocklist) removePeer(prefix string) (bool, error) {
+	ipNet, err := parsePrefix(prefix)
+	if err != nil {
+		return false, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.removeExpired()
+	_, ok := b.peers[ipNet.String()]
+	delete(b.peers, ipNet.String())
+	return ok, nil
+}
+
+//addZone blocks zone in context until expiration.
+func (b *blocklist) addZone(zone, context string, expiration int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.removeExpired()
+	b.zones[ZoneContext{Zone: zone, Context: context}] = expiration
+}
+
+//removeZone unblocks zone in context. It returns false if zone was not blocked in context.
+func (b *blocklist) removeZone(zone, context string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.removeExpired()
+	key := ZoneContext{Zone: zone, Context: context}
+	_, ok := b.zones[key]
+	delete(b.zones, key)
+	return ok
+}
+
+//removeExpired deletes all expired entries. The caller must hold the write lock.
+func (b *blocklist) removeExpired() {
+	now := time.Now().Unix()
+	for k, v := range b.peers {
+		if isExpired(v.expiration, now) {
+			delete(b.peers, k)
+		}
+	}
+	for k, v := range b.zones {
+		if isExpired(v, now) {
+			delete(b.zones, k)
+		}
+	}
+}
+
+//containsPeer returns true if the IP address of addr is blocked. Addresses without an IP are never
+//blocked.
+func (b *blocklist) containsPeer(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	now := time.Now().Unix()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, p := range b.peers {
+		if !isExpired(p.expiration, now) && p.ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//containsZone returns true if zone is blocked in context.
+func (b *blocklist) containsZone(zone, context string) bool {
+	now := time.Now().Unix()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if exp, ok := b.zones[ZoneContext{Zone: zone, Context: context}]; ok && !isExpired(exp, now) {
+		return true
+	}
+	exp, ok := b.zones[ZoneContext{Zone: zone}]
+	return ok && !isExpired(exp, now)
+}
+
+//entries returns all blocklist entries which have not yet expired.
+func (b *blocklist) entries() BlocklistEntries {
+	now := time.Now().Unix()
+	result := BlocklistEntries{Peers: []BlockedPeer{}, Zones: []BlockedZone{}}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for k, v := range b.peers {
+		if !isExpired(v.expiration, now) {
+			result.Peers = append(result.Peers, BlockedPeer{Prefix: k, Expiration: v.expiration})
+		}
+	}
+	for k, v := range b.zones {
+		if !isExpired(v, now) {
+			result.Zones = append(result.Zones,
+				BlockedZone{Zone: k.Zone, Context: k.Context, Expiration: v})
+		}
+	}
+	return result
+}
+
+func isExpired(expiration, now int64) bool {
+	return expiration != 0 && expiration < now
+}
+
+//addrIP returns the IP address of addr or nil if addr has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case packetAddr:
+		return addrIP(a.Addr)
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *snet.UDPAddr:
+		if a.Host != nil {
+			return a.Host.IP
+		}
+	}
+	return nil
+}
+
+//BlockPeer blocks all peers with an IP address in prefix until expiration. A zero expiration blocks
+//the peers permanently. Messages from blocked peers are dropped.
+func (s *Server) BlockPeer(prefix string, expiration time.Time) error {
+	if err := s.blocklist.addPeer(prefix, unixOrZero(expiration)); err != nil {
+		return err
+	}
+	log.Info("Blocked peers", "prefix", prefix, "expiration", expiration)
+	return nil
+}
+
+//UnblockPeer removes prefix from the blocklist. It returns false if prefix was not blocked.
+func (s *Server) UnblockPeer(prefix string) (bool, error) {
+	return s.blocklist.removePeer(prefix)
+}
+
+//BlockZone blocks zone in context until expiration. An empty context blocks zone in all contexts
+//and a zero expiration blocks zone permanently. All cached assertions, shards, pshards and zones of
+//zone are removed.
+func (s *Server) BlockZone(zone, context string, expiration time.Time) {
+	s.blocklist.addZone(zone, context, unixOrZero(expiration))
+	s.caches.removeZone(zone, context)
+	log.Info("Blocked zone", "zone", zone, "context", context, "expiration", expiration)
+}
+
+//UnblockZone removes zone in context from the blocklist. It returns false if zone was not blocked
+//in context.
+func (s *Server) UnblockZone(zone, context string) bool {
+	return s.blocklist.removeZone(zone, context)
+}
+
+//Blocklist returns all blocklist entries of the server which have not yet expired.
+func (s *Server) Blocklist() BlocklistEntries {
+	return s.blocklist.entries()
+}
+
+//LoadBlocklist replaces the server's blocklist with the content of the file at path and removes
+//all cached sections of blocked zones.
+func (s *Server) LoadBlocklist(path string) error {
+	entries, err := loadBlocklist(path)
+	if err != nil {
+		return err
+	}
+	if err := s.blocklist.replace(entries); err != nil {
+		return err
+	}
+	s.purgeBlockedZones()
+	log.Info("Loaded blocklist", "path", path, "peers", len(entries.Peers),
+		"zones", len(entries.Zones))
+	return nil
+}
+
+//purgeBlockedZones removes all cached sections of blocked zones.
+func (s *Server) purgeBlockedZones() {
+	for _, z := range s.blocklist.entries().Zones {
+		s.caches.removeZone(z.Zone, z.Context)
+	}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,179 @@
+package rainsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+func TestParsePrefix(t *testing.T) {
+	var tests = []struct {
+		prefix string
+		ipNet  string
+		valid  bool
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24", true},
+		{"192.0.2.7/24", "192.0.2.0/24", true},
+		{"192.0.2.7", "192.0.2.7/32", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"192.0.2.0/33", "", false},
+		{"example.com", "", false},
+		{"", "", false},
+	}
+	for i, test := range tests {
+		ipNet, err := parsePrefix(test.prefix)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: wrong result for %s. expected valid=%t actual error=%v", i, test.prefix,
+				test.valid, err)
+			continue
+		}
+		if err == nil && ipNet.String() != test.ipNet {
+			t.Errorf("%d: wrong network. expected=%s actual=%s", i, test.ipNet, ipNet.String())
+		}
+	}
+}
+
+func TestBlocklistContainsPeer(t *testing.T) {
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Minute).Unix()
+	b := newBlocklist()
+	b.addPeer("192.0.2.0/24", 0)
+	b.addPeer("198.51.100.1", future)
+	b.addPeer("203.0.113.0/24", past)
+	b.addPeer("2001:db8::/32", 0)
+	var tests = []struct {
+		addr    net.Addr
+		blocked bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.17"), Port: 5022}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.17"), Port: 5022}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.3.1"), Port: 5022}, false},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5022}, true},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 5022}, false},
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5022}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5022}, true},
+		{&net.UnixAddr{Name: "/run/rainsd.sock", Net: "unix"}, false},
+	}
+	for i, test := range tests {
+		if blocked := b.containsPeer(test.addr); blocked != test.blocked {
+			t.Errorf("%d: wrong result for %v. expected=%t actual=%t", i, test.addr,
+				test.blocked, blocked)
+		}
+	}
+	if ok, _ := b.removePeer("192.0.2.0/24"); !ok {
+		t.Error("blocked prefix was not removed")
+	}
+	if b.containsPeer(tests[0].addr) {
+		t.Error("removed prefix is still blocked")
+	}
+	if len(b.entries().Peers) != 2 {
+		t.Errorf("wrong number of entries. expected=2 actual=%d", len(b.entries().Peers))
+	}
+}
+
+func TestBlocklistContainsZone(t *testing.T) {
+	past := time.Now().Add(-time.Minute).Unix()
+	b := newBlocklist()
+	b.addZone("example.", ".", 0)
+	b.addZone("example.org.", "", 0)
+	b.addZone("example.net.", ".", past)
+	var tests = []struct {
+		zone    string
+		context string
+		blocked bool
+	}{
+		{"example.", ".", true},
+		{"example.", "other", false},
+		{"example.org.", ".", true},
+		{"example.org.", "other", true},
+		{"example.net.", ".", false},
+		{"www.example.", ".", false},
+	}
+	for i, test := range tests {
+		if blocked := b.containsZone(test.zone, test.context); blocked != test.blocked {
+			t.Errorf("%d: wrong result for %s in %s. expected=%t actual=%t", i, test.zone,
+				test.context, test.blocked, blocked)
+		}
+	}
+}
+
+func TestBlocklistReplace(t *testing.T) {
+	var tests = []struct {
+		entries BlocklistEntries
+		valid   bool
+		peers   int
+		zones   int
+	}{
+		{BlocklistEntries{Peers: []BlockedPeer{{Prefix: "192.0.2.0/24"}},
+			Zones: []BlockedZone{{Zone: "example.", Context: "."}}}, true, 1, 1},
+		{BlocklistEntries{}, true, 0, 0},
+		{BlocklistEntries{Peers: []BlockedPeer{{Prefix: "192.0.2.0/24"}, {Prefix: "invalid"}},
+			Zones: []BlockedZone{{Zone: "example.org."}}}, false, 1, 1},
+	}
+	for i, test := range tests {
+		b := newBlocklist()
+		b.addPeer("198.51.100.0/24", 0)
+		b.addZone("example.net.", ".", 0)
+		if err := b.replace(test.entries); (err == nil) != test.valid {
+			t.Errorf("%d: wrong result. expected valid=%t actual error=%v", i, test.valid, err)
+		}
+		entries := b.entries()
+		if len(entries.Peers) != test.peers || len(entries.Zones) != test.zones {
+			t.Errorf("%d: wrong number of entries. expected=(%d,%d) actual=(%d,%d)", i,
+				test.peers, test.zones, len(entries.Peers), len(entries.Zones))
+		}
+		if !test.valid && !b.containsZone("example.net.", ".") {
+			t.Errorf("%d: blocklist changed although an entry is malformed", i)
+		}
+	}
+}
+
+func TestBlockZone(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	var tests = []struct {
+		context string
+		cached  []bool
+	}{
+		{".", []bool{false, true, true}},
+		{"other", []bool{true, false, true}},
+		{"", []bool{false, false, true}},
+	}
+	for i, test := range tests {
+		s := newTestServer(DefaultConfig())
+		assertions := []*section.Assertion{
+			testAssertion("www", "example.", "."),
+			testAssertion("www", "example.", "other"),
+			testAssertion("www", "example.org.", "."),
+		}
+		for _, a := range assertions {
+			s.caches.AssertionsCache.Add(a, a.ValidUntil(), false)
+		}
+		s.BlockZone("example.", test.context, time.Time{})
+		for j, a := range assertions {
+			_, ok := s.caches.AssertionsCache.Get(a.FQDN(), a.Context, object.OTIP4Addr, true)
+			if ok != test.cached[j] {
+				t.Errorf("%d.%d: wrong cache content for %s in %s. expected=%t actual=%t", i, j,
+					a.FQDN(), a.Context, test.cached[j], ok)
+			}
+		}
+	}
+}
+
+//testAssertion returns an assertion of an IPv4 address for name in zone and context which is valid
+//for an hour.
+func testAssertion(name, zone, context string) *section.Assertion {
+	a := &section.Assertion{
+		SubjectName: name,
+		SubjectZone: zone,
+		Context:     context,
+		Content:     []object.Object{{Type: object.OTIP4Addr, Value: "192.0.2.1"}},
+	}
+	a.UpdateValidity(time.Now().Unix(), time.Now().Add(time.Hour).Unix(), 24*time.Hour)
+	return a
+}
@@ -1,6 +1,9 @@
 package rainsd
 
 import (
+	"context"
+	"sync"
+
 	"github.com/netsec-ethz/rains/internal/pkg/cache"
 )
 
@@ -44,10 +47,22 @@ func initCaches(config Config) *Caches {
 	return caches
 }
 
-func initReapers(config Config, caches *Caches, stop chan bool) {
-	go repeatFuncCaller(caches.ZoneKeyCache.RemoveExpiredKeys, config.ReapZoneKeyCacheInterval, stop)
-	go repeatFuncCaller(caches.PendingKeys.RemoveExpiredValues, config.ReapPendingKeyCacheInterval, stop)
-	go repeatFuncCaller(caches.AssertionsCache.RemoveExpiredValues, config.ReapAssertionCacheInterval, stop)
-	go repeatFuncCaller(caches.NegAssertionCache.RemoveExpiredValues, config.ReapNegAssertionCacheInterval, stop)
-	go repeatFuncCaller(caches.PendingQueries.RemoveExpiredValues, config.ReapPendingQCacheInterval, stop)
+//removeZone deletes all cached assertions, shards, pshards and zones of zone in context. An empty
+//context deletes them in all contexts.
+func (c *Caches) removeZone(zone, context string) {
+	if context == "" {
+		c.AssertionsCache.RemoveZone(zone)
+		c.NegAssertionCache.RemoveZone(zone)
+		return
+	}
+	c.AssertionsCache.RemoveZoneContext(zone, context)
+	c.NegAssertionCache.RemoveZoneContext(zone, context)
+}
+
+func initReapers(ctx context.Context, wg *sync.WaitGroup, config Config, caches *Caches) {
+	wg.Add(4)
+	go repeatFuncCaller(ctx, wg, caches.ZoneKeyCache.RemoveExpiredKeys, config.ReapZoneKeyCacheInterval)
+	go repeatFuncCaller(ctx, wg, caches.AssertionsCache.RemoveExpiredValues, config.ReapAssertionCacheInterval)
+	go repeatFuncCaller(ctx, wg, caches.NegAssertionCache.RemoveExpiredValues, config.ReapNegAssertionCacheInterval)
+	go repeatFuncCaller(ctx, wg, caches.PendingQueries.RemoveExpiredValues, config.ReapPendingQCacheInterval)
 }
@@ -0,0 +1,235 @@
+package rainsd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	cbor "github.com/britram/borat"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+const (
+	aCheckPointFileName = "assertionCheckPoint.cbor"
+	nCheckPointFileName = "negAssertionCheckPoint.cbor"
+	zCheckPointFileName = "zoneKeyCheckPoint.cbor"
+
+	//checkpointVersion is the version of the checkpoint format. Checkpoints of other versions are
+	//not loaded.
+	checkpointVersion = 1
+)
+
+//Section types of checkpoint entries. They are the same as in the content of a message.
+const (
+	cpAssertion = 1
+	cpShard     = 2
+	cpPshard    = 3
+	cpZone      = 4
+)
+
+//checkpoint writes the entries returned by entries to the checkpoint file at path.
+func checkpoint(path string, entries func() []cache.CheckpointEntry) {
+	if err := writeCheckpoint(path, entries()); err != nil {
+		log.Error("Was not able to checkpoint cache", "path", path, "error", err)
+	}
+}
+
+//writeCheckpoint stores entries cbor encoded at path. The checkpoint is first written to a
+//temporary file which then replaces the file at path such that a crash never leaves a partially
+//written checkpoint behind. Each entry is encoded as an array containing the section's type, the
+//section, its validity, its cache expiration and its internal flag.
+func writeCheckpoint(path string, entries []cache.CheckpointEntry) error {
+	encoded := [][]interface{}{}
+	for _, e := range entries {
+		t, err := checkpointType(e.Section)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, []interface{}{t, e.Section, e.Section.ValidSince(),
+			e.Section.ValidUntil(), e.Expiration, e.Internal})
+	}
+	dir, file := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, file+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	err = cbor.NewCBORWriter(writer).WriteIntMap(map[int]interface{}{
+		0: checkpointVersion,
+		1: encoded,
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func checkpointType(sec section.WithSigForward) (int, error) {
+	switch sec.(type) {
+	case *section.Assertion:
+		return cpAssertion, nil
+	case *section.Shard:
+		return cpShard, nil
+	case *section.Pshard:
+		return cpPshard, nil
+	case *section.Zone:
+		return cpZone, nil
+	default:
+		return 0, fmt.Errorf("unknown section type: %T", sec)
+	}
+}
+
+//readCheckpoint returns the entries of the checkpoint file at path which have not yet expired.
+func readCheckpoint(path string) ([]cache.CheckpointEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := cbor.NewCBORReader(bufio.NewReader(file)).ReadIntMapUntagged()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	if version, ok := m[0].(int); !ok || version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version: %v", m[0])
+	}
+	encoded, ok := m[1].([]interface{})
+	if !ok {
+		return nil, errors.New("cbor checkpoint encoding of the entries should be an array")
+	}
+	now := time.Now().Unix()
+	entries := []cache.CheckpointEntry{}
+	for _, e := range encoded {
+		entry, err := decodeCheckpointEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Expiration > now {
+			entries = append(entries, entry)
+		}
+	}
+	if dropped := len(encoded) - len(entries); dropped > 0 {
+		log.Info("Dropped expired checkpoint entries", "path", path, "count", dropped)
+	}
+	return entries, nil
+}
+
+func decodeCheckpointEntry(e interface{}) (cache.CheckpointEntry, error) {
+	fields, ok := e.([]interface{})
+	if !ok || len(fields) != 6 {
+		return cache.CheckpointEntry{}, errors.New("cbor checkpoint entry should be an array of " +
+			"length 6")
+	}
+	val, ok := fields[1].(map[int]interface{})
+	if !ok {
+		return cache.CheckpointEntry{}, errors.New("cbor checkpoint encoding of a section should " +
+			"be a map")
+	}
+	var sec interface {
+		section.WithSigForward
+		UnmarshalMap(map[int]interface{}) error
+	}
+	switch fields[0] {
+	case cpAssertion:
+		sec = &section.Assertion{}
+	case cpShard:
+		sec = &section.Shard{}
+	case cpPshard:
+		sec = &section.Pshard{}
+	case cpZone:
+		sec = &section.Zone{}
+	default:
+		return cache.CheckpointEntry{}, fmt.Errorf("unknown checkpoint section type: %v",
+			fields[0])
+	}
+	if err := sec.UnmarshalMap(val); err != nil {
+		return cache.CheckpointEntry{}, err
+	}
+	validSince, ok1 := fields[2].(int)
+	validUntil, ok2 := fields[3].(int)
+	expiration, ok3 := fields[4].(int)
+	internal, ok4 := fields[5].(bool)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return cache.CheckpointEntry{}, errors.New("malformed cbor checkpoint entry")
+	}
+	sec.SetValidSince(int64(validSince))
+	sec.SetValidUntil(int64(validUntil))
+	return cache.CheckpointEntry{Section: sec, Expiration: int64(expiration), Internal: internal},
+		nil
+}
+
+//loadCaches adds the non expired entries of the checkpoint files in cpPath to the caches.
+func loadCaches(cpPath string, caches *Caches) {
+	//load assertion check point
+	entries, err := readCheckpoint(filepath.Join(cpPath, aCheckPointFileName))
+	if err != nil {
+		log.Warn("Was not able to load assertion check point from file", "error", err)
+	}
+	for _, e := range entries {
+		if a, ok := e.Section.(*section.Assertion); ok {
+			caches.AssertionsCache.Add(a, e.Expiration, e.Internal)
+		} else {
+			log.Warn("Invalid type for assertion cache", "type", fmt.Sprintf("%T", e.Section))
+		}
+	}
+
+	//load negAssertion check point
+	entries, err = readCheckpoint(filepath.Join(cpPath, nCheckPointFileName))
+	if err != nil {
+		log.Warn("Was not able to load negAssertion check point from file", "error", err)
+	}
+	for _, e := range entries {
+		switch s := e.Section.(type) {
+		case *section.Shard:
+			caches.NegAssertionCache.AddShard(s, e.Expiration, e.Internal)
+		case *section.Pshard:
+			caches.NegAssertionCache.AddPshard(s, e.Expiration, e.Internal)
+		case *section.Zone:
+			caches.NegAssertionCache.AddZone(s, e.Expiration, e.Internal)
+		default:
+			log.Warn("Invalid type for negative Assertion cache", "type", fmt.Sprintf("%T", s))
+		}
+	}
+
+	//load zone key check point
+	entries, err = readCheckpoint(filepath.Join(cpPath, zCheckPointFileName))
+	if err != nil {
+		log.Warn("Was not able to load zone key check point from file", "error", err)
+	}
+	for _, e := range entries {
+		a, ok := e.Section.(*section.Assertion)
+		if !ok {
+			log.Warn("Invalid type for zone key cache", "type", fmt.Sprintf("%T", e.Section))
+			continue
+		}
+		for _, o := range a.Content {
+			if o.Type == object.OTDelegation {
+				publicKey := o.Value.(keys.PublicKey)
+				publicKey.ValidSince = a.ValidSince()
+				publicKey.ValidUntil = e.Expiration
+				caches.ZoneKeyCache.Add(a, publicKey, e.Internal)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package rainsd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cbor "github.com/britram/borat"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+)
+
+//testCheckpointEntries returns an entry of each section type which can be checkpointed. The entry
+//at index expired has expired.
+func testCheckpointEntries() (entries []cache.CheckpointEntry, expired int) {
+	sig := section.Signature()
+	sig.Data = []byte("signature")
+	now := time.Now()
+	a := &section.Assertion{SubjectName: "www", SubjectZone: "example.", Context: ".",
+		Content:    []object.Object{{Type: object.OTIP4Addr, Value: net.ParseIP("192.0.2.1")}},
+		Signatures: []signature.Sig{sig}}
+	a.UpdateValidity(now.Unix(), now.Add(time.Hour).Unix(), 24*time.Hour)
+	old := &section.Assertion{SubjectName: "old", SubjectZone: "example.", Context: ".",
+		Content:    []object.Object{{Type: object.OTIP4Addr, Value: net.ParseIP("192.0.2.2")}},
+		Signatures: []signature.Sig{sig}}
+	old.UpdateValidity(now.Add(-time.Hour).Unix(), now.Add(-time.Minute).Unix(), 24*time.Hour)
+	shard := &section.Shard{SubjectZone: "example.", Context: ".", RangeFrom: "a", RangeTo: "m",
+		Signatures: []signature.Sig{sig}}
+	shard.UpdateValidity(now.Unix(), now.Add(2*time.Hour).Unix(), 24*time.Hour)
+	zone := &section.Zone{SubjectZone: "example.", Context: ".",
+		Signatures: []signature.Sig{sig}}
+	zone.UpdateValidity(now.Unix(), now.Add(3*time.Hour).Unix(), 24*time.Hour)
+	return []cache.CheckpointEntry{
+		{Section: a, Expiration: a.ValidUntil(), Internal: true},
+		{Section: old, Expiration: old.ValidUntil()},
+		{Section: shard, Expiration: now.Add(time.Hour).Unix()},
+		{Section: zone, Expiration: zone.ValidUntil(), Internal: true},
+	}, 1
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, aCheckPointFileName)
+	entries, expired := testCheckpointEntries()
+	if err := writeCheckpoint(path, entries); err != nil {
+		t.Fatalf("Was not able to write checkpoint: %v", err)
+	}
+	read, err := readCheckpoint(path)
+	if err != nil {
+		t.Fatalf("Was not able to read checkpoint: %v", err)
+	}
+	expected := append(append([]cache.CheckpointEntry{}, entries[:expired]...),
+		entries[expired+1:]...)
+	if len(read) != len(expected) {
+		t.Fatalf("wrong number of entries. expected=%d actual=%d", len(expected), len(read))
+	}
+	for i, e := range expected {
+		r := read[i]
+		if r.Section.Hash() != e.Section.Hash() {
+			t.Errorf("%d: wrong section. expected=%v actual=%v", i, e.Section, r.Section)
+		}
+		if r.Section.ValidSince() != e.Section.ValidSince() ||
+			r.Section.ValidUntil() != e.Section.ValidUntil() {
+			t.Errorf("%d: wrong validity. expected=(%d,%d) actual=(%d,%d)", i,
+				e.Section.ValidSince(), e.Section.ValidUntil(), r.Section.ValidSince(),
+				r.Section.ValidUntil())
+		}
+		if r.Expiration != e.Expiration || r.Internal != e.Internal {
+			t.Errorf("%d: wrong cache metadata. expected=(%d,%t) actual=(%d,%t)", i,
+				e.Expiration, e.Internal, r.Expiration, r.Internal)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary checkpoint file was not removed. files=%d", len(files))
+	}
+}
+
+func TestReadCheckpointErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var tests = []struct {
+		content map[int]interface{}
+	}{
+		{nil},
+		{map[int]interface{}{0: checkpointVersion + 1, 1: []interface{}{}}},
+		{map[int]interface{}{0: checkpointVersion, 1: "entries"}},
+		{map[int]interface{}{0: checkpointVersion, 1: []interface{}{[]interface{}{cpAssertion}}}},
+		{map[int]interface{}{0: checkpointVersion, 1: []interface{}{[]interface{}{
+			42, map[int]interface{}{}, 0, 0, 0, false}}}},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "checkpoint.cbor")
+		os.Remove(path)
+		if test.content != nil {
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cbor.NewCBORWriter(file).WriteIntMap(test.content); err != nil {
+				t.Fatalf("%d: was not able to write checkpoint: %v", i, err)
+			}
+			file.Close()
+		}
+		if _, err := readCheckpoint(path); err == nil {
+			t.Errorf("%d: invalid checkpoint was read", i)
+		}
+	}
+}
+
+func TestLoadCaches(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entries, _ := testCheckpointEntries()
+	if err := writeCheckpoint(filepath.Join(dir, aCheckPointFileName), entries[:2]); err != nil {
+		t.Fatalf("Was not able to write checkpoint: %v", err)
+	}
+	if err := writeCheckpoint(filepath.Join(dir, nCheckPointFileName), entries[2:]); err != nil {
+		t.Fatalf("Was not able to write checkpoint: %v", err)
+	}
+	caches := initCaches(DefaultConfig())
+	loadCaches(dir, caches)
+	var tests = []struct {
+		name   string
+		cached bool
+	}{
+		{"www.example.", true},
+		{"old.example.", false},
+	}
+	for i, test := range tests {
+		_, ok := caches.AssertionsCache.Get(test.name, ".", object.OTIP4Addr, true)
+		if ok != test.cached {
+			t.Errorf("%d: wrong cache content for %s. expected=%t actual=%t", i, test.name,
+				test.cached, ok)
+		}
+	}
+	if caches.NegAssertionCache.Len() != 2 {
+		t.Errorf("wrong number of negative assertions. expected=2 actual=%d",
+			caches.NegAssertionCache.Len())
+	}
+}
@@ -0,0 +1,451 @@
+package rainsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+const (
+	//unixSocketPrefix marks an event log path as a unix socket.
+	unixSocketPrefix = "unix://"
+	//maxPendingEvents is the maximum number of received queries of which the event log keeps
+	//track to compute the latency of their answers.
+	maxPendingEvents = 10000
+	//maxPendingEventAge is the time after which a query without answer is no longer tracked.
+	maxPendingEventAge = time.Minute
+	//eventWriteTimeout is the maximum time a write to the event log's socket may take.
+	eventWriteTimeout = 100 * time.Millisecond
+	//eventRedialInterval is the minimum time between two attempts to connect to the socket.
+	eventRedialInterval = time.Second
+	//eventQueueSize is the number of events which wait to be written. Further events are dropped.
+	eventQueueSize = 1000
+)
+
+//Types of events.
+const (
+	EventQuery               = "query"
+	EventAnswer              = "answer"
+	EventNotification        = "notification"
+	EventVerificationFailure = "verificationFailure"
+)
+
+//Sources of answers.
+const (
+	SourceCache         = "cache"
+	SourceForwarded     = "forwarded"
+	SourceAuthoritative = "authoritative"
+)
+
+//Event is a record of the event log. Each event is written as a json object on a separate line.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Token string    `json:"token"`
+	Peer  string    `json:"peer,omitempty"`
+	//LatencyMicros is the time between the receipt of a query and its answer in microseconds.
+	LatencyMicros int64 `json:"latencyMicros,omitempty"`
+	//Source states whether an answer was cached, forwarded or authoritative.
+	Source   string           `json:"source,omitempty"`
+	Queries  []QuerySummary   `json:"queries,omitempty"`
+	Sections []SectionSummary `json:"sections,omitempty"`
+	//Reason describes why a verification failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+//QuerySummary summarizes a query.
+type QuerySummary struct {
+	Name    string   `json:"name"`
+	Context string   `json:"context"`
+	Types   []string `json:"types,omitempty"`
+}
+
+//SectionSummary summarizes a section.
+type SectionSummary struct {
+	Type      string   `json:"type"`
+	Name      string   `json:"name,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+	Context   string   `json:"context,omitempty"`
+	Types     []string `json:"types,omitempty"`
+	RangeFrom string   `json:"rangeFrom,omitempty"`
+	RangeTo   string   `json:"rangeTo,omitempty"`
+	//Notification and Data are only set for notifications.
+	Notification int    `json:"notification,omitempty"`
+	Data         string `json:"data,omitempty"`
+}
+
+//pendingEvent is a received query waiting for its answer.
+type pendingEvent struct {
+	received time.Time
+	source   string
+}
+
+//eventLog writes events to a file, which is rotated when it exceeds its maximum size, or to a unix
+//socket. Events are queued and written by a single goroutine such that slow writes do not block
+//the caller. It is safe for concurrent use. All methods of a nil eventLog do nothing.
+type eventLog struct {
+	//mutex protects pending, untracked, overflow and closed.
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	//queue contains the events waiting to be written. It is closed when the event log is closed.
+	queue  chan Event
+	closed bool
+	//done is closed when all queued events have been written and the file or socket is closed.
+	done chan struct{}
+	//closeErr is the error of closing the file or socket.
+	closeErr error
+	//The following fields are only accessed by the goroutine writing the events.
+	//file is the current log file and size its size. file is nil if events are sent to a socket.
+	file *os.File
+	size int64
+	//conn is the connection to the socket. It is nil if it is not connected.
+	conn           net.Conn
+	lastDial       time.Time
+	redialInterval time.Duration
+	//pending maps the token of a received query to the time it was received.
+	pending map[token.Token]pendingEvent
+	//untracked is the number of received queries which were not tracked as too many were pending.
+	untracked uint64
+	//overflow is the time the last query was not tracked.
+	overflow time.Time
+}
+
+//newEventLog returns an event log writing to the file or unix socket at config's EventLogPath or
+//nil if no event log is configured. The connection to a socket is established when the first
+//event is written.
+func newEventLog(config Config) (*eventLog, error) {
+	if config.EventLogPath == "" {
+		return nil, nil
+	}
+	l := &eventLog{
+		path:           config.EventLogPath,
+		maxSize:        config.EventLogMaxSize,
+		maxFiles:       config.EventLogMaxFiles,
+		queue:          make(chan Event, eventQueueSize),
+		done:           make(chan struct{}),
+		redialInterval: eventRedialInterval,
+		pending:        make(map[token.Token]pendingEvent),
+	}
+	if !l.isSocket() {
+		if err := l.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	go l.run()
+	return l, nil
+}
+
+//run writes the queued events until the queue is closed. It then closes the file or socket.
+func (l *eventLog) run() {
+	for event := range l.queue {
+		l.writeEvent(event)
+	}
+	var c io.Closer
+	if l.file != nil {
+		c, l.file = l.file, nil
+	} else if l.conn != nil {
+		c, l.conn = l.conn, nil
+	}
+	if c != nil {
+		l.closeErr = c.Close()
+	}
+	close(l.done)
+}
+
+func (l *eventLog) isSocket() bool {
+	return strings.HasPrefix(l.path, unixSocketPrefix)
+}
+
+//openFile opens the log file for appending.
+func (l *eventLog) openFile() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+//rotate renames the log file to path.1, shifting older files by one such that at most maxFiles
+//rotated files are kept, and opens a new log file.
+func (l *eventLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.openFile()
+}
+
+//write queues event to be appended to the log. The event is dropped if the queue is full or the
+//log is closed.
+func (l *eventLog) write(event Event) {
+	event.Time = time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- event:
+	default:
+		log.Debug("Event log queue is full. Drop event", "path", l.path, "type", event.Type)
+	}
+}
+
+//writeEvent appends event to the log. Events which cannot be written are dropped.
+func (l *eventLog) writeEvent(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Warn("Was not able to encode event", "event", event, "error", err)
+		return
+	}
+	line = append(line, '\n')
+	if l.isSocket() {
+		err = l.writeSocket(line)
+	} else {
+		err = l.writeFile(line)
+	}
+	if err != nil {
+		log.Debug("Was not able to write event", "path", l.path, "error", err)
+	}
+}
+
+//writeFile writes line to the log file. The file is rotated first if line would exceed its
+//maximum size.
+func (l *eventLog) writeFile(line []byte) error {
+	if l.file == nil {
+		return errors.New("event log is closed")
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Warn("Was not able to rotate event log", "path", l.path, "error", err)
+			if l.file == nil {
+				return err
+			}
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+//writeSocket writes line to the socket. It connects to the socket if it is not connected. The
+//connection is closed if a write fails and established again for a later event.
+func (l *eventLog) writeSocket(line []byte) error {
+	if l.conn == nil {
+		if time.Since(l.lastDial) < l.redialInterval {
+			return errors.New("event log socket is not connected")
+		}
+		l.lastDial = time.Now()
+		conn, err := net.Dial("unix", strings.TrimPrefix(l.path, unixSocketPrefix))
+		if err != nil {
+			return err
+		}
+		l.conn = conn
+	}
+	l.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if _, err := l.conn.Write(line); err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return err
+	}
+	return nil
+}
+
+//close writes the queued events and closes the log file or the connection to the socket.
+func (l *eventLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mutex.Unlock()
+	<-l.done
+	return l.closeErr
+}
+
+//query records the queries in ss and keeps track of when they were received.
+func (l *eventLog) query(ss util.MsgSectionSender) {
+	if l == nil {
+		return
+	}
+	l.track(ss.Token)
+	event := Event{Type: EventQuery, Token: ss.Token.String(), Peer: addrString(ss.Sender)}
+	for _, sec := range ss.Sections {
+		if q, ok := sec.(*query.Name); ok {
+			eq := QuerySummary{Name: q.Name, Context: q.Context}
+			for _, t := range q.Types {
+				eq.Types = append(eq.Types, t.CLIString())
+			}
+			event.Queries = append(event.Queries, eq)
+		}
+	}
+	l.write(event)
+}
+
+//track records that a query with tok has been received now. If too many queries are waiting for
+//an answer, the ones received more than maxPendingEventAge ago are no longer tracked. If there are
+//still too many, the query is counted as untracked.
+func (l *eventLog) track(tok token.Token) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.pending) >= maxPendingEvents {
+		for t, p := range l.pending {
+			if time.Since(p.received) > maxPendingEventAge {
+				delete(l.pending, t)
+			}
+		}
+		if len(l.pending) >= maxPendingEvents {
+			l.untracked++
+			l.overflow = time.Now()
+			return
+		}
+	}
+	l.pending[tok] = pendingEvent{received: time.Now()}
+}
+
+//setSource records source as the source of the answer to the query with tok.
+func (l *eventLog) setSource(tok token.Token, source string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if p, ok := l.pending[tok]; ok {
+		p.source = source
+		l.pending[tok] = p
+	}
+}
+
+//answer records that sections have been sent to peer in answer to the query with tok. Nothing is
+//recorded if no query with tok has been received. While queries might not have been tracked as too
+//many were pending, answers to unknown tokens are recorded without latency and source.
+func (l *eventLog) answer(tok token.Token, peer net.Addr, sections []section.Section) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	p, ok := l.pending[tok]
+	delete(l.pending, tok)
+	overflow := time.Since(l.overflow) <= maxPendingEventAge
+	l.mutex.Unlock()
+	event := Event{
+		Type:     EventAnswer,
+		Token:    tok.String(),
+		Peer:     addrString(peer),
+		Sections: sectionSummaries(sections),
+	}
+	if ok {
+		event.LatencyMicros = int64(time.Since(p.received) / time.Microsecond)
+		event.Source = p.source
+	} else if !overflow {
+		return
+	}
+	l.write(event)
+}
+
+//untrackedQueries returns the number of received queries which were not tracked.
+func (l *eventLog) untrackedQueries() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.untracked
+}
+
+//notification records the notification in ss.
+func (l *eventLog) notification(ss util.MsgSectionSender) {
+	if l == nil {
+		return
+	}
+	l.write(Event{
+		Type:     EventNotification,
+		Token:    ss.Token.String(),
+		Peer:     addrString(ss.Sender),
+		Sections: sectionSummaries(ss.Sections),
+	})
+}
+
+//verificationFailure records that the signatures of a message with tok from peer containing
+//sections could not be verified.
+func (l *eventLog) verificationFailure(tok token.Token, peer net.Addr,
+	sections []section.Section, reason string) {
+	if l == nil {
+		return
+	}
+	l.write(Event{
+		Type:     EventVerificationFailure,
+		Token:    tok.String(),
+		Peer:     addrString(peer),
+		Sections: sectionSummaries(sections),
+		Reason:   reason,
+	})
+}
+
+//sectionSummaries returns a summary of sections.
+func sectionSummaries(sections []section.Section) []SectionSummary {
+	summaries := []SectionSummary{}
+	for _, sec := range sections {
+		var e SectionSummary
+		switch sec := sec.(type) {
+		case *section.Assertion:
+			e = SectionSummary{Type: "assertion", Name: sec.SubjectName, Zone: sec.SubjectZone,
+				Context: sec.Context}
+			for _, o := range sec.Content {
+				e.Types = append(e.Types, o.Type.CLIString())
+			}
+		case *section.Shard:
+			e = SectionSummary{Type: "shard", Zone: sec.SubjectZone, Context: sec.Context,
+				RangeFrom: sec.RangeFrom, RangeTo: sec.RangeTo}
+		case *section.Pshard:
+			e = SectionSummary{Type: "pshard", Zone: sec.SubjectZone, Context: sec.Context,
+				RangeFrom: sec.RangeFrom, RangeTo: sec.RangeTo}
+		case *section.Zone:
+			e = SectionSummary{Type: "zone", Zone: sec.SubjectZone, Context: sec.Context}
+		case *section.Notification:
+			e = SectionSummary{Type: "notification", Notification: int(sec.Type), Data: sec.Data}
+		case *query.Name:
+			e = SectionSummary{Type: "query", Name: sec.Name, Context: sec.Context}
+		default:
+			e = SectionSummary{Type: fmt.Sprintf("%T", sec)}
+		}
+		summaries = append(summaries, e)
+	}
+	return summaries
+}
+
+//addrString returns the string representation of addr or the empty string if addr is nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,273 @@
+package rainsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+//readEvents returns the events in the event log file at path.
+func readEvents(t *testing.T, path string) []Event {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Was not able to open event log: %v", err)
+	}
+	defer file.Close()
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Was not able to decode event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+//newTestEventLog returns an event log writing to a file in dir.
+func newTestEventLog(t *testing.T, dir string, maxSize int64, maxFiles int) *eventLog {
+	config := DefaultConfig()
+	config.EventLogPath = filepath.Join(dir, "events.json")
+	config.EventLogMaxSize = maxSize
+	config.EventLogMaxFiles = maxFiles
+	l, err := newEventLog(config)
+	if err != nil {
+		t.Fatalf("Was not able to create event log: %v", err)
+	}
+	return l
+}
+
+func TestEventLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//Each event exceeds the maximum size such that every event is written to a new file.
+	l := newTestEventLog(t, dir, 1, 2)
+	for i := 0; i < 5; i++ {
+		l.write(Event{Type: EventNotification, Token: fmt.Sprint(i)})
+	}
+	if err := l.close(); err != nil {
+		t.Fatalf("Was not able to close event log: %v", err)
+	}
+	var tests = []struct {
+		file   string
+		tokens []string
+	}{
+		{"events.json", []string{"4"}},
+		{"events.json.1", []string{"3"}},
+		{"events.json.2", []string{"2"}},
+		{"events.json.3", nil},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if test.tokens == nil {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%d: too many rotated files are kept: %s", i, test.file)
+			}
+			continue
+		}
+		tokens := []string{}
+		for _, e := range readEvents(t, path) {
+			tokens = append(tokens, e.Token)
+		}
+		if fmt.Sprint(tokens) != fmt.Sprint(test.tokens) {
+			t.Errorf("%d: wrong events in %s. expected=%v actual=%v", i, test.file, test.tokens,
+				tokens)
+		}
+	}
+}
+
+func TestEventLogAnswer(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "eventLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	s := newTestServer(DefaultConfig())
+	s.events = newTestEventLog(t, dir, 1<<20, 1)
+	queried, notified, unknown := token.New(), token.New(), token.New()
+	for _, tok := range []token.Token{queried, notified} {
+		msg := testQueryMsg()
+		s.events.query(util.MsgSectionSender{Sender: peer, Sections: msg.Content, Token: tok})
+	}
+	s.events.setSource(queried, SourceAuthoritative)
+	//Sending fails as nothing listens at peer, but the answer is logged nevertheless.
+	sendSections([]section.Section{testAssertion("www", "example.", ".")}, queried, peer, s)
+	sendSections([]section.Section{testAssertion("www", "example.", ".")}, unknown, peer, s)
+	sendNotificationMsg(notified, peer, section.NTNoAssertionsExist, "", s)
+	s.events.close()
+	var tests = []struct {
+		token    token.Token
+		source   string
+		sections []string
+	}{
+		{queried, SourceAuthoritative, []string{"assertion"}},
+		{notified, "", []string{"notification"}},
+	}
+	answers := []Event{}
+	for _, e := range readEvents(t, s.events.path) {
+		if e.Type == EventAnswer {
+			answers = append(answers, e)
+		}
+	}
+	if len(answers) != len(tests) {
+		t.Fatalf("wrong number of answers. expected=%d actual=%d", len(tests), len(answers))
+	}
+	for i, test := range tests {
+		e := answers[i]
+		sections := []string{}
+		for _, sec := range e.Sections {
+			sections = append(sections, sec.Type)
+		}
+		if e.Token != test.token.String() || e.Source != test.source ||
+			fmt.Sprint(sections) != fmt.Sprint(test.sections) || e.Peer != peer.String() {
+			t.Errorf("%d: wrong answer. expected=(%s,%s,%v) actual=(%s,%s,%v)", i, test.token,
+				test.source, test.sections, e.Token, e.Source, sections)
+		}
+	}
+}
+
+func TestEventLogQueue(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	//Without writer, events remain in the queue and further events are dropped.
+	l := &eventLog{queue: make(chan Event, 2), pending: make(map[token.Token]pendingEvent)}
+	var tests = []struct {
+		closed bool
+		queued int
+	}{
+		{false, 1},
+		{false, 2},
+		{false, 2},
+		{true, 2},
+	}
+	for i, test := range tests {
+		l.closed = test.closed
+		l.write(Event{Type: EventNotification})
+		if len(l.queue) != test.queued {
+			t.Errorf("%d: wrong number of queued events. expected=%d actual=%d", i, test.queued,
+				len(l.queue))
+		}
+	}
+}
+
+func TestEventLogSocket(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "eventLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Was not able to listen: %v", err)
+	}
+	defer listener.Close()
+	conns := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}
+	}()
+	config := DefaultConfig()
+	config.EventLogPath = unixSocketPrefix + path
+	l, err := newEventLog(config)
+	if err != nil {
+		t.Fatalf("Was not able to create event log: %v", err)
+	}
+	defer l.close()
+	l.redialInterval = 0
+	//The event log connects when the first event is written and reconnects after the connection
+	//has been closed.
+	for i := 0; i < 2; i++ {
+		var conn net.Conn
+		for j := 0; conn == nil; j++ {
+			if j == 50 {
+				t.Fatalf("%d: event log did not connect", i)
+			}
+			l.write(Event{Type: EventNotification, Token: fmt.Sprint(i)})
+			select {
+			case conn = <-conns:
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("%d: was not able to read event: %v", i, err)
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil || e.Token != fmt.Sprint(i) {
+			t.Errorf("%d: wrong event. expected token=%d actual=%s error=%v", i, i, e.Token, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestEventLogUntracked(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	answer := []section.Section{testAssertion("www", "example.", ".")}
+	var tests = []struct {
+		overflow  bool
+		untracked uint64
+		answers   []string
+	}{
+		{false, 0, []string{"tracked"}},
+		{true, 1, []string{"tracked", "dropped"}},
+	}
+	for i, test := range tests {
+		l := &eventLog{queue: make(chan Event, 10), pending: make(map[token.Token]pendingEvent)}
+		tracked, dropped := token.New(), token.New()
+		names := map[string]string{tracked.String(): "tracked", dropped.String(): "dropped"}
+		l.track(tracked)
+		time.Sleep(time.Millisecond)
+		if test.overflow {
+			for len(l.pending) < maxPendingEvents {
+				l.track(token.New())
+			}
+			l.track(dropped)
+		}
+		//The query with dropped is unknown if the event log has not overflown.
+		l.answer(tracked, peer, answer)
+		l.answer(dropped, peer, answer)
+		if l.untrackedQueries() != test.untracked {
+			t.Errorf("%d: wrong number of untracked queries. expected=%d actual=%d", i,
+				test.untracked, l.untrackedQueries())
+		}
+		answers := []string{}
+		for len(l.queue) > 0 {
+			e := <-l.queue
+			answers = append(answers, names[e.Token])
+			if (e.LatencyMicros > 0) != (names[e.Token] == "tracked") {
+				t.Errorf("%d: wrong latency of %s answer: %d", i, names[e.Token],
+					e.LatencyMicros)
+			}
+		}
+		if fmt.Sprint(answers) != fmt.Sprint(test.answers) {
+			t.Errorf("%d: wrong logged answers. expected=%v actual=%v", i, test.answers, answers)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package rainsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/netsec-ethz/rains/internal/pkg/connection"
+	"github.com/netsec-ethz/rains/internal/pkg/libresolve"
+)
+
+//ForwardingRule determines how the resolver of a caching server resolves queries for a zone.
+type ForwardingRule struct {
+	//Zone is fully qualified. The rule applies to Zone and all names below it.
+	Zone string
+	//Context of the queries to which the rule applies. An empty context matches all contexts.
+	Context string
+	//Forwarders receive the queries to which the rule applies. If empty, these queries are
+	//resolved recursively starting at the root name servers.
+	Forwarders []connection.Info
+}
+
+//checkForwardingRules returns an error if a forwarding rule of config is invalid.
+func checkForwardingRules(config Config) error {
+	for _, rule := range config.ForwardingRules {
+		if !strings.HasSuffix(rule.Zone, ".") {
+			return fmt.Errorf("zone of forwarding rule is not fully qualified: %s", rule.Zone)
+		}
+		for _, f := range rule.Forwarders {
+			if f.Addr == nil {
+				return fmt.Errorf("forwarder without address in forwarding rule of zone %s",
+					rule.Zone)
+			}
+		}
+	}
+	return nil
+}
+
+//ResolverRules returns rules in the form used by a resolver.
+func ResolverRules(rules []ForwardingRule) []libresolve.ForwardingRule {
+	result := []libresolve.ForwardingRule{}
+	for _, rule := range rules {
+		forwarders := []net.Addr{}
+		for _, f := range rule.Forwarders {
+			forwarders = append(forwarders, f.Addr)
+		}
+		result = append(result, libresolve.ForwardingRule{Zone: rule.Zone, Context: rule.Context,
+			Forwarders: forwarders})
+	}
+	return result
+}
@@ -3,10 +3,11 @@ package rainsd
 import (
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/inconshreveable/log15"
-	"github.com/netsec-ethz/rains/internal/pkg/cache"
 	"github.com/netsec-ethz/rains/internal/pkg/message"
 	"github.com/netsec-ethz/rains/internal/pkg/query"
 	"github.com/netsec-ethz/rains/internal/pkg/section"
@@ -22,22 +23,90 @@ type InputQueues struct {
 	Normal chan util.MsgSectionSender
 	Notify chan util.MsgSectionSender
 
-	//These channels limit the number of go routines working on the different queues to avoid memory
-	//exhaustion.
-	PrioW   chan struct{}
-	NormalW chan struct{}
-	NotifyW chan struct{}
+	//These limits restrict the number of go routines working on the different queues to avoid
+	//memory exhaustion.
+	PrioW   *workerLimit
+	NormalW *workerLimit
+	NotifyW *workerLimit
 }
 
-//deliver pushes all incoming messages to the prio or normal channel.
-//A message is added to the priority channel if it is the response to a non-expired delegation query
-func deliver(msg *message.Message, sender net.Addr, prioChannel chan util.MsgSectionSender,
-	normalChannel chan util.MsgSectionSender, notificationChannel chan util.MsgSectionSender,
-	pendingKeys cache.PendingKey) {
+//workerLimit restricts the number of go routines working on a queue. In contrast to a buffered
+//channel, the limit can be changed while workers are running.
+type workerLimit struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newWorkerLimit(limit int) *workerLimit {
+	w := &workerLimit{limit: limit}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+//acquire blocks until less than limit go routines are working and then registers a new one.
+func (w *workerLimit) acquire() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.active >= w.limit {
+		w.cond.Wait()
+	}
+	w.active++
+}
+
+//release unregisters a working go routine.
+func (w *workerLimit) release() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.active == 0 {
+		log.Error("Released worker which was not acquired")
+		return
+	}
+	w.active--
+	w.cond.Signal()
+}
 
-	//TODO Check message signatures here once they are implemented
+//setLimit changes the maximum number of working go routines. If it is decreased, running workers
+//finish their work but no new ones are started until less than limit are working.
+func (w *workerLimit) setLimit(limit int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.limit = limit
+	w.cond.Broadcast()
+}
 
-	processCapability(msg.Capabilities, sender, msg.Token)
+//usage returns the number of working go routines and the limit.
+func (w *workerLimit) usage() (active, limit int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.active, w.limit
+}
+
+//deliver pushes all incoming messages to the prio or normal channel.
+//Messages from blocked peers and messages rejected by the message signature policy are dropped.
+//While the server is shutting down, only answers to queries of this server are accepted.
+func (s *Server) deliver(msg *message.Message, sender net.Addr) {
+	s.metrics.message(msg, sender, directionReceived)
+	if s.isStopping() && !s.isResponse(msg) {
+		log.Info("Dropped message as server is shutting down", "sender", sender, "token", msg.Token)
+		return
+	}
+	if s.blocklist.containsPeer(sender) {
+		log.Info("Dropped message from blocked peer", "sender", sender, "token", msg.Token)
+		return
+	}
+	if !s.checkMessageSignatures(msg, sender, true) {
+		return
+	}
+	s.enqueue(msg, sender)
+}
+
+//enqueue pushes the sections of msg to the prio, normal or notification channel.
+//A message is added to the priority channel if it is the response to a non-expired delegation query.
+//Sections of blocked zones are dropped.
+func (s *Server) enqueue(msg *message.Message, sender net.Addr) {
+	s.processCapability(msg.Capabilities, sender, msg.Token)
 
 	//handle notification separately. Assertions and Queries are processed together respectively.
 	queries := []section.Section{}
@@ -45,100 +114,112 @@ func deliver(msg *message.Message, sender net.Addr, prioChannel chan util.MsgSec
 	for _, m := range msg.Content {
 		switch m := m.(type) {
 		case *section.Assertion, *section.Shard, *section.Pshard, *section.Zone:
-			if !isZoneBlacklisted(m.(section.WithSig).GetSubjectZone()) {
+			sec := m.(section.WithSig)
+			if !s.blocklist.containsZone(sec.GetSubjectZone(), sec.GetContext()) {
 				sections = append(sections, m)
+			} else {
+				log.Info("Dropped section of blocked zone", "zone", sec.GetSubjectZone(),
+					"context", sec.GetContext())
 			}
 		case *query.Name:
 			log.Debug(fmt.Sprintf("add %T to normal queue", m))
 			queries = append(queries, m)
 		case *section.Notification:
+			//The answer to a zone transfer request is recorded before the transferred sections are
+			//processed.
+			if m.Type == section.NTZoneTransfer && s.zoneTransferAnswered(m, msg, sender) {
+				continue
+			}
 			log.Debug("Add notification to notification queue", "token", msg.Token)
-			notificationChannel <- util.MsgSectionSender{
+			s.push(s.queues.Notify, util.MsgSectionSender{
 				Sender:   sender,
 				Sections: []section.Section{m},
 				Token:    msg.Token,
-			}
+				Msg:      msg,
+			})
 		default:
 			log.Warn(fmt.Sprintf("unsupported message section type %T", m))
 			return
 		}
 	}
 	if len(queries) > 0 {
-		normalChannel <- util.MsgSectionSender{Sender: sender, Sections: queries, Token: msg.Token}
+		s.push(s.queues.Normal, util.MsgSectionSender{Sender: sender, Sections: queries,
+			Token: msg.Token})
 	}
 	if len(sections) > 0 {
 		mss := util.MsgSectionSender{Sender: sender, Sections: sections, Token: msg.Token}
-		if pendingKeys.ContainsToken(msg.Token) {
+		if s.caches.PendingKeys.ContainsToken(msg.Token) {
 			log.Debug("add section with signature to priority queue", "token", msg.Token)
-			prioChannel <- mss
+			s.push(s.queues.Prio, mss)
 		} else {
 			log.Debug("add section with signature to normal queue", "token", msg.Token)
-			normalChannel <- mss
+			s.push(s.queues.Normal, mss)
 		}
 	}
 }
 
-//processCapability processes capabilities and sends a notification back to the sender if the hash
-//is not understood.
-func processCapability(caps []message.Capability, sender net.Addr, token token.Token) {
-	log.Debug("Processing Capabilities not yet supported")
-	/*log.Debug("Process capabilities", "capabilities", caps)
-	if len(caps) > 0 {
-		isHash := !strings.HasPrefix(string(caps[0]), "urn:")
-		if isHash {
-			if caps, ok := capabilities.Get([]byte(caps[0])); ok {
-				addCapabilityAndRespond(sender, caps)
-			} else { //capability hash not understood
-				sendNotificationMsg(token, sender, section.NTCapHashNotKnown, capabilityHash)
-			}
-		} else {
-			addCapabilityAndRespond(sender, caps)
-		}
-	}*/
+//push adds mss to queue and counts it as in flight until it has been processed. It returns false if
+//the server has stopped working on its input queues before mss could be added.
+func (s *Server) push(queue chan util.MsgSectionSender, mss util.MsgSectionSender) bool {
+	atomic.AddInt64(&s.inFlight, 1)
+	select {
+	case queue <- mss:
+		return true
+	case <-s.ctx.Done():
+		atomic.AddInt64(&s.inFlight, -1)
+		log.Warn("Dropped message as server has shut down", "token", mss.Token)
+		return false
+	}
 }
 
-//addCapabilityAndRespond adds caps to the connection cache entry of sender and sends its own
-//capabilities back if it has not already received capability information on this connection.
-func addCapabilityAndRespond(sender net.Addr, caps []message.Capability) {
-	/*if !connCache.AddCapabilityList(sender, caps) {
-		sendCapability(sender, []message.Capability{message.Capability(capabilityHash)})
-	}*/
+//processed marks a message taken from an input queue as processed.
+func (s *Server) processed() {
+	atomic.AddInt64(&s.inFlight, -1)
 }
 
-//isZoneBlacklisted returns true if zone is blacklisted
-func isZoneBlacklisted(zone string) bool {
-	return false
+//processCapability stores the capabilities of sender. caps is either the full capability list or
+//its hash. If the hash is not known, a notification is sent back to the sender containing this
+//server's capability list upon which the sender responds with its full capability list.
+func (s *Server) processCapability(caps []message.Capability, sender net.Addr, tok token.Token) {
+	if len(caps) == 0 {
+		return
+	}
+	log.Debug("Process capabilities", "capabilities", caps)
+	if len(caps) == 1 && capabilityIsHash(string(caps[0])) {
+		if list, ok := s.caches.Capabilities.Get([]byte(caps[0])); ok {
+			s.caches.ConnCache.AddCapabilityList(sender, list)
+		} else {
+			sendNotificationMsg(tok, sender, section.NTCapHashNotKnown, s.capabilityList, s)
+		}
+		return
+	}
+	s.caches.Capabilities.Add(caps)
+	s.caches.ConnCache.AddCapabilityList(sender, caps)
 }
 
 //workBoth works on the prioChannel and on the normalChannel. A worker only fetches a message from
-//the normalChannel if the prioChannel is empty. the channel normalWorkers enforces a maximum number
+//the normalChannel if the prioChannel is empty. the normalWorkers limit enforces a maximum number
 //of go routines working on the prioChannel and normalChannel.
 func (s *Server) workBoth() {
 	for {
 		select {
-		case <-s.shutdown:
-			//Avoid closing the s.queues.Normal channel before server.Shutdown() has sent a dummy
-			//message in case this worker is not waiting on the s.queues.Normal channel
-			time.Sleep(time.Second)
-			close(s.queues.Normal)
-			close(s.queues.NormalW)
-			log.Debug("Closed normal server channels")
+		case <-s.ctx.Done():
 			return
 		default:
 		}
-		s.queues.NormalW <- struct{}{}
+		s.queues.NormalW.acquire()
 		select {
 		case msg := <-s.queues.Prio:
-			go prioWorkerHandler(s, msg, false)
+			s.goWork(func() { prioWorkerHandler(s, msg, false) })
 			continue
 		default:
 			//do nothing
 		}
 		select {
 		case msg := <-s.queues.Normal:
-			go normalWorkerHandler(s, msg)
+			s.goWork(func() { normalWorkerHandler(s, msg) })
 		default:
-			<-s.queues.NormalW
+			s.queues.NormalW.release()
 			time.Sleep(time.Millisecond)
 		}
 	}
@@ -146,14 +227,13 @@ func (s *Server) workBoth() {
 
 //normalWorkerHandler handles sections on the normalChannel
 func normalWorkerHandler(s *Server, msg util.MsgSectionSender) {
-	if msg.Sections != nil {
-		s.verify(msg)
-	}
-	<-s.queues.NormalW
+	s.verify(msg)
+	s.processed()
+	s.queues.NormalW.release()
 }
 
 //workPrio works on the prioChannel. It waits on the prioChannel and creates a new go routine which handles the section.
-//the channel prioWorkers enforces a maximum number of go routines working on the prioChannel.
+//the prioWorkers limit enforces a maximum number of go routines working on the prioChannel.
 //The prio channel is necessary to avoid a blocking of the server. e.g. in the following unrealistic scenario
 //1) normal queue fills up with non delegation queries which all are missing a public key
 //2) The non-delegation queries get processed by the normalWorkers and added to the pendingSignature cache
@@ -162,57 +242,48 @@ func normalWorkerHandler(s *Server, msg util.MsgSectionSender) {
 //4) Then although the server is working all the time, no section is added to the caches.
 func (s *Server) workPrio() {
 	for {
+		s.queues.PrioW.acquire()
 		select {
-		case <-s.shutdown:
-			//Avoid closing the s.queues.Prio channel before server.Shutdown() has sent a dummy
-			//message in case this worker is not waiting on the s.queues.Prio channel
-			time.Sleep(time.Second)
-			close(s.queues.Prio)
-			close(s.queues.PrioW)
+		case msg := <-s.queues.Prio:
+			s.goWork(func() { prioWorkerHandler(s, msg, true) })
+		case <-s.ctx.Done():
+			s.queues.PrioW.release()
 			return
-		default:
 		}
-		s.queues.PrioW <- struct{}{}
-		msg := <-s.queues.Prio
-		go prioWorkerHandler(s, msg, true)
 	}
 }
 
-//prioWorkerHandler handles sections on the prioChannel
+//prioWorkerHandler handles sections on the prioChannel. prioWorker is false if the section has
+//been fetched by a worker of the normalChannel.
 func prioWorkerHandler(s *Server, msg util.MsgSectionSender, prioWorker bool) {
-	if msg.Sections != nil {
-		s.verify(msg)
-	}
+	s.verify(msg)
+	s.processed()
 	if prioWorker {
-		<-s.queues.PrioW
+		s.queues.PrioW.release()
+	} else {
+		s.queues.NormalW.release()
 	}
 }
 
 //workNotification works on the notificationChannel. It waits on the notificationChannel and creates
-//a new go routine which handles the notification. the channel notificationWorkers enforces a
+//a new go routine which handles the notification. the notificationWorkers limit enforces a
 //maximum number of go routines working on the notificationChannel
 func (s *Server) workNotification() {
 	for {
+		s.queues.NotifyW.acquire()
 		select {
-		case <-s.shutdown:
-			//Avoid closing the s.queues.Notify channel before server.Shutdown() has sent a dummy
-			//message in case this worker is not waiting on the s.queues.Notify channel
-			time.Sleep(time.Second)
-			close(s.queues.Notify)
-			close(s.queues.NotifyW)
+		case msg := <-s.queues.Notify:
+			s.goWork(func() { handleNotification(s, msg) })
+		case <-s.ctx.Done():
+			s.queues.NotifyW.release()
 			return
-		default:
 		}
-		s.queues.NotifyW <- struct{}{}
-		msg := <-s.queues.Notify
-		go handleNotification(s, msg)
 	}
 }
 
 //handleNotification works on notificationChannel.
 func handleNotification(s *Server, msg util.MsgSectionSender) {
-	if msg.Sections != nil {
-		s.notify(msg)
-	}
-	<-s.queues.NormalW
+	s.notify(msg)
+	s.processed()
+	s.queues.NotifyW.release()
 }
@@ -0,0 +1,79 @@
+package rainsd
+
+import (
+	"net"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+//isRetained returns true if sec is stored on behalf of an authority because this server acts as
+//an intermediary for sec's zone and context. Sections of zones which are not configured as
+//intermediary zones are never retained.
+func isRetained(sec section.WithSigForward, config Config) bool {
+	if !config.IntermediaryService {
+		return false
+	}
+	for _, zc := range config.IntermediaryZones {
+		if zc.Zone == sec.GetSubjectZone() && zc.Context == sec.GetContext() {
+			return true
+		}
+	}
+	return false
+}
+
+//acceptsPush returns true if this server is an intermediary for all sections of msgSender.
+func acceptsPush(msgSender util.MsgSectionSender, config Config) bool {
+	for _, sec := range msgSender.Sections {
+		if !isRetained(sec.(section.WithSigForward), config) {
+			return false
+		}
+	}
+	return true
+}
+
+//retentionEnd returns the time until which a retained section is stored. Zero is returned if
+//retained sections are stored until they expire.
+func retentionEnd(config Config) int64 {
+	if config.RetentionPeriod == 0 {
+		return 0
+	}
+	return time.Now().Add(config.RetentionPeriod).Unix()
+}
+
+//cacheExpiration returns the time at which sec is removed from the cache. It is sec's expiration
+//time unless retainUntil is earlier.
+func cacheExpiration(sec section.WithSigForward, retainUntil int64) int64 {
+	if retainUntil != 0 && retainUntil < sec.ValidUntil() {
+		return retainUntil
+	}
+	return sec.ValidUntil()
+}
+
+//answerQueriesIntermediary is how an intermediary answers queries. Queries are only answered with
+//stored sections and are never forwarded. Queries about names this server has authority over are
+//answered from its authoritative sections. If no section is stored for any of the queries, a
+//notification is sent.
+func answerQueriesIntermediary(qs []*query.Name, sender net.Addr, token token.Token, s *Server) {
+	log.Info("Start processing query as intermediary", "queries", qs)
+	s.events.setSource(token, SourceCache)
+	authorities := s.authorities()
+	sections := []section.Section{}
+	for _, q := range qs {
+		if zone, ok := authority(q, authorities); ok {
+			sections = append(sections, authoritativeLookup(q, zone, s)...)
+		} else if secs := cacheLookup(q, sender, token, s); secs != nil {
+			sections = append(sections, secs...)
+		}
+	}
+	if len(sections) == 0 {
+		log.Info("No stored section answers the queries", "queries", qs)
+		sendNotificationMsg(token, sender, section.NTNoAssertionAvail, "", s)
+		return
+	}
+	sendSections(sections, token, sender, s)
+}
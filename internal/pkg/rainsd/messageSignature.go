@@ -0,0 +1,348 @@
+package rainsd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/netsec-ethz/rains/internal/pkg/keyManager"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/siglib"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+)
+
+//Message signature policies
+const (
+	//sigPolicyNone ignores message signatures.
+	sigPolicyNone = "none"
+	//sigPolicyVerify rejects signed messages of configured peers if a signature is invalid.
+	//Unsigned messages are accepted.
+	sigPolicyVerify = "verify"
+	//sigPolicyRequire rejects all messages which do not carry a valid signature of a configured
+	//peer.
+	sigPolicyRequire = "require"
+
+	//messageSignatureValidity is the validity period of signatures on outgoing messages.
+	messageSignatureValidity = time.Minute
+	//maxPendingSignedMessages is the maximum number of messages waiting for the infrastructure key
+	//of their sender.
+	maxPendingSignedMessages = 1000
+)
+
+//InfraKeyPeer associates peers with the name whose infrastructure key signs their messages.
+type InfraKeyPeer struct {
+	//Prefix is in CIDR notation. A single IP address matches only this address.
+	Prefix string
+	//Name is the fully qualified name holding the peers' infrastructure key.
+	Name    string
+	Context string
+}
+
+type infraPeer struct {
+	ipNet   *net.IPNet
+	name    string
+	context string
+}
+
+//newInfraPeers parses the prefixes of peers.
+func newInfraPeers(peers []InfraKeyPeer) ([]infraPeer, error) {
+	result := []infraPeer{}
+	for _, p := range peers {
+		ipNet, err := parsePrefix(p.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, infraPeer{ipNet: ipNet, name: p.Name, context: p.Context})
+	}
+	return result, nil
+}
+
+//loadInfraKey loads the unencrypted private key stored by the keyManager at keyPath.
+func loadInfraKey(keyPath string) (keys.PublicKeyID, interface{}, error) {
+	folder, file := path.Split(keyPath)
+	block, err := keyManager.DecryptKey(folder, file+keyManager.SecSuffix, "")
+	if err != nil {
+		return keys.PublicKeyID{}, nil, err
+	}
+	return keyManager.PemToKeyID(block)
+}
+
+//checkSigPolicy returns an error if policy is not a valid message signature policy.
+func checkSigPolicy(policy string) error {
+	switch policy {
+	case sigPolicyNone, sigPolicyVerify, sigPolicyRequire:
+		return nil
+	default:
+		return fmt.Errorf("unknown message signature policy: %s", policy)
+	}
+}
+
+//signMessage signs msg with the server's infrastructure key if one is configured.
+func (s *Server) signMessage(msg *message.Message) error {
+	if s.infraKey == nil {
+		return nil
+	}
+	msg.Signatures = []signature.Sig{signature.Sig{
+		PublicKeyID: s.infraKeyID,
+		ValidSince:  time.Now().Unix(),
+		ValidUntil:  time.Now().Add(messageSignatureValidity).Unix(),
+	}}
+	return siglib.SignMessageUnsafe(msg, map[keys.PublicKeyID]interface{}{s.infraKeyID: s.infraKey})
+}
+
+//checkMessageSignatures returns true if msg is accepted according to the server's message signature
+//policy. If the infrastructure key of sender is not cached and mayQuery is true, msg is kept until
+//the key has been obtained and false is returned. Answers to queries of this server containing
+//only signed sections are always accepted.
+func (s *Server) checkMessageSignatures(msg *message.Message, sender net.Addr, mayQuery bool) bool {
+	if s.config.MessageSigPolicy == sigPolicyNone || s.isResponse(msg) {
+		return true
+	}
+	peer, ok := s.infraPeer(sender)
+	if !ok || len(msg.Signatures) == 0 {
+		if s.config.MessageSigPolicy == sigPolicyRequire {
+			log.Warn("Rejected message without verifiable signature", "sender", sender,
+				"token", msg.Token)
+			s.rejectMessage(msg, sender, "message signature required")
+			return false
+		}
+		return true
+	}
+	pkeys := s.infraKeys(peer)
+	if len(pkeys) == 0 {
+		if mayQuery && s.queryInfraKey(peer, msg, sender) {
+			return false
+		}
+		log.Warn("Rejected message as infrastructure key of sender is not available",
+			"sender", sender, "name", peer.name, "token", msg.Token)
+		s.rejectMessage(msg, sender, "infrastructure key not available")
+		return false
+	}
+	if !siglib.CheckMessageSignatures(msg, pkeys) {
+		log.Warn("Rejected message with invalid signature", "sender", sender, "token", msg.Token)
+		s.events.verificationFailure(msg.Token, sender, msg.Content, "invalid message signature")
+		s.rejectMessage(msg, sender, "invalid message signature")
+		return false
+	}
+	return true
+}
+
+//isResponse returns true if msg answers a query this server has issued with a token it created
+//itself and only contains assertions, shards, pshards or zones whose signatures are verified later.
+func (s *Server) isResponse(msg *message.Message) bool {
+	if len(msg.Content) == 0 || !s.isOwnToken(msg.Token) {
+		return false
+	}
+	for _, sec := range msg.Content {
+		switch sec.(type) {
+		case *section.Assertion, *section.Shard, *section.Pshard, *section.Zone:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//isOwnToken returns true if tok belongs to a delegation, infrastructure key or forwarded query for
+//which this server has created the token. Tokens chosen by clients with the token tracing option
+//are not considered.
+func (s *Server) isOwnToken(tok token.Token) bool {
+	return s.caches.PendingKeys.ContainsToken(tok) || s.pendingSigned.containsToken(tok) ||
+		s.forwardedTokens.contains(tok)
+}
+
+//infraPeer returns the first configured peer whose prefix contains sender's IP address.
+func (s *Server) infraPeer(sender net.Addr) (infraPeer, bool) {
+	ip := addrIP(sender)
+	if ip == nil {
+		return infraPeer{}, false
+	}
+	for _, p := range s.infraPeers {
+		if p.ipNet.Contains(ip) {
+			return p, true
+		}
+	}
+	return infraPeer{}, false
+}
+
+//infraKeys returns the cached infrastructure keys of peer.
+func (s *Server) infraKeys(peer infraPeer) map[keys.PublicKeyID][]keys.PublicKey {
+	pkeys := make(map[keys.PublicKeyID][]keys.PublicKey)
+	assertions, _ := s.caches.AssertionsCache.Get(peer.name, peer.context, object.OTInfraKey, true)
+	for _, a := range assertions {
+		for _, obj := range a.Content {
+			if obj.Type != object.OTInfraKey {
+				continue
+			}
+			if key, ok := obj.Value.(keys.PublicKey); ok {
+				key.ValidSince = a.ValidSince()
+				key.ValidUntil = a.ValidUntil()
+				pkeys[key.PublicKeyID] = append(pkeys[key.PublicKeyID], key)
+			}
+		}
+	}
+	return pkeys
+}
+
+//queryInfraKey sends a query for the infrastructure key of peer and keeps msg until the answer
+//arrives. If the key has already been queried, msg waits for the answer to the outstanding query.
+//It returns false if msg cannot be kept, e.g. because the server is shutting down.
+func (s *Server) queryInfraKey(peer infraPeer, msg *message.Message, sender net.Addr) bool {
+	if s.resolver == nil || s.isStopping() {
+		return false
+	}
+	expiration := time.Now().Add(s.config.QueryValidity).Unix()
+	tok, isNew, ok := s.pendingSigned.add(peer.name, peer.context, msg, sender, expiration)
+	if !ok {
+		return false
+	}
+	if !isNew {
+		log.Info("Infrastructure key of peer has already been queried", "sender", sender,
+			"name", peer.name)
+		return true
+	}
+	q := &query.Name{
+		Name:       peer.name,
+		Context:    peer.context,
+		Types:      []object.Type{object.OTInfraKey},
+		Expiration: expiration,
+	}
+	log.Info("Query infrastructure key of peer", "sender", sender, "name", peer.name)
+	s.sendToRecursiveResolver(message.Message{Token: tok, Content: []section.Section{q}})
+	return true
+}
+
+//pendingSignedCallback processes the messages which waited for the answer to the infrastructure
+//key query with token tok.
+func (s *Server) pendingSignedCallback(tok token.Token) {
+	for _, m := range s.pendingSigned.getAndRemove(tok) {
+		if s.checkMessageSignatures(m.msg, m.sender, false) {
+			s.enqueue(m.msg, m.sender)
+		}
+	}
+}
+
+//rejectMessage informs sender that msg has been rejected. Messages only containing notifications
+//are dropped silently.
+func (s *Server) rejectMessage(msg *message.Message, sender net.Addr, reason string) {
+	for _, sec := range msg.Content {
+		if _, ok := sec.(*section.Notification); !ok {
+			sendNotificationMsg(msg.Token, sender, section.NTBadMessage, reason, s)
+			return
+		}
+	}
+}
+
+type pendingSignedMessage struct {
+	msg    *message.Message
+	sender net.Addr
+}
+
+//infraKeyName identifies a queried infrastructure key.
+type infraKeyName struct {
+	name    string
+	context string
+}
+
+//pendingInfraKeyQuery is an infrastructure key query and the messages waiting for its answer.
+type pendingInfraKeyQuery struct {
+	key        infraKeyName
+	expiration int64
+	msgs       []pendingSignedMessage
+}
+
+//pendingSignedMessages contains messages waiting for the infrastructure key of their sender. There
+//is at most one outstanding query per infrastructure key. It is safe for concurrent use.
+type pendingSignedMessages struct {
+	mutex sync.Mutex
+	//queries maps the token of an infrastructure key query to the messages waiting for the answer.
+	queries map[token.Token]*pendingInfraKeyQuery
+	//tokens maps a queried infrastructure key to the token of its query.
+	tokens map[infraKeyName]token.Token
+	//size is the number of waiting messages.
+	size    int
+	maxSize int
+}
+
+func newPendingSignedMessages(maxSize int) *pendingSignedMessages {
+	return &pendingSignedMessages{
+		queries: make(map[token.Token]*pendingInfraKeyQuery),
+		tokens:  make(map[infraKeyName]token.Token),
+		maxSize: maxSize,
+	}
+}
+
+//add stores msg until the infrastructure key of name and context arrives. It returns the token of
+//the key's query and true if the query is new and must be sent. If the key has already been
+//queried, msg is added to the messages waiting for the outstanding query. A new query expires at
+//expiration. The last return value is false if too many messages are waiting.
+func (p *pendingSignedMessages) add(name, context string, msg *message.Message, sender net.Addr,
+	expiration int64) (token.Token, bool, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now().Unix()
+	for t, q := range p.queries {
+		if q.expiration < now {
+			p.remove(t)
+		}
+	}
+	if p.size >= p.maxSize {
+		log.Warn("Too many messages are waiting for an infrastructure key")
+		return token.Token{}, false, false
+	}
+	p.size++
+	key := infraKeyName{name: name, context: context}
+	if tok, ok := p.tokens[key]; ok {
+		q := p.queries[tok]
+		q.msgs = append(q.msgs, pendingSignedMessage{msg: msg, sender: sender})
+		return tok, false, true
+	}
+	tok := token.New()
+	p.tokens[key] = tok
+	p.queries[tok] = &pendingInfraKeyQuery{
+		key:        key,
+		expiration: expiration,
+		msgs:       []pendingSignedMessage{{msg: msg, sender: sender}},
+	}
+	return tok, true, true
+}
+
+//remove removes the query with tok and its waiting messages. The caller must hold the lock.
+func (p *pendingSignedMessages) remove(tok token.Token) *pendingInfraKeyQuery {
+	q, ok := p.queries[tok]
+	if !ok {
+		return nil
+	}
+	delete(p.queries, tok)
+	delete(p.tokens, q.key)
+	p.size -= len(q.msgs)
+	return q
+}
+
+//getAndRemove returns the messages waiting for the answer to the non expired query with tok and
+//removes them.
+func (p *pendingSignedMessages) getAndRemove(tok token.Token) []pendingSignedMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	q := p.remove(tok)
+	if q == nil || q.expiration < time.Now().Unix() {
+		return nil
+	}
+	return q.msgs
+}
+
+//containsToken returns true if messages wait for the answer to the query with token tok.
+func (p *pendingSignedMessages) containsToken(tok token.Token) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.queries[tok]
+	return ok
+}
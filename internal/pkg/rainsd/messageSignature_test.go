@@ -0,0 +1,232 @@
+package rainsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/siglib"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+//newTestServer returns a server with config which is not started. Messages it enqueues are pushed
+//to buffered queues.
+func newTestServer(config Config) *Server {
+	s := &Server{
+		config:          config,
+		caches:          initCaches(config),
+		blocklist:       newBlocklist(),
+		rateLimits:      newRateLimits(config),
+		sentMsgs:        newSentMessages(maxSentMessages),
+		pendingSigned:   newPendingSignedMessages(maxPendingSignedMessages),
+		forwardedTokens: newTokenSet(maxForwardedTokens),
+		zonefiles:       newZonefileWatcher(),
+		zoneTransfers:   newZoneTransfers(),
+		queues: InputQueues{
+			Prio:    make(chan util.MsgSectionSender, 10),
+			Normal:  make(chan util.MsgSectionSender, 10),
+			Notify:  make(chan util.MsgSectionSender, 10),
+			PrioW:   newWorkerLimit(config.PrioWorkerCount),
+			NormalW: newWorkerLimit(config.NormalWorkerCount),
+			NotifyW: newWorkerLimit(config.NotificationWorkerCount),
+		},
+		ctx:      context.Background(),
+		stopping: make(chan struct{}),
+	}
+	s.metrics = newServerMetrics(s)
+	return s
+}
+
+//testQueryMsg returns a message containing a query.
+func testQueryMsg() *message.Message {
+	return &message.Message{
+		Token: token.New(),
+		Content: []section.Section{&query.Name{Name: "www.example.", Context: ".",
+			Types: []object.Type{object.OTIP4Addr}, Expiration: time.Now().Add(time.Minute).Unix()}},
+	}
+}
+
+//signTestMsg signs msg with key under the key id of section.Signature.
+func signTestMsg(t *testing.T, msg *message.Message, key ed25519.PrivateKey) {
+	sig := section.Signature()
+	msg.Signatures = []signature.Sig{sig}
+	if err := siglib.SignMessageUnsafe(msg,
+		map[keys.PublicKeyID]interface{}{sig.PublicKeyID: key}); err != nil {
+		t.Fatalf("Was not able to sign message: %v", err)
+	}
+}
+
+//cacheInfraKey adds an assertion with key as infrastructure key of ns.example. to s's cache.
+func cacheInfraKey(s *Server, key ed25519.PublicKey) {
+	a := &section.Assertion{
+		SubjectName: "ns",
+		SubjectZone: "example.",
+		Context:     ".",
+		Content: []object.Object{{Type: object.OTInfraKey, Value: keys.PublicKey{
+			PublicKeyID: section.Signature().PublicKeyID,
+			Key:         key,
+		}}},
+	}
+	expiration := time.Now().Add(time.Hour).Unix()
+	a.UpdateValidity(time.Now().Add(-time.Minute).Unix(), expiration, 24*time.Hour)
+	s.caches.AssertionsCache.Add(a, expiration, false)
+}
+
+func TestCheckMessageSignatures(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5022}
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	signed := testQueryMsg()
+	signTestMsg(t, signed, privKey)
+	wrongKey := testQueryMsg()
+	signTestMsg(t, wrongKey, otherKey)
+	unsigned := testQueryMsg()
+	//Only answers with signed sections to queries with a token of this server are exempted.
+	own, client := token.New(), token.New()
+	answer := &message.Message{Token: own,
+		Content: []section.Section{testAssertion("www", "example.", ".")}}
+	ownQuery := testQueryMsg()
+	ownQuery.Token = own
+	notification := &message.Message{Token: own, Content: []section.Section{
+		&section.Notification{Type: section.NTNoAssertionsExist, Token: own}}}
+	clientAnswer := &message.Message{Token: client,
+		Content: []section.Section{testAssertion("www", "example.", ".")}}
+	var tests = []struct {
+		policy   string
+		msg      *message.Message
+		sender   net.Addr
+		keyKnown bool
+		accepted bool
+	}{
+		{sigPolicyNone, unsigned, peer, true, true},
+		{sigPolicyNone, wrongKey, peer, true, true},
+		{sigPolicyVerify, signed, peer, true, true},
+		{sigPolicyVerify, unsigned, peer, true, true},
+		{sigPolicyVerify, wrongKey, peer, true, false},
+		{sigPolicyVerify, signed, peer, false, false},
+		{sigPolicyVerify, wrongKey, other, true, true},
+		{sigPolicyRequire, signed, peer, true, true},
+		{sigPolicyRequire, unsigned, peer, true, false},
+		{sigPolicyRequire, wrongKey, peer, true, false},
+		{sigPolicyRequire, signed, other, true, false},
+		{sigPolicyRequire, answer, peer, true, true},
+		{sigPolicyRequire, ownQuery, peer, true, false},
+		{sigPolicyRequire, notification, peer, true, false},
+		{sigPolicyRequire, clientAnswer, peer, true, false},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.MessageSigPolicy = test.policy
+		s := newTestServer(config)
+		s.infraPeers, _ = newInfraPeers([]InfraKeyPeer{
+			{Prefix: "192.0.2.0/24", Name: "ns.example.", Context: "."}})
+		if test.keyKnown {
+			cacheInfraKey(s, pubKey)
+		}
+		s.forwardedTokens.add(own, time.Now().Add(time.Minute).Unix())
+		s.caches.PendingQueries.Add(util.MsgSectionSender{}, client,
+			time.Now().Add(time.Minute).Unix())
+		//Without resolver, the server cannot query a missing key and rejects the message.
+		accepted := s.checkMessageSignatures(test.msg, test.sender, true)
+		if accepted != test.accepted {
+			t.Errorf("%d: wrong result for policy %s. expected=%t actual=%t", i, test.policy,
+				test.accepted, accepted)
+		}
+	}
+}
+
+func TestPendingSignedCallback(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	pubKey, privKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	var tests = []struct {
+		key      ed25519.PrivateKey
+		enqueued bool
+	}{
+		{privKey, true},
+		{otherKey, false},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.MessageSigPolicy = sigPolicyRequire
+		s := newTestServer(config)
+		s.infraPeers, _ = newInfraPeers([]InfraKeyPeer{
+			{Prefix: "192.0.2.0/24", Name: "ns.example.", Context: "."}})
+		msg := testQueryMsg()
+		signTestMsg(t, msg, test.key)
+		tok, _, _ := s.pendingSigned.add("ns.example.", ".", msg, peer,
+			time.Now().Add(time.Minute).Unix())
+		cacheInfraKey(s, pubKey)
+		s.pendingSignedCallback(tok)
+		if enqueued := len(s.queues.Normal) == 1; enqueued != test.enqueued {
+			t.Errorf("%d: wrong result of deferred check. expected=%t actual=%t", i,
+				test.enqueued, enqueued)
+		}
+		if s.pendingSigned.containsToken(tok) {
+			t.Errorf("%d: message still waits after the key arrived", i)
+		}
+	}
+}
+
+func TestPendingSignedMessages(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	sender := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	future := time.Now().Add(time.Minute).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	var tests = []struct {
+		name       string
+		expiration int64
+		isNew      bool
+		ok         bool
+	}{
+		{"ns.example.", future, true, true},
+		{"ns.example.", future, false, true},
+		{"ns.example.org.", future, true, true},
+		{"ns.example.net.", future, false, false},
+	}
+	p := newPendingSignedMessages(3)
+	tokens := []token.Token{}
+	for i, test := range tests {
+		tok, isNew, ok := p.add(test.name, ".", testQueryMsg(), sender, test.expiration)
+		if isNew != test.isNew || ok != test.ok {
+			t.Errorf("%d: wrong result of add. expected=(%t,%t) actual=(%t,%t)", i, test.isNew,
+				test.ok, isNew, ok)
+		}
+		tokens = append(tokens, tok)
+	}
+	if tokens[0] != tokens[1] {
+		t.Error("messages waiting for the same key have different tokens")
+	}
+	if msgs := p.getAndRemove(tokens[0]); len(msgs) != 2 {
+		t.Errorf("wrong number of waiting messages. expected=2 actual=%d", len(msgs))
+	}
+	if p.containsToken(tokens[0]) || len(p.getAndRemove(tokens[0])) != 0 {
+		t.Error("messages were not removed")
+	}
+	//Removed messages free space and a new query for the key is sent.
+	if _, isNew, ok := p.add("ns.example.", ".", testQueryMsg(), sender, past); !isNew || !ok {
+		t.Errorf("key was not queried again. isNew=%t ok=%t", isNew, ok)
+	}
+	//Expired queries are removed when a message is added.
+	tok, isNew, ok := p.add("ns.example.net.", ".", testQueryMsg(), sender, future)
+	if !isNew || !ok {
+		t.Errorf("expired query was not removed. isNew=%t ok=%t", isNew, ok)
+	}
+	if msgs := p.getAndRemove(tok); len(msgs) != 1 {
+		t.Errorf("wrong number of waiting messages. expected=1 actual=%d", len(msgs))
+	}
+}
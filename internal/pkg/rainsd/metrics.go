@@ -0,0 +1,293 @@
+package rainsd
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/connection"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/metrics"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	queuePrio   = "prio"
+	queueNormal = "normal"
+	queueNotify = "notify"
+
+	cacheConnection     = "connection"
+	cacheCapability     = "capability"
+	cacheZoneKey        = "zoneKey"
+	cachePendingKey     = "pendingKey"
+	cachePendingQuery   = "pendingQuery"
+	cacheAssertion      = "assertion"
+	cacheNegAssertion   = "negAssertion"
+	directionSent       = "sent"
+	directionReceived   = "received"
+	lookupHit           = "hit"
+	lookupMiss          = "miss"
+	verificationValid   = "valid"
+	verificationInvalid = "invalid"
+)
+
+//serverMetrics contains the metrics of a server which are updated while processing messages.
+//Queue and cache sizes are computed when the metrics are read.
+type serverMetrics struct {
+	registry *metrics.Registry
+	//cacheLookups counts cache lookups by cache and result (hit or miss).
+	cacheLookups *metrics.Counter
+	//verifications counts signature verifications of sections by result (valid or invalid).
+	verifications *metrics.Counter
+	//notifications counts notifications by direction (sent or received) and notification type.
+	notifications *metrics.Counter
+	//messages counts messages by transport and direction (sent or received).
+	messages *metrics.Counter
+	//rateLimited counts messages and answers exceeding a rate limit by limit (address, prefix or
+	//response).
+	rateLimited *metrics.Counter
+}
+
+//newServerMetrics creates the metrics of s. It must be called after the server's queues and caches
+//have been initialized.
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.New()
+	m := &serverMetrics{
+		registry: r,
+		cacheLookups: r.NewCounter("rains_cache_lookups_total",
+			"Number of cache lookups by cache and result.", "cache", "result"),
+		verifications: r.NewCounter("rains_signature_verifications_total",
+			"Number of verified sections by result.", "result"),
+		notifications: r.NewCounter("rains_notifications_total",
+			"Number of notifications by direction and type.", "direction", "type"),
+		messages: r.NewCounter("rains_messages_total",
+			"Number of messages by transport and direction.", "transport", "direction"),
+		rateLimited: r.NewCounter("rains_rate_limited_total",
+			"Number of messages and answers exceeding a rate limit by limit.", "limit"),
+	}
+	queueLen := r.NewGauge("rains_queue_length", "Number of messages waiting in a queue.", "queue")
+	queueCap := r.NewGauge("rains_queue_capacity", "Maximum number of messages in a queue.", "queue")
+	workersBusy := r.NewGauge("rains_queue_workers_busy",
+		"Number of go routines working on a queue.", "queue")
+	workersMax := r.NewGauge("rains_queue_workers_max",
+		"Maximum number of go routines working on a queue.", "queue")
+	for name, q := range map[string]chan util.MsgSectionSender{queuePrio: s.queues.Prio,
+		queueNormal: s.queues.Normal, queueNotify: s.queues.Notify} {
+		q := q
+		queueLen.Func(func() float64 { return float64(len(q)) }, name)
+		queueCap.Func(func() float64 { return float64(cap(q)) }, name)
+	}
+	for name, w := range map[string]*workerLimit{queuePrio: s.queues.PrioW,
+		queueNormal: s.queues.NormalW, queueNotify: s.queues.NotifyW} {
+		w := w
+		workersBusy.Func(func() float64 {
+			active, _ := w.usage()
+			return float64(active)
+		}, name)
+		workersMax.Func(func() float64 {
+			_, limit := w.usage()
+			return float64(limit)
+		}, name)
+	}
+	untracked := r.NewGauge("rains_event_log_untracked_queries",
+		"Number of received queries whose answers are logged without latency.")
+	untracked.Func(func() float64 { return float64(s.events.untrackedQueries()) })
+	entries := r.NewGauge("rains_cache_entries", "Number of entries in a cache.", "cache")
+	hitRatio := r.NewGauge("rains_cache_hit_ratio", "Fraction of cache lookups which were hits.",
+		"cache")
+	for name, c := range map[string]interface{ Len() int }{
+		cacheConnection:   s.caches.ConnCache,
+		cacheCapability:   s.caches.Capabilities,
+		cacheZoneKey:      s.caches.ZoneKeyCache,
+		cachePendingKey:   s.caches.PendingKeys,
+		cachePendingQuery: s.caches.PendingQueries,
+		cacheAssertion:    s.caches.AssertionsCache,
+		cacheNegAssertion: s.caches.NegAssertionCache,
+	} {
+		name, c := name, c
+		entries.Func(func() float64 { return float64(c.Len()) }, name)
+		hitRatio.Func(func() float64 { return m.hitRatio(name) }, name)
+	}
+	return m
+}
+
+func (m *serverMetrics) hitRatio(cacheName string) float64 {
+	hits := m.cacheLookups.Value(cacheName, lookupHit)
+	misses := m.cacheLookups.Value(cacheName, lookupMiss)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (m *serverMetrics) lookup(cacheName string, hit bool) {
+	if hit {
+		m.cacheLookups.Inc(cacheName, lookupHit)
+	} else {
+		m.cacheLookups.Inc(cacheName, lookupMiss)
+	}
+}
+
+func (m *serverMetrics) verification(valid bool) {
+	if valid {
+		m.verifications.Inc(verificationValid)
+	} else {
+		m.verifications.Inc(verificationInvalid)
+	}
+}
+
+//message counts msg as sent to or received from addr, including all notifications it contains.
+func (m *serverMetrics) message(msg *message.Message, addr net.Addr, direction string) {
+	m.messages.Inc(transportName(addr), direction)
+	for _, sec := range msg.Content {
+		if n, ok := sec.(*section.Notification); ok {
+			m.notifications.Inc(direction, notificationTypeLabel(n.Type))
+		}
+	}
+}
+
+//notificationTypeLabel returns the metric label of t. All types which are not defined share the
+//label unknown such that peers cannot create arbitrarily many counters.
+func notificationTypeLabel(t section.NotificationType) string {
+	switch t {
+	case section.NTHeartbeat, section.NTZoneTransfer, section.NTZoneChanged,
+		section.NTCapHashNotKnown, section.NTBadMessage, section.NTRcvInconsistentMsg,
+		section.NTNoAssertionsExist, section.NTMsgTooLarge, section.NTUnspecServerErr,
+		section.NTServerNotCapable, section.NTNoAssertionAvail:
+		return t.String()
+	}
+	return "unknown"
+}
+
+//transportName returns the name of the transport over which addr is reached.
+func transportName(addr net.Addr) string {
+	switch a := addr.(type) {
+	case packetAddr:
+		return strings.ToLower(a.listener.info.Type.String())
+	case *net.TCPAddr:
+		return strings.ToLower(connection.TCP.String())
+	case *net.UDPAddr:
+		return strings.ToLower(connection.UDP.String())
+	case *snet.UDPAddr:
+		return strings.ToLower(connection.SCION.String())
+	default:
+		return "unknown"
+	}
+}
+
+//measureSystemRessources starts serving the server's metrics on the configured metrics address.
+func (s *Server) measureSystemRessources() {
+	if s.config.MetricsAddress == "" {
+		log.Warn("No metrics address configured. Metrics are only available on the admin API")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry)
+	s.metricsServer = &http.Server{Addr: s.config.MetricsAddress, Handler: mux}
+	s.goRead(func() {
+		log.Info("Serving metrics", "addr", s.config.MetricsAddress)
+		if err := s.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("Metrics endpoint stopped", "addr", s.config.MetricsAddress, "error", err)
+		}
+	})
+}
+
+//instrumentCaches wraps all caches of caches such that lookups are counted in m.
+func instrumentCaches(caches *Caches, m *serverMetrics) {
+	caches.ConnCache = connCacheMetrics{caches.ConnCache, m}
+	caches.Capabilities = capabilityCacheMetrics{caches.Capabilities, m}
+	caches.ZoneKeyCache = zoneKeyCacheMetrics{caches.ZoneKeyCache, m}
+	caches.PendingKeys = pendingKeyCacheMetrics{caches.PendingKeys, m}
+	caches.PendingQueries = pendingQueryCacheMetrics{caches.PendingQueries, m}
+	caches.AssertionsCache = assertionCacheMetrics{caches.AssertionsCache, m}
+	caches.NegAssertionCache = negAssertionCacheMetrics{caches.NegAssertionCache, m}
+}
+
+type connCacheMetrics struct {
+	cache.Connection
+	m *serverMetrics
+}
+
+func (c connCacheMetrics) GetConnection(dstAddr net.Addr) ([]net.Conn, bool) {
+	conns, ok := c.Connection.GetConnection(dstAddr)
+	c.m.lookup(cacheConnection, ok)
+	return conns, ok
+}
+
+type capabilityCacheMetrics struct {
+	cache.Capability
+	m *serverMetrics
+}
+
+func (c capabilityCacheMetrics) Get(hash []byte) ([]message.Capability, bool) {
+	caps, ok := c.Capability.Get(hash)
+	c.m.lookup(cacheCapability, ok)
+	return caps, ok
+}
+
+type zoneKeyCacheMetrics struct {
+	cache.ZonePublicKey
+	m *serverMetrics
+}
+
+func (c zoneKeyCacheMetrics) Get(zone, context string, sigMetaData signature.MetaData) (
+	keys.PublicKey, *section.Assertion, bool) {
+	key, a, ok := c.ZonePublicKey.Get(zone, context, sigMetaData)
+	c.m.lookup(cacheZoneKey, ok)
+	return key, a, ok
+}
+
+type pendingKeyCacheMetrics struct {
+	cache.PendingKey
+	m *serverMetrics
+}
+
+func (c pendingKeyCacheMetrics) GetAndRemove(t token.Token) (util.MsgSectionSender, int, bool) {
+	ss, queries, ok := c.PendingKey.GetAndRemove(t)
+	c.m.lookup(cachePendingKey, ok)
+	return ss, queries, ok
+}
+
+type pendingQueryCacheMetrics struct {
+	cache.PendingQuery
+	m *serverMetrics
+}
+
+func (c pendingQueryCacheMetrics) GetAndRemove(t token.Token) []util.MsgSectionSender {
+	ss := c.PendingQuery.GetAndRemove(t)
+	c.m.lookup(cachePendingQuery, len(ss) > 0)
+	return ss
+}
+
+type assertionCacheMetrics struct {
+	cache.Assertion
+	m *serverMetrics
+}
+
+func (c assertionCacheMetrics) Get(fqdn, context string, objType object.Type, strict bool) (
+	[]*section.Assertion, bool) {
+	as, ok := c.Assertion.Get(fqdn, context, objType, strict)
+	c.m.lookup(cacheAssertion, ok)
+	return as, ok
+}
+
+type negAssertionCacheMetrics struct {
+	cache.NegativeAssertion
+	m *serverMetrics
+}
+
+func (c negAssertionCacheMetrics) Get(subjectZone, context string, interval section.Interval) (
+	[]section.WithSigForward, bool) {
+	secs, ok := c.NegativeAssertion.Get(subjectZone, context, interval)
+	c.m.lookup(cacheNegAssertion, ok)
+	return secs, ok
+}
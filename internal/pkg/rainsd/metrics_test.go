@@ -0,0 +1,27 @@
+package rainsd
+
+import (
+	"testing"
+
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+func TestNotificationTypeLabel(t *testing.T) {
+	var tests = []struct {
+		input section.NotificationType
+		label string
+	}{
+		{section.NTHeartbeat, "NTHeartbeat"},
+		{section.NTBadMessage, "NTBadMessage"},
+		{section.NTNoAssertionAvail, "NTNoAssertionAvail"},
+		{0, "unknown"},
+		{402, "unknown"},
+		{1 << 30, "unknown"},
+	}
+	for i, test := range tests {
+		if label := notificationTypeLabel(test.input); label != test.label {
+			t.Errorf("%d: wrong label for %d. expected=%s actual=%s", i, test.input, test.label,
+				label)
+		}
+	}
+}
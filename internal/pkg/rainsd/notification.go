@@ -1,6 +1,7 @@
 package rainsd
 
 import (
+	"net"
 	"strings"
 
 	log "github.com/inconshreveable/log15"
@@ -15,31 +16,36 @@ import (
 func (s *Server) notify(msgSender util.MsgSectionSender) {
 	notifLog := log.New("notificationMsgSection", msgSender.Sections[0])
 	sec := msgSender.Sections[0].(*section.Notification)
+	s.events.notification(msgSender)
 	switch sec.Type {
 	case section.NTHeartbeat:
+	case section.NTZoneTransfer:
+		s.transferZone(sec, msgSender.Sender)
+	case section.NTZoneChanged:
+		s.zoneChanged(sec, msgSender.Msg, msgSender.Sender)
 	case section.NTCapHashNotKnown:
-		if len(sec.Data) == 0 {
-			caps, _ := s.caches.ConnCache.GetCapabilityList(s.config.ServerAddress.Addr)
-			sendCapability(msgSender.Sender, caps, s)
-		} else {
+		//The notification contains the capabilities of its sender as hash or as list. If the hash
+		//is not known, the sender is notified in turn such that it responds with its list.
+		//Otherwise, this server's capability list is sent to the sender.
+		if sec.Data != "" {
 			if capabilityIsHash(sec.Data) {
 				if caps, ok := s.caches.Capabilities.Get([]byte(sec.Data)); ok {
 					s.caches.ConnCache.AddCapabilityList(msgSender.Sender, caps)
-					ownCaps, _ := s.caches.ConnCache.GetCapabilityList(s.config.ServerAddress.Addr)
-					sendCapability(msgSender.Sender, ownCaps, s)
 				} else {
-					sendNotificationMsg(msgSender.Token, msgSender.Sender, section.NTCapHashNotKnown, "", s)
+					sendNotificationMsg(msgSender.Token, msgSender.Sender, section.NTCapHashNotKnown,
+						s.capabilityList, s)
+					return
 				}
 			} else {
 				cList := []message.Capability{}
 				for _, c := range strings.Split(sec.Data, " ") {
 					cList = append(cList, message.Capability(c))
 				}
+				s.caches.Capabilities.Add(cList)
 				s.caches.ConnCache.AddCapabilityList(msgSender.Sender, cList)
-				ownCaps, _ := s.caches.ConnCache.GetCapabilityList(s.config.ServerAddress.Addr)
-				sendCapability(msgSender.Sender, ownCaps, s)
 			}
 		}
+		sendCapability(msgSender.Sender, s.config.Capabilities, s)
 	case section.NTBadMessage:
 		notifLog.Error("Sent msg was malformed")
 		dropPendingSectionsAndQueries(msgSender.Token, sec, true, s)
@@ -47,11 +53,18 @@ func (s *Server) notify(msgSender util.MsgSectionSender) {
 		notifLog.Error("Sent msg was inconsistent")
 		dropPendingSectionsAndQueries(msgSender.Token, sec, true, s)
 	case section.NTMsgTooLarge:
-		notifLog.Error("Sent msg was too large")
-		//TODO CFE resend message in smaller chunks
+		msg, receiver, ok := s.sentMsgs.getAndRemove(sec.Token, msgSender.Sender)
+		if !ok || len(msg.Content) < 2 {
+			notifLog.Error("Sent msg was too large and cannot be split")
+			dropPendingSectionsAndQueries(sec.Token, sec, true, s)
+			return
+		}
+		notifLog.Info("Sent msg was too large. Resend it in smaller chunks",
+			"sections", len(msg.Content))
+		resendInChunks(msg, receiver, s)
 	case section.NTNoAssertionsExist:
-		notifLog.Info("Bad request, only clients receive this notification type")
-		sendNotificationMsg(msgSender.Token, msgSender.Sender, section.NTBadMessage, "", s)
+		notifLog.Info("No assertion exists")
+		dropPendingSectionsAndQueries(sec.Token, sec, false, s)
 	case section.NTUnspecServerErr:
 		notifLog.Error("Unspecified error of other server")
 		dropPendingSectionsAndQueries(msgSender.Token, sec, false, s)
@@ -67,21 +80,32 @@ func (s *Server) notify(msgSender util.MsgSectionSender) {
 	}
 }
 
+//resendInChunks splits the content of msg in two halves and sends each of them in a separate
+//message with the same token to receiver. If a chunk is still too large, the receiver responds
+//again with NTMsgTooLarge and the chunk gets split further.
+func resendInChunks(msg message.Message, receiver net.Addr, s *Server) {
+	half := len(msg.Content) / 2
+	for _, content := range [][]section.Section{msg.Content[:half], msg.Content[half:]} {
+		chunk := message.Message{Token: msg.Token, Content: content}
+		if err := s.sendTo(chunk, receiver, 1, 1); err != nil {
+			log.Warn("Was not able to resend chunk of too large msg", "receiver", receiver,
+				"error", err)
+		}
+	}
+}
+
 //capabilityIsHash returns true if capabilities are represented as a hash.
 func capabilityIsHash(capabilities string) bool {
 	return !strings.HasPrefix(capabilities, "urn:")
 }
 
 //dropPendingSectionsAndQueries removes all entries from the pending caches matching token and
-//forwards the received notification or unspecServerErr depending on serverError flag
+//forwards the received notification or unspecServerErr depending on serverError flag. Sections
+//waiting for the answer to a failed delegation query are kept and the next delegation query is sent.
 func dropPendingSectionsAndQueries(token token.Token, notification *section.Notification,
 	serverError bool, s *Server) {
-	if ss, ok := s.caches.PendingKeys.GetAndRemove(token); ok {
-		if serverError {
-			sendNotificationMsg(ss.Token, ss.Sender, section.NTUnspecServerErr, "", s)
-		} else {
-			sendNotificationMsg(ss.Token, ss.Sender, notification.Type, notification.Data, s)
-		}
+	if ss, sent, ok := s.caches.PendingKeys.GetAndRemove(token); ok {
+		s.retryMissingKeys(ss, sent)
 	}
 	sectionSenders := s.caches.PendingQueries.GetAndRemove(token)
 	for _, ss := range sectionSenders {
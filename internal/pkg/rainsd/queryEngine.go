@@ -1,14 +1,16 @@
 package rainsd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	cbor "github.com/britram/borat"
 	log "github.com/inconshreveable/log15"
-	"github.com/netsec-ethz/rains/internal/pkg/cache"
 	"github.com/netsec-ethz/rains/internal/pkg/libresolve"
 	"github.com/netsec-ethz/rains/internal/pkg/message"
 	"github.com/netsec-ethz/rains/internal/pkg/object"
@@ -20,6 +22,9 @@ import (
 
 const (
 	rainsSrvPrefix = "_rains."
+	//maxForwardedTokens is the maximum number of tokens of forwarded queries of which this server
+	//keeps track to recognize their answers.
+	maxForwardedTokens = 10000
 )
 
 //processQuery processes msgSender containing a query section
@@ -33,36 +38,69 @@ func (s *Server) processQuery(msgSender util.MsgSectionSender) {
 			return
 		}
 	}
-	if len(s.config.Authorities) == 0 {
-		//caching resolver
-		answerQueriesCachingResolver(msgSender, s)
-	} else {
+	s.events.query(msgSender)
+	authorities := s.authorities()
+	if len(authorities) > 0 && (!s.config.IntermediaryService ||
+		allAuthoritative(queries, authorities)) {
 		//naming server
 		answerQueriesAuthoritative(queries, msgSender.Sender, msgSender.Token, s)
+	} else if s.config.IntermediaryService {
+		answerQueriesIntermediary(queries, msgSender.Sender, msgSender.Token, s)
+	} else {
+		//caching resolver
+		answerQueriesCachingResolver(msgSender, s)
+	}
+}
+
+//allAuthoritative returns true if all queries are about names this server has authority over.
+func allAuthoritative(queries []*query.Name, authorities []ZoneContext) bool {
+	for _, q := range queries {
+		if _, ok := authority(q, authorities); !ok {
+			return false
+		}
 	}
+	return true
 }
 
-//answerQueryCachingResolver is how a caching resolver answers queries
+//answerQueryCachingResolver is how a caching resolver answers queries. Queries with the
+//QOMaxFreshness option bypass the cache and queries with the QOCachedAnswersOnly option are never
+//forwarded. If both options are present, only cached answers are returned.
 func answerQueriesCachingResolver(ss util.MsgSectionSender, s *Server) {
 	log.Info("Start processing query as cr", "queries", ss.Sections)
 	queries := []*query.Name{}
 	sections := []section.Section{}
+	unanswered := false
 	for _, q := range ss.Sections {
 		q := q.(*query.Name)
-		if secs := cacheLookup(q, ss.Sender, ss.Token, s); secs != nil {
+		cachedOnly := q.ContainsOption(query.QOCachedAnswersOnly)
+		if q.ContainsOption(query.QOMaxFreshness) && !cachedOnly {
+			log.Debug("Bypassing cache for query with max freshness option", "query", q)
+			queries = append(queries, q)
+		} else if secs := cacheLookup(q, ss.Sender, ss.Token, s); secs != nil {
 			sections = append(sections, secs...)
+		} else if cachedOnly {
+			log.Debug("No cached answer for query with cached answers only option", "query", q)
+			unanswered = true
 		} else {
 			queries = append(queries, q)
 		}
 	}
 	if len(queries) == 0 {
+		if len(sections) == 0 && unanswered {
+			sendNotificationMsg(ss.Token, ss.Sender, section.NTNoAssertionAvail,
+				"no cached answer available", s)
+			return
+		}
+		s.events.setSource(ss.Token, SourceCache)
 		sendSections(sections, ss.Token, ss.Sender, s)
 		return
 	}
 
 	log.Debug("Not all queries have a cached answer", "token", ss.Token)
+	s.events.setSource(ss.Token, SourceForwarded)
 	tok := ss.Token
-	if !ss.Sections[0].(*query.Name).ContainsOption(query.QOTokenTracing) {
+	tokenTracing := ss.Sections[0].(*query.Name).ContainsOption(query.QOTokenTracing)
+	if !tokenTracing {
 		tok = token.New()
 	}
 	validUntil := time.Now().Add(s.config.QueryValidity).Unix() //Upper bound for forwarded query expiration time
@@ -71,6 +109,9 @@ func answerQueriesCachingResolver(ss util.MsgSectionSender, s *Server) {
 			validUntil = q.Expiration
 		}
 	}
+	if !tokenTracing {
+		s.forwardedTokens.add(tok, validUntil)
+	}
 	log.Info("Adding sectionSender to pending query cache", "sectionSender", ss)
 	if isNew := s.caches.PendingQueries.Add(ss, tok, validUntil); isNew {
 		log.Info("Forwarding queries to recursive resolver", "queries", queries)
@@ -85,51 +126,67 @@ func answerQueriesCachingResolver(ss util.MsgSectionSender, s *Server) {
 	}
 }
 
-//answerQueryAuthoritative is how an authoritative server answers queries
+//answerQueryAuthoritative is how an authoritative server answers queries. It never forwards
+//queries and its cached sections are the freshest available. Thus, the QOCachedAnswersOnly and
+//QOMaxFreshness options are always satisfied. A query is answered with the queried assertions, a
+//referral to the closest delegated zone containing the queried name or a shard, pshard or zone
+//proving the name's nonexistence. Queries which are not about a name this server has authority
+//over are skipped. If no query can be answered, the sender is notified instead. All answers are
+//subject to the response rate limit.
 func answerQueriesAuthoritative(qs []*query.Name, sender net.Addr, token token.Token, s *Server) {
 	log.Info("Start processing query as authority", "queries", qs)
-	for _, q := range qs {
-		for i, auth := range s.config.Authorities {
-			// check this server is authoritative for the name and the query has the right context
-			if strings.HasSuffix(q.Name, auth.Zone) && q.Name != auth.Zone && q.Context == auth.Context {
-				break
-			}
-			if i == len(s.config.Authorities)-1 {
-				log.Info("Query is not about a name this zone has authority over", "name", q.Name,
-					"authorities", s.config.Authorities)
-				return
-			}
-		}
-	}
-
-	queries := []*query.Name{}
+	s.events.setSource(token, SourceAuthoritative)
+	authorities := s.authorities()
 	sections := []section.Section{}
+	answerable := false
 	for _, q := range qs {
-		if secs := cacheLookup(q, sender, token, s); secs != nil {
-			sections = append(sections, secs...)
-		} else {
-			queries = append(queries, q)
+		auth, ok := authority(q, authorities)
+		if !ok {
+			log.Info("Query is not about a name this zone has authority over", "name", q.Name,
+				"authorities", authorities)
+			continue
 		}
+		answerable = true
+		sections = append(sections, authoritativeLookup(q, auth, s)...)
 	}
-
-	if len(queries) != 0 {
-		//glueRecordNames assumes that the names of delegates do not contain a dot '.'.
-		names := glueRecordNames(queries, s.config.Authorities)
-		for name := range names {
-			glueRecords, err := s.glueRecordLookup(name.Zone, name.Context, s.caches.AssertionsCache)
-			if err != nil {
-				log.Warn("Was not able to find all glue records.", "name", name, "error", err.Error())
-				return
-			}
-			sections = append(sections, glueRecords...)
+	if len(sections) == 0 {
+		notification := &section.Notification{Type: section.NTNoAssertionsExist,
+			Data: "no assertion exists for the queried names"}
+		if !answerable {
+			notification = &section.Notification{Type: section.NTNoAssertionAvail,
+				Data: "query is not about a name this server has authority over"}
+		}
+		if s.allowResponse([]section.Section{notification}, token, sender) {
+			sendNotificationMsg(token, sender, notification.Type, notification.Data, s)
 		}
+		log.Info("Finished handling query by notifying the sender", "queries", qs,
+			"type", notification.Type)
+		return
+	}
+	if !s.allowResponse(sections, token, sender) {
+		return
 	}
 	sendSections(sections, token, sender, s)
 	log.Info("Finished handling query by sending records from cache", "queries", qs,
 		"sections", sections)
 }
 
-//cacheLookup answers q with a cached entry if there is one. True is returned in case of a cache hit
+//authoritativeLookup returns the queried assertions of q, a referral or a proof of the queried
+//name's nonexistence from the sections of zone, which is one of this server's authorities.
+func authoritativeLookup(q *query.Name, zone ZoneContext, s *Server) []section.Section {
+	if secs := assertionLookup(q, s.authStore.Get); len(secs) > 0 {
+		return secs
+	} else if secs := s.referral(q, zone); len(secs) > 0 {
+		return secs
+	} else if secs := nonexistenceProof(q, zone, s); len(secs) > 0 {
+		return secs
+	}
+	log.Debug("No assertion or proof of nonexistence found", "query", q)
+	return nil
+}
+
+//cacheLookup answers q with a cached entry if there is one. True is returned in case of a cache hit.
+//Expired entries are only returned if q contains the QOExpiredAssertionsOk option.
 func cacheLookup(q *query.Name, sender net.Addr, token token.Token, s *Server) []section.Section {
 	assertions := assertionCacheLookup(q, s)
 	if len(assertions) > 0 {
@@ -146,25 +203,49 @@ func cacheLookup(q *query.Name, sender net.Addr, token token.Token, s *Server) [
 	return nil
 }
 
-func assertionCacheLookup(q *query.Name, s *Server) (assertions []section.Section) {
+func assertionCacheLookup(q *query.Name, s *Server) []section.Section {
+	return assertionLookup(q, cachedAssertions(s.caches.AssertionsCache))
+}
+
+//assertionLookup returns the assertions get returns for the name and types of q. Expired
+//assertions are only returned if q contains the QOExpiredAssertionsOk option. If q contains the
+//QOMinLastHopAnswerSize option, the assertion with the smallest encoding is returned for each name.
+func assertionLookup(q *query.Name, get assertionGetter) (assertions []section.Section) {
+	expiredOk := q.ContainsOption(query.QOExpiredAssertionsOk)
+	minSize := q.ContainsOption(query.QOMinLastHopAnswerSize)
 	assertionSet := make(map[string]bool)
 	asKey := func(a *section.Assertion) string {
 		return fmt.Sprintf("%s_%s_%s", a.SubjectName, a.SubjectZone, a.Context)
 	}
 
 	for _, t := range q.Types {
-		if asserts, ok := s.caches.AssertionsCache.Get(q.Name, q.Context, t, true); ok {
-			for _, a := range asserts {
-				if _, ok := assertionSet[asKey(a)]; ok {
-					continue
+		asserts, ok := get(q.Name, q.Context, t)
+		if !ok {
+			continue
+		}
+		candidates := make(map[string]*section.Assertion)
+		sizes := make(map[string]int)
+		for _, a := range asserts {
+			key := asKey(a)
+			if assertionSet[key] || (!expiredOk && a.ValidUntil() <= time.Now().Unix()) {
+				continue
+			}
+			if _, ok := candidates[key]; !ok {
+				candidates[key] = a
+				if minSize {
+					sizes[key] = encodedSize(a)
 				}
-				if a.ValidUntil() > time.Now().Unix() {
-					log.Debug(fmt.Sprintf("appending valid assertion: %v", a))
-					assertions = append(assertions, a)
-					assertionSet[asKey(a)] = true
+			} else if minSize {
+				if size := encodedSize(a); size < sizes[key] {
+					candidates[key], sizes[key] = a, size
 				}
 			}
 		}
+		for key, a := range candidates {
+			log.Debug(fmt.Sprintf("appending valid assertion: %v", a))
+			assertions = append(assertions, a)
+			assertionSet[key] = true
+		}
 	}
 	return
 }
@@ -178,46 +259,49 @@ func negativeCacheLookup(q *query.Name, sender net.Addr, token token.Token, s *S
 		return nil
 	}
 	answer, _ := s.caches.NegAssertionCache.Get(zone, q.Context, section.StringInterval{Name: subject})
-	return filterAnswer(answer)
+	return filterAnswer(answer, q)
 }
 
-func filterAnswer(sections []section.WithSigForward) (answer []section.Section) {
+//filterAnswer removes expired sections unless q contains the QOExpiredAssertionsOk option. If q
+//contains the QOMinLastHopAnswerSize option, only the section with the smallest encoding is
+//returned.
+func filterAnswer(sections []section.WithSigForward, q *query.Name) (answer []section.Section) {
 	//TODO CFE For each type check if one of the zone or shards contain the queried
-	//assertion. If there is at least one assertion answer with it. If no assertion is
-	//contained in a zone or shard for any of the queried connection, answer with the shortest
-	//element. shortest according to what? size in bytes? how to efficiently determine that.
-	//e.g. using gob encoding. alternatively we could also count the number of contained
-	//elements.
+	//assertion. If there is at least one assertion answer with it.
+	expiredOk := q.ContainsOption(query.QOExpiredAssertionsOk)
+	minSize := q.ContainsOption(query.QOMinLastHopAnswerSize)
+	var smallest section.Section
+	smallestSize := 0
 	for _, s := range sections {
-		answer = append(answer, s)
+		if !expiredOk && s.ValidUntil() <= time.Now().Unix() {
+			continue
+		}
+		if !minSize {
+			answer = append(answer, s)
+			continue
+		}
+		if size := encodedSize(s); smallest == nil || size < smallestSize {
+			smallest, smallestSize = s, size
+		}
+	}
+	if smallest != nil {
+		answer = append(answer, smallest)
 	}
 	return
 }
 
-//glueRecordNames returns the unique names for which glue records should be looked up based on qs.
-//It assumes that the names of all delegates do not contain a dot '.'.
-func glueRecordNames(qs []*query.Name, zoneAuths []ZoneContext) map[ZoneContext]bool {
-	result := make(map[ZoneContext]bool)
-	for _, q := range qs {
-		for _, auth := range zoneAuths {
-			if strings.HasSuffix(q.Name, auth.Zone) {
-				name := strings.TrimSuffix(q.Name, auth.Zone)
-				names := strings.Split(name, ".")
-				if len(names) > 1 && names[len(names)-1] == "" {
-					name = fmt.Sprintf("%s.%s", names[len(names)-2], auth.Zone)
-				} else { //root zone
-					name = names[len(names)-1] + auth.Zone
-				}
-				result[ZoneContext{name, q.Context}] = true
-			}
-		}
+//encodedSize returns the number of bytes of sec's cbor encoding.
+func encodedSize(sec section.WithSigForward) int {
+	encoding := new(bytes.Buffer)
+	if err := sec.MarshalCBOR(cbor.NewCBORWriter(encoding)); err != nil {
+		log.Warn("Was not able to marshal section", "section", sec, "error", err)
 	}
-	return result
+	return encoding.Len()
 }
 
-func (s *Server) glueRecordLookup(name, context string, cache cache.Assertion) ([]section.Section, error) {
+func (s *Server) glueRecordLookup(name, context string, get assertionGetter) ([]section.Section, error) {
 	var assertions []section.Section
-	asserts, ok := cache.Get(name, context, object.OTDelegation, true)
+	asserts, ok := get(name, context, object.OTDelegation)
 	if !ok {
 		return nil, errors.New("no delegation assertion found")
 	}
@@ -226,14 +310,14 @@ func (s *Server) glueRecordLookup(name, context string, cache cache.Assertion) (
 	}
 
 	//Follow redirect and get all assertions along the way
-	asserts, ok = cache.Get(name, context, object.OTRedirection, true) //returns cached redirect assertions in random order
+	asserts, ok = get(name, context, object.OTRedirection) //returns redirect assertions in random order
 	if !ok {
 		return nil, errors.New("no redirect assertion found")
 	}
 	for _, a := range asserts {
 		for _, o := range a.Content {
 			if o.Type == object.OTRedirection {
-				if answers, err := s.handleRedirect(o.Value.(string), context, cache,
+				if answers, err := s.handleRedirect(o.Value.(string), context, get,
 					libresolve.AllowedRedirectTypes); err == nil {
 					assertions = append(assertions, a) //append redir
 					for _, answer := range answers {
@@ -247,29 +331,29 @@ func (s *Server) glueRecordLookup(name, context string, cache cache.Assertion) (
 	return nil, errors.New("no redir ended in a host addr")
 }
 
-func (s *Server) handleRedirect(name, context string, cache cache.Assertion, allowedTypes map[object.Type]bool) ([]*section.Assertion, error) {
+func (s *Server) handleRedirect(name, context string, get assertionGetter, allowedTypes map[object.Type]bool) ([]*section.Assertion, error) {
 	if allowedTypes[object.OTIP6Addr] {
-		if asserts, ok := cache.Get(name, context, object.OTIP6Addr, true); ok {
+		if asserts, ok := get(name, context, object.OTIP6Addr); ok {
 			return asserts, nil
 		}
 	}
 	if allowedTypes[object.OTIP4Addr] {
-		if asserts, ok := cache.Get(name, context, object.OTIP4Addr, true); ok {
+		if asserts, ok := get(name, context, object.OTIP4Addr); ok {
 			return asserts, nil
 		}
 	}
 	if allowedTypes[object.OTScionAddr] {
-		if asserts, ok := cache.Get(name, context, object.OTScionAddr, true); ok {
+		if asserts, ok := get(name, context, object.OTScionAddr); ok {
 			return asserts, nil
 		}
 	}
 	if allowedTypes[object.OTServiceInfo] && strings.HasPrefix(name, rainsSrvPrefix) {
-		if asserts, ok := cache.Get(name, context, object.OTServiceInfo, true); ok {
+		if asserts, ok := get(name, context, object.OTServiceInfo); ok {
 			for _, srv := range asserts {
 				for _, srvObj := range srv.Content {
 					if srvObj.Type == object.OTServiceInfo {
 						srvVal := srvObj.Value.(object.ServiceInfo)
-						if as, err := s.handleRedirect(srvVal.Name, context, cache,
+						if as, err := s.handleRedirect(srvVal.Name, context, get,
 							libresolve.AllowedAddrTypes); err == nil {
 							return append(as, srv), nil
 						}
@@ -279,7 +363,7 @@ func (s *Server) handleRedirect(name, context string, cache cache.Assertion, all
 		}
 	}
 	if allowedTypes[object.OTName] {
-		if asserts, ok := cache.Get(name, context, object.OTName, true); ok {
+		if asserts, ok := get(name, context, object.OTName); ok {
 			for _, name := range asserts {
 				for _, nameObj := range name.Content {
 					if nameObj.Type == object.OTName {
@@ -288,7 +372,7 @@ func (s *Server) handleRedirect(name, context string, cache cache.Assertion, all
 						for _, t := range nameVal.Types {
 							allowTypes[t] = true
 						}
-						if as, err := s.handleRedirect(nameVal.Name, context, cache,
+						if as, err := s.handleRedirect(nameVal.Name, context, get,
 							allowTypes); err == nil {
 							return append(as, name), nil
 						}
@@ -318,3 +402,42 @@ func toSubjectZone(name string) (subject, zone string, e error) {
 	log.Debug("Split into zone and name", "subject", subject, "zone", zone)
 	return
 }
+
+//tokenSet contains tokens until they expire. It is safe for concurrent use.
+type tokenSet struct {
+	mutex   sync.Mutex
+	tokens  map[token.Token]int64
+	maxSize int
+}
+
+func newTokenSet(maxSize int) *tokenSet {
+	return &tokenSet{tokens: make(map[token.Token]int64), maxSize: maxSize}
+}
+
+//add adds tok which expires at expiration. If the set is full, the expired tokens are removed and
+//tok is not added if there is still no space.
+func (t *tokenSet) add(tok token.Token, expiration int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.tokens) >= t.maxSize {
+		now := time.Now().Unix()
+		for tok, exp := range t.tokens {
+			if exp < now {
+				delete(t.tokens, tok)
+			}
+		}
+		if len(t.tokens) >= t.maxSize {
+			log.Warn("Too many forwarded queries are tracked")
+			return
+		}
+	}
+	t.tokens[tok] = expiration
+}
+
+//contains returns true if tok is in the set and has not expired.
+func (t *tokenSet) contains(tok token.Token) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	exp, ok := t.tokens[tok]
+	return ok && exp >= time.Now().Unix()
+}
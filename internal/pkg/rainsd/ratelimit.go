@@ -0,0 +1,262 @@
+package rainsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/netsec-ethz/rains/internal/pkg/cbor"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+)
+
+//Rate limit actions
+const (
+	//rateLimitDrop silently drops messages exceeding a rate limit.
+	rateLimitDrop = "drop"
+	//rateLimitNotify answers messages exceeding a rate limit with a notification of type
+	//NTUnspecServerErr.
+	rateLimitNotify = "notify"
+
+	limitAddress  = "address"
+	limitPrefix   = "prefix"
+	limitResponse = "response"
+
+	//maxRateLimitBuckets is the maximum number of addresses, prefixes or answers for which a rate
+	//limiter keeps track of the rate.
+	maxRateLimitBuckets = 100000
+)
+
+//checkRateLimits returns an error if the rate limit configuration of config is invalid.
+func checkRateLimits(config Config) error {
+	switch config.RateLimitAction {
+	case rateLimitDrop, rateLimitNotify:
+	default:
+		return fmt.Errorf("unknown rate limit action: %s", config.RateLimitAction)
+	}
+	if config.RateLimit < 0 || config.PrefixRateLimit < 0 || config.ResponseRateLimit < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if config.RateLimitIPv4PrefixLength > 32 || config.RateLimitIPv6PrefixLength > 128 {
+		return fmt.Errorf("invalid rate limit prefix length: ipv4=%d ipv6=%d",
+			config.RateLimitIPv4PrefixLength, config.RateLimitIPv6PrefixLength)
+	}
+	return nil
+}
+
+//tokenBucket allows rate events per second on average and bursts of up to burst events.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//take refills b for the time passed since the last call and removes one token. It returns false
+//if no token is left.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//full returns true if b would be completely refilled at time now.
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+//rateLimiter keeps a token bucket per key. It is safe for concurrent use.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setLimit(rate, burst)
+	return l
+}
+
+//setLimit changes the rate and burst of all buckets. A rate of zero disables the limit. All
+//buckets are reset if the limit changes.
+func (l *rateLimiter) setLimit(rate float64, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	if rate != l.rate || burst != l.burst {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	l.rate, l.burst = rate, burst
+}
+
+//allow returns true if the bucket of key has a token left.
+func (l *rateLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.removeFull(now)
+		}
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, l.rate, l.burst)
+}
+
+//removeFull deletes all buckets which are completely refilled as they do not differ from new ones.
+//If all buckets are in use, an arbitrary bucket is deleted. The caller must hold the lock.
+func (l *rateLimiter) removeFull(now time.Time) {
+	for k, b := range l.buckets {
+		if b.full(now, l.rate, l.burst) {
+			delete(l.buckets, k)
+		}
+	}
+	for k := range l.buckets {
+		if len(l.buckets) < maxRateLimitBuckets {
+			return
+		}
+		delete(l.buckets, k)
+	}
+}
+
+//rateLimits contains the rate limiters of a server. It is safe for concurrent use.
+type rateLimits struct {
+	//addresses limits the messages per source address.
+	addresses *rateLimiter
+	//prefixes limits the messages per source prefix.
+	prefixes *rateLimiter
+	//responses limits identical answers of an authoritative server per destination prefix.
+	responses *rateLimiter
+	mutex     sync.RWMutex
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	notify    bool
+}
+
+func newRateLimits(config Config) *rateLimits {
+	l := &rateLimits{
+		addresses: newRateLimiter(config.RateLimit, config.RateLimitBurst),
+		prefixes:  newRateLimiter(config.PrefixRateLimit, config.PrefixRateLimitBurst),
+		responses: newRateLimiter(config.ResponseRateLimit, config.ResponseRateLimitBurst),
+	}
+	l.configure(config)
+	return l
+}
+
+//configure applies the rate limits of config.
+func (l *rateLimits) configure(config Config) {
+	l.addresses.setLimit(config.RateLimit, config.RateLimitBurst)
+	l.prefixes.setLimit(config.PrefixRateLimit, config.PrefixRateLimitBurst)
+	l.responses.setLimit(config.ResponseRateLimit, config.ResponseRateLimitBurst)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ipv4Mask = net.CIDRMask(config.RateLimitIPv4PrefixLength, 32)
+	l.ipv6Mask = net.CIDRMask(config.RateLimitIPv6PrefixLength, 128)
+	l.notify = config.RateLimitAction == rateLimitNotify
+}
+
+//prefix returns the network containing ip whose rate is limited together.
+func (l *rateLimits) prefix(ip net.IP) string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.ipv4Mask).String()
+	}
+	return ip.Mask(l.ipv6Mask).String()
+}
+
+func (l *rateLimits) notifyExcess() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.notify
+}
+
+//allowMessage returns true if neither the rate limit of sender's address nor of its prefix is
+//exceeded. It is called before a message is decoded and data contains the message's encoding or a
+//prefix of it. Answers to queries of this server containing only signed sections are never
+//limited. A message exceeding a limit is dropped or answered with a notification depending on the
+//rate limit action.
+func (s *Server) allowMessage(data []byte, sender net.Addr) bool {
+	ip := addrIP(sender)
+	if ip == nil {
+		return true
+	}
+	limit := ""
+	if !s.rateLimits.addresses.allow(ip.String()) {
+		limit = limitAddress
+	} else if !s.rateLimits.prefixes.allow(s.rateLimits.prefix(ip)) {
+		limit = limitPrefix
+	} else {
+		return true
+	}
+	tok, _ := message.PeekToken(data)
+	if s.isOwnToken(tok) {
+		//Only answers which exclusively contain signed sections are exempted. The message is decoded
+		//as the token alone does not tell what the message contains.
+		msg := message.Message{}
+		if err := cbor.NewReader(bytes.NewReader(data)).Unmarshal(&msg); err == nil &&
+			s.isResponse(&msg) {
+			return true
+		}
+	}
+	s.rateLimited(tok, sender, limit)
+	return false
+}
+
+//allowResponse returns true if the response rate limit permits to send sections to receiver.
+//Answers containing the same sections to the same prefix share their rate.
+func (s *Server) allowResponse(sections []section.Section, tok token.Token,
+	receiver net.Addr) bool {
+	ip := addrIP(receiver)
+	if ip == nil {
+		return true
+	}
+	if s.rateLimits.responses.allow(responseKey(s.rateLimits.prefix(ip), sections)) {
+		return true
+	}
+	s.rateLimited(tok, receiver, limitResponse)
+	return false
+}
+
+//rateLimited counts a message exceeding limit and notifies sender if so configured.
+func (s *Server) rateLimited(tok token.Token, sender net.Addr, limit string) {
+	log.Debug("Rate limit exceeded", "sender", sender, "limit", limit, "token", tok)
+	s.metrics.rateLimited.Inc(limit)
+	if s.rateLimits.notifyExcess() {
+		sendNotificationMsg(tok, sender, section.NTUnspecServerErr, "rate limit exceeded", s)
+	}
+}
+
+//responseKey identifies the answer containing sections to prefix.
+func responseKey(prefix string, sections []section.Section) string {
+	key := []string{prefix}
+	for _, sec := range sections {
+		switch sec := sec.(type) {
+		case section.WithSigForward:
+			key = append(key, fmt.Sprintf("%T %s %s %s %s", sec, sec.GetSubjectZone(),
+				sec.GetContext(), sec.Begin(), sec.End()))
+		default:
+			key = append(key, fmt.Sprintf("%T", sec))
+		}
+	}
+	return strings.Join(key, " ")
+}
@@ -0,0 +1,234 @@
+package rainsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cbor"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	now := time.Now()
+	var tests = []struct {
+		tokens  float64
+		elapsed time.Duration
+		rate    float64
+		burst   int
+		allowed bool
+		left    float64
+	}{
+		{5, 0, 1, 5, true, 4},
+		{1, 0, 1, 5, true, 0},
+		{0, 0, 1, 5, false, 0},
+		{0.5, 0, 1, 5, false, 0.5},
+		{0, time.Second, 1, 5, true, 0},
+		{0, 2 * time.Second, 1, 5, true, 1},
+		{0, time.Minute, 1, 5, true, 4},
+		{0, 500 * time.Millisecond, 4, 5, true, 1},
+	}
+	for i, test := range tests {
+		b := &tokenBucket{tokens: test.tokens, last: now.Add(-test.elapsed)}
+		if allowed := b.take(now, test.rate, test.burst); allowed != test.allowed {
+			t.Errorf("%d: wrong result. expected=%t actual=%t", i, test.allowed, allowed)
+		}
+		if b.tokens != test.left || b.last != now {
+			t.Errorf("%d: wrong bucket state. expected=(%v,%v) actual=(%v,%v)", i, test.left, now,
+				b.tokens, b.last)
+		}
+	}
+}
+
+func TestRateLimiterRemoveFull(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(1, 2)
+	l.buckets = map[string]*tokenBucket{
+		"full":     {tokens: 2, last: now},
+		"used":     {tokens: 0, last: now},
+		"refilled": {tokens: 0, last: now.Add(-10 * time.Second)},
+		"partial":  {tokens: 1, last: now.Add(-500 * time.Millisecond)},
+	}
+	l.removeFull(now)
+	var tests = []struct {
+		key  string
+		kept bool
+	}{
+		{"full", false},
+		{"used", true},
+		{"refilled", false},
+		{"partial", true},
+	}
+	for i, test := range tests {
+		if _, ok := l.buckets[test.key]; ok != test.kept {
+			t.Errorf("%d: wrong result for bucket %s. expected kept=%t actual=%t", i, test.key,
+				test.kept, ok)
+		}
+	}
+
+	//If all buckets are in use, an arbitrary one is removed to make room for a new bucket.
+	l.buckets = make(map[string]*tokenBucket)
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		l.buckets[fmt.Sprint(i)] = &tokenBucket{tokens: 0, last: now}
+	}
+	if !l.allow("new") {
+		t.Error("new key was limited")
+	}
+	if len(l.buckets) != maxRateLimitBuckets {
+		t.Errorf("wrong number of buckets. expected=%d actual=%d", maxRateLimitBuckets,
+			len(l.buckets))
+	}
+	if _, ok := l.buckets["new"]; !ok {
+		t.Error("bucket of new key was not added")
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	var tests = []struct {
+		rate    float64
+		burst   int
+		allowed []bool
+	}{
+		{0, 1, []bool{true, true, true}},
+		{1, 1, []bool{true, false, false}},
+		{1, 2, []bool{true, true, false}},
+		{1, 0, []bool{true, false, false}},
+	}
+	l := newRateLimiter(0, 0)
+	for i, test := range tests {
+		l.setLimit(test.rate, test.burst)
+		for j, expected := range test.allowed {
+			if allowed := l.allow("key"); allowed != expected {
+				t.Errorf("%d.%d: wrong result. expected=%t actual=%t", i, j, expected, allowed)
+			}
+		}
+	}
+}
+
+func TestRateLimitsPrefix(t *testing.T) {
+	var tests = []struct {
+		ipv4Length int
+		ipv6Length int
+		ip         string
+		prefix     string
+	}{
+		{24, 56, "192.0.2.17", "192.0.2.0"},
+		{16, 56, "192.0.2.17", "192.0.0.0"},
+		{32, 56, "192.0.2.17", "192.0.2.17"},
+		{24, 56, "2001:db8:1:2:3::1", "2001:db8:1::"},
+		{24, 64, "2001:db8:1:2:3::1", "2001:db8:1:2::"},
+		{24, 128, "2001:db8:1:2:3::1", "2001:db8:1:2:3::1"},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.RateLimitIPv4PrefixLength = test.ipv4Length
+		config.RateLimitIPv6PrefixLength = test.ipv6Length
+		l := newRateLimits(config)
+		if prefix := l.prefix(net.ParseIP(test.ip)); prefix != test.prefix {
+			t.Errorf("%d: wrong prefix of %s. expected=%s actual=%s", i, test.ip, test.prefix,
+				prefix)
+		}
+	}
+}
+
+//encodeTestMsg returns the encoding of a message with tok.
+func encodeTestMsg(t *testing.T, tok token.Token) []byte {
+	msg := testQueryMsg()
+	msg.Token = tok
+	return encodeMsg(t, msg)
+}
+
+//encodeMsg returns the encoding of msg.
+func encodeMsg(t *testing.T, msg *message.Message) []byte {
+	encoding := new(bytes.Buffer)
+	if err := cbor.NewWriter(encoding).Marshal(msg); err != nil {
+		t.Fatalf("Was not able to encode message: %v", err)
+	}
+	return encoding.Bytes()
+}
+
+func TestAllowMessage(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	config := DefaultConfig()
+	config.RateLimit = 1
+	config.RateLimitBurst = 1
+	config.PrefixRateLimit = 1
+	config.PrefixRateLimitBurst = 2
+	s := newTestServer(config)
+	//Only answers containing signed sections to queries with a token of this server are exempted.
+	own, client := token.New(), token.New()
+	s.forwardedTokens.add(own, time.Now().Add(time.Minute).Unix())
+	s.caches.PendingQueries.Add(util.MsgSectionSender{}, client,
+		time.Now().Add(time.Minute).Unix())
+	answer := func(tok token.Token) []byte {
+		return encodeMsg(t, &message.Message{Token: tok,
+			Content: []section.Section{testShard("a", "m")}})
+	}
+	var tests = []struct {
+		ip      string
+		data    []byte
+		allowed bool
+		limit   string
+	}{
+		{"192.0.2.1", encodeTestMsg(t, token.New()), true, ""},
+		{"192.0.2.1", encodeTestMsg(t, token.New()), false, limitAddress},
+		{"192.0.2.2", encodeTestMsg(t, token.New()), true, ""},
+		{"192.0.2.3", encodeTestMsg(t, token.New()), false, limitPrefix},
+		{"192.0.2.1", answer(own), true, ""},
+		{"192.0.2.3", answer(own), true, ""},
+		{"192.0.2.1", answer(client), false, limitAddress},
+		{"192.0.2.1", encodeTestMsg(t, own), false, limitAddress},
+		{"198.51.100.1", encodeTestMsg(t, token.New()), true, ""},
+	}
+	for i, test := range tests {
+		sender := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 5022}
+		before := s.metrics.rateLimited.Value(test.limit)
+		allowed := s.allowMessage(test.data, sender)
+		if allowed != test.allowed {
+			t.Errorf("%d: wrong result for %s. expected=%t actual=%t", i, test.ip, test.allowed,
+				allowed)
+		}
+		if test.limit != "" && s.metrics.rateLimited.Value(test.limit) != before+1 {
+			t.Errorf("%d: rate limited message was not counted", i)
+		}
+	}
+	if !s.allowMessage(nil, &net.UnixAddr{Name: "/run/rainsd.sock", Net: "unix"}) {
+		t.Error("message from address without IP was limited")
+	}
+}
+
+func TestAllowResponse(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	config := DefaultConfig()
+	config.ResponseRateLimit = 1
+	config.ResponseRateLimitBurst = 1
+	s := newTestServer(config)
+	a := []section.Section{testAssertion("www", "example.", ".")}
+	b := []section.Section{testAssertion("www", "example.org.", ".")}
+	var tests = []struct {
+		ip       string
+		sections []section.Section
+		allowed  bool
+	}{
+		{"192.0.2.1", a, true},
+		{"192.0.2.1", a, false},
+		{"192.0.2.2", a, false},
+		{"192.0.2.2", b, true},
+		{"198.51.100.1", a, true},
+	}
+	for i, test := range tests {
+		receiver := &net.UDPAddr{IP: net.ParseIP(test.ip), Port: 5022}
+		allowed := s.allowResponse(test.sections, token.New(), receiver)
+		if allowed != test.allowed {
+			t.Errorf("%d: wrong result for %s. expected=%t actual=%t", i, test.ip, test.allowed,
+				allowed)
+		}
+	}
+}
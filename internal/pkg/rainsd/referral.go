@@ -0,0 +1,81 @@
+package rainsd
+
+import (
+	"strings"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+//authority returns the zone and context of authorities to which q's name belongs. If several
+//zones contain the name, the closest one is returned. False is returned if q is not about a name
+//this server has authority over.
+func authority(q *query.Name, authorities []ZoneContext) (ZoneContext, bool) {
+	var match ZoneContext
+	found := false
+	for _, auth := range authorities {
+		if q.Context == auth.Context && inZone(q.Name, auth.Zone) &&
+			(!found || len(auth.Zone) > len(match.Zone)) {
+			match, found = auth, true
+		}
+	}
+	return match, found
+}
+
+//inZone returns true if name is zone's apex or a name below it.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+//enclosingNames returns name and all names between it and zone, starting with name. The apex of
+//zone is not included. Name must be below zone.
+func enclosingNames(name, zone string) []string {
+	names := []string{}
+	for name != zone {
+		names = append(names, name)
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			break //root zone
+		}
+		name = name[i+1:]
+	}
+	return names
+}
+
+//referral returns the delegation of auth closest to the name of q together with the redirection and
+//address assertions needed to reach the delegated zone. If the latter are missing, only the
+//delegation is returned. Nil is returned if no delegation of auth contains q's name.
+func (s *Server) referral(q *query.Name, auth ZoneContext) []section.Section {
+	for _, name := range enclosingNames(q.Name, auth.Zone) {
+		delegations, ok := s.authStore.Get(name, auth.Context, object.OTDelegation)
+		if !ok {
+			continue
+		}
+		glueRecords, err := s.glueRecordLookup(name, auth.Context, s.authStore.Get)
+		if err != nil {
+			log.Warn("Was not able to find all glue records.", "name", name, "error", err.Error())
+			sections := []section.Section{}
+			for _, a := range delegations {
+				sections = append(sections, a)
+			}
+			return sections
+		}
+		return glueRecords
+	}
+	return nil
+}
+
+//nonexistenceProof returns the stored shards, pshards and zones of auth whose range contains the
+//name of q.
+func nonexistenceProof(q *query.Name, auth ZoneContext, s *Server) []section.Section {
+	subject := "@"
+	if q.Name != auth.Zone {
+		subject = strings.TrimSuffix(strings.TrimSuffix(q.Name, auth.Zone), ".")
+	}
+	answer, _ := s.authStore.GetNegAssertions(auth.Zone, auth.Context,
+		section.StringInterval{Name: subject})
+	return filterAnswer(answer, q)
+}
@@ -0,0 +1,143 @@
+package rainsd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+)
+
+func TestAuthority(t *testing.T) {
+	authorities := []ZoneContext{
+		{Zone: "example.", Context: "."},
+		{Zone: "sub.example.", Context: "."},
+		{Zone: "example.org.", Context: "other"},
+	}
+	var tests = []struct {
+		name    string
+		context string
+		zone    string
+		ok      bool
+	}{
+		{"example.", ".", "example.", true},
+		{"www.example.", ".", "example.", true},
+		{"sub.example.", ".", "sub.example.", true},
+		{"www.sub.example.", ".", "sub.example.", true},
+		{"www.notsub.example.", ".", "example.", true},
+		{"www.example.org.", "other", "example.org.", true},
+		{"www.example.org.", ".", "", false},
+		{"www.example.", "other", "", false},
+		{"www.example.net.", ".", "", false},
+		{"anexample.", ".", "", false},
+	}
+	for i, test := range tests {
+		q := &query.Name{Name: test.name, Context: test.context}
+		auth, ok := authority(q, authorities)
+		if ok != test.ok || auth.Zone != test.zone {
+			t.Errorf("%d: wrong authority of %s. expected=(%s,%t) actual=(%s,%t)", i, test.name,
+				test.zone, test.ok, auth.Zone, ok)
+		}
+	}
+}
+
+func TestEnclosingNames(t *testing.T) {
+	var tests = []struct {
+		name  string
+		zone  string
+		names []string
+	}{
+		{"www.example.", "example.", []string{"www.example."}},
+		{"a.b.example.", "example.", []string{"a.b.example.", "b.example."}},
+		{"www.example.", ".", []string{"www.example.", "example."}},
+		{"example.", "example.", []string{}},
+	}
+	for i, test := range tests {
+		if names := enclosingNames(test.name, test.zone); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%d: wrong names. expected=%v actual=%v", i, test.names, names)
+		}
+	}
+}
+
+//newReferralTestServer returns a server with authority over example. whose store contains a
+//delegation of sub.example. with glue records, a delegation of a.b.example. without them and a
+//shard of example. from a to m.
+func newReferralTestServer() (*Server, []*section.Assertion, *section.Shard) {
+	s := newTestServer(DefaultConfig())
+	s.config.Authorities = []ZoneContext{{Zone: "example.", Context: "."}}
+	s.authStore = cache.NewAuthoritativeMemory()
+	validUntil := time.Now().Add(time.Hour).Unix()
+	newAssertion := func(name string, obj object.Object) *section.Assertion {
+		a := &section.Assertion{SubjectName: name, SubjectZone: "example.", Context: ".",
+			Content: []object.Object{obj}}
+		a.UpdateValidity(time.Now().Unix(), validUntil, 24*time.Hour)
+		return a
+	}
+	pub, _, _ := ed25519.GenerateKey(nil)
+	key := keys.PublicKey{PublicKeyID: section.Signature().PublicKeyID, Key: pub}
+	assertions := []*section.Assertion{
+		newAssertion("sub", object.Object{Type: object.OTDelegation, Value: key}),
+		newAssertion("sub", object.Object{Type: object.OTRedirection, Value: "ns.sub.example."}),
+		newAssertion("ns.sub", object.Object{Type: object.OTIP4Addr, Value: "192.0.2.1"}),
+		newAssertion("a.b", object.Object{Type: object.OTDelegation, Value: key}),
+	}
+	for _, a := range assertions {
+		s.authStore.AddAssertion(a)
+	}
+	shard := &section.Shard{SubjectZone: "example.", Context: ".", RangeFrom: "a", RangeTo: "m"}
+	shard.UpdateValidity(time.Now().Unix(), validUntil, 24*time.Hour)
+	s.authStore.AddNegAssertion(shard)
+	return s, assertions, shard
+}
+
+func TestReferral(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	s, assertions, _ := newReferralTestServer()
+	var tests = []struct {
+		name     string
+		sections []section.Section
+	}{
+		{"www.sub.example.", []section.Section{assertions[0], assertions[1], assertions[2]}},
+		{"sub.example.", []section.Section{assertions[0], assertions[1], assertions[2]}},
+		{"a.b.example.", []section.Section{assertions[3]}},
+		{"www.a.b.example.", []section.Section{assertions[3]}},
+		{"b.example.", nil},
+		{"www.example.", nil},
+	}
+	for i, test := range tests {
+		q := &query.Name{Name: test.name, Context: ".", Types: []object.Type{object.OTIP4Addr}}
+		secs := s.referral(q, ZoneContext{Zone: "example.", Context: "."})
+		if !reflect.DeepEqual(secs, test.sections) {
+			t.Errorf("%d: wrong referral for %s. expected=%v actual=%v", i, test.name,
+				test.sections, secs)
+		}
+	}
+}
+
+func TestNonexistenceProof(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	s, _, shard := newReferralTestServer()
+	var tests = []struct {
+		name     string
+		sections []section.Section
+	}{
+		{"c.example.", []section.Section{shard}},
+		{"x.example.", nil},
+		{"a.example.", nil},
+	}
+	for i, test := range tests {
+		q := &query.Name{Name: test.name, Context: ".", Types: []object.Type{object.OTIP4Addr}}
+		secs := nonexistenceProof(q, ZoneContext{Zone: "example.", Context: "."}, s)
+		if !reflect.DeepEqual(secs, test.sections) {
+			t.Errorf("%d: wrong proof for %s. expected=%v actual=%v", i, test.name,
+				test.sections, secs)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package rainsd
+
+import (
+	"errors"
+	"reflect"
+
+	log "github.com/inconshreveable/log15"
+)
+
+//liveConfigFields contains the names of the configuration fields which are applied to a running
+//server on a reload. Changes of all other fields only take effect after a restart.
+var liveConfigFields = map[string]bool{
+	"LogLevel":                   true,
+	"ShutdownTimeout":            true,
+	"RootZonePublicKeyPath":      true,
+	"BlocklistPath":              true,
+	"RateLimit":                  true,
+	"RateLimitBurst":             true,
+	"PrefixRateLimit":            true,
+	"PrefixRateLimitBurst":       true,
+	"RateLimitIPv4PrefixLength":  true,
+	"RateLimitIPv6PrefixLength":  true,
+	"ResponseRateLimit":          true,
+	"ResponseRateLimitBurst":     true,
+	"RateLimitAction":            true,
+	"MaxDelegationQueries":       true,
+	"BackupServers":              true,
+	"PrioWorkerCount":            true,
+	"NormalWorkerCount":          true,
+	"NotificationWorkerCount":    true,
+	"ZoneKeyCacheSize":           true,
+	"PendingKeyCacheSize":        true,
+	"AssertionCacheSize":         true,
+	"NegativeAssertionCacheSize": true,
+	"PendingQueryCacheSize":      true,
+	"Authorities":                true,
+	"SecondaryZones":             true,
+	"Secondaries":                true,
+	"Zonefiles":                  true,
+}
+
+//ReloadResult lists the configuration fields which have changed on a reload.
+type ReloadResult struct {
+	//Applied contains the changed fields which are in effect now.
+	Applied []string
+	//RestartRequired contains the changed fields which only take effect after a restart.
+	RestartRequired []string
+}
+
+//SetConfigLoader sets the function returning the configuration which is applied on a reload.
+func (s *Server) SetConfigLoader(loader func() (Config, error)) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	s.configLoader = loader
+}
+
+//Reload obtains the configuration from the config loader and applies it to the running server.
+func (s *Server) Reload() (ReloadResult, error) {
+	s.reloadMutex.Lock()
+	loader := s.configLoader
+	s.reloadMutex.Unlock()
+	if loader == nil {
+		return ReloadResult{}, errors.New("no configuration file to reload")
+	}
+	config, err := loader()
+	if err != nil {
+		log.Warn("Was not able to load configuration", "error", err)
+		return ReloadResult{}, err
+	}
+	return s.ApplyConfig(config)
+}
+
+//ApplyConfig compares config with the server's current configuration. Changes of the log level,
+//the trust anchor, the blocklist, the rate limits, the worker counts, the cache sizes, the
+//authorities, the replication peers and the zonefiles are applied immediately. The trust anchor is
+//read again and its root zone public keys replace the old ones if the content of its file has
+//changed. The blocklist is only loaded again if its path has changed. New zonefiles are loaded at
+//the next zonefile check. Changes of all other fields are reported but have no effect until the
+//server is restarted. Nothing is applied if one of the changed values is invalid.
+func (s *Server) ApplyConfig(config Config) (ReloadResult, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	setConfigDefaults(&config)
+	current := s.Config()
+	if config.LogLevel == "" {
+		config.LogLevel = current.LogLevel
+	}
+	result := ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	for _, name := range changedConfigFields(current, config) {
+		if liveConfigFields[name] {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	changed := make(map[string]bool)
+	for _, name := range result.Applied {
+		changed[name] = true
+	}
+
+	//Validate the changed values before anything is applied.
+	lvl := getLogLevel()
+	if changed["LogLevel"] {
+		var err error
+		if lvl, err = log.LvlFromString(config.LogLevel); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+	blocked := BlocklistEntries{}
+	if changed["BlocklistPath"] && config.BlocklistPath != "" {
+		var err error
+		if blocked, err = loadBlocklist(config.BlocklistPath); err != nil {
+			log.Warn("Failed to load blocklist", "path", config.BlocklistPath, "error", err)
+			return ReloadResult{}, err
+		}
+		for _, p := range blocked.Peers {
+			if _, err := parsePrefix(p.Prefix); err != nil {
+				log.Warn("Invalid blocklist", "path", config.BlocklistPath, "error", err)
+				return ReloadResult{}, err
+			}
+		}
+	}
+	if err := checkRateLimits(config); err != nil {
+		return ReloadResult{}, err
+	}
+	if err := checkReplication(config); err != nil {
+		return ReloadResult{}, err
+	}
+	if err := checkZonefiles(config); err != nil {
+		return ReloadResult{}, err
+	}
+	if changed["ZoneKeyCacheSize"] && config.ZoneKeyCacheSize <= 0 ||
+		changed["PendingKeyCacheSize"] && config.PendingKeyCacheSize <= 0 ||
+		changed["AssertionCacheSize"] && config.AssertionCacheSize <= 0 ||
+		changed["NegativeAssertionCacheSize"] && config.NegativeAssertionCacheSize <= 0 ||
+		changed["PendingQueryCacheSize"] && config.PendingQueryCacheSize <= 0 {
+		return ReloadResult{}, errors.New("cache sizes must be positive")
+	}
+	if changed["PrioWorkerCount"] && config.PrioWorkerCount <= 0 ||
+		changed["NormalWorkerCount"] && config.NormalWorkerCount <= 0 ||
+		changed["NotificationWorkerCount"] && config.NotificationWorkerCount <= 0 {
+		return ReloadResult{}, errors.New("worker counts must be positive")
+	}
+	anchor, err := readTrustAnchor(config.RootZonePublicKeyPath, current.MaxCacheValidity)
+	if err != nil {
+		log.Warn("Failed to load root zone public key", "path", config.RootZonePublicKeyPath)
+		return ReloadResult{}, err
+	}
+	//The trust anchor is replaced if the content of its file has changed, even at the same path.
+	anchorChanged := anchor.hash != s.trustAnchor.hash
+	if anchorChanged && !changed["RootZonePublicKeyPath"] {
+		result.Applied = append(result.Applied, "RootZonePublicKeyPath")
+	}
+
+	if changed["LogLevel"] {
+		setLogLevel(lvl)
+	}
+	if anchorChanged {
+		if err := anchor.replace(s.trustAnchor, s.caches.ZoneKeyCache); err != nil {
+			log.Warn("Failed to replace root zone public keys", "error", err)
+		}
+		s.trustAnchor = anchor
+		log.Info("Replaced root zone public keys", "path", config.RootZonePublicKeyPath)
+	}
+	if changed["BlocklistPath"] {
+		s.blocklist.replace(blocked)
+		s.purgeBlockedZones()
+		log.Info("Loaded blocklist", "path", config.BlocklistPath, "peers", len(blocked.Peers),
+			"zones", len(blocked.Zones))
+	}
+	s.rateLimits.configure(config)
+	s.queues.PrioW.setLimit(config.PrioWorkerCount)
+	s.queues.NormalW.setLimit(config.NormalWorkerCount)
+	s.queues.NotifyW.setLimit(config.NotificationWorkerCount)
+	s.caches.ZoneKeyCache.SetMaxSize(config.ZoneKeyCacheSize)
+	s.caches.PendingKeys.SetMaxSize(config.PendingKeyCacheSize)
+	s.caches.AssertionsCache.SetMaxSize(config.AssertionCacheSize)
+	s.caches.NegAssertionCache.SetMaxSize(config.NegativeAssertionCacheSize)
+	s.caches.PendingQueries.SetMaxSize(config.PendingQueryCacheSize)
+
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	running := reflect.ValueOf(&s.config).Elem()
+	for _, name := range result.Applied {
+		running.FieldByName(name).Set(reflect.ValueOf(config).FieldByName(name))
+	}
+	if len(result.RestartRequired) > 0 {
+		log.Warn("Configuration changes require a restart", "fields", result.RestartRequired)
+	}
+	log.Info("Reloaded configuration", "applied", result.Applied)
+	return result, nil
+}
+
+//changedConfigFields returns the names of the fields whose values differ in c1 and c2. Empty
+//and unset lists are considered equal.
+func changedConfigFields(c1, c2 Config) []string {
+	v1, v2 := reflect.ValueOf(c1), reflect.ValueOf(c2)
+	fields := []string{}
+	for i := 0; i < v1.NumField(); i++ {
+		f1, f2 := v1.Field(i), v2.Field(i)
+		if f1.Kind() == reflect.Slice && f1.Len() == 0 && f2.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(f1.Interface(), f2.Interface()) {
+			fields = append(fields, v1.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,174 @@
+package rainsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/siglib"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+//writeTrustAnchor stores a root zone delegation assertion self signed by a new key at path and
+//returns the key.
+func writeTrustAnchor(t *testing.T, path string) keys.PublicKey {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	sig := section.Signature()
+	pkey := keys.PublicKey{PublicKeyID: sig.PublicKeyID, Key: pub}
+	a := &section.Assertion{
+		SubjectName: "@",
+		SubjectZone: ".",
+		Context:     ".",
+		Content:     []object.Object{{Type: object.OTDelegation, Value: pkey}},
+	}
+	a.AddSig(sig)
+	ks := map[keys.PublicKeyID]interface{}{sig.PublicKeyID: priv}
+	if err := siglib.SignSectionUnsafe(a, ks); err != nil {
+		t.Fatalf("Was not able to sign trust anchor: %v", err)
+	}
+	if err := util.Save(path, a); err != nil {
+		t.Fatalf("Was not able to store trust anchor: %v", err)
+	}
+	return pkey
+}
+
+//newReloadTestServer returns a server with config whose trust anchor has been loaded.
+func newReloadTestServer(t *testing.T, config Config) *Server {
+	s := newTestServer(config)
+	anchor, err := readTrustAnchor(config.RootZonePublicKeyPath, config.MaxCacheValidity)
+	if err != nil {
+		t.Fatalf("Was not able to read trust anchor: %v", err)
+	}
+	if err := anchor.addTo(s.caches.ZoneKeyCache); err != nil {
+		t.Fatalf("Was not able to add trust anchor: %v", err)
+	}
+	s.trustAnchor = anchor
+	return s
+}
+
+//rootKey returns the root zone public key in s's zone key cache.
+func rootKey(s *Server) interface{} {
+	key, _, _ := s.caches.ZoneKeyCache.Get(".", ".", section.Signature().MetaData())
+	return key.Key
+}
+
+func TestChangedConfigFields(t *testing.T) {
+	var tests = []struct {
+		change func(*Config)
+		fields []string
+	}{
+		{func(c *Config) {}, []string{}},
+		{func(c *Config) { c.LogLevel = "debug" }, []string{"LogLevel"}},
+		{func(c *Config) { c.Authorities = []ZoneContext{} }, []string{}},
+		{func(c *Config) { c.Authorities = nil }, []string{}},
+		{func(c *Config) {
+			c.RateLimit = 10
+			c.Authorities = []ZoneContext{{Zone: "example.", Context: "."}}
+		}, []string{"Authorities", "RateLimit"}},
+	}
+	for i, test := range tests {
+		c1, c2 := DefaultConfig(), DefaultConfig()
+		c1.Authorities = nil
+		test.change(&c2)
+		fields := changedConfigFields(c1, c2)
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%d: wrong changed fields. expected=%v actual=%v", i, test.fields, fields)
+		}
+	}
+}
+
+func TestApplyConfigRollback(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var tests = []struct {
+		change func(*Config)
+	}{
+		{func(c *Config) { c.LogLevel = "loud" }},
+		{func(c *Config) { c.AssertionCacheSize = -1 }},
+		{func(c *Config) { c.NormalWorkerCount = -1 }},
+		{func(c *Config) { c.RateLimitAction = "ignore" }},
+		{func(c *Config) { c.BlocklistPath = filepath.Join(dir, "missing.json") }},
+		{func(c *Config) { c.RootZonePublicKeyPath = filepath.Join(dir, "missing.gob") }},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.RootZonePublicKeyPath = filepath.Join(dir, "root.gob")
+		setConfigDefaults(&config)
+		oldKey := writeTrustAnchor(t, config.RootZonePublicKeyPath)
+		s := newReloadTestServer(t, config)
+		lvl := getLogLevel()
+		//The new trust anchor and the valid rate limit must not be applied either.
+		writeTrustAnchor(t, config.RootZonePublicKeyPath)
+		changed := config
+		changed.RateLimit = 42
+		test.change(&changed)
+		if _, err := s.ApplyConfig(changed); err == nil {
+			t.Errorf("%d: invalid configuration was applied", i)
+		}
+		if !reflect.DeepEqual(s.Config(), config) {
+			t.Errorf("%d: configuration changed although reload failed", i)
+		}
+		if getLogLevel() != lvl {
+			t.Errorf("%d: log level changed although reload failed", i)
+		}
+		if !reflect.DeepEqual(rootKey(s), oldKey.Key) {
+			t.Errorf("%d: trust anchor changed although reload failed", i)
+		}
+	}
+}
+
+func TestApplyConfigTrustAnchor(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.RootZonePublicKeyPath = filepath.Join(dir, "root.gob")
+	setConfigDefaults(&config)
+	key := writeTrustAnchor(t, config.RootZonePublicKeyPath)
+	s := newReloadTestServer(t, config)
+	var tests = []struct {
+		rewrite bool
+		applied []string
+	}{
+		{false, []string{}},
+		{true, []string{"RootZonePublicKeyPath"}},
+		{false, []string{}},
+	}
+	for i, test := range tests {
+		if test.rewrite {
+			key = writeTrustAnchor(t, config.RootZonePublicKeyPath)
+		}
+		result, err := s.ApplyConfig(config)
+		if err != nil {
+			t.Fatalf("%d: was not able to reload: %v", i, err)
+		}
+		if !reflect.DeepEqual(result.Applied, test.applied) {
+			t.Errorf("%d: wrong applied fields. expected=%v actual=%v", i, test.applied,
+				result.Applied)
+		}
+		if !reflect.DeepEqual(rootKey(s), key.Key) {
+			t.Errorf("%d: wrong root zone public key in cache", i)
+		}
+		if s.caches.ZoneKeyCache.Len() != 1 {
+			t.Errorf("%d: old root zone public key was not removed. keys=%d", i,
+				s.caches.ZoneKeyCache.Len())
+		}
+	}
+}
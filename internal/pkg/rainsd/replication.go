@@ -0,0 +1,479 @@
+package rainsd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/connection"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+)
+
+const (
+	//maxZoneVersions is the number of recent versions per zone a primary keeps track of to answer
+	//incremental zone transfer requests.
+	maxZoneVersions = 10
+)
+
+//SecondaryZone is a zone which this server obtains from its primary by zone transfers.
+type SecondaryZone struct {
+	Zone    string
+	Context string
+	//Primary is the authoritative server from which the zone is transferred.
+	Primary connection.Info
+}
+
+//checkReplication returns an error if a secondary zone of config is not one of its authorities or
+//has no primary.
+func checkReplication(config Config) error {
+	for _, z := range config.SecondaryZones {
+		if z.Primary.Addr == nil {
+			return fmt.Errorf("secondary zone without primary: zone=%s context=%s", z.Zone,
+				z.Context)
+		}
+		if !containsZone(config.Authorities, ZoneContext{Zone: z.Zone, Context: z.Context}) {
+			return fmt.Errorf("secondary zone is not an authority: zone=%s context=%s", z.Zone,
+				z.Context)
+		}
+	}
+	return nil
+}
+
+//zoneVersion identifies the content of a zone at some point in time.
+type zoneVersion struct {
+	//hash is computed over the digests of all sections. It is empty if there are no sections.
+	hash string
+	//digests contains the digest of each section.
+	digests map[[sha256.Size]byte]bool
+}
+
+//zoneVersions keeps track of the recent versions of zones. It is safe for concurrent use.
+type zoneVersions struct {
+	mutex    sync.Mutex
+	versions map[ZoneContext][]zoneVersion
+}
+
+func newZoneVersions() *zoneVersions {
+	return &zoneVersions{versions: make(map[ZoneContext][]zoneVersion)}
+}
+
+//add records version as the latest version of zone. Only the maxZoneVersions latest versions are
+//kept.
+func (v *zoneVersions) add(zone ZoneContext, version zoneVersion) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	versions := v.versions[zone]
+	if version.hash == "" || len(versions) > 0 && versions[len(versions)-1].hash == version.hash {
+		return
+	}
+	versions = append(versions, version)
+	if len(versions) > maxZoneVersions {
+		versions = versions[len(versions)-maxZoneVersions:]
+	}
+	v.versions[zone] = versions
+}
+
+//get returns the version of zone with hash.
+func (v *zoneVersions) get(zone ZoneContext, hash string) (zoneVersion, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, version := range v.versions[zone] {
+		if version.hash == hash {
+			return version, true
+		}
+	}
+	return zoneVersion{}, false
+}
+
+//zoneTransfer is a zone transfer this server has requested from the primary of a secondary zone.
+type zoneTransfer struct {
+	token   token.Token
+	primary net.Addr
+	//full is true if the primary has announced to send all sections of the zone.
+	full bool
+	//removed contains the digests of the sections the primary has removed since the version of
+	//this server.
+	removed map[[sha256.Size]byte]bool
+}
+
+//isFromPrimary returns true if addr has the IP address of the transfer's primary.
+func (t zoneTransfer) isFromPrimary(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && ip.Equal(addrIP(t.primary))
+}
+
+//zoneTransfers keeps track of the latest zone transfer requested per secondary zone. It is safe for
+//concurrent use.
+type zoneTransfers struct {
+	mutex   sync.Mutex
+	pending map[ZoneContext]zoneTransfer
+}
+
+func newZoneTransfers() *zoneTransfers {
+	return &zoneTransfers{pending: make(map[ZoneContext]zoneTransfer)}
+}
+
+//add records that a transfer of zone has been requested from primary with tok. It replaces an
+//earlier transfer of zone which has not been answered yet.
+func (t *zoneTransfers) add(zone ZoneContext, tok token.Token, primary net.Addr) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending[zone] = zoneTransfer{token: tok, primary: primary}
+}
+
+//get returns the zone and the transfer requested with tok.
+func (t *zoneTransfers) get(tok token.Token) (ZoneContext, zoneTransfer, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for zone, transfer := range t.pending {
+		if transfer.token == tok {
+			return zone, transfer, true
+		}
+	}
+	return ZoneContext{}, zoneTransfer{}, false
+}
+
+//update replaces the transfer of zone if it is still pending.
+func (t *zoneTransfers) update(zone ZoneContext, transfer zoneTransfer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending[zone].token == transfer.token {
+		t.pending[zone] = transfer
+	}
+}
+
+//remove removes and returns the zone and the transfer requested with tok if sender has the IP
+//address of the transfer's primary.
+func (t *zoneTransfers) remove(tok token.Token, sender net.Addr) (ZoneContext, zoneTransfer, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for zone, transfer := range t.pending {
+		if transfer.token == tok && transfer.isFromPrimary(sender) {
+			delete(t.pending, zone)
+			return zone, transfer, true
+		}
+	}
+	return ZoneContext{}, zoneTransfer{}, false
+}
+
+//zoneContent returns the stored zone, shards and pshards of zone which have not expired together
+//with their digests and the resulting version.
+func (s *Server) zoneContent(zone ZoneContext) ([]section.Section, [][sha256.Size]byte,
+	zoneVersion) {
+	stored, _ := s.authStore.GetNegAssertions(zone.Zone, zone.Context, section.TotalInterval{})
+	now := time.Now().Unix()
+	sections := []section.Section{}
+	digests := [][sha256.Size]byte{}
+	version := zoneVersion{digests: make(map[[sha256.Size]byte]bool)}
+	for _, sec := range stored {
+		if sec.ValidUntil() <= now {
+			continue
+		}
+		digest := sha256.Sum256([]byte(sec.Hash()))
+		if version.digests[digest] {
+			continue
+		}
+		sections = append(sections, sec)
+		digests = append(digests, digest)
+		version.digests[digest] = true
+	}
+	if len(digests) > 0 {
+		sorted := make([][sha256.Size]byte, len(digests))
+		copy(sorted, digests)
+		sort.Slice(sorted, func(i, j int) bool {
+			return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+		})
+		h := sha256.New()
+		for _, digest := range sorted {
+			h.Write(digest[:])
+		}
+		version.hash = hex.EncodeToString(h.Sum(nil))
+	}
+	return sections, digests, version
+}
+
+//zoneTransferData returns the data of a zone transfer or zone changed notification about the
+//version with hash of zone.
+func zoneTransferData(zone ZoneContext, hash string) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", zone.Zone, zone.Context, hash))
+}
+
+//parseZoneTransferData returns the zone and version hash contained in the data of a zone transfer
+//or zone changed notification.
+func parseZoneTransferData(data string) (ZoneContext, string, error) {
+	fields := strings.Fields(data)
+	switch len(fields) {
+	case 2:
+		return ZoneContext{Zone: fields[0], Context: fields[1]}, "", nil
+	case 3:
+		return ZoneContext{Zone: fields[0], Context: fields[1]}, fields[2], nil
+	default:
+		return ZoneContext{}, "", fmt.Errorf("malformed zone transfer data: %s", data)
+	}
+}
+
+//zoneTransferAnswerData returns the data of the notification describing a zone transfer of zone.
+//A full transfer only contains the zone. An incremental transfer additionally contains the version
+//hash it is based on and the digests of the sections removed since.
+func zoneTransferAnswerData(zone ZoneContext, base string, removed [][sha256.Size]byte) string {
+	if base == "" {
+		return zoneTransferData(zone, "")
+	}
+	fields := []string{zone.Zone, zone.Context, base}
+	for _, digest := range removed {
+		fields = append(fields, hex.EncodeToString(digest[:]))
+	}
+	sort.Strings(fields[3:])
+	return strings.Join(fields, " ")
+}
+
+//parseZoneTransferAnswerData returns the zone and the transfer described by the data of a zone
+//transfer answer notification.
+func parseZoneTransferAnswerData(data string) (ZoneContext, zoneTransfer, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return ZoneContext{}, zoneTransfer{}, fmt.Errorf("malformed zone transfer data: %s", data)
+	}
+	zone := ZoneContext{Zone: fields[0], Context: fields[1]}
+	if len(fields) == 2 {
+		return zone, zoneTransfer{full: true}, nil
+	}
+	transfer := zoneTransfer{removed: make(map[[sha256.Size]byte]bool)}
+	for _, field := range fields[3:] {
+		b, err := hex.DecodeString(field)
+		if err != nil || len(b) != sha256.Size {
+			return ZoneContext{}, zoneTransfer{}, fmt.Errorf("malformed section digest: %s",
+				field)
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], b)
+		transfer.removed[digest] = true
+	}
+	return zone, transfer, nil
+}
+
+//requestZoneTransfers requests a transfer of each secondary zone from its primary.
+func (s *Server) requestZoneTransfers() {
+	for _, z := range s.Config().SecondaryZones {
+		s.requestZoneTransfer(z)
+	}
+}
+
+//requestZoneTransfer sends a zone transfer request for z to its primary. The request contains the
+//version of z this server has such that the primary can omit unchanged sections.
+func (s *Server) requestZoneTransfer(z SecondaryZone) {
+	zone := ZoneContext{Zone: z.Zone, Context: z.Context}
+	_, _, version := s.zoneContent(zone)
+	log.Debug("Requesting zone transfer", "zone", zone, "primary", z.Primary.Addr,
+		"version", version.hash)
+	tok := token.New()
+	s.zoneTransfers.add(zone, tok, z.Primary.Addr)
+	sendNotificationMsg(tok, z.Primary.Addr, section.NTZoneTransfer,
+		zoneTransferData(zone, version.hash), s)
+}
+
+//zoneTransferAnswered records the kind of zone transfer described by the notification n of sender
+//in msg. It returns false if msg does not answer a zone transfer request of this server. A transfer
+//without sections is applied immediately, otherwise it is applied when its sections are verified.
+func (s *Server) zoneTransferAnswered(n *section.Notification, msg *message.Message,
+	sender net.Addr) bool {
+	zone, transfer, ok := s.zoneTransfers.get(msg.Token)
+	if !ok {
+		return false
+	}
+	if !transfer.isFromPrimary(sender) {
+		log.Warn("Zone transfer answer is not from the primary", "sender", sender, "zone", zone)
+		return true
+	}
+	answered, answer, err := parseZoneTransferAnswerData(n.Data)
+	if err != nil || answered != zone {
+		log.Warn("Malformed zone transfer answer", "sender", sender, "zone", zone, "data", n.Data,
+			"error", err)
+		return true
+	}
+	answer.token, answer.primary = transfer.token, transfer.primary
+	for _, sec := range msg.Content {
+		if _, ok := sec.(section.WithSigForward); ok {
+			s.zoneTransfers.update(zone, answer)
+			return true
+		}
+	}
+	if _, _, ok := s.zoneTransfers.remove(msg.Token, sender); ok {
+		s.applyZoneTransfer(zone, answer, nil)
+	}
+	return true
+}
+
+//applyZoneTransfer replaces the stored sections of zone with the transferred sections of zone. If
+//transfer is incremental, the stored sections the primary has not removed are kept.
+func (s *Server) applyZoneTransfer(zone ZoneContext, transfer zoneTransfer,
+	sections []section.WithSigForward) {
+	content := []section.WithSigForward{}
+	if !transfer.full {
+		stored, digests, _ := s.zoneContent(zone)
+		for i, sec := range stored {
+			if !transfer.removed[digests[i]] {
+				content = append(content, sec.(section.WithSigForward))
+			}
+		}
+	}
+	for _, sec := range sections {
+		if sec.GetSubjectZone() == zone.Zone && sec.GetContext() == zone.Context {
+			content = append(content, sec)
+		} else {
+			log.Warn("Dropped transferred section of another zone", "zone", zone, "section", sec)
+		}
+	}
+	log.Info("Received zone transfer", "zone", zone, "full", transfer.full,
+		"sections", len(sections), "removed", len(transfer.removed))
+	if err := s.replaceZone(zone, content); err != nil {
+		log.Warn("Was not able to replace stored sections of zone", "zone", zone, "error", err)
+	}
+}
+
+//transferZone answers the zone transfer request n of sender. If sender's version of the zone is
+//known, only the sections it does not have yet are sent together with the digests of the sections
+//removed since. Otherwise, all sections are sent. Nothing is sent if sender's version is up to
+//date. The sections are preceded by a zone transfer notification describing the transfer.
+func (s *Server) transferZone(n *section.Notification, sender net.Addr) {
+	zone, hash, err := parseZoneTransferData(n.Data)
+	if err != nil {
+		log.Warn("Malformed zone transfer request", "sender", sender, "error", err)
+		sendNotificationMsg(n.Token, sender, section.NTBadMessage,
+			"malformed zone transfer request", s)
+		return
+	}
+	if !s.isSecondary(sender) {
+		log.Warn("Refused zone transfer to unknown secondary", "sender", sender, "zone", zone)
+		sendNotificationMsg(n.Token, sender, section.NTNoAssertionAvail, "zone transfer refused", s)
+		return
+	}
+	if !containsZone(s.authorities(), zone) {
+		log.Info("Zone transfer requested for zone without authority", "sender", sender,
+			"zone", zone)
+		sendNotificationMsg(n.Token, sender, section.NTNoAssertionAvail,
+			"no authority over the zone", s)
+		return
+	}
+	sections, digests, version := s.zoneContent(zone)
+	s.zoneVersions.add(zone, version)
+	if len(sections) == 0 {
+		sendNotificationMsg(n.Token, sender, section.NTNoAssertionAvail, "zone not available", s)
+		return
+	}
+	if hash == version.hash {
+		log.Debug("Secondary is up to date", "sender", sender, "zone", zone, "version", hash)
+		return
+	}
+	data := zoneTransferAnswerData(zone, "", nil)
+	if old, ok := s.zoneVersions.get(zone, hash); ok {
+		changed := []section.Section{}
+		for i, sec := range sections {
+			if !old.digests[digests[i]] {
+				changed = append(changed, sec)
+			}
+		}
+		removed := [][sha256.Size]byte{}
+		for digest := range old.digests {
+			if !version.digests[digest] {
+				removed = append(removed, digest)
+			}
+		}
+		log.Info("Incremental zone transfer", "sender", sender, "zone", zone, "from", hash,
+			"to", version.hash, "sections", len(changed), "removed", len(removed))
+		sections = changed
+		data = zoneTransferAnswerData(zone, hash, removed)
+	} else {
+		log.Info("Full zone transfer", "sender", sender, "zone", zone, "to", version.hash,
+			"sections", len(sections))
+	}
+	answer := &section.Notification{Type: section.NTZoneTransfer, Token: n.Token, Data: data}
+	sendSections(append([]section.Section{answer}, sections...), n.Token, sender, s)
+}
+
+//zoneChanged handles the notification n of sender that the content of a zone has changed. If msg
+//containing n is signed by the zone, the cached sections of the zone are invalidated and refetched.
+//A transfer of the zone is requested if it is a secondary zone of this server and its version
+//differs from the one in n.
+func (s *Server) zoneChanged(n *section.Notification, msg *message.Message, sender net.Addr) {
+	zone, hash, err := parseZoneTransferData(n.Data)
+	if err != nil {
+		log.Warn("Malformed zone changed notification", "sender", sender, "error", err)
+		return
+	}
+	if msg != nil && len(msg.Signatures) > 0 {
+		if s.signedByZone(msg, zone) {
+			s.invalidateZone(zone)
+		} else {
+			log.Warn("Zone changed notification is not signed by the zone", "sender", sender,
+				"zone", zone)
+		}
+	}
+	for _, z := range s.Config().SecondaryZones {
+		if z.Zone == zone.Zone && z.Context == zone.Context {
+			if _, _, version := s.zoneContent(zone); version.hash != hash {
+				s.requestZoneTransfer(z)
+			}
+			return
+		}
+	}
+	log.Debug("Zone changed notification is not about a secondary zone", "sender", sender,
+		"zone", zone)
+}
+
+//notifySecondaries notifies the secondaries about the changed zones of this server's authority to
+//which a zone, shard or pshard in sections belongs.
+func (s *Server) notifySecondaries(sections []section.WithSigForward) {
+	secondaries := s.Config().Secondaries
+	if len(secondaries) == 0 {
+		return
+	}
+	zones := make(map[ZoneContext]bool)
+	for _, sec := range sections {
+		switch sec.(type) {
+		case *section.Zone, *section.Shard, *section.Pshard:
+			if isAuthoritative(sec, s.authorities()) {
+				zones[ZoneContext{Zone: sec.GetSubjectZone(), Context: sec.GetContext()}] = true
+			}
+		}
+	}
+	for zone := range zones {
+		_, _, version := s.zoneContent(zone)
+		s.zoneVersions.add(zone, version)
+		for _, secondary := range secondaries {
+			sendNotificationMsg(token.New(), secondary.Addr, section.NTZoneChanged,
+				zoneTransferData(zone, version.hash), s)
+		}
+	}
+}
+
+//isSecondary returns true if addr has the IP address of a secondary.
+func (s *Server) isSecondary(addr net.Addr) bool {
+	ip := addrIP(addr)
+	for _, secondary := range s.Config().Secondaries {
+		if ip != nil && ip.Equal(addrIP(secondary.Addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+//containsZone returns true if zones contains zone.
+func containsZone(zones []ZoneContext, zone ZoneContext) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
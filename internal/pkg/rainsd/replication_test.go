@@ -0,0 +1,309 @@
+package rainsd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/cbor"
+	"github.com/netsec-ethz/rains/internal/pkg/connection"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/signature"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+func TestParseZoneTransferData(t *testing.T) {
+	var tests = []struct {
+		data  string
+		zone  ZoneContext
+		hash  string
+		valid bool
+	}{
+		{"example. . abc", ZoneContext{Zone: "example.", Context: "."}, "abc", true},
+		{"example. .", ZoneContext{Zone: "example.", Context: "."}, "", true},
+		{zoneTransferData(ZoneContext{Zone: "example.", Context: "."}, ""),
+			ZoneContext{Zone: "example.", Context: "."}, "", true},
+		{"example.", ZoneContext{}, "", false},
+		{"example. . abc def", ZoneContext{}, "", false},
+		{"", ZoneContext{}, "", false},
+	}
+	for i, test := range tests {
+		zone, hash, err := parseZoneTransferData(test.data)
+		if (err == nil) != test.valid || zone != test.zone || hash != test.hash {
+			t.Errorf("%d: wrong result for %q. expected=(%v,%s,%t) actual=(%v,%s,%v)", i,
+				test.data, test.zone, test.hash, test.valid, zone, hash, err)
+		}
+	}
+}
+
+func TestParseZoneTransferAnswerData(t *testing.T) {
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	digest := sha256.Sum256([]byte("section"))
+	var tests = []struct {
+		data    string
+		full    bool
+		removed int
+		valid   bool
+	}{
+		{zoneTransferAnswerData(zone, "", nil), true, 0, true},
+		{zoneTransferAnswerData(zone, "abc", nil), false, 0, true},
+		{zoneTransferAnswerData(zone, "abc", [][sha256.Size]byte{digest}), false, 1, true},
+		{"example. . abc def", false, 0, false},
+		{"example. . abc " + hex.EncodeToString(digest[:4]), false, 0, false},
+		{"example.", false, 0, false},
+	}
+	for i, test := range tests {
+		z, transfer, err := parseZoneTransferAnswerData(test.data)
+		if (err == nil) != test.valid {
+			t.Errorf("%d: wrong validity of %q. expected=%t actual=%v", i, test.data, test.valid,
+				err)
+			continue
+		}
+		if test.valid && (z != zone || transfer.full != test.full ||
+			len(transfer.removed) != test.removed) {
+			t.Errorf("%d: wrong transfer of %q. expected=(%t,%d) actual=(%t,%d)", i, test.data,
+				test.full, test.removed, transfer.full, len(transfer.removed))
+		}
+	}
+}
+
+func TestZoneVersions(t *testing.T) {
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	v := newZoneVersions()
+	v.add(zone, zoneVersion{})
+	for i := 0; i <= maxZoneVersions; i++ {
+		v.add(zone, zoneVersion{hash: fmt.Sprint(i)})
+		v.add(zone, zoneVersion{hash: fmt.Sprint(i)})
+	}
+	var tests = []struct {
+		hash  string
+		found bool
+	}{
+		{"", false},
+		{"0", false},
+		{"1", true},
+		{fmt.Sprint(maxZoneVersions), true},
+	}
+	for i, test := range tests {
+		if _, ok := v.get(zone, test.hash); ok != test.found {
+			t.Errorf("%d: wrong result for version %q. expected=%t actual=%t", i, test.hash,
+				test.found, ok)
+		}
+	}
+	if len(v.versions[zone]) != maxZoneVersions {
+		t.Errorf("wrong number of versions. expected=%d actual=%d", maxZoneVersions,
+			len(v.versions[zone]))
+	}
+}
+
+//testShard returns a shard of example. from from to to with a dummy signature which is valid for an
+//hour.
+func testShard(from, to string) *section.Shard {
+	sig := section.Signature()
+	sig.Data = []byte(from + to)
+	s := &section.Shard{SubjectZone: "example.", Context: ".", RangeFrom: from, RangeTo: to,
+		Signatures: []signature.Sig{sig}}
+	s.UpdateValidity(time.Now().Unix(), time.Now().Add(time.Hour).Unix(), 24*time.Hour)
+	return s
+}
+
+//listenTestUDP lets s send datagrams over a new local socket and returns a second local socket
+//acting as s's peer.
+func listenTestUDP(t *testing.T, s *Server) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Was not able to listen: %v", err)
+	}
+	l := newListener(connection.Info{Type: connection.UDP, Addr: conn.LocalAddr()})
+	l.setPacketConn(conn)
+	s.listeners = append(s.listeners, l)
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Was not able to listen: %v", err)
+	}
+	return peer
+}
+
+//receiveTestMsg returns the next message conn receives or nil if none arrives within a short time.
+func receiveTestMsg(t *testing.T, conn net.PacketConn) *message.Message {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	msg := &message.Message{}
+	if err := cbor.NewReader(bytes.NewReader(buf[:n])).Unmarshal(msg); err != nil {
+		t.Fatalf("Was not able to decode message: %v", err)
+	}
+	return msg
+}
+
+//sectionHashes returns the sorted hashes of sections.
+func sectionHashes(sections []section.Section) []string {
+	hashes := []string{}
+	for _, sec := range sections {
+		if h, ok := sec.(section.Hasher); ok {
+			hashes = append(hashes, h.Hash())
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func TestTransferZone(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	config := DefaultConfig()
+	config.Authorities = []ZoneContext{{Zone: "example.", Context: "."}}
+	s := newTestServer(config)
+	s.authStore = cache.NewAuthoritativeMemory()
+	s.zoneVersions = newZoneVersions()
+	peer := listenTestUDP(t, s)
+	defer peer.Close()
+	defer s.listeners[0].packetConn.Close()
+	s.config.Secondaries = []connection.Info{{Type: connection.UDP, Addr: peer.LocalAddr()}}
+
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	shards := []*section.Shard{testShard("", "f"), testShard("f", "p"), testShard("p", ""),
+		testShard("f", "")}
+	s.authStore.AddNegAssertion(shards[0])
+	s.authStore.AddNegAssertion(shards[1])
+	_, _, oldVersion := s.zoneContent(zone)
+	s.zoneVersions.add(zone, oldVersion)
+	//The zone is republished with the second shard replaced by two others.
+	s.authStore.RemoveZone(zone.Zone, zone.Context)
+	s.authStore.AddNegAssertion(shards[0])
+	s.authStore.AddNegAssertion(shards[2])
+	s.authStore.AddNegAssertion(shards[3])
+	_, _, version := s.zoneContent(zone)
+	all := []section.Section{shards[0], shards[2], shards[3]}
+	full := zoneTransferAnswerData(zone, "", nil)
+	incremental := zoneTransferAnswerData(zone, oldVersion.hash,
+		[][sha256.Size]byte{sha256.Sum256([]byte(shards[1].Hash()))})
+
+	var tests = []struct {
+		data         string
+		secondary    bool
+		answer       string
+		sections     []section.Section
+		notification section.NotificationType
+	}{
+		{"example. .", true, full, all, 0},
+		{"example. . " + oldVersion.hash, true, incremental, all[1:], 0},
+		{"example. . " + version.hash, true, "", nil, 0},
+		{"example. . unknown", true, full, all, 0},
+		{"example. . " + oldVersion.hash, false, "", nil, section.NTNoAssertionAvail},
+		{"example.org. .", true, "", nil, section.NTNoAssertionAvail},
+		{"example.", true, "", nil, section.NTBadMessage},
+	}
+	for i, test := range tests {
+		sender := peer.LocalAddr()
+		if !test.secondary {
+			s.config.Secondaries[0].Addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+		}
+		tok := token.New()
+		s.transferZone(&section.Notification{Type: section.NTZoneTransfer, Token: tok,
+			Data: test.data}, sender)
+		s.config.Secondaries[0].Addr = peer.LocalAddr()
+		msg := receiveTestMsg(t, peer)
+		switch {
+		case test.notification != 0:
+			if msg == nil || len(msg.Content) != 1 {
+				t.Errorf("%d: expected a notification. actual=%v", i, msg)
+				continue
+			}
+			n, ok := msg.Content[0].(*section.Notification)
+			if !ok || n.Type != test.notification || n.Token != tok {
+				t.Errorf("%d: wrong notification. expected=%v actual=%v", i, test.notification,
+					msg.Content[0])
+			}
+		case test.sections == nil:
+			if msg != nil {
+				t.Errorf("%d: unexpected answer to up to date secondary: %v", i, msg)
+			}
+		default:
+			if msg == nil {
+				t.Errorf("%d: zone was not transferred", i)
+				continue
+			}
+			expected, actual := sectionHashes(test.sections), sectionHashes(msg.Content)
+			if fmt.Sprint(expected) != fmt.Sprint(actual) || msg.Token != tok {
+				t.Errorf("%d: wrong transferred sections. expected=%v actual=%v", i, expected,
+					actual)
+			}
+			n, ok := msg.Content[0].(*section.Notification)
+			if !ok || n.Type != section.NTZoneTransfer || n.Data != test.answer {
+				t.Errorf("%d: wrong zone transfer answer. expected=%q actual=%v", i, test.answer,
+					msg.Content[0])
+			}
+		}
+	}
+}
+
+func TestReceiveZoneTransfer(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	primary := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5022}
+	stale, kept, added := testShard("", "f"), testShard("f", "p"), testShard("p", "")
+	removed := [][sha256.Size]byte{sha256.Sum256([]byte(stale.Hash()))}
+	var tests = []struct {
+		sender   net.Addr
+		data     string
+		sections []section.Section
+		stored   []section.Section
+	}{
+		{primary, zoneTransferAnswerData(zone, "", nil), []section.Section{added},
+			[]section.Section{added}},
+		{primary, zoneTransferAnswerData(zone, "abc", removed), []section.Section{added},
+			[]section.Section{kept, added}},
+		{primary, zoneTransferAnswerData(zone, "abc", removed), nil, []section.Section{kept}},
+		{primary, zoneTransferAnswerData(zone, "abc", nil), []section.Section{added},
+			[]section.Section{stale, kept, added}},
+		{other, zoneTransferAnswerData(zone, "", nil), nil, []section.Section{stale, kept}},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.Authorities = []ZoneContext{zone}
+		s := newTestServer(config)
+		s.authStore = cache.NewAuthoritativeMemory()
+		s.zoneVersions = newZoneVersions()
+		s.authStore.AddNegAssertion(stale)
+		s.authStore.AddNegAssertion(kept)
+		tok := token.New()
+		s.zoneTransfers.add(zone, tok, primary)
+		answer := &section.Notification{Type: section.NTZoneTransfer, Token: tok, Data: test.data}
+		msg := &message.Message{Token: tok,
+			Content: append([]section.Section{answer}, test.sections...)}
+		s.enqueue(msg, test.sender)
+		if len(s.queues.Notify) != 0 {
+			t.Errorf("%d: zone transfer answer was handled as a request", i)
+		}
+		if len(test.sections) > 0 {
+			//The verification of the transferred sections is skipped.
+			mss := <-s.queues.Normal
+			sections := []section.WithSigForward{}
+			for _, sec := range mss.Sections {
+				sections = append(sections, sec.(section.WithSigForward))
+			}
+			s.assert(util.SectionWithSigSender{Sender: mss.Sender, Token: mss.Token,
+				Sections: sections})
+		}
+		stored, _ := s.authStore.GetNegAssertions(zone.Zone, zone.Context,
+			section.TotalInterval{})
+		expected, actual := sectionHashes(test.stored), sectionHashes(sectionsOf(stored))
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Errorf("%d: wrong stored sections. expected=%v actual=%v", i, expected, actual)
+		}
+	}
+}
@@ -1,31 +1,39 @@
 package rainsd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/inconshreveable/log15"
-	"github.com/netsec-ethz/rains/internal/pkg/connection"
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
 	"github.com/netsec-ethz/rains/internal/pkg/libresolve"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
 	"github.com/netsec-ethz/rains/internal/pkg/util"
 )
 
-const (
-	nofReapers       = 3
-	nofCheckPointers = 3
-	noListeners      = 1
-	shutdownChannels = nofReapers + nofCheckPointers + noListeners
-)
+//drainPollInterval is the interval in which the server checks whether its input queues have been
+//drained during a shutdown.
+const drainPollInterval = 10 * time.Millisecond
 
 //Server represents a rainsd server instance.
 type Server struct {
+	//inFlight is the number of messages in the input queues or being processed. It is accessed
+	//atomically and thus the first field to guarantee its alignment.
+	inFlight int64
+	//started is set to 1 when the server is started. It is accessed atomically.
+	started int32
 	//resolver can be configured as a forwarder or perform recursive lookup by itself.
 	resolver *libresolve.Resolver
 	//config contains configurations of this server
 	config Config
-	//authority states the names over which this server has authority
-	authority map[ZoneContext]bool
 	//certPool stores received certificates
 	certPool *x509.CertPool
 	//tlsCert holds the tls certificate of this server
@@ -34,61 +42,216 @@ type Server struct {
 	capabilityHash string
 	//capabilityList contains the string representation of this server's capability list.
 	capabilityList string
-	//shutdown can be used to stop the go routines handling the input channels and closes them.
-	shutdown chan bool
+	//ctx is canceled when the server has processed its input queues during a shutdown. It stops the
+	//go routines working on the input queues, the reapers and the checkpointers.
+	ctx    context.Context
+	cancel context.CancelFunc
+	//stopping is closed when the server starts to shut down. From then on, only messages answering
+	//queries of this server are accepted.
+	stopping     chan struct{}
+	shutdownOnce sync.Once
+	//workers tracks the go routines processing messages and performing periodic tasks.
+	workers sync.WaitGroup
+	//readers tracks the go routines serving sockets and reading from connections.
+	readers sync.WaitGroup
 	//queues store the incoming sections and keeps track of how many go routines are working on it.
 	queues InputQueues
 	//caches contains all caches of this server
 	caches *Caches
-	//packetConn is the server UDP socket if we are in that mode, or nil otherwise.
-	packetConn net.PacketConn
+	//authStore contains the sections of the zones over which this server has authority.
+	authStore cache.AuthoritativeStore
+	//blocklist contains the peers and zones from which messages are dropped.
+	blocklist *blocklist
+	//rateLimits limits the messages per source and the answers of an authoritative server.
+	rateLimits *rateLimits
+	//metrics contains the counters and gauges describing the server's state.
+	metrics *serverMetrics
+	//metricsServer serves the metrics if resource monitoring is enabled.
+	metricsServer *http.Server
+	//admin serves the admin API if an admin address is configured.
+	admin *http.Server
+	//adminListener is the listener of the admin API. It is nil if no admin address is configured.
+	adminListener net.Listener
+	//listeners contains one listener per configured server address. All of them feed the same
+	//input queues.
+	listeners []*listener
+	//sentMsgs contains recently sent messages which can be split if the receiver rejects them as
+	//too large.
+	sentMsgs *sentMessages
+	//infraKeyID identifies infraKey.
+	infraKeyID keys.PublicKeyID
+	//infraKey is the private infrastructure key with which outgoing messages are signed. It is nil
+	//if messages are not signed.
+	infraKey interface{}
+	//infraPeers associates peers with the name holding their infrastructure key.
+	infraPeers []infraPeer
+	//pendingSigned contains messages waiting for the infrastructure key of their sender.
+	pendingSigned *pendingSignedMessages
+	//forwardedTokens contains the tokens this server has created for forwarded queries.
+	forwardedTokens *tokenSet
+	//zoneVersions contains the recent versions of the zones transferred to secondaries.
+	zoneVersions *zoneVersions
+	//zoneTransfers contains the pending zone transfers of the secondary zones.
+	zoneTransfers *zoneTransfers
+	//zonefiles keeps track of the loaded zonefiles to detect changes.
+	zonefiles *zonefileWatcher
+	//events records queries, answers, notifications and verification failures. It is nil if no
+	//event log is configured.
+	events *eventLog
+	//configMutex protects the fields of config which are changed when the configuration is
+	//reloaded. It must be held when config is copied as a whole.
+	configMutex sync.RWMutex
+	//reloadMutex serializes configuration reloads.
+	reloadMutex sync.Mutex
+	//configLoader returns the configuration which is applied on a reload.
+	configLoader func() (Config, error)
+	//trustAnchor contains the root zone public keys in the zone key cache. It is replaced on a
+	//reload if the content of the file at RootZonePublicKeyPath has changed.
+	trustAnchor trustAnchor
 }
 
 //New returns a pointer to a newly created rainsd server instance with the given config. The server
 //logs with the provided level of logging.
 func New(config Config, id string) (server *Server, err error) {
 	log.Info("server New", "id", id)
+	if len(config.ServerAddresses) == 0 {
+		return nil, errors.New("no server address configured")
+	}
 	server = &Server{config: config}
-	server.authority = make(map[ZoneContext]bool)
-	for _, auth := range server.config.Authorities {
-		server.authority[auth] = true
+	setConfigDefaults(&server.config)
+	if server.config.LogLevel != "" {
+		lvl, err := log.LvlFromString(server.config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		setLogLevel(lvl)
+	}
+	for _, info := range server.config.ServerAddresses {
+		server.listeners = append(server.listeners, newListener(info))
 	}
 	if server.certPool, server.tlsCert, err = loadTLSCertificate(server.config.TLSCertificateFile,
 		server.config.TLSPrivateKeyFile); err != nil {
 		return nil, err
 	}
 	server.capabilityHash, server.capabilityList = initOwnCapabilities(server.config.Capabilities)
+	server.blocklist = newBlocklist()
+	server.sentMsgs = newSentMessages(maxSentMessages)
+	if err := checkSigPolicy(server.config.MessageSigPolicy); err != nil {
+		return nil, err
+	}
+	if server.infraPeers, err = newInfraPeers(server.config.InfraKeyPeers); err != nil {
+		log.Warn("Invalid infrastructure key peers", "error", err)
+		return nil, err
+	}
+	if server.config.InfraKeyPath != "" {
+		if server.infraKeyID, server.infraKey, err = loadInfraKey(server.config.InfraKeyPath); err != nil {
+			log.Warn("Failed to load infrastructure key", "path", server.config.InfraKeyPath,
+				"error", err)
+			return nil, err
+		}
+	}
+	server.pendingSigned = newPendingSignedMessages(maxPendingSignedMessages)
+	server.forwardedTokens = newTokenSet(maxForwardedTokens)
+	if err := checkRateLimits(server.config); err != nil {
+		return nil, err
+	}
+	server.rateLimits = newRateLimits(server.config)
+	if err := checkForwardingRules(server.config); err != nil {
+		return nil, err
+	}
+	if err := checkReplication(server.config); err != nil {
+		return nil, err
+	}
+	server.zoneVersions = newZoneVersions()
+	server.zoneTransfers = newZoneTransfers()
+	if err := checkZonefiles(server.config); err != nil {
+		return nil, err
+	}
+	server.zonefiles = newZonefileWatcher()
+	if server.config.BlocklistPath != "" {
+		entries, err := loadBlocklist(server.config.BlocklistPath)
+		if err != nil {
+			log.Warn("Failed to load blocklist", "path", server.config.BlocklistPath, "error", err)
+			return nil, err
+		}
+		if err := server.blocklist.replace(entries); err != nil {
+			log.Warn("Invalid blocklist", "path", server.config.BlocklistPath, "error", err)
+			return nil, err
+		}
+	}
 
-	server.shutdown = make(chan bool, shutdownChannels)
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.stopping = make(chan struct{})
 	server.queues = InputQueues{
 		Prio:    make(chan util.MsgSectionSender, server.config.PrioBufferSize),
 		Normal:  make(chan util.MsgSectionSender, server.config.NormalBufferSize),
 		Notify:  make(chan util.MsgSectionSender, server.config.NotificationBufferSize),
-		PrioW:   make(chan struct{}, server.config.PrioWorkerCount),
-		NormalW: make(chan struct{}, server.config.NormalWorkerCount),
-		NotifyW: make(chan struct{}, server.config.NotificationWorkerCount),
+		PrioW:   newWorkerLimit(server.config.PrioWorkerCount),
+		NormalW: newWorkerLimit(server.config.NormalWorkerCount),
+		NotifyW: newWorkerLimit(server.config.NotificationWorkerCount),
 	}
 	log.Debug("Created server channels")
 	server.caches = initCaches(server.config)
-	if err = loadRootZonePublicKey(server.config.RootZonePublicKeyPath, server.caches.ZoneKeyCache,
+	server.caches.Capabilities.Add(server.config.Capabilities)
+	server.metrics = newServerMetrics(server)
+	instrumentCaches(server.caches, server.metrics)
+	if server.authStore, err = newAuthoritativeStore(server.config); err != nil {
+		log.Warn("Failed to open authoritative store", "path", server.config.AuthoritativeStorePath,
+			"error", err)
+		return nil, err
+	}
+	if server.events, err = newEventLog(server.config); err != nil {
+		log.Warn("Failed to open event log", "path", server.config.EventLogPath, "error", err)
+		return nil, err
+	}
+	if server.trustAnchor, err = readTrustAnchor(server.config.RootZonePublicKeyPath,
 		server.config.MaxCacheValidity); err != nil {
 		log.Warn("Failed to load root zone public key")
 		return nil, err
 	}
+	if err = server.trustAnchor.addTo(server.caches.ZoneKeyCache); err != nil {
+		log.Warn("Failed to load root zone public key")
+		return nil, err
+	}
+	if server.config.AdminAddress != "" {
+		if err := server.openAdmin(); err != nil {
+			log.Warn("Failed to open admin API", "addr", server.config.AdminAddress, "error", err)
+			return nil, err
+		}
+	}
 
 	log.Info("Successfully initialized server", "id", id)
 	return
 }
 
-//Addr returns the server's address
+//Addr returns the server's primary address, i.e. the first configured server address.
 func (s *Server) Addr() net.Addr {
-	return s.config.ServerAddress.Addr
+	return s.config.ServerAddresses[0].Addr
+}
+
+//Addrs returns all addresses on which the server is listening.
+func (s *Server) Addrs() []net.Addr {
+	addrs := []net.Addr{}
+	for _, info := range s.config.ServerAddresses {
+		addrs = append(addrs, info.Addr)
+	}
+	return addrs
 }
 
+//Config returns the server's current configuration.
 func (s *Server) Config() Config {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
 	return s.config
 }
 
+//authorities returns the zones and contexts over which this server has authority.
+func (s *Server) authorities() []ZoneContext {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.config.Authorities
+}
+
 //SetResolver adds a resolver which can forward or recursively resolve queries for this server
 func (s *Server) SetResolver(resolver *libresolve.Resolver) {
 	s.resolver = resolver
@@ -97,49 +260,171 @@ func (s *Server) SetResolver(resolver *libresolve.Resolver) {
 //Start starts up the server and it begins to listen for incoming connections according to its
 //config.
 func (s *Server) Start(monitorResources bool, id string) error {
-	go s.workPrio()
-	go s.workBoth()
-	go s.workNotification()
+	atomic.StoreInt32(&s.started, 1)
+	s.goWork(s.workPrio)
+	s.goWork(s.workBoth)
+	s.goWork(s.workNotification)
 	log.Debug("Goroutines working on input queue started")
-	initReapers(s.config, s.caches, s.shutdown)
+	initReapers(s.ctx, &s.workers, s.Config(), s.caches)
+	s.workers.Add(1)
+	go repeatFuncCaller(s.ctx, &s.workers, s.retryExpiredDelegationQueries,
+		s.Config().ReapPendingKeyCacheInterval)
 	if s.config.PreLoadCaches {
-		loadCaches(s.config.CheckPointPath, s.caches, s.config.Authorities)
+		loadCaches(s.config.CheckPointPath, s.caches)
 		log.Info("Caches loaded from checkpoint",
 			"assertions", s.caches.AssertionsCache.Len(),
 			"negAssertions", s.caches.NegAssertionCache.Len(),
 			"zoneKey", s.caches.ZoneKeyCache.Len())
+		s.purgeBlockedZones()
 	}
-	initStoreCachesContent(s.config, s.caches, s.shutdown)
+	initStoreCachesContent(s.ctx, &s.workers, s.Config(), s.caches)
+	s.workers.Add(1)
+	go repeatFuncCaller(s.ctx, &s.workers, s.requestZoneTransfers, s.Config().ZoneRefreshInterval)
+	s.workers.Add(1)
+	go repeatFuncCaller(s.ctx, &s.workers, s.removeExpiredAuthoritative,
+		s.Config().ReapAssertionCacheInterval)
+	s.loadChangedZonefiles()
+	s.workers.Add(1)
+	go repeatFuncCaller(s.ctx, &s.workers, s.loadChangedZonefiles,
+		s.Config().ZonefileCheckInterval)
 	log.Info("Reapers and Checkpointing started")
 	if monitorResources {
-		go measureSystemRessources()
+		s.measureSystemRessources()
+	}
+	if s.adminListener != nil {
+		s.startAdmin()
 	}
 	s.listen(id)
 	return nil
 }
 
-//Shutdown closes the input channels and stops the function creating new go routines to handle the
-//input. Already running worker go routines will finish eventually.
+//Shutdown gracefully shuts the server down. Queued messages are processed for at most the
+//configured shutdown timeout. See ShutdownContext.
 func (s *Server) Shutdown() {
-	for i := 0; i < shutdownChannels; i++ {
-		s.shutdown <- true
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config().ShutdownTimeout)
+	defer cancel()
+	s.ShutdownContext(ctx)
+}
+
+//ShutdownContext gracefully shuts the server down. It stops accepting connections and drops all
+//incoming messages except answers to queries of this server. The messages in the input queues are
+//processed until the queues are empty or ctx is done. Then, the remaining pending queries are
+//answered with a notification, a final checkpoint is written and all sockets and connections are
+//closed. ShutdownContext returns when all go routines of the server have exited. The returned error
+//is ctx's error if the input queues could not be drained in time.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		err = s.shutdown(ctx)
+	})
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	log.Info("Shutting down server")
+	close(s.stopping)
+	for _, l := range s.listeners {
+		l.stop()
+	}
+	err := s.drain(ctx)
+	s.cancel()
+	s.workers.Wait()
+	s.answerPendingQueries()
+	if atomic.LoadInt32(&s.started) == 1 {
+		checkpointCaches(s.config.CheckPointPath, s.caches)
+		log.Info("Final checkpoint written", "path", s.config.CheckPointPath)
+	}
+	if err := s.authStore.Close(); err != nil {
+		log.Warn("Was not able to close authoritative store", "error", err)
+	}
+	if err := s.events.close(); err != nil {
+		log.Warn("Was not able to close event log", "error", err)
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	} else if s.adminListener != nil {
+		s.adminListener.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	for _, l := range s.listeners {
+		l.close()
+	}
+	s.closeConnections()
+	log.Info("Server shut down")
+	return err
+}
+
+//drain waits until all queued messages have been processed or ctx is done.
+func (s *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Warn("Input queues have not been drained before the shutdown deadline",
+				"messages", atomic.LoadInt64(&s.inFlight))
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+//answerPendingQueries informs the senders of all queries waiting for an answer that the server has
+//shut down.
+func (s *Server) answerPendingQueries() {
+	for _, ss := range s.caches.PendingQueries.GetAllAndRemove() {
+		if ss.Sender != nil {
+			sendNotificationMsg(ss.Token, ss.Sender, section.NTUnspecServerErr,
+				"server shut down", s)
+		}
 	}
+}
 
-	// Unblock the switchboard listener to get the shutdown message delivered
-	switch s.config.ServerAddress.Type {
-	case connection.TCP:
-		if conn, err := net.Dial(s.Addr().Network(), s.Addr().String()); err == nil {
-			conn.Close()
+//closeConnections closes all connections and waits until the go routines reading from them have
+//exited. Connections are closed repeatedly as a reader might still open a connection to reply.
+func (s *Server) closeConnections() {
+	done := make(chan struct{})
+	go func() {
+		s.readers.Wait()
+		close(done)
+	}()
+	for {
+		s.caches.ConnCache.CloseAndRemoveAllConnections()
+		select {
+		case <-done:
+			return
+		case <-time.After(drainPollInterval):
 		}
-	case connection.SCION:
-		s.packetConn.Close()
+	}
+}
+
+//isStopping returns true if the server is shutting down.
+func (s *Server) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
 	default:
-		log.Warn("Unsupported Network address type.")
+		return false
 	}
+}
 
-	s.caches.ConnCache.CloseAndRemoveAllConnections()
-	s.queues.Normal <- util.MsgSectionSender{}
-	s.queues.Prio <- util.MsgSectionSender{}
-	s.queues.Notify <- util.MsgSectionSender{}
-	log.Info("Server shut down")
+//goWork runs f in a new go routine tracked by the server's workers.
+func (s *Server) goWork(f func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f()
+	}()
+}
+
+//goRead runs f in a new go routine tracked by the server's readers.
+func (s *Server) goRead(f func()) {
+	s.readers.Add(1)
+	go func() {
+		defer s.readers.Done()
+		f()
+	}()
 }
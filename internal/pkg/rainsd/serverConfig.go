@@ -4,6 +4,8 @@ import (
 	"net"
 	"time"
 
+	log "github.com/inconshreveable/log15"
+
 	"github.com/netsec-ethz/rains/internal/pkg/connection"
 	"github.com/netsec-ethz/rains/internal/pkg/message"
 	"github.com/netsec-ethz/rains/internal/pkg/util"
@@ -16,16 +18,36 @@ type Config struct {
 	AssertionCheckPointInterval    time.Duration //in seconds
 	NegAssertionCheckPointInterval time.Duration //in seconds
 	ZoneKeyCheckPointInterval      time.Duration //in seconds
+	ShutdownTimeout                time.Duration //in seconds, to process queued messages
 	CheckPointPath                 string
 	PreLoadCaches                  bool
+	AdminAddress                   string //unix:path or host:port, empty disables the admin API
+	MetricsAddress                 string //host:port of the metrics endpoint if monitoring is enabled
+	LogLevel                       string //debug, info, warn, error or crit
 
 	//switchboard
-	ServerAddress      connection.Info
+	ServerAddresses    []connection.Info
 	MaxConnections     int
 	KeepAlivePeriod    time.Duration //in seconds
 	TCPTimeout         time.Duration //in seconds
 	TLSCertificateFile string
 	TLSPrivateKeyFile  string
+	BlocklistPath      string
+	MaxMessageSize     int            //in bytes
+	InfraKeyPath       string         //path of the private infrastructure key signing messages
+	MessageSigPolicy   string         //none, verify or require
+	InfraKeyPeers      []InfraKeyPeer //names holding the infrastructure keys of peers
+
+	//rate limiting
+	RateLimit                 float64 //messages per second of a source address, zero disables it
+	RateLimitBurst            int
+	PrefixRateLimit           float64 //messages per second of a source prefix, zero disables it
+	PrefixRateLimitBurst      int
+	RateLimitIPv4PrefixLength int     //in bits
+	RateLimitIPv6PrefixLength int     //in bits
+	ResponseRateLimit         float64 //identical answers per second to a prefix, zero disables it
+	ResponseRateLimitBurst    int
+	RateLimitAction           string //drop or notify
 
 	//inbox
 	PrioBufferSize          int
@@ -44,7 +66,10 @@ type Config struct {
 	PendingKeyCacheSize         int
 	DelegationQueryValidity     time.Duration //in seconds
 	ReapZoneKeyCacheInterval    time.Duration //in seconds
-	ReapPendingKeyCacheInterval time.Duration //in seconds
+	ReapPendingKeyCacheInterval time.Duration //in seconds, expired delegation queries are retried
+	MaxDelegationQueries        int           //to the sender of a section before backup servers
+
+	BackupServers []connection.Info //queried in turn for delegations the sender did not provide
 
 	//engine
 	AssertionCacheSize            int
@@ -56,6 +81,30 @@ type Config struct {
 	ReapAssertionCacheInterval    time.Duration         //in seconds
 	ReapNegAssertionCacheInterval time.Duration         //in seconds
 	ReapPendingQCacheInterval     time.Duration         //in seconds
+	EvictInconsistentZones        bool                  //evict a zone when an inconsistency is detected
+	ForwardingRules               []ForwardingRule      //per zone, of the caching resolver
+
+	//intermediary
+	IntermediaryService bool          //store and serve sections of zones without authority over them
+	IntermediaryZones   []ZoneContext //zones for which sections are retained, others are cached
+	RetentionPeriod     time.Duration //in seconds, zero stores sections until they expire
+
+	//replication
+	SecondaryZones      []SecondaryZone   //authorities transferred from their primary
+	Secondaries         []connection.Info //may transfer zones and are notified when they change
+	ZoneRefreshInterval time.Duration     //in seconds, between transfer requests of secondary zones
+
+	//zonefiles
+	Zonefiles             []Zonefile    //signed zonefiles of authorities loaded at start up
+	ZonefileCheckInterval time.Duration //in seconds, between checks whether a zonefile changed
+
+	//authoritative store
+	AuthoritativeStorePath string //file storing the sections of the authorities, empty for memory
+
+	//event log
+	EventLogPath     string //file or unix:// socket to which events are written, empty disables it
+	EventLogMaxSize  int64  //in bytes, after which the event log file is rotated
+	EventLogMaxFiles int    //number of rotated event log files which are kept
 }
 
 //DefaultConfig return the default configuration for the zone publisher.
@@ -66,19 +115,40 @@ func DefaultConfig() Config {
 		AssertionCheckPointInterval:    30 * time.Minute,
 		NegAssertionCheckPointInterval: time.Hour,
 		ZoneKeyCheckPointInterval:      30 * time.Minute,
+		ShutdownTimeout:                5 * time.Second,
 		CheckPointPath:                 "data/checkpoint/resolver/",
 		PreLoadCaches:                  false,
+		AdminAddress:                   "",
+		MetricsAddress:                 "127.0.0.1:55555",
+		LogLevel:                       "info",
 
 		//switchboard
-		ServerAddress: connection.Info{
-			Type: connection.TCP,
-			Addr: serverAddr,
+		ServerAddresses: []connection.Info{
+			{
+				Type: connection.TCP,
+				Addr: serverAddr,
+			},
 		},
 		MaxConnections:     10000,
 		KeepAlivePeriod:    time.Minute,
 		TCPTimeout:         5 * time.Minute,
 		TLSCertificateFile: "data/cert/server.crt",
 		TLSPrivateKeyFile:  "data/cert/server.key",
+		MaxMessageSize:     1 << 20,
+		InfraKeyPath:       "",
+		MessageSigPolicy:   sigPolicyNone,
+		InfraKeyPeers:      []InfraKeyPeer{},
+
+		//rate limiting
+		RateLimit:                 0,
+		RateLimitBurst:            20,
+		PrefixRateLimit:           0,
+		PrefixRateLimitBurst:      100,
+		RateLimitIPv4PrefixLength: 24,
+		RateLimitIPv6PrefixLength: 56,
+		ResponseRateLimit:         0,
+		ResponseRateLimitBurst:    5,
+		RateLimitAction:           rateLimitDrop,
 
 		//inbox
 		PrioBufferSize:          50,
@@ -97,7 +167,9 @@ func DefaultConfig() Config {
 		PendingKeyCacheSize:         100,
 		DelegationQueryValidity:     time.Second,
 		ReapZoneKeyCacheInterval:    15 * time.Minute,
-		ReapPendingKeyCacheInterval: 15 * time.Minute,
+		ReapPendingKeyCacheInterval: time.Second,
+		MaxDelegationQueries:        2,
+		BackupServers:               []connection.Info{},
 
 		//engine
 		AssertionCacheSize:         10000,
@@ -114,5 +186,68 @@ func DefaultConfig() Config {
 		ReapAssertionCacheInterval:    15 * time.Minute,
 		ReapNegAssertionCacheInterval: 15 * time.Minute,
 		ReapPendingQCacheInterval:     15 * time.Minute,
+		ForwardingRules:               []ForwardingRule{},
+
+		//intermediary
+		IntermediaryService: false,
+		IntermediaryZones:   []ZoneContext{},
+		RetentionPeriod:     0,
+
+		//replication
+		SecondaryZones:      []SecondaryZone{},
+		Secondaries:         []connection.Info{},
+		ZoneRefreshInterval: time.Hour,
+
+		//zonefiles
+		Zonefiles:             []Zonefile{},
+		ZonefileCheckInterval: 30 * time.Second,
+
+		//authoritative store
+		AuthoritativeStorePath: "",
+
+		//event log
+		EventLogPath:     "",
+		EventLogMaxSize:  100 << 20,
+		EventLogMaxFiles: 5,
+	}
+}
+
+//setConfigDefaults replaces unset values of config which the server cannot run without by their
+//default.
+func setConfigDefaults(config *Config) {
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultConfig().MaxMessageSize
+		log.Info("No maximum message size configured. Using default",
+			"maxMessageSize", config.MaxMessageSize)
+	}
+	if config.MessageSigPolicy == "" {
+		config.MessageSigPolicy = sigPolicyNone
+	}
+	if config.RateLimitAction == "" {
+		config.RateLimitAction = rateLimitDrop
+	}
+	if config.RateLimitIPv4PrefixLength <= 0 {
+		config.RateLimitIPv4PrefixLength = DefaultConfig().RateLimitIPv4PrefixLength
+	}
+	if config.RateLimitIPv6PrefixLength <= 0 {
+		config.RateLimitIPv6PrefixLength = DefaultConfig().RateLimitIPv6PrefixLength
+	}
+	if config.MaxDelegationQueries <= 0 {
+		config.MaxDelegationQueries = DefaultConfig().MaxDelegationQueries
+	}
+	if config.ZoneRefreshInterval <= 0 {
+		config.ZoneRefreshInterval = DefaultConfig().ZoneRefreshInterval
+	}
+	if config.ZonefileCheckInterval <= 0 {
+		config.ZonefileCheckInterval = DefaultConfig().ZonefileCheckInterval
+	}
+	if config.EventLogMaxSize <= 0 {
+		config.EventLogMaxSize = DefaultConfig().EventLogMaxSize
+	}
+	if config.EventLogMaxFiles <= 0 {
+		config.EventLogMaxFiles = DefaultConfig().EventLogMaxFiles
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = DefaultConfig().ShutdownTimeout
 	}
 }
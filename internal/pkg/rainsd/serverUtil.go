@@ -1,8 +1,12 @@
 package rainsd
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +15,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
@@ -24,12 +29,6 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/util"
 )
 
-const (
-	aCheckPointFileName = "assertionCheckPoint.gob"
-	nCheckPointFileName = "negAssertionCheckPoint.gob"
-	zCheckPointFileName = "zoneKeyCheckPoint.gob"
-)
-
 type missingKeyMetaData struct {
 	Zone     string
 	Context  string
@@ -42,12 +41,6 @@ type ZoneContext struct {
 	Context string
 }
 
-type checkPointValue struct {
-	Sections   []section.Section
-	ValidSince []int64
-	ValidUntil []int64
-}
-
 //sendNotificationMsg sends a message containing freshly generated token and a notification section with
 //notificationType, token, and data to destination.
 func sendNotificationMsg(tok token.Token, destination net.Addr,
@@ -57,6 +50,8 @@ func sendNotificationMsg(tok token.Token, destination net.Addr,
 		Token: tok,
 		Data:  data,
 	}
+	//The notification is sent in a message with a new token but answers the message with tok.
+	s.events.answer(tok, destination, []section.Section{notification})
 	sendSection(notification, token.Token{}, destination, s)
 }
 
@@ -67,6 +62,7 @@ func sendSections(sections []section.Section, tok token.Token, destination net.A
 		tok = token.New()
 	}
 	msg := message.Message{Token: tok, Content: sections}
+	s.events.answer(tok, destination, sections)
 	return s.sendTo(msg, destination, 1, 1)
 }
 
@@ -76,7 +72,7 @@ func sendSection(sec section.Section, token token.Token, destination net.Addr, s
 	return sendSections([]section.Section{sec}, token, destination, s)
 }
 
-//sendCapability sends a message with capabilities to sender
+//sendCapability sends a message with the full list of capabilities to destination
 func sendCapability(destination net.Addr, capabilities []message.Capability, s *Server) {
 	msg := message.Message{Token: token.New(), Capabilities: capabilities}
 	s.sendTo(msg, destination, 1, 1)
@@ -97,6 +93,7 @@ func LoadConfig(configPath string) (Config, error) {
 	config.AssertionCheckPointInterval *= time.Second
 	config.NegAssertionCheckPointInterval *= time.Second
 	config.ZoneKeyCheckPointInterval *= time.Second
+	config.ShutdownTimeout *= time.Second
 	config.KeepAlivePeriod *= time.Second
 	config.TCPTimeout *= time.Second
 	config.DelegationQueryValidity *= time.Second
@@ -110,6 +107,9 @@ func LoadConfig(configPath string) (Config, error) {
 	config.ReapAssertionCacheInterval *= time.Second
 	config.ReapNegAssertionCacheInterval *= time.Second
 	config.ReapPendingQCacheInterval *= time.Second
+	config.RetentionPeriod *= time.Second
+	config.ZoneRefreshInterval *= time.Second
+	config.ZonefileCheckInterval *= time.Second
 	return config, nil
 }
 
@@ -145,31 +145,39 @@ func loadTLSCertificate(certPath string, TLSPrivateKeyPath string) (*x509.CertPo
 	return pool, cert, nil
 }
 
-//initOwnCapabilities sorts capabilities in lexicographically increasing order.
-//It stores the hex encoded sha256 hash of the sorted capabilities to capabilityHash
-//and a string representation of the capability list to capabilityList
+//initOwnCapabilities returns the hex encoded sha256 hash of the cbor serialized capabilities sorted
+//in lexicographically increasing order and a string representation of the capability list.
 func initOwnCapabilities(capabilities []message.Capability) (string, string) {
-	//TODO CFE when we have CBOR use it to normalize&serialize the array before hashing it.
-	//Currently we use the hard coded version from the draft.
-	capabilityHash := "e5365a09be554ae55b855f15264dbc837b04f5831daeb321359e18cdabab5745"
 	cs := make([]string, len(capabilities))
 	for i, c := range capabilities {
 		cs[i] = string(c)
 	}
-	return capabilityHash, strings.Join(cs, " ")
+	return message.CapabilityHash(capabilities), strings.Join(cs, " ")
 }
 
-//loadRootZonePublicKey stores the root zone public key from disk into the zoneKeyCache.
-func loadRootZonePublicKey(keyPath string, zoneKeyCache cache.ZonePublicKey,
-	maxValidity util.MaxCacheValidity) error {
-	a := new(section.Assertion)
-	err := util.Load(keyPath, a)
+//trustAnchor contains the root zone's delegation assertion and the public keys it contains.
+type trustAnchor struct {
+	assertion *section.Assertion
+	keys      []keys.PublicKey
+	//hash is the sha256 hash of the file from which the trust anchor has been read.
+	hash [sha256.Size]byte
+}
+
+//readTrustAnchor reads the root zone's delegation assertion from keyPath and checks that it is
+//signed by the contained root zone public keys. Nothing is added to a cache.
+func readTrustAnchor(keyPath string, maxValidity util.MaxCacheValidity) (trustAnchor, error) {
+	data, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		log.Warn("Failed to load root zone public key", "err", err)
-		return err
+		return trustAnchor{}, err
+	}
+	a := new(section.Assertion)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(a); err != nil {
+		log.Warn("Failed to decode root zone public key", "err", err)
+		return trustAnchor{}, err
 	}
 	log.Info("Content loaded from root zone public key", "a", a)
-	var keysAdded int
+	anchor := trustAnchor{assertion: a, hash: sha256.Sum256(data)}
 	for _, c := range a.Content {
 		if c.Type == object.OTDelegation {
 			if publicKey, ok := c.Value.(keys.PublicKey); ok {
@@ -177,129 +185,75 @@ func loadRootZonePublicKey(keyPath string, zoneKeyCache cache.ZonePublicKey,
 				publicKey.ValidUntil = a.Signatures[0].ValidUntil
 				keyMap := make(map[keys.PublicKeyID][]keys.PublicKey)
 				keyMap[publicKey.PublicKeyID] = []keys.PublicKey{publicKey}
-				if siglib.CheckSectionSignatures(a, keyMap, maxValidity) {
-					if ok := zoneKeyCache.Add(a, publicKey, true); !ok {
-						return errors.New("Cache is smaller than the amount of root public keys")
-					}
-					log.Info("Added root public key to zone key cache.",
-						"context", a.Context,
-						"zone", a.SubjectZone,
-						"RootPublicKey", c.Value,
-					)
-					keysAdded++
-				} else {
-					return fmt.Errorf("Failed to validate signature for assertion: %v", a)
+				if !siglib.CheckSectionSignatures(a, keyMap, maxValidity) {
+					return trustAnchor{}, fmt.Errorf(
+						"Failed to validate signature for assertion: %v", a)
 				}
+				anchor.keys = append(anchor.keys, publicKey)
 			} else {
 				log.Warn(fmt.Sprintf("Was not able to cast to keys.PublicKey Got Type:%T", c.Value))
 			}
 		}
 	}
-	log.Info("Keys added to zoneKeyCache", "count", keysAdded)
-	return err
+	if len(anchor.keys) == 0 {
+		return trustAnchor{}, errors.New("no root zone public key found")
+	}
+	return anchor, nil
 }
 
-//measureSystemRessources measures current cpu usage
-func measureSystemRessources() {
-	//Not yet implemented
+//addTo stores the root zone public keys of t into zoneKeyCache.
+func (t trustAnchor) addTo(zoneKeyCache cache.ZonePublicKey) error {
+	for _, publicKey := range t.keys {
+		if ok := zoneKeyCache.Add(t.assertion, publicKey, true); !ok {
+			return errors.New("Cache is smaller than the amount of root public keys")
+		}
+		log.Info("Added root public key to zone key cache.",
+			"context", t.assertion.Context,
+			"zone", t.assertion.SubjectZone,
+			"RootPublicKey", publicKey,
+		)
+	}
+	log.Info("Keys added to zoneKeyCache", "count", len(t.keys))
+	return nil
+}
+
+//replace removes the root zone public keys of old from zoneKeyCache and stores the ones of t.
+func (t trustAnchor) replace(old trustAnchor, zoneKeyCache cache.ZonePublicKey) error {
+	if old.assertion != nil {
+		zoneKeyCache.RemoveZoneContext(old.assertion.FQDN(), old.assertion.Context)
+	}
+	return t.addTo(zoneKeyCache)
 }
 
-func initStoreCachesContent(config Config, caches *Caches, stop chan bool) {
+//initStoreCachesContent periodically writes the content of the caches to checkpoint files in
+//config.CheckPointPath until ctx is done.
+func initStoreCachesContent(ctx context.Context, wg *sync.WaitGroup, config Config,
+	caches *Caches) {
 	if err := os.MkdirAll(config.CheckPointPath, os.ModePerm); err != nil {
 		log.Error("Was not able to create folders", "error", err)
 	}
 	time.Sleep(100 * time.Millisecond)
-	go repeatFuncCaller(func() {
+	wg.Add(3)
+	go repeatFuncCaller(ctx, wg, func() {
 		checkpoint(path.Join(config.CheckPointPath, aCheckPointFileName),
 			caches.AssertionsCache.Checkpoint)
-	}, config.AssertionCheckPointInterval, stop)
-	go repeatFuncCaller(func() {
+	}, config.AssertionCheckPointInterval)
+	go repeatFuncCaller(ctx, wg, func() {
 		checkpoint(path.Join(config.CheckPointPath, nCheckPointFileName),
 			caches.NegAssertionCache.Checkpoint)
-	}, config.NegAssertionCheckPointInterval, stop)
-	go repeatFuncCaller(func() {
+	}, config.NegAssertionCheckPointInterval)
+	go repeatFuncCaller(ctx, wg, func() {
 		checkpoint(path.Join(config.CheckPointPath, zCheckPointFileName),
 			caches.ZoneKeyCache.Checkpoint)
-	}, config.ZoneKeyCheckPointInterval, stop)
-}
-
-func checkpoint(path string, values func() []section.Section) {
-	value := checkPointValue{Sections: values()}
-	for _, s := range value.Sections {
-		value.ValidSince = append(value.ValidSince, s.(section.WithSigForward).ValidSince())
-		value.ValidUntil = append(value.ValidUntil, s.(section.WithSigForward).ValidUntil())
-	}
-	if err := util.Save(path, value); err != nil {
-		log.Error("Was not able to checkpoint cache", "path", path, "error", err)
-	}
-}
-
-func loadCaches(cpPath string, caches *Caches, authorities []ZoneContext) {
-
-	//load assertion check point
-	sections, err := readMsgFromFile(path.Join(cpPath, aCheckPointFileName))
-	if err != nil {
-		log.Warn("Was not able to load assertion check point from file", "error", err)
-	}
-	for _, s := range sections {
-		if s, ok := s.(*section.Assertion); ok {
-			caches.AssertionsCache.Add(s, time.Now().Add(24*time.Hour).Unix(),
-				isAuthoritative(s, authorities))
-		} else {
-			log.Warn("Invalid type for assertion cache", "type", fmt.Sprintf("%T", s))
-		}
-	}
-
-	//load negAssertion check point
-	sections, err = readMsgFromFile(path.Join(cpPath, nCheckPointFileName))
-	if err != nil {
-		log.Warn("Was not able to load negAssertion check point from file", "error", err)
-	}
-	for _, s := range sections {
-		switch s := s.(type) {
-		case *section.Shard:
-			caches.NegAssertionCache.AddShard(s, time.Now().Add(24*time.Hour).Unix(),
-				isAuthoritative(s, authorities))
-		case *section.Pshard:
-			caches.NegAssertionCache.AddPshard(s, time.Now().Add(24*time.Hour).Unix(),
-				isAuthoritative(s, authorities))
-		case *section.Zone:
-			caches.NegAssertionCache.AddZone(s, time.Now().Add(24*time.Hour).Unix(),
-				isAuthoritative(s, authorities))
-		default:
-			log.Warn("Invalid type for negative Assertion cache", "type", fmt.Sprintf("%T", s))
-		}
-	}
-
-	//load zone key check point
-	sections, err = readMsgFromFile(path.Join(cpPath, zCheckPointFileName))
-	if err != nil {
-		log.Warn("Was not able to load zone key check point from file", "error", err)
-	}
-	for _, s := range sections {
-		if s, ok := s.(*section.Assertion); ok {
-			for _, o := range s.Content {
-				if o.Type == object.OTDelegation {
-					caches.ZoneKeyCache.Add(s, o.Value.(keys.PublicKey),
-						isAuthoritative(s, authorities))
-				}
-			}
-		} else {
-			log.Warn("Invalid type for zone key cache", "type", fmt.Sprintf("%T", s))
-		}
-	}
+	}, config.ZoneKeyCheckPointInterval)
 }
 
-func readMsgFromFile(path string) ([]section.Section, error) {
-	values := &checkPointValue{}
-	if err := util.Load(path, values); err != nil {
-		return nil, err
-	}
-	for i, s := range values.Sections {
-		s.(section.WithSigForward).SetValidSince(values.ValidSince[i])
-		s.(section.WithSigForward).SetValidUntil(values.ValidUntil[i])
-	}
-	return values.Sections, nil
+//checkpointCaches writes the content of the assertion, negative assertion and zone key cache to
+//their checkpoint files in cpPath.
+func checkpointCaches(cpPath string, caches *Caches) {
+	checkpoint(path.Join(cpPath, aCheckPointFileName), caches.AssertionsCache.Checkpoint)
+	checkpoint(path.Join(cpPath, nCheckPointFileName), caches.NegAssertionCache.Checkpoint)
+	checkpoint(path.Join(cpPath, zCheckPointFileName), caches.ZoneKeyCache.Checkpoint)
 }
 
 func isAuthoritative(s section.WithSigForward, authorities []ZoneContext) bool {
@@ -313,15 +267,24 @@ func isAuthoritative(s section.WithSigForward, authorities []ZoneContext) bool {
 	return isAuthoritative
 }
 
-//repeatFuncCaller executes function in intervals of waitTime
-func repeatFuncCaller(function func(), waitTime time.Duration, stop chan bool) {
+//repeatFuncCaller executes function in intervals of waitTime until ctx is done. It marks wg as done
+//when it returns.
+func repeatFuncCaller(ctx context.Context, wg *sync.WaitGroup, function func(),
+	waitTime time.Duration) {
+	defer wg.Done()
 	for {
 		select {
-		case <-stop:
+		case <-ctx.Done():
 			return
 		default:
 		}
 		function()
-		time.Sleep(waitTime)
+		timer := time.NewTimer(waitTime)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
 }
@@ -6,11 +6,14 @@ package rainsd
 
 import (
 	"bytes"
+	"container/list"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
@@ -20,15 +23,30 @@ import (
 	"github.com/netsec-ethz/rains/internal/pkg/connection/scion"
 	"github.com/netsec-ethz/rains/internal/pkg/message"
 	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
+const (
+	//maxSentMessages is the maximum number of sent messages kept for resending them in chunks.
+	maxSentMessages = 1000
+	//sentMessageValidity is the duration for which a sent message is kept.
+	sentMessageValidity = 10 * time.Second
+)
+
 //sendTo sends message to the specified receiver with retries
 func (s *Server) sendTo(msg message.Message, receiver net.Addr, retries,
 	backoffMilliSeconds int) (err error) {
 
-	// In any case we add the capabilities of this server to the message.
-	msg.Capabilities = []message.Capability{message.Capability(s.capabilityHash)}
+	// Unless the full capability list is sent, we add the hash of this server's capabilities to
+	// the message.
+	if len(msg.Capabilities) == 0 {
+		msg.Capabilities = []message.Capability{message.Capability(s.capabilityHash)}
+	}
+	if err := s.signMessage(&msg); err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
 	encodedMsg := new(bytes.Buffer)
 	if err := cbor.NewWriter(encodedMsg).Marshal(&msg); err != nil {
 		return fmt.Errorf("failed to marshal message: %v", err)
@@ -37,12 +55,14 @@ func (s *Server) sendTo(msg message.Message, receiver net.Addr, retries,
 	// Try to send the message, with given number of retries
 	backoff := time.Duration(backoffMilliSeconds) * time.Millisecond
 	if err := s.sendToTry(encodedMsg.Bytes(), receiver); err == nil {
+		s.sent(msg, receiver)
 		return nil
 	}
 	for i := 1; i < retries; i++ {
 		time.Sleep(backoff)
 		backoff *= 2
 		if err := s.sendToTry(encodedMsg.Bytes(), receiver); err == nil {
+			s.sent(msg, receiver)
 			return nil
 		}
 	}
@@ -50,44 +70,85 @@ func (s *Server) sendTo(msg message.Message, receiver net.Addr, retries,
 	return errors.New("Was not able to send the mesage. No retries left")
 }
 
+//sent records that msg has been sent to receiver. Messages with several sections are kept for a
+//short time such that they can be resent in smaller chunks if receiver rejects them as too large.
+func (s *Server) sent(msg message.Message, receiver net.Addr) {
+	s.metrics.message(&msg, receiver, directionSent)
+	if len(msg.Content) > 1 {
+		s.sentMsgs.add(msg, receiver)
+	}
+}
+
 //sendToTry sends message to the specified receiver.
 func (s *Server) sendToTry(encodedMsg []byte, receiver net.Addr) (err error) {
-	if s.packetConn != nil {
-		if _, err := s.packetConn.WriteTo(encodedMsg, receiver); err != nil {
+	if packetConn, addr := s.packetConnTo(receiver); packetConn != nil {
+		if _, err := packetConn.WriteTo(encodedMsg, addr); err != nil {
 			return fmt.Errorf("unable to send message: %v", err)
 		}
 		return nil
-	} else {
-		conns, ok := s.caches.ConnCache.GetConnection(receiver)
-		if !ok {
-			conn, err := createConnection(receiver, s.config.KeepAlivePeriod, s.certPool)
-			//add connection to cache
-			conns = append(conns, conn)
-			if err != nil {
-				log.Warn("Could not establish connection", "error", err, "receiver", receiver)
-				return err
-			}
-			s.caches.ConnCache.AddConnection(conn)
-			go s.handleConnection(conn, receiver)
-			conns = []net.Conn{conn}
+	}
+	conns, ok := s.caches.ConnCache.GetConnection(receiver)
+	if !ok {
+		//Only open a tls connection to receivers which have not announced that they do not accept
+		//tls connections, e.g. clients connected from an ephemeral port.
+		if caps, ok := s.caches.ConnCache.GetCapabilityList(receiver); ok &&
+			!message.ContainsCapability(caps, message.TLSOverTCP) {
+			return fmt.Errorf("receiver does not accept tls connections: %v", receiver)
 		}
-		for _, conn := range conns {
-			if _, err := conn.Write(encodedMsg); err != nil {
-				s.caches.ConnCache.CloseAndRemoveConnection(conn)
-				log.Warn("Was not able to send encoded message")
-			} else {
-				log.Debug("Send successful", "receiver", receiver)
-				return nil
-			}
+		conn, err := createConnection(receiver, s.config.KeepAlivePeriod, s.certPool)
+		if err != nil {
+			log.Warn("Could not establish connection", "error", err, "receiver", receiver)
+			return err
 		}
-		return errors.New("unable to send message on any connection")
+		//add connection to cache
+		s.caches.ConnCache.AddConnection(conn)
+		s.goRead(func() { s.handleConnection(conn, receiver) })
+		conns = []net.Conn{conn}
 	}
+	for _, conn := range conns {
+		if _, err := conn.Write(encodedMsg); err != nil {
+			s.caches.ConnCache.CloseAndRemoveConnection(conn)
+			log.Warn("Was not able to send encoded message")
+		} else {
+			log.Debug("Send successful", "receiver", receiver)
+			return nil
+		}
+	}
+	return errors.New("unable to send message on any connection")
+}
+
+//packetConnTo returns the datagram socket over which a message to receiver must be sent together
+//with the address to write to. A reply to a datagram is sent over the socket on which the datagram
+//arrived. Other datagram receivers are reached over the first listener of matching type. The
+//returned socket is nil if receiver must be reached over a stream connection.
+func (s *Server) packetConnTo(receiver net.Addr) (net.PacketConn, net.Addr) {
+	if addr, ok := receiver.(packetAddr); ok {
+		return addr.listener.getPacketConn(), addr.Addr
+	}
+	var t connection.Type
+	switch receiver.(type) {
+	case *snet.UDPAddr:
+		t = connection.SCION
+	case *net.UDPAddr:
+		t = connection.UDP
+	default:
+		return nil, receiver
+	}
+	for _, l := range s.listeners {
+		if l.info.Type != t {
+			continue
+		}
+		if packetConn := l.getPacketConn(); packetConn != nil {
+			return packetConn, receiver
+		}
+	}
+	return nil, receiver
 }
 
 func (s *Server) sendToRecursiveResolver(msg message.Message) {
 	for _, sec := range msg.Content {
 		if q, ok := sec.(*query.Name); ok {
-			go s.resolver.ServerLookup(q, s.Addr(), msg.Token)
+			s.goWork(func() { s.resolver.ServerLookup(q, s.Addr(), msg.Token) })
 		}
 	}
 }
@@ -105,46 +166,62 @@ func createConnection(receiver net.Addr, keepAlive time.Duration, pool *x509.Cer
 	}
 }
 
-//Listen listens for incoming connections and creates a go routine for each connection.
+//listen starts an accept loop for each configured server address and blocks until all of them
+//have been shut down.
 func (s *Server) listen(id string) {
-	srvLogger := log.New("id", id, "addr", s.Addr().String())
-	switch s.config.ServerAddress.Type {
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		l := l
+		wg.Add(1)
+		s.goRead(func() {
+			defer wg.Done()
+			s.serve(l, id)
+		})
+	}
+	wg.Wait()
+}
+
+//serve opens the socket of l and passes all incoming messages to the inbox until l is closed.
+func (s *Server) serve(l *listener, id string) {
+	srvLogger := log.New("id", id, "addr", l.info.Addr.String())
+	switch l.info.Type {
 	case connection.TCP:
 		srvLogger.Info("Start TCP listener")
 		tlsConfig := &tls.Config{Certificates: []tls.Certificate{s.tlsCert}, InsecureSkipVerify: true}
-		listener, err := tls.Listen(s.Addr().Network(),
-			s.config.ServerAddress.Addr.String(), tlsConfig)
+		listener, err := tls.Listen(l.info.Addr.Network(), l.info.Addr.String(), tlsConfig)
 		if err != nil {
 			srvLogger.Error("Listener error on startup", "error", err)
 			return
 		}
-		defer listener.Close()
+		if !l.setStreamListener(listener) {
+			return
+		}
 		defer srvLogger.Info("TCP Shutdown listener")
 		for {
-			select {
-			case <-s.shutdown:
-				// break out of the loop when receiving shutdown
-				srvLogger.Info("Received shutdown signal from TCP")
-				return
-			default:
-			}
 			conn, err := listener.Accept()
 			if err != nil {
+				if l.isStopped() {
+					// break out of the loop when receiving shutdown
+					srvLogger.Info("Received shutdown signal from TCP")
+					return
+				}
 				srvLogger.Error("listener could not accept connection", "error", err)
 				continue
 			}
-			if isIPBlacklisted(conn.RemoteAddr()) {
+			if s.blocklist.containsPeer(conn.RemoteAddr()) {
+				srvLogger.Info("Refused connection from blocked peer", "addr", conn.RemoteAddr())
+				conn.Close()
 				continue
 			}
 			s.caches.ConnCache.AddConnection(conn)
 			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-				go s.handleConnection(conn, tcpAddr)
+				s.goRead(func() { s.handleConnection(conn, tcpAddr) })
 			} else {
 				log.Warn("Type assertion failed. Expected *net.TCPAddr", "addr", conn.RemoteAddr())
 			}
 		}
 	case connection.SCION:
-		addr, ok := s.config.ServerAddress.Addr.(*snet.UDPAddr)
+		addr, ok := l.info.Addr.(*snet.UDPAddr)
 		if !ok {
 			log.Warn(fmt.Sprintf("Type assertion failed. Expected *connection.SCIONAddr, got %T", addr))
 			return
@@ -155,66 +232,284 @@ func (s *Server) listen(id string) {
 			log.Warn("failed to ListenSCION", "err", err)
 			return
 		}
-		defer conn.Close()
+		if !l.setPacketConn(conn) {
+			return
+		}
 		defer srvLogger.Info("SCION Shutdown listener", "id", id)
-		s.packetConn = conn
-		for {
-			select {
-			case <-s.shutdown:
+		s.handlePackets(l, srvLogger)
+	case connection.UDP:
+		addr, ok := l.info.Addr.(*net.UDPAddr)
+		if !ok {
+			log.Warn(fmt.Sprintf("Type assertion failed. Expected *net.UDPAddr, got %T", addr))
+			return
+		}
+		conn, err := net.ListenUDP(addr.Network(), addr)
+		srvLogger.Info(fmt.Sprintf("Started UDP listener on %v", addr), "id", id)
+		if err != nil {
+			log.Warn("failed to ListenUDP", "err", err)
+			return
+		}
+		if !l.setPacketConn(conn) {
+			return
+		}
+		defer srvLogger.Info("UDP Shutdown listener", "id", id)
+		s.handlePackets(l, srvLogger)
+	default:
+		log.Warn("Unsupported Network address type.")
+	}
+}
+
+//handlePackets reads datagrams from the packet socket of l until l is closed. Each datagram must
+//contain exactly one message which is passed to the inbox along with the datagram's source address.
+func (s *Server) handlePackets(l *listener, srvLogger log.Logger) {
+	packetConn := l.getPacketConn()
+	//A datagram larger than the buffer is truncated to the buffer's size. One additional byte allows
+	//to detect datagrams exceeding the maximum message size.
+	maxSize := s.config.MaxMessageSize
+	if maxSize > connection.MaxUDPPacketBytes {
+		maxSize = connection.MaxUDPPacketBytes
+	}
+	for {
+		buf := make([]byte, maxSize+1)
+		n, addr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			if l.isStopped() {
 				// break out of the loop when receiving shutdown
-				srvLogger.Info("Received shutdown signal from SCION")
+				srvLogger.Info("Received shutdown signal from packet listener")
 				return
-			default:
-			}
-			buf := make([]byte, connection.MaxUDPPacketBytes)
-			n, addr, err := s.packetConn.ReadFrom(buf)
-			if err != nil {
-				log.Warn("Failed to ReadFrom", "err", err)
-				continue
 			}
-			data := buf[:n]
-			// Note: We cannot use handleConnection because UDP is connectionless and we have to
-			// manually stick the remote endpoint address in the handler.
-			var msg message.Message
-			if err := cbor.NewReader(bytes.NewReader(data)).Unmarshal(&msg); err != nil {
-				log.Warn("failed to unmarshal CBOR", "err", err)
-				continue
-			}
-			deliver(&msg, addr,
-				s.queues.Prio, s.queues.Normal, s.queues.Notify, s.caches.PendingKeys)
+			log.Warn("Failed to ReadFrom", "err", err)
+			continue
 		}
-	default:
-		log.Warn("Unsupported Network address type.")
+		data := buf[:n]
+		sender := packetAddr{Addr: addr, listener: l}
+		if !s.allowMessage(data, sender) {
+			continue
+		}
+		if n > maxSize {
+			s.rejectTooLarge(data[:maxSize], sender)
+			continue
+		}
+		// Note: We cannot use handleConnection because UDP is connectionless and we have to
+		// manually stick the remote endpoint address in the handler.
+		var msg message.Message
+		if err := cbor.NewReader(bytes.NewReader(data)).Unmarshal(&msg); err != nil {
+			log.Warn("failed to unmarshal CBOR", "err", err)
+			continue
+		}
+		s.deliver(&msg, sender)
 	}
 }
 
 //handleConnection deframes all incoming messages on conn and passes them to the inbox along with the dstAddr
 func (s *Server) handleConnection(conn net.Conn, dstAddr net.Addr) {
 	log.Info("New connection", "serverAddr", s.Addr(), "conn", dstAddr)
-	reader := cbor.NewReader(conn)
+	//Messages are read item by item such that at most MaxMessageSize bytes are buffered for a
+	//message before it is decoded.
+	reader := cbor.NewFrameReader(conn, s.config.MaxMessageSize)
 	for {
 		var msg message.Message
 		select {
-		case <-s.shutdown:
+		case <-s.ctx.Done():
 			return
 		default:
 		}
-		//FIXME CFE how to check efficiently that message is not too large?
-		if err := reader.Unmarshal(&msg); err != nil {
-			if err.Error() == "failed to read tag: EOF" {
+		data, err := reader.ReadItem()
+		if (err == nil || err == cbor.ErrTooLarge) && !s.allowMessage(data, conn.RemoteAddr()) {
+			continue
+		}
+		if err == cbor.ErrTooLarge {
+			s.rejectTooLarge(data, conn.RemoteAddr())
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
 				log.Info("Connection has been closed", "conn", dstAddr)
 			} else {
 				log.Warn(fmt.Sprintf("failed to read from client: %v", err))
 			}
 			break
 		}
-		deliver(&msg, conn.RemoteAddr(),
-			s.queues.Prio, s.queues.Normal, s.queues.Notify, s.caches.PendingKeys)
+		if err := cbor.NewReader(bytes.NewReader(data)).Unmarshal(&msg); err != nil {
+			log.Warn(fmt.Sprintf("failed to unmarshal message from client: %v", err))
+			break
+		}
+		if s.blocklist.containsPeer(conn.RemoteAddr()) {
+			log.Info("Closing connection to blocked peer", "conn", dstAddr)
+			break
+		}
+		s.deliver(&msg, conn.RemoteAddr())
 	}
 	s.caches.ConnCache.CloseAndRemoveConnection(conn)
 }
 
-//isIPBlacklisted returns true if addr is blacklisted
-func isIPBlacklisted(addr net.Addr) bool {
-	return false
+//rejectTooLarge answers a message exceeding the maximum message size with a notification of type
+//NTMsgTooLarge. prefix contains the beginning of the message's encoding from which the message's
+//token is extracted if possible.
+func (s *Server) rejectTooLarge(prefix []byte, sender net.Addr) {
+	tok, ok := message.PeekToken(prefix)
+	log.Warn("Received message exceeds maximum message size", "sender", sender,
+		"maxMessageSize", s.config.MaxMessageSize, "token", tok, "tokenFound", ok)
+	sendNotificationMsg(tok, sender, section.NTMsgTooLarge, "", s)
+}
+
+//listener is one of the server's listening sockets. Depending on the type of info either
+//streamListener or packetConn is set once the socket is open.
+type listener struct {
+	info  connection.Info
+	mutex sync.Mutex
+	//stopped is set when the listener stops accepting connections and reading datagrams.
+	stopped        bool
+	closed         bool
+	streamListener net.Listener
+	packetConn     net.PacketConn
+}
+
+func newListener(info connection.Info) *listener {
+	return &listener{info: info}
+}
+
+//setStreamListener stores l as the listener's socket. It closes l and returns false if the
+//listener has already been stopped.
+func (l *listener) setStreamListener(sl net.Listener) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopped {
+		sl.Close()
+		return false
+	}
+	l.streamListener = sl
+	return true
+}
+
+//setPacketConn stores conn as the listener's socket. It closes conn and returns false if the
+//listener has already been stopped.
+func (l *listener) setPacketConn(conn net.PacketConn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopped {
+		conn.Close()
+		return false
+	}
+	l.packetConn = conn
+	return true
+}
+
+//getPacketConn returns the listener's datagram socket or nil if it has none.
+func (l *listener) getPacketConn() net.PacketConn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.packetConn
+}
+
+func (l *listener) isStopped() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.stopped
+}
+
+//stop closes the listener's stream socket and stops reading from its datagram socket. The datagram
+//socket stays open such that replies can be sent until the listener is closed.
+func (l *listener) stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	if l.streamListener != nil {
+		l.streamListener.Close()
+	}
+	if l.packetConn != nil {
+		//Unblocks the go routine waiting in ReadFrom.
+		l.packetConn.SetReadDeadline(time.Now())
+	}
+}
+
+//close stops the listener and closes its sockets, if any.
+func (l *listener) close() {
+	l.stop()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.packetConn != nil {
+		l.packetConn.Close()
+	}
+}
+
+//packetAddr is the source address of a datagram received by one of the server's packet listeners.
+//It remembers the listener such that replies are sent back over the socket the datagram arrived on.
+type packetAddr struct {
+	net.Addr
+	listener *listener
+}
+
+//sentMessages stores a bounded number of recently sent messages by token and receiver. When full,
+//the oldest message is evicted.
+type sentMessages struct {
+	mutex    sync.Mutex
+	maxSize  int
+	order    *list.List
+	messages map[sentMessageKey]*list.Element
+}
+
+type sentMessageKey struct {
+	token    token.Token
+	receiver string
+}
+
+type sentMessage struct {
+	key        sentMessageKey
+	msg        message.Message
+	receiver   net.Addr
+	expiration time.Time
+}
+
+func newSentMessages(maxSize int) *sentMessages {
+	return &sentMessages{
+		maxSize:  maxSize,
+		order:    list.New(),
+		messages: make(map[sentMessageKey]*list.Element),
+	}
+}
+
+//add stores msg which has been sent to receiver. It replaces a message with the same token sent to
+//the same receiver.
+func (m *sentMessages) add(msg message.Message, receiver net.Addr) {
+	key := sentMessageKey{token: msg.Token, receiver: receiver.String()}
+	entry := &sentMessage{key: key, msg: msg, receiver: receiver,
+		expiration: time.Now().Add(sentMessageValidity)}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.messages[key]; ok {
+		m.order.Remove(e)
+	}
+	m.messages[key] = m.order.PushBack(entry)
+	for m.order.Len() > m.maxSize {
+		oldest := m.order.Remove(m.order.Front()).(*sentMessage)
+		delete(m.messages, oldest.key)
+	}
+}
+
+//getAndRemove returns the non-expired message with token tok sent to receiver together with the
+//address it has been sent to and removes it.
+func (m *sentMessages) getAndRemove(tok token.Token, receiver net.Addr) (message.Message, net.Addr,
+	bool) {
+	key := sentMessageKey{token: tok, receiver: receiver.String()}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.messages[key]
+	if !ok {
+		return message.Message{}, nil, false
+	}
+	m.order.Remove(e)
+	delete(m.messages, key)
+	entry := e.Value.(*sentMessage)
+	if time.Now().After(entry.expiration) {
+		return message.Message{}, nil, false
+	}
+	return entry.msg, entry.receiver, true
 }
@@ -31,10 +31,13 @@ func (s *Server) verify(msgSender util.MsgSectionSender) {
 	switch msgSender.Sections[0].(type) {
 	case *section.Assertion, *section.Shard, *section.Pshard, *section.Zone:
 		isAuthoritative := hasAuthority(msgSender, s)
-		if len(s.config.Authorities) != 0 {
+		if len(s.authorities()) != 0 {
 			//An authoritative server drops all messages containing sections over which it has no
-			//authority and are not a response to a query issued by this server
-			if !isAuthoritative && !s.caches.PendingKeys.ContainsToken(msgSender.Token) {
+			//authority, which it does not store as an intermediary and are not a response to a
+			//query issued by this server
+			if !isAuthoritative && !acceptsPush(msgSender, s.Config()) &&
+				!s.caches.PendingKeys.ContainsToken(msgSender.Token) &&
+				!s.pendingSigned.containsToken(msgSender.Token) {
 				log.Info("Drop message not part of authority", "msgSender", msgSender)
 				return
 			}
@@ -49,7 +52,7 @@ func (s *Server) verify(msgSender util.MsgSectionSender) {
 
 func hasAuthority(msgSender util.MsgSectionSender, s *Server) bool {
 	for _, sec := range msgSender.Sections {
-		if !isAuthoritative(sec.(section.WithSigForward), s.config.Authorities) {
+		if !isAuthoritative(sec.(section.WithSigForward), s.authorities()) {
 			return false
 		}
 	}
@@ -93,6 +96,7 @@ func verifySections(ss util.MsgSectionSender, s *Server, isAuthoritative bool) {
 		return
 	}
 	log.Info("Invalid signature")
+	s.events.verificationFailure(ss.Token, ss.Sender, ss.Sections, "invalid section signature")
 }
 
 //verifyQueries forwards the received query to be processed if it is consistent and not expired.
@@ -159,7 +163,9 @@ func verifySignatures(ss util.MsgSectionSender, keys map[keys.PublicKeyID][]keys
 	for _, sec := range ss.Sections {
 		sec := sec.(section.WithSigForward)
 		sections = append(sections, sec)
-		if !siglib.CheckSectionSignatures(sec, keys, s.config.MaxCacheValidity) {
+		valid := siglib.CheckSectionSignatures(sec, keys, s.config.MaxCacheValidity)
+		s.metrics.verification(valid)
+		if !valid {
 			return nil, false
 		}
 	}
@@ -170,13 +176,33 @@ func verifySignatures(ss util.MsgSectionSender, keys map[keys.PublicKeyID][]keys
 //necessary
 func handleMissingKeys(ss util.MsgSectionSender, missingKeys map[missingKeyMetaData]bool, s *Server,
 	isAuthoritative bool) {
-	sec := ss.Sections
 	log.Info("Some public keys are missing. Add section to pending key cache",
 		"#missingKeys", len(missingKeys), "sections", ss.Sections)
-	exp := getQueryValidity(sec[0].(section.WithSigForward).Sigs(keys.RainsKeySpace),
-		s.config.DelegationQueryValidity)
+	s.queryMissingKeys(ss, missingKeys, 0, isAuthoritative)
+}
+
+//queryMissingKeys sends the next delegation query for missingKeys and adds ss to the pending key
+//cache. sent is the number of delegation queries which have already failed for ss. The first
+//MaxDelegationQueries queries are sent to the sender of ss or, if the server has authority over ss,
+//to the recursive resolver. Afterwards, the backup servers are queried in turn. When all of them
+//have failed, ss is dropped and its sender is notified.
+func (s *Server) queryMissingKeys(ss util.MsgSectionSender, missingKeys map[missingKeyMetaData]bool,
+	sent int, isAuthoritative bool) {
+	config := s.Config()
+	backup := sent - config.MaxDelegationQueries
+	if backup >= len(config.BackupServers) {
+		log.Warn("Drop sections as delegations could not be obtained", "queries", sent,
+			"sections", ss.Sections)
+		if ss.Sender != nil {
+			sendNotificationMsg(ss.Token, ss.Sender, section.NTNoAssertionAvail,
+				"delegation not available", s)
+		}
+		return
+	}
+	exp := getQueryValidity(ss.Sections[0].(section.WithSigForward).Sigs(keys.RainsKeySpace),
+		config.DelegationQueryValidity)
 	t := token.New()
-	s.caches.PendingKeys.Add(ss, t, exp)
+	s.caches.PendingKeys.Add(ss, t, exp, sent+1)
 	queries := []section.Section{}
 	for k := range missingKeys {
 		log.Info("MissingKeys", "key", k)
@@ -189,14 +215,43 @@ func handleMissingKeys(ss util.MsgSectionSender, missingKeys map[missingKeyMetaD
 		})
 	}
 	msg := message.Message{Token: t, Content: queries}
-	if isAuthoritative {
+	switch {
+	case backup >= 0:
+		log.Info("Send delegation query to backup server", "msg", msg,
+			"server", config.BackupServers[backup].Addr)
+		s.sendTo(msg, config.BackupServers[backup].Addr, 0, 0)
+	case isAuthoritative:
 		log.Info("Send missing delegation keys to recursive resolver", "msg", msg)
 		s.sendToRecursiveResolver(msg)
-	} else {
+	default:
 		s.sendTo(msg, ss.Sender, 0, 0)
 	}
 }
 
+//retryMissingKeys is called when the delegation query for ss has failed after sent delegation
+//queries. If the missing public keys have been obtained in the meantime, ss is verified again.
+//Otherwise, the next delegation query is sent.
+func (s *Server) retryMissingKeys(ss util.MsgSectionSender, sent int) {
+	pkeys := make(map[keys.PublicKeyID][]keys.PublicKey)
+	missingKeys := make(map[missingKeyMetaData]bool)
+	for _, sec := range ss.Sections {
+		publicKeysPresent(sec.(section.WithSigForward), s.caches.ZoneKeyCache, pkeys, missingKeys)
+	}
+	if len(missingKeys) == 0 {
+		s.push(s.queues.Normal, ss)
+		return
+	}
+	s.queryMissingKeys(ss, missingKeys, sent, hasAuthority(ss, s))
+}
+
+//retryExpiredDelegationQueries sends the next delegation query for all sections in the pending key
+//cache whose delegation query has expired.
+func (s *Server) retryExpiredDelegationQueries() {
+	for _, e := range s.caches.PendingKeys.RemoveExpiredValues() {
+		s.retryMissingKeys(e.MsgSectionSender, e.Queries)
+	}
+}
+
 //getQueryValidity returns the expiration value for a delegation query. It is either a configured
 //upper bound or if smaller the longest validity time of all present signatures.
 func getQueryValidity(sigs []signature.Sig, delegQValidity time.Duration) (validity int64) {
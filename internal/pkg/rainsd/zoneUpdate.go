@@ -0,0 +1,96 @@
+package rainsd
+
+import (
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/message"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/query"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/siglib"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+)
+
+const (
+	//maxRefetchedNames is the maximum number of names which are queried again after the cached
+	//sections of a changed zone have been invalidated.
+	maxRefetchedNames = 100
+)
+
+//signedByZone returns true if all signatures on msg are valid signatures of zone. The public keys
+//of zone must be cached.
+func (s *Server) signedByZone(msg *message.Message, zone ZoneContext) bool {
+	pkeys := make(map[keys.PublicKeyID][]keys.PublicKey)
+	for _, sig := range msg.Signatures {
+		key, _, ok := s.caches.ZoneKeyCache.Get(zone.Zone, zone.Context, sig.MetaData())
+		if !ok {
+			log.Info("Public key of zone is not cached", "zone", zone, "signature", sig)
+			return false
+		}
+		pkeys[key.PublicKeyID] = append(pkeys[key.PublicKeyID], key)
+	}
+	return siglib.CheckMessageSignatures(msg, pkeys)
+}
+
+//invalidateZone removes the cached assertions, shards, pshards and zones of zone and queries the
+//names of the removed assertions again. Nothing is removed if this server has authority over zone.
+func (s *Server) invalidateZone(zone ZoneContext) {
+	if containsZone(s.authorities(), zone) {
+		log.Debug("Did not invalidate zone with authority", "zone", zone)
+		return
+	}
+	assertions := s.caches.AssertionsCache.GetZone(zone.Zone, zone.Context,
+		section.TotalInterval{})
+	negAssertions, _ := s.caches.NegAssertionCache.Get(zone.Zone, zone.Context,
+		section.TotalInterval{})
+	if len(assertions) == 0 && len(negAssertions) == 0 {
+		log.Debug("Zone to invalidate is not cached", "zone", zone)
+		return
+	}
+	s.caches.removeZone(zone.Zone, zone.Context)
+	log.Info("Invalidated cached sections of changed zone", "zone", zone,
+		"assertions", len(assertions), "negAssertions", len(negAssertions))
+	if s.resolver == nil {
+		return
+	}
+	queries := refetchQueries(assertions, time.Now().Add(s.Config().QueryValidity).Unix())
+	if len(queries) > 0 {
+		s.sendToRecursiveResolver(message.Message{Token: token.New(), Content: queries})
+	}
+}
+
+//refetchQueries returns a query for each name of assertions asking for the types the assertions
+//of this name contain. At most maxRefetchedNames queries are returned.
+func refetchQueries(assertions []*section.Assertion, expiration int64) []section.Section {
+	queries := []section.Section{}
+	byName := make(map[string]*query.Name)
+	for _, a := range assertions {
+		q, ok := byName[a.FQDN()]
+		if !ok {
+			if len(queries) == maxRefetchedNames {
+				continue
+			}
+			q = &query.Name{Name: a.FQDN(), Context: a.Context, Expiration: expiration}
+			byName[a.FQDN()] = q
+			queries = append(queries, q)
+		}
+		for _, obj := range a.Content {
+			if !containsType(q.Types, obj.Type) {
+				q.Types = append(q.Types, obj.Type)
+			}
+		}
+	}
+	return queries
+}
+
+func containsType(types []object.Type, t object.Type) bool {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package rainsd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/keys"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/siglib"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+	"github.com/netsec-ethz/rains/internal/pkg/zonefile"
+)
+
+//Zonefile is a signed zonefile of one of this server's authorities. Its content is loaded at start
+//up and whenever the file changes.
+type Zonefile struct {
+	Zone    string
+	Context string
+	Path    string
+}
+
+//checkZonefiles returns an error if a zonefile of config has no path or does not belong to one of
+//its authorities.
+func checkZonefiles(config Config) error {
+	for _, z := range config.Zonefiles {
+		if z.Path == "" {
+			return fmt.Errorf("zonefile without path: zone=%s context=%s", z.Zone, z.Context)
+		}
+		if !containsZone(config.Authorities, ZoneContext{Zone: z.Zone, Context: z.Context}) {
+			return fmt.Errorf("zonefile is not of an authority: zone=%s context=%s path=%s",
+				z.Zone, z.Context, z.Path)
+		}
+	}
+	return nil
+}
+
+//zonefileState describes a zonefile at the time it was last loaded.
+type zonefileState struct {
+	modTime time.Time
+	size    int64
+}
+
+//zonefileWatcher keeps track of the loaded zonefiles to detect when they change. It is safe for
+//concurrent use.
+type zonefileWatcher struct {
+	mutex  sync.Mutex
+	states map[string]zonefileState
+	//pending contains per zone the token under which the sections of its latest zonefile wait for
+	//missing public keys.
+	pending map[ZoneContext]token.Token
+}
+
+func newZonefileWatcher() *zonefileWatcher {
+	return &zonefileWatcher{
+		states:  make(map[string]zonefileState),
+		pending: make(map[ZoneContext]token.Token),
+	}
+}
+
+//changed returns true if the file at path has not been loaded yet or has been modified since. The
+//current state of the file is recorded such that it is only reported once per change.
+func (w *zonefileWatcher) changed(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	state := zonefileState{modTime: info.ModTime(), size: info.Size()}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	old, ok := w.states[path]
+	if ok && old.modTime.Equal(state.modTime) && old.size == state.size {
+		return false, nil
+	}
+	w.states[path] = state
+	return true, nil
+}
+
+//setPending records that the sections of zone's latest zonefile wait for missing public keys under
+//tok. It supersedes a previous zonefile of zone which is still waiting.
+func (w *zonefileWatcher) setPending(zone ZoneContext, tok token.Token) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending[zone] = tok
+}
+
+//clearPending supersedes a zonefile of zone which is still waiting for missing public keys.
+func (w *zonefileWatcher) clearPending(zone ZoneContext) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.pending, zone)
+}
+
+//removePending returns the zone whose latest zonefile waits for missing public keys under tok and
+//removes it. It returns false if tok does not belong to such a zonefile.
+func (w *zonefileWatcher) removePending(tok token.Token) (ZoneContext, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for zone, t := range w.pending {
+		if t == tok {
+			delete(w.pending, zone)
+			return zone, true
+		}
+	}
+	return ZoneContext{}, false
+}
+
+//loadChangedZonefiles loads the configured zonefiles which are new or have changed since they
+//were last loaded.
+func (s *Server) loadChangedZonefiles() {
+	for _, z := range s.Config().Zonefiles {
+		changed, err := s.zonefiles.changed(z.Path)
+		if err != nil {
+			log.Warn("Was not able to check zonefile", "path", z.Path, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := s.loadZonefile(z); err != nil {
+			log.Warn("Was not able to load zonefile", "path", z.Path, "error", err)
+		}
+	}
+}
+
+//loadZonefile parses the zonefile z and verifies the signatures of its sections. If the public keys
+//of the zone are cached, the previously stored sections of the zone are replaced by the sections of
+//z. Otherwise, the sections of z are processed like sections received from a peer such that the
+//missing delegations are fetched first. They replace the stored sections of the zone once their
+//signatures have been verified. Nothing is changed if z contains an unsigned section, a section of
+//another zone or an invalid signature.
+func (s *Server) loadZonefile(z Zonefile) error {
+	sections, err := zonefile.IO{}.LoadZonefile(z.Path)
+	if err != nil {
+		return err
+	}
+	zone := ZoneContext{Zone: z.Zone, Context: z.Context}
+	pkeys := make(map[keys.PublicKeyID][]keys.PublicKey)
+	missingKeys := make(map[missingKeyMetaData]bool)
+	for _, sec := range sections {
+		if sec.GetSubjectZone() != z.Zone || sec.GetContext() != z.Context {
+			return fmt.Errorf("section is not of zone %s and context %s: %s", z.Zone, z.Context,
+				sec)
+		}
+		if len(sec.Sigs(keys.RainsKeySpace)) == 0 {
+			return fmt.Errorf("section is not signed: %s", sec)
+		}
+		publicKeysPresent(sec, s.caches.ZoneKeyCache, pkeys, missingKeys)
+	}
+	if len(missingKeys) > 0 {
+		log.Info("Public keys of zonefile are missing. Verify it when they are obtained",
+			"path", z.Path, "missingKeys", len(missingKeys))
+		tok := token.New()
+		s.zonefiles.setPending(zone, tok)
+		s.verify(util.MsgSectionSender{Sender: s.Addr(), Sections: sectionsOf(sections),
+			Token: tok})
+		return nil
+	}
+	for _, sec := range sections {
+		if !siglib.CheckSectionSignatures(sec, pkeys, s.Config().MaxCacheValidity) {
+			return fmt.Errorf("invalid signature on section: %s", sec)
+		}
+	}
+	s.zonefiles.clearPending(zone)
+	if err := s.replaceZone(zone, sections); err != nil {
+		return err
+	}
+	log.Info("Loaded zonefile", "path", z.Path, "zone", z.Zone, "context", z.Context)
+	return nil
+}
+
+//replaceZone replaces the stored sections of zone by the verified sections of a zonefile and
+//notifies the secondaries. Sections whose signatures have all expired are skipped.
+func (s *Server) replaceZone(zone ZoneContext, sections []section.WithSigForward) error {
+	valid := []section.WithSigForward{}
+	for _, sec := range sections {
+		if len(sec.Sigs(keys.RainsKeySpace)) == 0 {
+			log.Info("Skip section with expired signatures", "zone", zone, "section", sec)
+			continue
+		}
+		valid = append(valid, sec)
+	}
+	if err := s.authStore.RemoveZone(zone.Zone, zone.Context); err != nil {
+		return err
+	}
+	addSectionsToCache(valid, s.Config(), s.caches.AssertionsCache, s.caches.NegAssertionCache,
+		s.caches.ZoneKeyCache, s.authStore)
+	log.Info("Replaced stored sections of zone", "zone", zone, "sections", len(valid))
+	s.notifySecondaries(valid)
+	return nil
+}
+
+//replacePushedZones replaces the stored sections of each authority to which a section of sections
+//belongs with the sections of this authority. The sections of other zones are returned.
+func (s *Server) replacePushedZones(sections []section.WithSigForward) []section.WithSigForward {
+	authorities := s.authorities()
+	zones := make(map[ZoneContext][]section.WithSigForward)
+	others := []section.WithSigForward{}
+	for _, sec := range sections {
+		if isAuthoritative(sec, authorities) {
+			zone := ZoneContext{Zone: sec.GetSubjectZone(), Context: sec.GetContext()}
+			zones[zone] = append(zones[zone], sec)
+		} else {
+			others = append(others, sec)
+		}
+	}
+	for zone, secs := range zones {
+		if err := s.replaceZone(zone, secs); err != nil {
+			log.Warn("Was not able to replace stored sections of zone", "zone", zone,
+				"error", err)
+		}
+	}
+	return others
+}
+
+func sectionsOf(sections []section.WithSigForward) []section.Section {
+	secs := []section.Section{}
+	for _, sec := range sections {
+		secs = append(secs, sec)
+	}
+	return secs
+}
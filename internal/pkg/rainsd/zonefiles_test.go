@@ -0,0 +1,89 @@
+package rainsd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/rains/internal/pkg/cache"
+	"github.com/netsec-ethz/rains/internal/pkg/object"
+	"github.com/netsec-ethz/rains/internal/pkg/section"
+	"github.com/netsec-ethz/rains/internal/pkg/token"
+	"github.com/netsec-ethz/rains/internal/pkg/util"
+)
+
+func TestZonefilePending(t *testing.T) {
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	other := ZoneContext{Zone: "example.org.", Context: "."}
+	w := newZonefileWatcher()
+	tok1, tok2, tok3 := token.New(), token.New(), token.New()
+	w.setPending(zone, tok1)
+	w.setPending(zone, tok2)
+	w.setPending(other, tok3)
+	w.clearPending(other)
+	var tests = []struct {
+		tok   token.Token
+		zone  ZoneContext
+		found bool
+	}{
+		{tok1, ZoneContext{}, false},
+		{tok3, ZoneContext{}, false},
+		{tok2, zone, true},
+		{tok2, ZoneContext{}, false},
+	}
+	for i, test := range tests {
+		if z, ok := w.removePending(test.tok); ok != test.found || z != test.zone {
+			t.Errorf("%d: wrong pending zone. expected=(%v,%t) actual=(%v,%t)", i, test.zone,
+				test.found, z, ok)
+		}
+	}
+}
+
+func TestAssertReplaceZone(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	zone := ZoneContext{Zone: "example.", Context: "."}
+	old, loaded := testShard("", "m"), testShard("a", "z")
+	peer := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5022}
+	//The loaded shard states that the stored assertion of www does not exist anymore. Sections of a
+	//zonefile or a push replace the stored sections, whereas answers to queries are checked against
+	//them.
+	var tests = []struct {
+		pending bool
+		answer  bool
+		stored  []section.Section
+		www     bool
+	}{
+		{true, false, []section.Section{loaded}, false},
+		{false, false, []section.Section{loaded}, false},
+		{false, true, []section.Section{old}, true},
+	}
+	for i, test := range tests {
+		config := DefaultConfig()
+		config.Authorities = []ZoneContext{zone}
+		s := newTestServer(config)
+		s.authStore = cache.NewAuthoritativeMemory()
+		s.authStore.AddNegAssertion(old)
+		s.authStore.AddAssertion(testAssertion("www", "example.", "."))
+		tok := token.New()
+		if test.pending {
+			s.zonefiles.setPending(zone, tok)
+		}
+		if test.answer {
+			s.forwardedTokens.add(tok, time.Now().Add(time.Minute).Unix())
+		}
+		s.assert(util.SectionWithSigSender{Sender: peer, Token: tok,
+			Sections: []section.WithSigForward{loaded}})
+		stored, _ := s.authStore.GetNegAssertions(zone.Zone, zone.Context,
+			section.TotalInterval{})
+		expected, actual := sectionHashes(test.stored), sectionHashes(sectionsOf(stored))
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Errorf("%d: wrong stored sections. expected=%v actual=%v", i, expected, actual)
+		}
+		if _, ok := s.authStore.Get("www.example.", ".", object.OTIP4Addr); ok != test.www {
+			t.Errorf("%d: wrong stored assertion. expected=%t actual=%t", i, test.www, ok)
+		}
+	}
+}
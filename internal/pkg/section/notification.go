@@ -98,6 +98,8 @@ type NotificationType int
 //go:generate stringer -type=NotificationType
 const (
 	NTHeartbeat          NotificationType = 100
+	NTZoneTransfer       NotificationType = 110
+	NTZoneChanged        NotificationType = 111
 	NTCapHashNotKnown    NotificationType = 399
 	NTBadMessage         NotificationType = 400
 	NTRcvInconsistentMsg NotificationType = 403
@@ -9,6 +9,8 @@ func _() {
 	// Re-run the stringer command to generate them again.
 	var x [1]struct{}
 	_ = x[NTHeartbeat-100]
+	_ = x[NTZoneTransfer-110]
+	_ = x[NTZoneChanged-111]
 	_ = x[NTCapHashNotKnown-399]
 	_ = x[NTBadMessage-400]
 	_ = x[NTRcvInconsistentMsg-403]
@@ -21,36 +23,41 @@ func _() {
 
 const (
 	_NotificationType_name_0 = "NTHeartbeat"
-	_NotificationType_name_1 = "NTCapHashNotKnownNTBadMessage"
-	_NotificationType_name_2 = "NTRcvInconsistentMsgNTNoAssertionsExist"
-	_NotificationType_name_3 = "NTMsgTooLarge"
-	_NotificationType_name_4 = "NTUnspecServerErrNTServerNotCapable"
-	_NotificationType_name_5 = "NTNoAssertionAvail"
+	_NotificationType_name_1 = "NTZoneTransferNTZoneChanged"
+	_NotificationType_name_2 = "NTCapHashNotKnownNTBadMessage"
+	_NotificationType_name_3 = "NTRcvInconsistentMsgNTNoAssertionsExist"
+	_NotificationType_name_4 = "NTMsgTooLarge"
+	_NotificationType_name_5 = "NTUnspecServerErrNTServerNotCapable"
+	_NotificationType_name_6 = "NTNoAssertionAvail"
 )
 
 var (
-	_NotificationType_index_1 = [...]uint8{0, 17, 29}
-	_NotificationType_index_2 = [...]uint8{0, 20, 39}
-	_NotificationType_index_4 = [...]uint8{0, 17, 35}
+	_NotificationType_index_1 = [...]uint8{0, 14, 27}
+	_NotificationType_index_2 = [...]uint8{0, 17, 29}
+	_NotificationType_index_3 = [...]uint8{0, 20, 39}
+	_NotificationType_index_5 = [...]uint8{0, 17, 35}
 )
 
 func (i NotificationType) String() string {
 	switch {
 	case i == 100:
 		return _NotificationType_name_0
+	case 110 <= i && i <= 111:
+		i -= 110
+		return _NotificationType_name_1[_NotificationType_index_1[i]:_NotificationType_index_1[i+1]]
 	case 399 <= i && i <= 400:
 		i -= 399
-		return _NotificationType_name_1[_NotificationType_index_1[i]:_NotificationType_index_1[i+1]]
+		return _NotificationType_name_2[_NotificationType_index_2[i]:_NotificationType_index_2[i+1]]
 	case 403 <= i && i <= 404:
 		i -= 403
-		return _NotificationType_name_2[_NotificationType_index_2[i]:_NotificationType_index_2[i+1]]
+		return _NotificationType_name_3[_NotificationType_index_3[i]:_NotificationType_index_3[i+1]]
 	case i == 413:
-		return _NotificationType_name_3
+		return _NotificationType_name_4
 	case 500 <= i && i <= 501:
 		i -= 500
-		return _NotificationType_name_4[_NotificationType_index_4[i]:_NotificationType_index_4[i+1]]
+		return _NotificationType_name_5[_NotificationType_index_5[i]:_NotificationType_index_5[i+1]]
 	case i == 504:
-		return _NotificationType_name_5
+		return _NotificationType_name_6
 	default:
 		return "NotificationType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
@@ -160,6 +160,63 @@ func signSectionUnsafe(s section.WithSig, ks map[keys.PublicKeyID]interface{}) e
 	return nil
 }
 
+//SignMessageUnsafe signs msg with the given private keys. msg.Signatures must contain the meta data
+//of the signatures to create, which are replaced by the resulting signatures. It does not check the
+//validity of msg or its signatures.
+func SignMessageUnsafe(msg *message.Message, ks map[keys.PublicKeyID]interface{}) error {
+	sigs := msg.Signatures
+	msg.Signatures = nil
+	encoding := new(bytes.Buffer)
+	if err := msg.MarshalCBOR(cbor.NewCBORWriter(encoding)); err != nil {
+		msg.Signatures = sigs
+		return fmt.Errorf("Was not able to marshal message: %v", err)
+	}
+	signed := []signature.Sig{}
+	for _, sig := range sigs {
+		if err := (&sig).SignData(ks[sig.PublicKeyID], encoding.Bytes()); err != nil {
+			msg.Signatures = sigs
+			return err
+		}
+		signed = append(signed, sig)
+	}
+	msg.Signatures = signed
+	return nil
+}
+
+//CheckMessageSignatures verifies all signatures on msg with the infrastructure keys in pkeys.
+//Expired signatures are removed. Returns true if at least one non expired signature remains and
+//all of them are correct.
+func CheckMessageSignatures(msg *message.Message, pkeys map[keys.PublicKeyID][]keys.PublicKey) bool {
+	if !checkMessageStringFields(msg) {
+		return false //error already logged
+	}
+	sigs := msg.Signatures
+	msg.Signatures = nil
+	encoding := new(bytes.Buffer)
+	if err := msg.MarshalCBOR(cbor.NewCBORWriter(encoding)); err != nil {
+		log.Warn("Was not able to marshal message.", "error", err)
+		return false
+	}
+	for _, sig := range sigs {
+		if sig.ValidUntil < time.Now().Unix() {
+			log.Info("signature is expired", "signature", sig)
+			continue
+		}
+		key, ok := getPublicKey(pkeys[sig.PublicKeyID], sig.MetaData())
+		if !ok {
+			log.Warn("No time overlapping infrastructure key for signature", "keys", pkeys,
+				"signature", sig)
+			return false
+		}
+		if !sig.VerifySignature(key.Key, encoding.Bytes()) {
+			log.Warn("Message signature does not match", "token", msg.Token, "signature", sig)
+			return false
+		}
+		msg.Signatures = append(msg.Signatures, sig)
+	}
+	return len(msg.Signatures) > 0
+}
+
 //ValidSectionAndSignature returns true if the section is not nil, all the signatures ValidUntil are
 //in the future, the string fields do not contain  <whitespace>:<non whitespace>:<whitespace>, and
 //the section's content is sorted (by sorting it).
@@ -95,6 +95,43 @@ func TestCheckSectionSignaturesErrors(t *testing.T) {
 	}
 }
 
+func TestSignAndCheckMessage(t *testing.T) {
+	log.Root().SetHandler(log.DiscardHandler())
+	genPublicKey, genPrivateKey, _ := ed25519.GenerateKey(nil)
+	sig := section.Signature()
+	pubKey := keys.PublicKey{
+		PublicKeyID: sig.PublicKeyID,
+		ValidSince:  time.Now().Unix(),
+		ValidUntil:  time.Now().Add(time.Hour).Unix(),
+		Key:         genPublicKey,
+	}
+	ksPub := map[keys.PublicKeyID][]keys.PublicKey{sig.PublicKeyID: []keys.PublicKey{pubKey}}
+	msg := message.GetMessage()
+	msg.Signatures = []signature.Sig{sig}
+	if err := SignMessageUnsafe(&msg, map[keys.PublicKeyID]interface{}{sig.PublicKeyID: genPrivateKey}); err != nil {
+		t.Fatalf("Was not able to sign message: %v", err)
+	}
+	if !CheckMessageSignatures(&msg, ksPub) {
+		t.Error("Valid message signature was rejected")
+	}
+	msg.Capabilities = append(msg.Capabilities, message.Capability("urn:x-rains:other"))
+	if CheckMessageSignatures(&msg, ksPub) {
+		t.Error("Signature of modified message was accepted")
+	}
+	unsigned := message.GetMessage()
+	if CheckMessageSignatures(&unsigned, ksPub) {
+		t.Error("Message without signature was accepted")
+	}
+	otherPublicKey, _, _ := ed25519.GenerateKey(nil)
+	pubKey.Key = otherPublicKey
+	msg = message.GetMessage()
+	msg.Signatures = []signature.Sig{sig}
+	SignMessageUnsafe(&msg, map[keys.PublicKeyID]interface{}{sig.PublicKeyID: genPrivateKey})
+	if CheckMessageSignatures(&msg, map[keys.PublicKeyID][]keys.PublicKey{sig.PublicKeyID: []keys.PublicKey{pubKey}}) {
+		t.Error("Signature was accepted with a wrong key")
+	}
+}
+
 func TestCheckMessageStringFields(t *testing.T) {
 	log.Root().SetHandler(log.DiscardHandler())
 	msg := message.GetMessage()
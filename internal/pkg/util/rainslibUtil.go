@@ -51,6 +51,9 @@ type MsgSectionSender struct {
 	Sender   net.Addr
 	Sections []section.Section
 	Token    token.Token
+	//Msg is the message containing Sections. It is only set for notifications as their handling
+	//may depend on the message's signatures.
+	Msg *message.Message
 }
 
 //SectionWithSigSender contains a section with a signature and connection infos about the sender
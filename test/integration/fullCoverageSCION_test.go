@@ -143,7 +143,7 @@ func TestFullCoverageCLIToolsSCION(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Was not able to load namingServerRoot config: %v", err)
 	}
-	rootServerAddr := rootConfig.ServerAddress.Addr.String()
+	rootServerAddr := rootConfig.ServerAddresses[0].Addr.String()
 
 	cmd := exec.Command(pathRainsd,
 		"./testdata/conf/SCIONnamingServerRoot.conf",
@@ -199,7 +199,7 @@ func TestFullCoverageCLIToolsSCION(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Was not able to load resolver config: %v", err)
 	}
-	resolverAddr := resolverConfig.ServerAddress.Addr.(*snet.UDPAddr)
+	resolverAddr := resolverConfig.ServerAddresses[0].Addr.(*snet.UDPAddr)
 	resolverHostAddr := fmt.Sprintf("%s,%s", resolverAddr.IA, resolverAddr.Host.IP)
 	resolverPort := strconv.Itoa(resolverAddr.Host.Port)
 
@@ -132,7 +132,7 @@ func TestFullCoverageCLITools(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Was not able to load namingServerRoot config: %v", err)
 	}
-	rootIPAddr, err := net.ResolveTCPAddr("", rootConfig.ServerAddress.Addr.String())
+	rootIPAddr, err := net.ResolveTCPAddr("", rootConfig.ServerAddresses[0].Addr.String())
 	if err != nil {
 		t.Fatalf("Was not able to load ServerAddress from namingServerRoot config: %v", err)
 	}
@@ -185,7 +185,7 @@ func TestFullCoverageCLITools(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Was not able to load resolver config: %v", err)
 	}
-	resolverIPAddr, err := net.ResolveTCPAddr("", resolverConfig.ServerAddress.Addr.String())
+	resolverIPAddr, err := net.ResolveTCPAddr("", resolverConfig.ServerAddresses[0].Addr.String())
 	if err != nil {
 		t.Fatalf("Was not able to load ServerAddress from resolver config: %v", err)
 	}